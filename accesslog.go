@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// accessEntry is one request in the access log. Bytes is what went out on the connection, after
+// response compression and for chunk streams however far the stream got.
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	RemoteIP  string    `json:"remote_ip"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Route     string    `json:"route,omitempty"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	LatencyMS int64     `json:"latency_ms"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Referer   string    `json:"referer,omitempty"`
+	Aborted   bool      `json:"aborted,omitempty"` // the client went away before the response was done
+}
+
+// accessLog appends requests as JSON lines to ACCESS_LOG_PATH. The file is rotated to <path>.1
+// once it passes ACCESS_LOG_MAX_BYTES or is ACCESS_LOG_ROTATE_INTERVAL old, older ones shift up
+// and ACCESS_LOG_MAX_FILES of them are kept. reopen lets logrotate move the file away instead.
+type accessLog struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	interval time.Duration
+	keep     int
+	f        *os.File
+	size     int64
+	opened   time.Time
+}
+
+var accessLogs = &accessLog{}
+
+func (l *accessLog) configure(path string, maxBytes int64, interval time.Duration, keep int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.path, l.maxBytes, l.interval, l.keep = path, maxBytes, interval, keep
+}
+
+func (l *accessLog) write(e accessEntry) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.path == "" {
+		return
+	}
+	if l.f == nil {
+		if err := l.openLocked(); err != nil {
+			slog.Error("Error opening access log", "path", l.path, "err", err)
+			return
+		}
+	}
+	if l.maxBytes > 0 && l.size > 0 && l.size+int64(len(line)) >= l.maxBytes ||
+		l.interval > 0 && time.Since(l.opened) >= l.interval {
+		l.rotateLocked()
+		if err := l.openLocked(); err != nil {
+			slog.Error("Error opening access log", "path", l.path, "err", err)
+			return
+		}
+	}
+	n, _ := l.f.Write(append(line, '\n'))
+	l.size += int64(n)
+}
+
+// rotateLocked closes the file and shifts <path> to <path>.1 and every <path>.N one up, dropping
+// what falls past ACCESS_LOG_MAX_FILES
+func (l *accessLog) rotateLocked() {
+	l.f.Close()
+	l.f = nil
+	if l.keep <= 0 {
+		_ = os.Remove(l.path)
+		return
+	}
+	_ = os.Remove(fmt.Sprintf("%s.%d", l.path, l.keep))
+	for i := l.keep - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		slog.Error("Error rotating access log", "path", l.path, "err", err)
+	}
+}
+
+// openLocked appends to the file, the rotation interval counts from here
+func (l *accessLog) openLocked() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size, l.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+// reopen closes the file so the next request opens whatever is at the path now, after an
+// external rotation moved it away
+func (l *accessLog) reopen() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+	}
+}
+
+// reopenOnHangup reopens the access log on every SIGHUP until ctx is done
+func reopenOnHangup(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			accessLogs.reopen()
+			slog.Info("Reopened access log", "path", cfg.AccessLogPath)
+		}
+	}
+}
+
+// accessLogMiddleware writes each request to the access log. It counts the bytes below the
+// response compression and after the error handler, so the entry has what the client was sent.
+func accessLogMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		res := c.Response()
+		counter := &wireCounter{ResponseWriter: res.Writer}
+		res.Writer = counter
+		err := next(c)
+		if err != nil && !res.Committed {
+			c.Error(err)
+		}
+
+		req := c.Request()
+		accessLogs.write(accessEntry{
+			Time:      start,
+			RequestID: res.Header().Get(echo.HeaderXRequestID),
+			RemoteIP:  c.RealIP(),
+			Method:    req.Method,
+			URI:       req.RequestURI,
+			Route:     c.Path(),
+			Status:    res.Status,
+			Bytes:     counter.n,
+			LatencyMS: time.Since(start).Milliseconds(),
+			UserAgent: req.UserAgent(),
+			Referer:   req.Referer(),
+			Aborted:   req.Context().Err() != nil,
+		})
+		// handled already, the error handler leaves a committed response alone
+		return err
+	}
+}
+
+// wireCounter counts the body bytes the connection accepted
+type wireCounter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *wireCounter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *wireCounter) Flush() {
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *wireCounter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *wireCounter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useAccessLog gives the test an access log of its own under a temp dir and returns its path
+func useAccessLog(t *testing.T, maxBytes int64, interval time.Duration, keep int) string {
+	path := filepath.Join(t.TempDir(), "access.log")
+	previous := accessLogs
+	accessLogs = &accessLog{}
+	accessLogs.configure(path, maxBytes, interval, keep)
+	t.Cleanup(func() {
+		accessLogs.reopen()
+		accessLogs = previous
+	})
+	return path
+}
+
+// accessEntries reads back the entries of the log file at path
+func accessEntries(t *testing.T, path string) []accessEntry {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []accessEntry
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var e accessEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("access log line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestAccessLogRecordsWhatWasSent(t *testing.T) {
+	useConfig(t, "RESPONSE_COMPRESSION_MIN_SIZE", "100")
+	path := useAccessLog(t, 0, 0, 7)
+	text := strings.Repeat("a manifest line that compresses well\n", 100)
+	e := echo.New()
+	e.Use(middleware.RequestID())
+	e.Use(accessLogMiddleware)
+	e.Use(compressMiddleware)
+	e.GET("/manifest/:name", func(c echo.Context) error { return c.String(http.StatusOK, text) })
+	e.GET("/missing", func(c echo.Context) error { return echo.NewHTTPError(http.StatusNotFound, "File not found") })
+
+	compressed := request(e, http.MethodGet, "/manifest/main?v=2", "", "Accept-Encoding", "gzip", "User-Agent", "patcher/1.0")
+	missing := request(e, http.MethodGet, "/missing", "", "Referer", "https://example.com/")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/manifest/main", nil).WithContext(ctx))
+
+	entries := accessEntries(t, path)
+	if len(entries) != 3 {
+		t.Fatalf("%d access log entries, want 3", len(entries))
+	}
+	first := entries[0]
+	if first.Method != http.MethodGet || first.URI != "/manifest/main?v=2" || first.Route != "/manifest/:name" ||
+		first.Status != http.StatusOK || first.UserAgent != "patcher/1.0" || first.Aborted {
+		t.Errorf("entry of the manifest = %+v", first)
+	}
+	// the bytes are the compressed ones the client got, not the length of the text
+	if first.Bytes != int64(compressed.Body.Len()) || first.Bytes >= int64(len(text)) {
+		t.Errorf("entry of the manifest has %d bytes, %d went out compressed", first.Bytes, compressed.Body.Len())
+	}
+	if first.RequestID == "" || first.RequestID != compressed.Header().Get(echo.HeaderXRequestID) {
+		t.Errorf("entry of the manifest has request ID %q, the response %q", first.RequestID, compressed.Header().Get(echo.HeaderXRequestID))
+	}
+	if second := entries[1]; second.Status != http.StatusNotFound || second.Bytes != int64(missing.Body.Len()) || second.Referer != "https://example.com/" {
+		t.Errorf("entry of the error = %+v, the client got %d %d bytes", second, missing.Code, missing.Body.Len())
+	}
+	if !entries[2].Aborted {
+		t.Errorf("entry of a request whose client went away = %+v, want it aborted", entries[2])
+	}
+}
+
+func TestAccessLogRotates(t *testing.T) {
+	path := useAccessLog(t, 300, 0, 2)
+	for i := range 12 {
+		accessLogs.write(accessEntry{Method: http.MethodGet, URI: fmt.Sprintf("/file/%d", i), Status: http.StatusOK})
+	}
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("rotated log: %v", err)
+		}
+		if info.Size() > 300 {
+			t.Errorf("%s is %d bytes, past ACCESS_LOG_MAX_BYTES=300", filepath.Base(name), info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("a third rotated file was kept with ACCESS_LOG_MAX_FILES=2: %v", err)
+	}
+	if entries := accessEntries(t, path); entries[len(entries)-1].URI != "/file/11" {
+		t.Errorf("the live log ends with %+v, want the last request", entries[len(entries)-1])
+	}
+
+	// ACCESS_LOG_ROTATE_INTERVAL rotates by age whatever the size
+	path = useAccessLog(t, 0, 10*time.Millisecond, 1)
+	accessLogs.write(accessEntry{URI: "/old"})
+	time.Sleep(20 * time.Millisecond)
+	accessLogs.write(accessEntry{URI: "/new"})
+	if old, current := accessEntries(t, path+".1"), accessEntries(t, path); len(old) != 1 || old[0].URI != "/old" || len(current) != 1 || current[0].URI != "/new" {
+		t.Errorf("log past the interval = %+v, rotated %+v", current, old)
+	}
+
+	// after logrotate moves the file away, reopen starts a new one at the path
+	if err := os.Rename(path, path+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	accessLogs.write(accessEntry{URI: "/before-reopen"})
+	accessLogs.reopen()
+	accessLogs.write(accessEntry{URI: "/after-reopen"})
+	if moved := accessEntries(t, path+".moved"); moved[len(moved)-1].URI != "/before-reopen" {
+		t.Errorf("moved log ends with %+v, want the write before the reopen", moved[len(moved)-1])
+	}
+	if current := accessEntries(t, path); len(current) != 1 || current[0].URI != "/after-reopen" {
+		t.Errorf("log reopened at the path = %+v", current)
+	}
+}
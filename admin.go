@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/subtle"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// adminMiddleware guards the /admin endpoints with ADMIN_KEY, sent as X-Admin-Key, a bearer token
+// or the password of HTTP basic auth (what the browser sends for the dashboard)
+func adminMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !validAdminKey(c.Request()) {
+			c.Response().Header().Set("WWW-Authenticate", `Basic realm="patcher admin"`)
+			return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid or missing admin key."})
+		}
+		if crossSite(c.Request()) {
+			return c.JSON(http.StatusForbidden, echo.Map{"error": "Cross-site admin requests are not allowed."})
+		}
+		return next(c)
+	}
+}
+
+// validAdminKey reports whether the request carries ADMIN_KEY in one of the ways adminMiddleware
+// takes it
+func validAdminKey(r *http.Request) bool {
+	key := r.Header.Get("X-Admin-Key")
+	if key == "" {
+		key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		key = password
+	}
+	return cfg.AdminKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(cfg.AdminKey)) == 1
+}
+
+// crossSite tells a state changing request sent by a browser from another site, which would
+// come with the basic auth credentials the browser remembers for the dashboard. Browsers say so
+// in Sec-Fetch-Site, older ones only send an Origin. curl and scripts send neither.
+func crossSite(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site != "same-origin" && site != "none"
+	}
+	origin := r.Header.Get(echo.HeaderOrigin)
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || !strings.EqualFold(u.Host, r.Host)
+}
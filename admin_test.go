@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAdminRejectsCrossSitePosts(t *testing.T) {
+	useConfig(t, "ADMIN_KEY", "admin-secret")
+	e := echo.New()
+	admin := e.Group("/admin", adminMiddleware)
+	admin.GET("/status", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+	admin.POST("/cleanup", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+
+	tests := []struct {
+		method  string
+		headers []string
+		want    int
+	}{
+		{http.MethodPost, nil, http.StatusOK}, // curl
+		{http.MethodPost, []string{"Sec-Fetch-Site", "same-origin"}, http.StatusOK},
+		{http.MethodPost, []string{"Sec-Fetch-Site", "none"}, http.StatusOK},
+		{http.MethodPost, []string{"Sec-Fetch-Site", "cross-site"}, http.StatusForbidden},
+		{http.MethodPost, []string{"Sec-Fetch-Site", "same-site"}, http.StatusForbidden},
+		{http.MethodPost, []string{echo.HeaderOrigin, "http://example.com"}, http.StatusOK},
+		{http.MethodPost, []string{echo.HeaderOrigin, "https://evil.example"}, http.StatusForbidden},
+		{http.MethodPost, []string{echo.HeaderOrigin, "null"}, http.StatusForbidden},
+		{http.MethodGet, []string{"Sec-Fetch-Site", "cross-site"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		target := "/admin/cleanup"
+		if tt.method == http.MethodGet {
+			target = "/admin/status"
+		}
+		headers := append([]string{"X-Admin-Key", "admin-secret"}, tt.headers...)
+		if rec := request(e, tt.method, target, "", headers...); rec.Code != tt.want {
+			t.Errorf("%s %s with %v = %d, want %d", tt.method, target, tt.headers, rec.Code, tt.want)
+		}
+	}
+	// the check comes after auth, without the key it's still 401
+	if rec := request(e, http.MethodPost, "/admin/cleanup", "", "Sec-Fetch-Site", "cross-site"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("POST without the key = %d, want 401", rec.Code)
+	}
+}
+
+func TestMaintenanceTurnsDownloadsAway(t *testing.T) {
+	useConfig(t, "TMPDIR", t.TempDir())
+	root := useContent(t, map[string]string{"maps/a.txt": "a"})
+	t.Cleanup(func() { setMaintenance(false, "") })
+	e := chunkServer(t)
+	e.POST("/admin/maintenance", handleAdminSetMaintenance)
+	e.GET("/file/*", handleFile, maintenanceMiddleware)
+	e.POST("/guarded/zip-chunks/init", handleChunkInit, maintenanceMiddleware)
+	serveStatic(e, root)
+	url := initChunks(t, e, `{"files":["maps/a.txt"]}`)[0]
+
+	rec := request(e, http.MethodPost, "/admin/maintenance", `{"enabled":true,"message":"Back at 8"}`)
+	if rec.Code != http.StatusOK || !getMaintenance().Enabled {
+		t.Fatalf("turning maintenance on = %d %s", rec.Code, rec.Body.String())
+	}
+	for _, target := range []string{"/file/maps/a.txt", "/maps/a.txt"} {
+		rec := request(e, http.MethodGet, target, "")
+		if rec.Code != http.StatusServiceUnavailable || rec.Header().Get(echo.HeaderRetryAfter) == "" || !strings.Contains(rec.Body.String(), "Back at 8") {
+			t.Errorf("GET %s in maintenance = %d %s, want 503 with the message and Retry-After", target, rec.Code, rec.Body.String())
+		}
+	}
+	if rec := request(e, http.MethodPost, "/guarded/zip-chunks/init", `{"files":["maps/a.txt"]}`); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("init in maintenance = %d, want 503", rec.Code)
+	}
+	// a session created before keeps downloading
+	if rec := request(e, http.MethodGet, url, ""); rec.Code != http.StatusOK {
+		t.Errorf("chunk of an earlier session in maintenance = %d, want 200", rec.Code)
+	}
+
+	request(e, http.MethodPost, "/admin/maintenance", `{"enabled":false}`)
+	if m := getMaintenance(); m.Enabled || m.Message != "" {
+		t.Errorf("maintenance after turning it off = %+v", m)
+	}
+	if rec := request(e, http.MethodGet, "/maps/a.txt", ""); rec.Code != http.StatusOK || rec.Body.String() != "a" {
+		t.Errorf("GET /maps/a.txt after maintenance = %d %q", rec.Code, rec.Body.String())
+	}
+}
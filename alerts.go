@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	alertOK     = "ok"
+	alertFiring = "firing"
+)
+
+// alertRule is one threshold evaluated by the alert loop
+type alertRule struct {
+	Name      string     `json:"name"`
+	Threshold string     `json:"threshold"`
+	State     string     `json:"state"`
+	Since     time.Time  `json:"since"`
+	Detail    string     `json:"detail,omitempty"`
+	Notified  *time.Time `json:"last_notified,omitempty"`
+
+	check func() (bool, string) // firing and a human readable reading
+}
+
+var (
+	alertRules   []*alertRule
+	alertRulesMu sync.Mutex
+)
+
+// configureAlerts builds the rules enabled in the config and starts evaluating them
+func configureAlerts() {
+	now := time.Now()
+	add := func(name, threshold string, check func() (bool, string)) {
+		alertRules = append(alertRules, &alertRule{Name: name, Threshold: threshold, State: alertOK, Since: now, check: check})
+	}
+
+	if cfg.AlertErrorRate > 0 {
+		add("error_rate", fmt.Sprintf("5xx above %.1f%% over %s", cfg.AlertErrorRate*100, cfg.AlertErrorWindow), func() (bool, string) {
+			total, errs := requestStatuses.counts(cfg.AlertErrorWindow)
+			if total == 0 {
+				return false, "no requests"
+			}
+			rate := float64(errs) / float64(total)
+			return total >= cfg.AlertErrorMinRequests && rate > cfg.AlertErrorRate,
+				fmt.Sprintf("%d of %d requests failed (%.1f%%)", errs, total, rate*100)
+		})
+	}
+	if cfg.AlertBuildQueueWait > 0 {
+		add("build_queue_wait", "oldest queued build waiting over "+cfg.AlertBuildQueueWait.String(), func() (bool, string) {
+			wait := builds.oldestWait()
+			return wait > cfg.AlertBuildQueueWait, "oldest queued build has waited " + wait.Round(time.Second).String()
+		})
+	}
+	if cfg.AlertTempDirPercent > 0 && cfg.TempDirQuota > 0 {
+		add("temp_dir_usage", fmt.Sprintf("temp dir above %.0f%% of %d bytes", cfg.AlertTempDirPercent, cfg.TempDirQuota), func() (bool, string) {
+			used := cachedDirSize(chunkTempDir())
+			pct := float64(used) / float64(cfg.TempDirQuota) * 100
+			return pct > cfg.AlertTempDirPercent, fmt.Sprintf("%d bytes used (%.1f%%)", used, pct)
+		})
+	}
+	if cfg.AlertPullStale > 0 {
+		add("pull_stale", "no successful update for "+cfg.AlertPullStale.String(), func() (bool, string) {
+			last := lastSuccessfulUpdate()
+			if last.IsZero() {
+				return time.Since(startedAt) > cfg.AlertPullStale, "no successful update since startup"
+			}
+			age := time.Since(last)
+			return age > cfg.AlertPullStale, "last successful update " + age.Round(time.Second).String() + " ago"
+		})
+	}
+
+	if len(alertRules) > 0 {
+		go func() {
+			ticker := time.NewTicker(cfg.AlertInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				evaluateAlerts()
+			}
+		}()
+	}
+}
+
+// evaluateAlerts checks every rule and notifies on state transitions. A rule that fires again
+// within the cooldown of its last notification is tracked but not re-announced.
+func evaluateAlerts() {
+	alertRulesMu.Lock()
+	defer alertRulesMu.Unlock()
+
+	now := time.Now()
+	for _, r := range alertRules {
+		firing, detail := r.check()
+		r.Detail = detail
+		state := alertOK
+		if firing {
+			state = alertFiring
+		}
+		if state == r.State {
+			continue
+		}
+		r.State, r.Since = state, now
+
+		if state == alertFiring && r.Notified != nil && now.Sub(*r.Notified) < cfg.AlertCooldown {
+			slog.Warn("Alert firing again within cooldown", "rule", r.Name, "detail", detail)
+			continue
+		}
+		if state == alertOK && r.Notified == nil {
+			continue
+		}
+		r.Notified = &now
+		notify(fmt.Sprintf("[%s] %s: %s (%s)", state, r.Name, detail, r.Threshold), echo.Map{
+			"rule":      r.Name,
+			"state":     state,
+			"detail":    detail,
+			"threshold": r.Threshold,
+		})
+	}
+}
+
+// raiseAlert reports a condition an operator has to act on
+func raiseAlert(msg string) {
+	notify(msg, echo.Map{"state": alertFiring})
+}
+
+// notify logs the alert and posts it to NOTIFY_WEBHOOK_URL. The text is sent as both "text" and
+// "content" so Slack and Discord webhooks take the payload as is.
+func notify(text string, fields echo.Map) {
+	slog.Warn("Alert", "text", text, "state", fields["state"])
+	if cfg.NotifyWebhookURL == "" {
+		return
+	}
+
+	fields["text"] = text
+	fields["content"] = text
+	fields["at"] = time.Now()
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return
+	}
+	go func() {
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Post(cfg.NotifyWebhookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			slog.Error("Error sending alert", "err", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			slog.Error("Alert webhook failed", "status", resp.StatusCode)
+		}
+	}()
+}
+
+// GET /admin/alerts
+func handleAdminAlerts(c echo.Context) error {
+	alertRulesMu.Lock()
+	defer alertRulesMu.Unlock()
+	rules := make([]alertRule, 0, len(alertRules))
+	for _, r := range alertRules {
+		rules = append(rules, *r)
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"webhook_configured": cfg.NotifyWebhookURL != "",
+		"rules":              rules,
+	})
+}
+
+// statusCounter counts requests and 5xx responses in one minute buckets
+type statusCounter struct {
+	mu      sync.Mutex
+	buckets [60]statusBucket
+}
+
+type statusBucket struct {
+	minute int64
+	total  int
+	errors int
+}
+
+var requestStatuses = &statusCounter{}
+
+func (s *statusCounter) record(status int) {
+	minute := time.Now().Unix() / 60
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := &s.buckets[minute%int64(len(s.buckets))]
+	if b.minute != minute {
+		*b = statusBucket{minute: minute}
+	}
+	b.total++
+	if status >= 500 {
+		b.errors++
+	}
+}
+
+// counts sums the buckets within window, which is capped at an hour
+func (s *statusCounter) counts(window time.Duration) (int, int) {
+	now := time.Now().Unix() / 60
+	oldest := now - int64(window/time.Minute) + 1
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var total, errs int
+	for _, b := range s.buckets {
+		if b.minute >= oldest && b.minute <= now {
+			total += b.total
+			errs += b.errors
+		}
+	}
+	return total, errs
+}
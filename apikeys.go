@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strings"
+)
+
+// apiKeyContextKey is where apiKeyMiddleware leaves the ID of the key a request presented
+const apiKeyContextKey = "api_key"
+
+// apiKeyID names a key in chunk tokens without carrying the key itself
+func apiKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// presentedAPIKey is the key from X-Api-Key or an Authorization bearer token
+func presentedAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-Api-Key"); key != "" {
+		return key
+	}
+	key, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return strings.TrimSpace(key)
+}
+
+// validAPIKey compares against every configured key, so the time taken doesn't tell which one
+// came close
+func validAPIKey(key string) bool {
+	match := 0
+	for _, k := range cfg.APIKeys {
+		match |= subtle.ConstantTimeCompare([]byte(key), []byte(k))
+	}
+	return match == 1
+}
+
+// requestAPIKey is the ID of the key the request was let in with, "" without API_KEYS
+func requestAPIKey(c echo.Context) string {
+	id, _ := c.Get(apiKeyContextKey).(string)
+	return id
+}
+
+// apiKeyMiddleware requires one of the API_KEYS, ahead of the rate limiters so a rejected
+// request doesn't spend a token. Without API_KEYS it lets everything through.
+func apiKeyMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if len(cfg.APIKeys) == 0 {
+			return next(c)
+		}
+		key := presentedAPIKey(c.Request())
+		if key == "" || !validAPIKey(key) {
+			metricAPIKeyRejections.Inc()
+			c.Response().Header().Set("WWW-Authenticate", `Bearer realm="patcher"`)
+			return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid or missing API key."})
+		}
+		c.Set(apiKeyContextKey, apiKeyID(key))
+		return next(c)
+	}
+}
+
+// fileAPIKeyMiddleware guards the whole-file downloads with API_KEYS_STATIC
+func fileAPIKeyMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	guarded := apiKeyMiddleware(next)
+	return func(c echo.Context) error {
+		if !cfg.APIKeysStatic {
+			return next(c)
+		}
+		return guarded(c)
+	}
+}
+
+// staticAPIKeyMiddleware guards what the static middleware serves with API_KEYS_STATIC, requests
+// a route matched are left to that route's middlewares
+func staticAPIKeyMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	guarded := fileAPIKeyMiddleware(next)
+	return func(c echo.Context) error {
+		if c.Path() != "" || staticSkipper(c) {
+			return next(c)
+		}
+		return guarded(c)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// a build that fails verification is quarantined and rebuilt, up to this many attempts in total
+const archiveBuildAttempts = 2
+
+// builtArchive is a chunk artifact written to disk
+type builtArchive struct {
+	Path    string
+	Format  string // container, "" is zip
+	Size    int64  // bytes the writer produced
+	SHA256  string // of the bytes the writer produced
+	Entries []archiveEntry
+	Omitted []archiveOmission // requested files that couldn't be included
+	Commit  string            // checkout the files were read at
+
+	// Compression is what each extension cost and saved, recorded once the archive verified
+	Compression map[string]*compressionTally
+
+	// IO behaviour of the build, fed to the pressure breaker
+	SourceBytes  int64
+	WriteLatency time.Duration
+}
+
+// archiveOmission is a requested file that's missing from the archive and why
+type archiveOmission struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// omissionError means a source file couldn't be read before its entry was started, the archive
+// itself is still consistent without it
+type omissionError struct {
+	reason string
+}
+
+func (e *omissionError) Error() string { return e.reason }
+
+// buildChunkArchive writes the chunk artifact under dir and verifies it before it's served. The
+// checkout can't move while it's read, so every artifact matches exactly one commit.
+func buildChunkArchive(dir, chunkID string, session *chunkSession) (*builtArchive, error) {
+	release := readContent()
+	defer release()
+	commit, _ := headCommit(session.Content.Dir)
+
+	var err error
+	for attempt := 1; attempt <= archiveBuildAttempts; attempt++ {
+		var a *builtArchive
+		a, err = writeChunkArchive(dir, chunkID, session)
+		if err != nil {
+			return nil, err
+		}
+		if err = verifyArchive(a); err == nil {
+			a.Commit = commit
+			stats.recordCompression(a.Compression)
+			return a, nil
+		}
+		slog.Warn("Archive failed verification", "path", a.Path, "attempt", attempt, "attempts", archiveBuildAttempts, "err", err)
+		quarantineArchive(dir, a.Path)
+	}
+	return nil, err
+}
+
+// writeChunkArchive builds the archive, any write or close error removes the partial file. Files
+// that changed since init go in with their current content, files that vanished are omitted.
+func writeChunkArchive(dir, chunkID string, session *chunkSession) (a *builtArchive, err error) {
+	if isTarFormat(session.Format) {
+		return writeTarArchive(dir, chunkID, session)
+	}
+	// the compression settings are part of the name so artifacts built with different
+	// settings are never mistaken for each other
+	tmpFile, err := os.CreateTemp(dir, chunkID+"-"+session.Compression.key()+"-*"+session.format().Ext)
+	if err != nil {
+		return nil, fmt.Errorf("create temp zip: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tmpFile.Close()
+			_ = os.Remove(tmpFile.Name())
+		}
+	}()
+
+	timed := &latencyWriter{w: tmpFile}
+	sum := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(timed, sum)}
+	zipWriter := zip.NewWriter(counter)
+	session.Compression.register(zipWriter)
+	var headers []*zip.FileHeader
+	var elapsed []time.Duration
+	var omitted []archiveOmission
+
+	for _, f := range session.Files {
+		start := time.Now()
+		header, err := writeArchiveEntry(zipWriter, session, f)
+		var omission *omissionError
+		if errors.As(err, &omission) {
+			omitted = append(omitted, archiveOmission{Name: f, Reason: omission.reason})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, header)
+		elapsed = append(elapsed, time.Since(start))
+	}
+	if len(omitted) > 0 && session.BestEffort {
+		// the archive comment travels with the zip, when it fits
+		if comment, err := json.Marshal(echo.Map{"omitted": omitted}); err == nil && len(comment) <= 0xffff {
+			_ = zipWriter.SetComment(string(comment))
+		}
+	}
+
+	if err := zipWriter.Close(); err != nil {
+		return nil, fmt.Errorf("finish zip: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return nil, fmt.Errorf("close temp zip: %w", err)
+	}
+
+	// the writer fills CRC and sizes into the headers it was given as each entry is closed
+	var sourceBytes int64
+	entries := make([]archiveEntry, 0, len(headers))
+	tallies := make(map[string]*compressionTally)
+	for i, h := range headers {
+		sourceBytes += int64(h.UncompressedSize64)
+		tallyEntry(tallies, h, elapsed[i])
+		entries = append(entries, archiveEntry{
+			Name:             h.Name,
+			CompressedSize:   h.CompressedSize64,
+			UncompressedSize: h.UncompressedSize64,
+			CRC32:            fmt.Sprintf("%08x", h.CRC32),
+		})
+	}
+
+	return &builtArchive{
+		Path:         tmpFile.Name(),
+		Size:         counter.n,
+		SHA256:       hex.EncodeToString(sum.Sum(nil)),
+		Entries:      entries,
+		Omitted:      omitted,
+		Compression:  tallies,
+		SourceBytes:  sourceBytes,
+		WriteLatency: timed.average(),
+	}, nil
+}
+
+// writeArchiveEntry adds one source file to the zip. The file is closed before it returns, so a
+// chunk of thousands of files only ever holds one descriptor.
+func writeArchiveEntry(zipWriter *zip.Writer, session *chunkSession, f string) (*zip.FileHeader, error) {
+	name, file, info, err := openEntrySource(session, f)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var src io.Reader = file
+	check := newIntegrityCheck(session.Content, name, info)
+	if check != nil {
+		src = check.reader(file)
+	}
+
+	method := session.Compression.zipMethod()
+	if method != zip.Store && storesExtension(name) {
+		method = zip.Store
+	}
+	// archive/zip sets the UTF-8 flag itself for names that need it. The mtime goes in as an
+	// extended timestamp too, so clients comparing mtimes see the checkout's and not the extraction's.
+	header := &zip.FileHeader{
+		Name:     name,
+		Method:   method,
+		Modified: info.ModTime().Truncate(time.Second),
+	}
+	header.SetMode(info.Mode().Perm())
+	w, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		return nil, fmt.Errorf("create entry %s: %w", f, err)
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		return nil, fmt.Errorf("write entry %s: %w", f, err)
+	}
+
+	if check != nil {
+		if err := check.verify(); err != nil && cfg.IntegrityMode == integrityFail {
+			return nil, err
+		}
+	}
+	return header, nil
+}
+
+// zip64Margin covers the headers and the rare deflate output a bit bigger than its input, chunks
+// that near the 32 bit limits are flagged rather than cut close
+const zip64Margin = 1 << 24
+
+// needsZip64 reports whether a zip of files will carry Zip64 extensions: an entry or the archive
+// past 4GB, or more than 65535 entries. archive/zip switches to them by itself, the flag in the init
+// response lets clients whose unzip can't read them fall back to single files.
+func needsZip64(files []sizedFile) bool {
+	if len(files) >= math.MaxUint16 {
+		return true
+	}
+	var total int64
+	for _, f := range files {
+		if f.Size >= math.MaxUint32-zip64Margin {
+			return true
+		}
+		total += f.Size
+	}
+	return total >= math.MaxUint32-zip64Margin
+}
+
+// openEntrySource opens the file behind a stored name for reading into an archive, any reason it
+// can't be read is an omissionError
+func openEntrySource(session *chunkSession, f string) (string, *os.File, os.FileInfo, error) {
+	// stored names were checked at init, they're resolved again as the checkout may have moved
+	name, full, err := resolveContentFile(session.Content.Dir, f)
+	if errors.Is(err, errOutsideRoot) {
+		return "", nil, nil, &omissionError{err.Error()}
+	}
+	if errors.Is(err, errExcluded) {
+		return "", nil, nil, &omissionError{"excluded"}
+	}
+	if problem := entryNameProblem(name); problem != "" {
+		return "", nil, nil, &omissionError{problem}
+	}
+	if err != nil && os.IsNotExist(err) {
+		return "", nil, nil, &omissionError{"no longer exists"}
+	}
+	file, err := os.Open(full)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil, nil, &omissionError{"no longer exists"}
+		}
+		return "", nil, nil, &omissionError{err.Error()}
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return "", nil, nil, &omissionError{err.Error()}
+	}
+	if info.IsDir() {
+		file.Close()
+		return "", nil, nil, &omissionError{"is a directory"}
+	}
+	return name, file, info, nil
+}
+
+// tallyEntry adds a written entry to the per-extension compression totals. Stored entries are only
+// counted, their sizes would pull the ratio of the compressed ones towards 1.
+func tallyEntry(tallies map[string]*compressionTally, h *zip.FileHeader, elapsed time.Duration) {
+	ext := entryExtension(h.Name)
+	t, ok := tallies[ext]
+	if !ok {
+		t = &compressionTally{}
+		tallies[ext] = t
+	}
+	t.Files++
+	if h.Method == zip.Store {
+		t.Stored++
+		return
+	}
+	t.In += int64(h.UncompressedSize64)
+	t.Out += int64(h.CompressedSize64)
+	t.Nanos += int64(elapsed)
+}
+
+// verifyArchive re-opens the artifact and checks its size and central directory against what
+// the writer recorded, catching truncated or otherwise damaged files before they're served
+func verifyArchive(a *builtArchive) error {
+	info, err := os.Stat(a.Path)
+	if err != nil {
+		return err
+	}
+	if info.Size() != a.Size {
+		return fmt.Errorf("size on disk %d, wrote %d", info.Size(), a.Size)
+	}
+	if isTarFormat(a.Format) {
+		return verifyTarArchive(a)
+	}
+
+	r, err := zip.OpenReader(a.Path)
+	if err != nil {
+		return fmt.Errorf("reopen: %w", err)
+	}
+	defer r.Close()
+
+	if len(r.File) != len(a.Entries) {
+		return fmt.Errorf("central directory has %d entries, wrote %d", len(r.File), len(a.Entries))
+	}
+	for i, f := range r.File {
+		e := a.Entries[i]
+		if f.Name != e.Name || f.UncompressedSize64 != e.UncompressedSize || f.CompressedSize64 != e.CompressedSize ||
+			fmt.Sprintf("%08x", f.CRC32) != e.CRC32 {
+			return fmt.Errorf("entry %d (%s) doesn't match what was written", i, e.Name)
+		}
+	}
+	return nil
+}
+
+// quarantineArchive moves a damaged artifact aside for inspection, the cleanup sweep removes it later
+func quarantineArchive(dir, path string) {
+	qdir := filepath.Join(dir, "quarantine")
+	if err := os.MkdirAll(qdir, 0o755); err == nil {
+		if err := os.Rename(path, filepath.Join(qdir, filepath.Base(path))); err == nil {
+			return
+		}
+	}
+	_ = os.Remove(path)
+}
+
+// countingWriter counts the bytes that pass through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
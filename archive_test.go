@@ -0,0 +1,287 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestChunkBySize(t *testing.T) {
+	f := func(name string, size int64) sizedFile { return sizedFile{Path: name, Size: size} }
+	tests := []struct {
+		files []sizedFile
+		max   int64
+		want  [][]string
+	}{
+		{[]sizedFile{f("a", 4), f("b", 4), f("c", 4)}, 8, [][]string{{"a", "b"}, {"c"}}},
+		// a file bigger than the limit isn't dropped, it gets a chunk to itself
+		{[]sizedFile{f("a", 4), f("big", 20), f("b", 4)}, 8, [][]string{{"a"}, {"big"}, {"b"}}},
+		{[]sizedFile{f("big", 20)}, 8, [][]string{{"big"}}},
+		{[]sizedFile{f("empty", 0), f("a", 8)}, 8, [][]string{{"empty", "a"}}},
+		{nil, 8, nil},
+	}
+	for _, tt := range tests {
+		var got [][]string
+		for _, chunk := range chunkBySize(tt.files, tt.max) {
+			var names []string
+			for _, f := range chunk {
+				names = append(names, f.Path)
+			}
+			got = append(got, names)
+		}
+		if !slices.EqualFunc(got, tt.want, slices.Equal) {
+			t.Errorf("chunkBySize(%v, %d) = %v, want %v", tt.files, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestNeedsZip64(t *testing.T) {
+	small := sizedFile{Path: "a", Size: 1 << 20}
+	huge := sizedFile{Path: "huge.eqg", Size: 5 << 30}
+	if needsZip64([]sizedFile{small}) {
+		t.Error("a 1MB chunk needs Zip64")
+	}
+	if !needsZip64([]sizedFile{small, huge}) {
+		t.Error("a chunk with a 5GB file doesn't need Zip64")
+	}
+	// no file past 4GB, the archive is
+	var many []sizedFile
+	for range 5 {
+		many = append(many, sizedFile{Path: "part", Size: 1 << 30})
+	}
+	if !needsZip64(many) {
+		t.Error("a 5GB chunk of 1GB files doesn't need Zip64")
+	}
+	if !needsZip64(make([]sizedFile, 70000)) {
+		t.Error("70000 entries don't need Zip64")
+	}
+}
+
+// sparseBuffer keeps what's written in blocks, leaving out the all zero ones, so a multi-GB zip of
+// a sparse file fits in memory
+type sparseBuffer struct {
+	blocks map[int64][]byte
+	size   int64
+}
+
+const sparseBlock = 1 << 16
+
+func (b *sparseBuffer) Write(p []byte) (int, error) {
+	for n := 0; n < len(p); {
+		block, off := b.size/sparseBlock, b.size%sparseBlock
+		k := min(len(p)-n, int(sparseBlock-off))
+		if data, ok := b.blocks[block]; ok || slices.ContainsFunc(p[n:n+k], func(c byte) bool { return c != 0 }) {
+			if !ok {
+				data = make([]byte, sparseBlock)
+				b.blocks[block] = data
+			}
+			copy(data[off:], p[n:n+k])
+		}
+		n += k
+		b.size += int64(k)
+	}
+	return len(p), nil
+}
+
+func (b *sparseBuffer) ReadAt(p []byte, at int64) (int, error) {
+	n := 0
+	for n < len(p) && at < b.size {
+		block, off := at/sparseBlock, at%sparseBlock
+		k := int(min(int64(len(p)-n), sparseBlock-off, b.size-at))
+		if data, ok := b.blocks[block]; ok {
+			copy(p[n:n+k], data[off:])
+		} else {
+			clear(p[n : n+k])
+		}
+		n += k
+		at += int64(k)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestZip64Chunk(t *testing.T) {
+	if testing.Short() {
+		t.Skip("zips a 4.5GB file")
+	}
+	useConfig(t, "TMPDIR", t.TempDir())
+	root := useContent(t, map[string]string{"maps/after.txt": "after the big one"})
+	big := filepath.Join(root, "maps", "huge.eqg")
+	if err := os.WriteFile(big, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	const bigSize = 4<<30 + 512<<20
+	if err := os.Truncate(big, bigSize); err != nil {
+		t.Skipf("no sparse files: %v", err)
+	}
+
+	// a file past max_chunk_size gets a chunk of its own, flagged as Zip64
+	e := chunkServer(t)
+	res := chunkInit(t, e, `{"max_chunk_size":1048576,"files":["maps/huge.eqg","maps/after.txt"]}`)
+	if len(res.Chunks) != 2 || res.Chunks[0].FileCount != 1 || res.Chunks[0].TotalSizeUncompressed != bigSize || !res.Chunks[0].Zip64 || res.Chunks[1].Zip64 {
+		t.Fatalf("chunks = %+v, want the big file alone and flagged Zip64", res.Chunks)
+	}
+	if res := chunkInit(t, e, `{"files":["maps/after.txt"]}`); res.Chunks[0].Zip64 {
+		t.Error("small chunk flagged Zip64")
+	}
+
+	// both in one zip, the small entry starts past 4GB
+	session := &chunkSession{
+		Content:     defaultContent,
+		Files:       []string{"maps/huge.eqg", "maps/after.txt"},
+		Compression: compressionSettings{Method: methodStore},
+	}
+	buf := &sparseBuffer{blocks: make(map[int64][]byte)}
+	if _, _, _, err := streamEntries(context.Background(), &countingWriter{w: buf}, session, func() {}); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(buf, buf.size)
+	if err != nil {
+		t.Fatalf("Zip64 archive doesn't open: %v", err)
+	}
+	if len(zr.File) != 2 || zr.File[0].UncompressedSize64 != bigSize {
+		t.Fatalf("entries = %+v", zr.File)
+	}
+	if offset, err := zr.File[1].DataOffset(); err != nil || offset < 4<<30 {
+		t.Fatalf("second entry at %d, %v, want past 4GB", offset, err)
+	}
+	r, err := zr.File[1].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if data, err := io.ReadAll(r); err != nil || string(data) != "after the big one" {
+		t.Errorf("entry past 4GB = %q, %v", data, err)
+	}
+}
+
+func TestArchivesKeepModTimes(t *testing.T) {
+	useConfig(t, "TMPDIR", t.TempDir())
+	root := useContent(t, map[string]string{"maps/qeynos.eqg": t.Name(), "eqgame.exe": "exe"})
+	mtime := time.Date(2021, 3, 14, 15, 9, 26, 535897932, time.Local)
+	for _, name := range []string{"maps/qeynos.eqg", "eqgame.exe"} {
+		if err := os.Chtimes(filepath.Join(root, filepath.FromSlash(name)), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := mtime.Truncate(time.Second)
+	e := chunkServer(t)
+
+	for _, format := range []string{"zip", formatTarGz, formatTarZst} {
+		body := `{"format":"` + format + `","files":["maps/qeynos.eqg","eqgame.exe"]}`
+		if format == formatTarZst {
+			body = `{"format":"` + format + `","compression":{"method":"zstd"},"files":["maps/qeynos.eqg","eqgame.exe"]}`
+		}
+		rec := request(e, http.MethodGet, initChunks(t, e, body)[0], "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: GET = %d %s", format, rec.Code, rec.Body.String())
+		}
+
+		// extract like a client would, setting the mtime each entry carries
+		dir := t.TempDir()
+		for name, modified := range archiveModTimes(t, format, rec.Body.Bytes()) {
+			p := filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(p, nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(p, modified, modified); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, name := range []string{"maps/qeynos.eqg", "eqgame.exe"} {
+			info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+			if err != nil {
+				t.Fatalf("%s: %s isn't in the archive: %v", format, name, err)
+			}
+			if !info.ModTime().Equal(want) {
+				t.Errorf("%s: %s extracted with mtime %v, want %v", format, name, info.ModTime(), want)
+			}
+		}
+	}
+}
+
+// archiveModTimes reads the mtime of every entry in a zip or tar chunk
+func archiveModTimes(t *testing.T, format string, body []byte) map[string]time.Time {
+	t.Helper()
+	times := make(map[string]time.Time)
+	if format == "zip" {
+		zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			times[f.Name] = f.Modified
+		}
+		return times
+	}
+	var r io.Reader
+	var err error
+	if format == formatTarZst {
+		r, err = zstd.NewReader(bytes.NewReader(body))
+	} else {
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return times
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Typeflag == tar.TypeReg {
+			times[h.Name] = h.ModTime
+		}
+	}
+}
+
+func TestWriteChunkArchiveListsWhatWentIn(t *testing.T) {
+	useConfig(t, "TMPDIR", t.TempDir())
+	useContent(t, map[string]string{"a.txt": "a", "maps/b.txt": "bb"})
+	session := &chunkSession{
+		Content:     defaultContent,
+		Files:       []string{"a.txt", "gone.txt", "../outside.txt", "maps/b.txt"},
+		Compression: compressionSettings{Method: methodDeflate, Level: 6},
+		BestEffort:  true,
+	}
+	a, err := writeChunkArchive(t.TempDir(), "1-0", session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written []string
+	for _, entry := range a.Entries {
+		written = append(written, entry.Name)
+	}
+	if want := []string{"a.txt", "maps/b.txt"}; !slices.Equal(written, want) {
+		t.Errorf("entries = %v, want %v", written, want)
+	}
+	if len(a.Omitted) != 2 || a.Omitted[0] != (archiveOmission{Name: "gone.txt", Reason: "no longer exists"}) || a.Omitted[1].Name != "../outside.txt" {
+		t.Errorf("omitted = %+v", a.Omitted)
+	}
+	body, err := os.ReadFile(a.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := zipNames(t, body); !slices.Equal(names, written) {
+		t.Errorf("zip holds %v, entries say %v", names, written)
+	}
+}
@@ -0,0 +1,48 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestWriteChunkArchiveClosesEachFile(t *testing.T) {
+	useConfig(t, "TMPDIR", t.TempDir())
+	files := make(map[string]string)
+	var names []string
+	for i := range 2000 {
+		name := fmt.Sprintf("maps/zone%04d.txt", i)
+		files[name] = name
+		names = append(names, name)
+	}
+	useContent(t, files)
+	session := &chunkSession{Content: defaultContent, Files: names, Compression: compressionSettings{Method: methodStore}}
+
+	// far fewer descriptors than the chunk has files
+	open, err := os.ReadDir("/dev/fd")
+	if err != nil {
+		t.Skipf("can't count descriptors: %v", err)
+	}
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		t.Fatal(err)
+	}
+	lowered := limit
+	lowered.Cur = uint64(len(open) + 64)
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lowered); err != nil {
+		t.Skipf("can't lower the descriptor limit: %v", err)
+	}
+	a, err := writeChunkArchive(t.TempDir(), "1-0", session)
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		t.Fatal(err)
+	}
+	if err != nil {
+		t.Fatalf("build of %d files with %d descriptors: %v", len(names), lowered.Cur, err)
+	}
+	if len(a.Entries) != len(names) || len(a.Omitted) != 0 {
+		t.Errorf("%d entries, %d omitted, want %d and none", len(a.Entries), len(a.Omitted), len(names))
+	}
+}
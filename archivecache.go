@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// archiveCache shares built chunk archives between inits. Builds are deterministic and a chunk's
+// ETag covers every file's size and mtime, so a chunk whose tag matches an archive built for
+// another init gets a hard link to it instead of a build of its own. A tree's entries go when its
+// checkout changes, the cleanup sweep evicts by ARCHIVE_CACHE_TTL and ARCHIVE_CACHE_MAX_BYTES.
+var archiveCache = struct {
+	sync.Mutex
+	entries map[string]*cachedArchive
+	bytes   int64
+}{entries: make(map[string]*cachedArchive)}
+
+// cachedArchive is a shared build, archive.Path is the cache's own link
+type cachedArchive struct {
+	archive  builtArchive
+	tree     string
+	lastUsed time.Time
+}
+
+func archiveCacheDir() string {
+	return filepath.Join(chunkTempDir(), "cache")
+}
+
+// archiveCacheKey keeps trees apart, two worktrees can hold files that look the same
+func archiveCacheKey(t *contentTree, etag string) string {
+	return t.Dir + "\x00" + etag
+}
+
+// cacheArchive links a fresh build into the cache. Archives missing files stay with their session.
+func cacheArchive(session *chunkSession, etag string, a *builtArchive) {
+	if cfg.ArchiveCacheMaxBytes == 0 || etag == "" || len(a.Omitted) > 0 {
+		return
+	}
+	key := archiveCacheKey(session.Content, etag)
+	archiveCache.Lock()
+	_, cached := archiveCache.entries[key]
+	archiveCache.Unlock()
+	if cached {
+		return
+	}
+
+	dir := archiveCacheDir()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		slog.Error("Error creating archive cache dir", "dir", dir, "err", err)
+		return
+	}
+	sum := sha256.Sum256([]byte(key))
+	path := filepath.Join(dir, hex.EncodeToString(sum[:16])+session.format().Ext)
+	if err := os.Link(a.Path, path); err != nil {
+		// another build of the same chunk got there first
+		if !os.IsExist(err) {
+			slog.Warn("Error caching chunk archive", "path", a.Path, "err", err)
+		}
+		return
+	}
+
+	entry := &cachedArchive{archive: *a, tree: session.Content.Dir, lastUsed: time.Now()}
+	entry.archive.Path = path
+	archiveCache.Lock()
+	defer archiveCache.Unlock()
+	if _, ok := archiveCache.entries[key]; ok {
+		_ = os.Remove(path)
+		return
+	}
+	archiveCache.entries[key] = entry
+	archiveCache.bytes += a.Size
+}
+
+// cachedArchiveFor links the cached archive of etag to a path of the chunk's own, nil on a miss.
+// The session owns the link like a build of its own, evicting the cache entry doesn't touch it.
+func cachedArchiveFor(session *chunkSession, chunkID, etag string) *builtArchive {
+	if cfg.ArchiveCacheMaxBytes == 0 {
+		return nil
+	}
+	key := archiveCacheKey(session.Content, etag)
+	archiveCache.Lock()
+	entry, ok := archiveCache.entries[key]
+	var a builtArchive
+	if ok {
+		entry.lastUsed = time.Now()
+		a = entry.archive
+	}
+	archiveCache.Unlock()
+	if !ok {
+		metricArchiveCacheLookups.WithLabelValues("miss").Inc()
+		return nil
+	}
+
+	path := filepath.Join(chunkTempDir(), chunkID+"-"+session.Compression.key()+"-"+randomToken()+session.format().Ext)
+	if err := os.Link(a.Path, path); err != nil {
+		slog.Warn("Cached chunk archive is gone", "path", a.Path, "err", err)
+		archiveCache.Lock()
+		if archiveCache.entries[key] == entry {
+			delete(archiveCache.entries, key)
+			archiveCache.bytes -= a.Size
+		}
+		archiveCache.Unlock()
+		metricArchiveCacheLookups.WithLabelValues("miss").Inc()
+		return nil
+	}
+	metricArchiveCacheLookups.WithLabelValues("hit").Inc()
+	a.Path = path
+	return &a
+}
+
+// purgeArchiveCache drops the entries built from tree t, its checkout changed
+func purgeArchiveCache(t *contentTree) {
+	archiveCache.Lock()
+	var paths []string
+	for key, e := range archiveCache.entries {
+		if e.tree == t.Dir {
+			delete(archiveCache.entries, key)
+			archiveCache.bytes -= e.archive.Size
+			paths = append(paths, e.archive.Path)
+		}
+	}
+	archiveCache.Unlock()
+	for _, path := range paths {
+		_ = os.Remove(path)
+	}
+	if len(paths) > 0 {
+		slog.Info("Dropped cached chunk archives", "ref", t.Ref, "repo", t.Repo, "count", len(paths))
+	}
+}
+
+// clearArchiveCache drops every entry, what POST /admin/cleanup?all=true does to the cache
+func clearArchiveCache() (int, int64) {
+	archiveCache.Lock()
+	entries, bytes := archiveCache.entries, archiveCache.bytes
+	archiveCache.entries, archiveCache.bytes = make(map[string]*cachedArchive), 0
+	archiveCache.Unlock()
+	for _, e := range entries {
+		_ = os.Remove(e.archive.Path)
+	}
+	return len(entries), bytes
+}
+
+// sweepArchiveCache evicts entries unused for ARCHIVE_CACHE_TTL, then the least recently used
+// until the cache fits ARCHIVE_CACHE_MAX_BYTES. Files nothing indexes, left by an earlier run, go
+// once they're older than a build could be.
+func sweepArchiveCache(now time.Time) {
+	archiveCache.Lock()
+	var evicted []string
+	indexed := make(map[string]bool)
+	byUse := make([]string, 0, len(archiveCache.entries))
+	for key, e := range archiveCache.entries {
+		if now.Sub(e.lastUsed) > cfg.ArchiveCacheTTL {
+			delete(archiveCache.entries, key)
+			archiveCache.bytes -= e.archive.Size
+			evicted = append(evicted, e.archive.Path)
+			continue
+		}
+		byUse = append(byUse, key)
+	}
+	sort.Slice(byUse, func(i, j int) bool {
+		return archiveCache.entries[byUse[i]].lastUsed.Before(archiveCache.entries[byUse[j]].lastUsed)
+	})
+	for _, key := range byUse {
+		e := archiveCache.entries[key]
+		if archiveCache.bytes <= cfg.ArchiveCacheMaxBytes {
+			indexed[e.archive.Path] = true
+			continue
+		}
+		delete(archiveCache.entries, key)
+		archiveCache.bytes -= e.archive.Size
+		evicted = append(evicted, e.archive.Path)
+	}
+	archiveCache.Unlock()
+
+	for _, path := range evicted {
+		_ = os.Remove(path)
+	}
+	if len(evicted) > 0 {
+		slog.Debug("Evicted cached chunk archives", "count", len(evicted))
+	}
+
+	dir := archiveCacheDir()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Error during archive cache cleanup", "dir", dir, "err", err)
+		}
+		return
+	}
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		if e.IsDir() || indexed[path] {
+			continue
+		}
+		if info, err := e.Info(); err == nil && now.Sub(info.ModTime()) > chunkArtifactMaxAge {
+			_ = os.Remove(path)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// benchCase is one format and compression combination the bench command builds
+type benchCase struct {
+	Format string
+	compressionSettings
+}
+
+var benchCases = []benchCase{
+	{formatZip, compressionSettings{Method: methodStore}},
+	{formatZip, compressionSettings{Method: methodDeflate, Level: 6}},
+	{formatZip, compressionSettings{Method: methodZstd, Level: 3}},
+	{formatTarGz, compressionSettings{Method: methodDeflate, Level: 6}},
+	{formatTarZst, compressionSettings{Method: methodZstd, Level: 3}},
+	{formatTarZst, compressionSettings{Method: methodZstd, Level: 9}},
+}
+
+// runBench builds every file under a directory as one chunk in each format and prints what it
+// cost, for picking defaults on real content
+//
+//	bench <content dir>
+func runBench(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: bench <content dir>")
+	}
+	root := args[0]
+	var files []string
+	var total int64
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		files = append(files, filepath.ToSlash(rel))
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no files under %s", root)
+	}
+
+	dir, err := os.MkdirTemp("", "patcher-bench")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	fmt.Printf("%d files, %d bytes\n", len(files), total)
+	fmt.Printf("%-8s %-12s %14s %7s %10s %9s\n", "format", "compression", "bytes", "ratio", "time", "MB/s")
+	session := &chunkSession{Content: &contentTree{Dir: root}, Files: files, Size: total}
+	for _, bc := range benchCases {
+		session.Format = bc.Format
+		session.Compression = bc.compressionSettings
+		start := time.Now()
+		a, err := writeChunkArchive(dir, "bench", session)
+		if err != nil {
+			return fmt.Errorf("%s %s: %w", bc.Format, bc.key(), err)
+		}
+		elapsed := time.Since(start)
+		_ = os.Remove(a.Path)
+		if len(a.Omitted) > 0 {
+			fmt.Printf("Warning: %d files couldn't be read\n", len(a.Omitted))
+		}
+		fmt.Printf("%-8s %-12s %14d %7.3f %10s %9.1f\n", bc.Format, bc.key(), a.Size,
+			float64(a.Size)/float64(max(a.SourceBytes, 1)), elapsed.Round(time.Millisecond),
+			float64(a.SourceBytes)/1e6/max(elapsed.Seconds(), 1e-9))
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	breakerClosed   = "closed"    // builds are accepted
+	breakerOpen     = "open"      // builds are rejected until the cooldown passes
+	breakerHalfOpen = "half-open" // a single probe build decides whether to close again
+)
+
+const (
+	breakerSamples    = 20              // rolling window of recent builds
+	breakerMinSamples = 5               // the breaker doesn't open on less history than this
+	breakerMinBytes   = 1 << 20         // builds smaller than this are too noisy to sample
+	breakerMargin     = 0.2             // a probe must beat the thresholds by this much to close
+	breakerProbeLimit = 5 * time.Minute // a probe that never reports back frees the half-open slot
+)
+
+// buildSample is the IO behaviour observed during one build
+type buildSample struct {
+	throughput   float64       // MB/s of source bytes read
+	writeLatency time.Duration // average latency of writes to the temp file
+}
+
+// ioBreaker rejects new builds while the disk is saturated. The pressure signal is the rolling
+// average build throughput and temp write latency, sampled by the build path.
+type ioBreaker struct {
+	mu       sync.Mutex
+	state    string
+	openedAt time.Time
+	probing  time.Time // start of the in-flight half-open probe, zero if none
+	samples  []buildSample
+}
+
+var breaker = &ioBreaker{state: breakerClosed}
+
+func (b *ioBreaker) enabled() bool {
+	return cfg.BreakerMinThroughput > 0 || cfg.BreakerMaxWriteLatency > 0
+}
+
+// allow reports whether a new build may start and whether it's the half-open probe
+func (b *ioBreaker) allow() (bool, bool) {
+	if !b.enabled() {
+		return true, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < cfg.BreakerCooldown {
+			return false, false
+		}
+		b.setStateLocked(breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if !b.probing.IsZero() && time.Since(b.probing) < breakerProbeLimit {
+			return false, false
+		}
+		b.probing = time.Now()
+		return true, true
+	}
+	return true, false
+}
+
+// record feeds the outcome of a build back into the breaker
+func (b *ioBreaker) record(sourceBytes int64, elapsed, writeLatency time.Duration, probe bool) {
+	if !b.enabled() {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probing = time.Time{}
+	}
+	if sourceBytes < breakerMinBytes || elapsed <= 0 {
+		// nothing measurable, a half-open breaker lets the next build probe
+		return
+	}
+
+	s := buildSample{
+		throughput:   float64(sourceBytes) / elapsed.Seconds() / (1 << 20),
+		writeLatency: writeLatency,
+	}
+	b.samples = append(b.samples, s)
+	if len(b.samples) > breakerSamples {
+		b.samples = b.samples[1:]
+	}
+	avg := b.averageLocked()
+	metricBuildThroughput.Set(avg.throughput)
+	metricTempWriteLatency.Set(avg.writeLatency.Seconds())
+
+	switch b.state {
+	case breakerClosed:
+		if len(b.samples) >= breakerMinSamples && b.pressuredLocked(avg, 0) {
+			b.samples = nil
+			b.setStateLocked(breakerOpen)
+		}
+	case breakerHalfOpen:
+		if probe {
+			if b.pressuredLocked(s, breakerMargin) {
+				b.setStateLocked(breakerOpen)
+			} else {
+				b.setStateLocked(breakerClosed)
+			}
+		}
+	}
+}
+
+// pressuredLocked compares a sample against the thresholds, margin tightens them for hysteresis
+func (b *ioBreaker) pressuredLocked(s buildSample, margin float64) bool {
+	if lo := cfg.BreakerMinThroughput; lo > 0 && s.throughput < lo*(1+margin) {
+		return true
+	}
+	if hi := cfg.BreakerMaxWriteLatency; hi > 0 && float64(s.writeLatency) > float64(hi)*(1-margin) {
+		return true
+	}
+	return false
+}
+
+func (b *ioBreaker) averageLocked() buildSample {
+	var avg buildSample
+	if len(b.samples) == 0 {
+		return avg
+	}
+	var latency time.Duration
+	for _, s := range b.samples {
+		avg.throughput += s.throughput
+		latency += s.writeLatency
+	}
+	avg.throughput /= float64(len(b.samples))
+	avg.writeLatency = latency / time.Duration(len(b.samples))
+	return avg
+}
+
+func (b *ioBreaker) setStateLocked(state string) {
+	if state == breakerOpen {
+		b.openedAt = time.Now()
+	}
+	b.state = state
+	metricBreakerState.Set(map[string]float64{breakerClosed: 0, breakerHalfOpen: 1, breakerOpen: 2}[state])
+}
+
+// status summarizes the breaker for /healthz
+func (b *ioBreaker) status() echo.Map {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	avg := b.averageLocked()
+	status := echo.Map{
+		"enabled":          b.enabled(),
+		"state":            b.state,
+		"throughput_mbps":  avg.throughput,
+		"write_latency_ms": float64(avg.writeLatency) / float64(time.Millisecond),
+		"samples":          len(b.samples),
+	}
+	if b.state != breakerClosed {
+		status["opened_at"] = b.openedAt
+	}
+	return status
+}
+
+// latencyWriter times every write it passes through
+type latencyWriter struct {
+	w      io.Writer
+	writes int
+	spent  time.Duration
+}
+
+func (l *latencyWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := l.w.Write(p)
+	l.spent += time.Since(start)
+	l.writes++
+	return n, err
+}
+
+func (l *latencyWriter) average() time.Duration {
+	if l.writes == 0 {
+		return 0
+	}
+	return l.spent / time.Duration(l.writes)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// useBreaker gives the test a closed breaker of its own
+func useBreaker(t *testing.T) *ioBreaker {
+	previous := breaker
+	breaker = &ioBreaker{state: breakerClosed}
+	t.Cleanup(func() { breaker = previous })
+	return breaker
+}
+
+func TestBreakerOpensUnderPressure(t *testing.T) {
+	useConfig(t, "BREAKER_MIN_THROUGHPUT_MBPS", "10", "BREAKER_COOLDOWN", "20ms")
+	b := useBreaker(t)
+	slow := func(probe bool) { b.record(10<<20, 2*time.Second, 0, probe) } // 5 MB/s
+	fast := func(probe bool) { b.record(10<<20, time.Second/2, 0, probe) } // 20 MB/s
+
+	// too little history, and builds too small to measure, leave it closed
+	for range breakerMinSamples - 1 {
+		slow(false)
+	}
+	for range 10 {
+		b.record(breakerMinBytes-1, time.Minute, 0, false)
+	}
+	if allowed, probe := b.allow(); !allowed || probe || b.status()["state"] != breakerClosed {
+		t.Fatalf("breaker on %d slow builds = %v", breakerMinSamples-1, b.status())
+	}
+	slow(false)
+	if allowed, _ := b.allow(); allowed || b.status()["state"] != breakerOpen {
+		t.Fatalf("breaker on %d slow builds = %v, want it open", breakerMinSamples, b.status())
+	}
+
+	// past the cooldown a single probe is let through, a slow one opens it again
+	time.Sleep(30 * time.Millisecond)
+	if allowed, probe := b.allow(); !allowed || !probe {
+		t.Fatalf("allow after the cooldown = %v %v, want the probe", allowed, probe)
+	}
+	if allowed, _ := b.allow(); allowed {
+		t.Error("a second build started while the probe ran")
+	}
+	slow(true)
+	if b.status()["state"] != breakerOpen {
+		t.Fatalf("breaker after a slow probe = %v, want it open", b.status())
+	}
+
+	// a probe that measures nothing frees the slot for the next one
+	time.Sleep(30 * time.Millisecond)
+	b.allow()
+	b.record(0, 0, 0, true)
+	if allowed, probe := b.allow(); !allowed || !probe {
+		t.Fatalf("allow after a probe that failed = %v %v, want another probe", allowed, probe)
+	}
+
+	// the probe has to beat the threshold by the margin: 11 MB/s isn't enough
+	b.record(11<<20, time.Second, 0, true)
+	if b.status()["state"] != breakerOpen {
+		t.Fatalf("breaker after a probe just over the threshold = %v, want it open", b.status())
+	}
+	time.Sleep(30 * time.Millisecond)
+	b.allow()
+	fast(true)
+	if allowed, probe := b.allow(); !allowed || probe || b.status()["state"] != breakerClosed {
+		t.Errorf("breaker after a fast probe = %v, want it closed", b.status())
+	}
+}
+
+func TestBreakerWatchesWriteLatency(t *testing.T) {
+	useConfig(t, "BREAKER_MAX_WRITE_LATENCY", "50ms")
+	b := useBreaker(t)
+	for range breakerMinSamples {
+		b.record(10<<20, time.Second, 20*time.Millisecond, false)
+	}
+	if b.status()["state"] != breakerClosed {
+		t.Fatalf("breaker on fast writes = %v", b.status())
+	}
+	// the rolling average crosses the threshold, not any single build
+	b.record(10<<20, time.Second, 100*time.Millisecond, false)
+	if b.status()["state"] != breakerClosed {
+		t.Fatalf("breaker opened on a single slow write = %v", b.status())
+	}
+	for n := 0; b.status()["state"] == breakerClosed; n++ {
+		if n == breakerSamples {
+			t.Fatalf("breaker on %d slow writes = %v, want it open", n, b.status())
+		}
+		b.record(10<<20, time.Second, 100*time.Millisecond, false)
+	}
+	if s := b.status(); s["state"] != breakerOpen || s["samples"] != 0 {
+		t.Errorf("breaker on slow writes = %v, want it open with its samples cleared", s)
+	}
+
+	// with both signals at 0 it never rejects
+	useConfig(t, "BREAKER_MAX_WRITE_LATENCY", "0")
+	if allowed, _ := b.allow(); !allowed || b.status()["enabled"] != false {
+		t.Errorf("disabled breaker = %v", b.status())
+	}
+}
+
+func TestOpenBreakerTurnsAwayBuilds(t *testing.T) {
+	useConfig(t, "TMPDIR", t.TempDir(), "BREAKER_MIN_THROUGHPUT_MBPS", "10", "BREAKER_COOLDOWN", "1m")
+	useContent(t, map[string]string{"maps/a.txt": "a"})
+	e := chunkServer(t)
+	urls := initChunks(t, e, `{"files":["maps/a.txt"]}`)
+	b := useBreaker(t)
+	b.mu.Lock()
+	b.setStateLocked(breakerOpen)
+	b.mu.Unlock()
+
+	rec := request(e, http.MethodGet, urls[0], "")
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "60" {
+		t.Errorf("GET %s with the breaker open = %d, Retry-After %q", urls[0], rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"sync"
+	"time"
+)
+
+// size classes of build jobs, by the uncompressed bytes they'll read
+const (
+	buildSmall = iota
+	buildMedium
+	buildLarge
+)
+
+var buildClassNames = [...]string{"small", "medium", "large"}
+
+var (
+	errBuildQueueTimeout = errors.New("timed out waiting for a build slot")
+	errBuildQueueFull    = errors.New("build queue is full")
+)
+
+// buildScheduler limits concurrent archive builds. Waiting jobs are queued per size class and
+// small jobs go first, with one worker always kept free of medium/large work so a tiny fix never
+// waits behind multi-GB builds. Jobs waiting longer than the aging threshold jump ahead of
+// fresher ones regardless of class, so large builds can't be starved either.
+type buildScheduler struct {
+	mu             sync.Mutex
+	limit          int // 0 means unlimited
+	queueLimit     int // waiting jobs, 0 means unlimited
+	aging          time.Duration
+	active         int
+	activeNonSmall int
+	queues         [3][]*buildJob
+}
+
+type buildJob struct {
+	class    int
+	enqueued time.Time
+	granted  bool
+	ready    chan struct{}
+}
+
+var builds = &buildScheduler{}
+
+func (s *buildScheduler) configure(limit, queueLimit int, aging time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit, s.queueLimit, s.aging = limit, queueLimit, aging
+}
+
+// buildClass picks the size class for a job of the given bytes
+func buildClass(bytes int64) int {
+	switch {
+	case bytes <= cfg.BuildSmallMaxBytes:
+		return buildSmall
+	case bytes <= cfg.BuildMediumMaxBytes:
+		return buildMedium
+	}
+	return buildLarge
+}
+
+// acquire waits for a build slot, returning the func that gives it back
+func (s *buildScheduler) acquire(ctx context.Context, bytes int64, timeout time.Duration) (func(), error) {
+	class := buildClass(bytes)
+	job := &buildJob{class: class, enqueued: time.Now(), ready: make(chan struct{})}
+
+	s.mu.Lock()
+	if s.limit <= 0 {
+		s.mu.Unlock()
+		return func() {}, nil
+	}
+	if s.queueLimit > 0 && s.queuedLocked() >= s.queueLimit {
+		s.mu.Unlock()
+		metricBuildsRejected.WithLabelValues("full").Inc()
+		return nil, errBuildQueueFull
+	}
+	s.queues[class] = append(s.queues[class], job)
+	s.scheduleLocked()
+	s.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-job.ready:
+	case <-ctx.Done():
+		if !s.abandon(job) {
+			return nil, ctx.Err()
+		}
+	case <-timer.C:
+		if !s.abandon(job) {
+			metricBuildsRejected.WithLabelValues("timeout").Inc()
+			return nil, errBuildQueueTimeout
+		}
+	}
+
+	metricBuildQueueWait.WithLabelValues(buildClassNames[class]).Observe(time.Since(job.enqueued).Seconds())
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.active--
+			if class != buildSmall {
+				s.activeNonSmall--
+			}
+			s.scheduleLocked()
+		})
+	}, nil
+}
+
+// abandon drops a job that stopped waiting. It returns true when the job had been granted a slot
+// in the meantime, the caller then owns that slot.
+func (s *buildScheduler) abandon(job *buildJob) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job.granted {
+		return true
+	}
+	q := s.queues[job.class]
+	for i, j := range q {
+		if j == job {
+			s.queues[job.class] = append(q[:i], q[i+1:]...)
+			break
+		}
+	}
+	s.updateMetricsLocked()
+	return false
+}
+
+// scheduleLocked grants free slots to waiting jobs
+func (s *buildScheduler) scheduleLocked() {
+	for s.active < s.limit {
+		class := s.pickLocked()
+		if class < 0 {
+			break
+		}
+		job := s.queues[class][0]
+		s.queues[class] = s.queues[class][1:]
+		job.granted = true
+		s.active++
+		if class != buildSmall {
+			s.activeNonSmall++
+		}
+		close(job.ready)
+	}
+	s.updateMetricsLocked()
+}
+
+// pickLocked returns the class whose head job runs next, or -1 if nothing may run now
+func (s *buildScheduler) pickLocked() int {
+	now := time.Now()
+	picked, aged := -1, false
+	for class := buildSmall; class <= buildLarge; class++ {
+		if len(s.queues[class]) == 0 {
+			continue
+		}
+		// keep one worker for small jobs when there's more than one
+		if class != buildSmall && s.limit > 1 && s.activeNonSmall >= s.limit-1 {
+			continue
+		}
+		head := s.queues[class][0]
+		isAged := s.aging > 0 && now.Sub(head.enqueued) >= s.aging
+		switch {
+		case picked < 0:
+			picked, aged = class, isAged
+		case isAged && (!aged || head.enqueued.Before(s.queues[picked][0].enqueued)):
+			picked, aged = class, true
+		}
+	}
+	return picked
+}
+
+func (s *buildScheduler) queuedLocked() int {
+	n := 0
+	for _, q := range s.queues {
+		n += len(q)
+	}
+	return n
+}
+
+// oldestWait is how long the longest waiting job has been queued
+func (s *buildScheduler) oldestWait() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var oldest time.Duration
+	for _, q := range s.queues {
+		if len(q) > 0 {
+			oldest = max(oldest, time.Since(q[0].enqueued))
+		}
+	}
+	return oldest
+}
+
+// snapshot reports the cap, running builds and queued builds per class
+func (s *buildScheduler) snapshot() echo.Map {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queued := make(map[string]int)
+	for class, q := range s.queues {
+		queued[buildClassNames[class]] = len(q)
+	}
+	return echo.Map{"limit": s.limit, "queue_limit": s.queueLimit, "active": s.active, "queued": queued}
+}
+
+func (s *buildScheduler) updateMetricsLocked() {
+	metricBuildsActive.Set(float64(s.active))
+	for class, q := range s.queues {
+		metricBuildQueueDepth.WithLabelValues(buildClassNames[class]).Set(float64(len(q)))
+	}
+}
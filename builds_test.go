@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	smallBuild = 5 << 20
+	largeBuild = 2 << 30
+)
+
+// queueBuild starts an acquire in the background and waits until it's queued, its release comes
+// out of the channel once it's granted a slot
+func queueBuild(t *testing.T, s *buildScheduler, bytes int64) chan func() {
+	t.Helper()
+	s.mu.Lock()
+	queued, active := s.queuedLocked(), s.active
+	s.mu.Unlock()
+	granted := make(chan func(), 1)
+	go func() {
+		release, err := s.acquire(context.Background(), bytes, time.Minute)
+		if err != nil {
+			t.Errorf("acquire(%d): %v", bytes, err)
+			return
+		}
+		granted <- release
+	}()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		s.mu.Lock()
+		started := s.queuedLocked() > queued || s.active > active
+		s.mu.Unlock()
+		if started {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("build never queued")
+		}
+	}
+	return granted
+}
+
+// mustRun is the release of a build that got its slot
+func mustRun(t *testing.T, what string, granted chan func()) func() {
+	t.Helper()
+	select {
+	case release := <-granted:
+		return release
+	case <-time.After(time.Second):
+		t.Fatalf("%s never got a slot", what)
+		return nil
+	}
+}
+
+// mustWait fails when a queued build already got a slot
+func mustWait(t *testing.T, what string, granted chan func()) {
+	t.Helper()
+	select {
+	case release := <-granted:
+		release()
+		t.Fatalf("%s got a slot", what)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+// activeBuilds is the running builds, failing the test when they're over the cap
+func activeBuilds(t *testing.T, s *buildScheduler) int {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active > s.limit {
+		t.Fatalf("%d builds running, the cap is %d", s.active, s.limit)
+	}
+	return s.active
+}
+
+// queueWaits is how many builds of a class have observed their queue wait
+func queueWaits(t *testing.T, class string) uint64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != "patcher_build_queue_wait_seconds" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "class" && l.GetValue() == class {
+					return m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestSmallBuildOvertakesLargeOnes(t *testing.T) {
+	useConfig(t)
+	s := &buildScheduler{}
+	s.configure(2, 0, 0)
+	smallWaits, largeWaits := queueWaits(t, "small"), queueWaits(t, "large")
+
+	large1 := mustRun(t, "first large build", queueBuild(t, s, largeBuild))
+	// the other worker is kept for small builds, large ones queue behind the first
+	large2, large3 := queueBuild(t, s, largeBuild), queueBuild(t, s, largeBuild)
+	mustWait(t, "second large build", large2)
+	small1 := mustRun(t, "small build", queueBuild(t, s, smallBuild))
+	if n := activeBuilds(t, s); n != 2 {
+		t.Fatalf("%d builds running, want 2", n)
+	}
+
+	// both workers busy, a small build queued after the large ones still goes first
+	small2 := queueBuild(t, s, smallBuild)
+	mustWait(t, "queued small build", small2)
+	small1()
+	release := mustRun(t, "queued small build", small2)
+	mustWait(t, "second large build", large2)
+	activeBuilds(t, s)
+	release()
+	// with a worker free and nothing small waiting, the large builds still keep to one
+	mustWait(t, "second large build", large2)
+
+	large1()
+	release = mustRun(t, "second large build", large2)
+	mustWait(t, "third large build", large3)
+	release()
+	mustRun(t, "third large build", large3)()
+	if n := activeBuilds(t, s); n != 0 {
+		t.Errorf("%d builds still running", n)
+	}
+	if got := queueWaits(t, "small") - smallWaits; got != 2 {
+		t.Errorf("%d small queue waits observed, want 2", got)
+	}
+	if got := queueWaits(t, "large") - largeWaits; got != 3 {
+		t.Errorf("%d large queue waits observed, want 3", got)
+	}
+}
+
+func TestAgedBuildGoesFirst(t *testing.T) {
+	useConfig(t)
+	for _, tt := range []struct {
+		aging time.Duration
+		first string
+	}{
+		{0, "small"},
+		{30 * time.Millisecond, "large"},
+	} {
+		s := &buildScheduler{}
+		s.configure(1, 0, tt.aging)
+		running := mustRun(t, "first build", queueBuild(t, s, smallBuild))
+		large := queueBuild(t, s, largeBuild)
+		time.Sleep(40 * time.Millisecond)
+		small := queueBuild(t, s, smallBuild)
+
+		running()
+		first, second := small, large
+		if tt.first == "large" {
+			first, second = large, small
+		}
+		release := mustRun(t, tt.first+" build", first)
+		mustWait(t, "the other build", second)
+		release()
+		mustRun(t, "the other build", second)()
+	}
+}
+
+func TestBuildCapHoldsUnderLoad(t *testing.T) {
+	useConfig(t)
+	s := &buildScheduler{}
+	s.configure(3, 0, 5*time.Millisecond)
+	var running, peak, done atomic.Int64
+	var wg sync.WaitGroup
+	for i := range 60 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			size := []int64{smallBuild, 200 << 20, largeBuild}[i%3]
+			release, err := s.acquire(context.Background(), size, time.Minute)
+			if err != nil {
+				t.Errorf("acquire: %v", err)
+				return
+			}
+			n := running.Add(1)
+			for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+			}
+			time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+			running.Add(-1)
+			done.Add(1)
+			release()
+			release() // a second release gives nothing back
+		}()
+	}
+	wg.Wait()
+	if peak.Load() > 3 {
+		t.Errorf("%d builds ran at once, the cap is 3", peak.Load())
+	}
+	if done.Load() != 60 || activeBuilds(t, s) != 0 {
+		t.Errorf("%d of 60 builds ran, %d still running", done.Load(), s.active)
+	}
+}
+
+func TestBuildQueueLimits(t *testing.T) {
+	useConfig(t)
+	s := &buildScheduler{}
+	s.configure(1, 1, 0)
+	running := mustRun(t, "first build", queueBuild(t, s, smallBuild))
+	waiting := queueBuild(t, s, smallBuild)
+	if _, err := s.acquire(context.Background(), smallBuild, time.Minute); !errors.Is(err, errBuildQueueFull) {
+		t.Errorf("acquire with the queue full = %v, want errBuildQueueFull", err)
+	}
+	running()
+	mustRun(t, "queued build", waiting)
+
+	s.configure(1, 0, 0)
+	if _, err := s.acquire(context.Background(), smallBuild, 20*time.Millisecond); !errors.Is(err, errBuildQueueTimeout) {
+		t.Errorf("acquire with every worker busy = %v, want errBuildQueueTimeout", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.acquire(ctx, smallBuild, time.Minute); !errors.Is(err, context.Canceled) {
+		t.Errorf("acquire for a gone client = %v, want context.Canceled", err)
+	}
+	s.mu.Lock()
+	queued := s.queuedLocked()
+	s.mu.Unlock()
+	if queued != 0 {
+		t.Errorf("%d builds left in the queue after giving up", queued)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// checksumMaxFiles bounds a batch of /checksum
+const checksumMaxFiles = 100
+
+// fileChecksum is what /checksum reports for a file
+type fileChecksum struct {
+	Path     string    `json:"path"`
+	MD5      string    `json:"md5"`
+	SHA256   string    `json:"sha256"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"mtime"`
+}
+
+// GET /checksum?file=<path>&ref=<branch> returns the digests of a file as it is on disk, 404 when
+// it doesn't exist. Several files, as repeated file= or comma separated, return them in "files"
+// and the ones that don't exist in "missing".
+func handleChecksum(c echo.Context) error {
+	t, err := contentFor(c)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for _, v := range c.QueryParams()["file"] {
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				paths = append(paths, p)
+			}
+		}
+	}
+	switch {
+	case len(paths) == 0:
+		return echo.NewHTTPError(http.StatusBadRequest, "Missing file")
+	case len(paths) > checksumMaxFiles:
+		return echo.NewHTTPError(http.StatusBadRequest, "Too many files, at most 100 per request")
+	}
+
+	files, missing := []fileChecksum{}, []string{}
+	for _, p := range paths {
+		sum, err := t.checksum(p)
+		if err != nil {
+			missing = append(missing, p)
+			continue
+		}
+		files = append(files, sum)
+	}
+	if len(paths) > 1 {
+		return c.JSON(http.StatusOK, echo.Map{"files": files, "missing": missing})
+	}
+	if len(files) == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "File not found")
+	}
+	return c.JSON(http.StatusOK, files[0])
+}
+
+// checksum returns the digests of a file of the tree from the hash cache the manifest builds
+// share, a file that changed since is hashed once and cached for both
+func (t *contentTree) checksum(p string) (fileChecksum, error) {
+	rel, full, err := resolveContentFile(t.Dir, p)
+	if err != nil {
+		return fileChecksum{}, err
+	}
+	info, err := os.Stat(full)
+	if err != nil {
+		return fileChecksum{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return fileChecksum{}, os.ErrNotExist
+	}
+
+	t.hashCacheMu.Lock()
+	entry, ok := t.hashCache[rel]
+	t.hashCacheMu.Unlock()
+	if !ok || entry.Size != info.Size() || !entry.Modified.Equal(info.ModTime()) {
+		if entry, err = hashFile(full); err != nil {
+			return fileChecksum{}, err
+		}
+		entry.Path = rel
+		entry.Modified = info.ModTime()
+		t.hashCacheMu.Lock()
+		t.hashCache[rel] = entry
+		t.hashCacheMu.Unlock()
+	}
+	return fileChecksum{Path: rel, MD5: entry.MD5, SHA256: entry.SHA256, Size: entry.Size, Modified: entry.Modified}, nil
+}
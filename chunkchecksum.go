@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"sync"
+)
+
+// chunkSHA256Header is the sha256 of the archive in a chunk response, a trailer when the archive
+// is streamed as it's built
+const chunkSHA256Header = "X-Chunk-SHA256"
+
+// chunkChecksumCacheSize bounds the remembered checksums, oldest go first
+const chunkChecksumCacheSize = 4096
+
+// builtChunk is what an archive of a chunk came out as
+type builtChunk struct {
+	sum  string
+	size int64
+}
+
+// chunkChecksums maps chunk ETags to the sha256 and size of the archive they were built to. Builds
+// are deterministic, so a later init of the same files in the same state can hand the checksum
+// out before anything is built, and a direct stream can send its Content-Length.
+var chunkChecksums = struct {
+	sync.Mutex
+	sums  map[string]builtChunk
+	order []string
+}{sums: make(map[string]builtChunk)}
+
+func rememberChunkChecksum(etag, sum string, size int64) {
+	if etag == "" || sum == "" {
+		return
+	}
+	chunkChecksums.Lock()
+	defer chunkChecksums.Unlock()
+	if _, ok := chunkChecksums.sums[etag]; !ok {
+		chunkChecksums.order = append(chunkChecksums.order, etag)
+	}
+	chunkChecksums.sums[etag] = builtChunk{sum: sum, size: size}
+	for len(chunkChecksums.order) > chunkChecksumCacheSize {
+		delete(chunkChecksums.sums, chunkChecksums.order[0])
+		chunkChecksums.order = chunkChecksums.order[1:]
+	}
+}
+
+func knownChunkChecksum(etag string) string {
+	chunkChecksums.Lock()
+	defer chunkChecksums.Unlock()
+	return chunkChecksums.sums[etag].sum
+}
+
+// knownChunkSize is the size of the archive knownChunkChecksum has the sum of, 0 when unknown
+func knownChunkSize(etag string) int64 {
+	chunkChecksums.Lock()
+	defer chunkChecksums.Unlock()
+	return chunkChecksums.sums[etag].size
+}
+
+// GET /zip-chunks/:chunkID/checksum returns the sha256 of the chunk's archive as it stands now,
+// 409 until a build of the current files has been seen
+func handleChunkChecksum(c echo.Context) error {
+	_, session, err := lookupChunk(c)
+	if err != nil {
+		return err
+	}
+	etag, _ := checkChunkETag(c, session)
+	sum := knownChunkChecksum(etag)
+	if sum == "" {
+		return echo.NewHTTPError(http.StatusConflict, "Chunk archive has not been built yet, the download sends its checksum")
+	}
+	return c.JSON(http.StatusOK, echo.Map{"sha256": sum, "etag": etag})
+}
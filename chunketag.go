@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"os"
+	"strings"
+)
+
+// chunkETag identifies the archive a chunk builds to without building it: the format and
+// compression settings, then every file in archive order with its size, mtime and whether a zip
+// stores it uncompressed. Archives are deterministic, so the same files in the same state always
+// give the same bytes and the same tag, whichever init created the chunk. Files that can't be read
+// go in as missing.
+func chunkETag(t *contentTree, files []string, compression compressionSettings, format string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\n", format, compression.key())
+	perEntry := !isTarFormat(format) && compression.Method != methodStore
+	for _, f := range files {
+		_, full, err := resolveContentFile(t.Dir, f)
+		if err == nil {
+			var info os.FileInfo
+			if info, err = os.Stat(full); err == nil && !info.IsDir() {
+				fmt.Fprintf(h, "%s\x00%d\x00%d\x00%t\n", f, info.Size(), info.ModTime().UnixNano(), perEntry && storesExtension(f))
+				continue
+			}
+		}
+		fmt.Fprintf(h, "%s\x00missing\n", f)
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header names etag, weak tags compare equal
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkChunkETag sets the chunk's current ETag on the response and returns it, along with whether
+// the client already holds that archive
+func checkChunkETag(c echo.Context, session *chunkSession) (string, bool) {
+	etag := chunkETag(session.Content, session.Files, session.Compression, session.Format)
+	c.Response().Header().Set("ETag", etag)
+	inm := c.Request().Header.Get("If-None-Match")
+	return etag, inm != "" && etagMatches(inm, etag)
+}
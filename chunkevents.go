@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/labstack/echo/v4"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// chunk lifecycle events
+const (
+	chunkCreated           = "created"
+	chunkBuildStarted      = "build_started"
+	chunkBuildFinished     = "build_finished"
+	chunkBuildFailed       = "build_failed"
+	chunkDownloadStarted   = "download_started"
+	chunkDownloadCompleted = "download_completed"
+	chunkDownloadAborted   = "download_aborted"
+	chunkNotModified       = "not_modified"
+	chunkExpired           = "expired"
+	chunkDeleted           = "deleted"
+)
+
+// chunkEvent is one step in the life of a chunk session
+type chunkEvent struct {
+	Time      time.Time      `json:"time"`
+	ChunkID   string         `json:"chunk_id"`
+	Event     string         `json:"event"`
+	RequestID string         `json:"request_id,omitempty"`
+	Client    string         `json:"client,omitempty"`
+	Fields    map[string]any `json:"fields,omitempty"`
+}
+
+// chunkEventLog appends events as JSON lines to CHUNK_EVENT_LOG. Once the file passes
+// CHUNK_EVENT_LOG_MAX_BYTES it's rotated to <path>.1, so at most twice that is kept on disk.
+type chunkEventLog struct {
+	mu   sync.Mutex
+	path string
+	max  int64
+	f    *os.File
+	size int64
+}
+
+var chunkEvents = &chunkEventLog{}
+
+func (l *chunkEventLog) configure(path string, max int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.path, l.max = path, max
+}
+
+// record writes an event, c may be nil for events outside a request
+func (l *chunkEventLog) record(c echo.Context, chunkID, event string, fields map[string]any) {
+	e := chunkEvent{Time: time.Now(), ChunkID: chunkID, Event: event, Fields: fields}
+	if c != nil {
+		e.RequestID = c.Response().Header().Get(echo.HeaderXRequestID)
+		e.Client = clientIdentity(c.Request())
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.path == "" {
+		return
+	}
+	if l.f == nil {
+		if err := l.openLocked(); err != nil {
+			slog.Error("Error opening chunk event log", "path", l.path, "err", err)
+			return
+		}
+	}
+	if l.max > 0 && l.size+int64(len(line)) >= l.max {
+		l.f.Close()
+		l.f = nil
+		_ = os.Rename(l.path, l.path+".1")
+		if err := l.openLocked(); err != nil {
+			slog.Error("Error opening chunk event log", "path", l.path, "err", err)
+			return
+		}
+	}
+	n, _ := l.f.Write(append(line, '\n'))
+	l.size += int64(n)
+}
+
+func (l *chunkEventLog) openLocked() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+// events returns everything recorded for a chunk, oldest first
+func (l *chunkEventLog) events(chunkID string) []chunkEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := []chunkEvent{}
+	if l.path == "" {
+		return out
+	}
+	for _, path := range []string{l.path + ".1", l.path} {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var e chunkEvent
+			if json.Unmarshal(scanner.Bytes(), &e) == nil && e.ChunkID == chunkID {
+				out = append(out, e)
+			}
+		}
+		f.Close()
+	}
+	return out
+}
+
+// GET /admin/chunks/:id/events
+func handleAdminChunkEvents(c echo.Context) error {
+	return c.JSON(http.StatusOK, echo.Map{"events": chunkEvents.events(c.Param("id"))})
+}
+
+// GET /admin/chunks/:id is the session status along with its events
+func handleAdminChunk(c echo.Context) error {
+	id := c.Param("id")
+	response := echo.Map{"id": id, "live": false, "events": chunkEvents.events(id)}
+
+	chunkStoreMu.Lock()
+	if s, ok := chunkStore[id]; ok {
+		response["live"] = true
+		response["ref"] = s.Content.Ref
+		response["files"] = s.Files
+		response["total_size_uncompressed"] = s.Size
+		response["compression"] = s.Compression
+		response["built"] = s.Entries != nil
+	}
+	chunkStoreMu.Unlock()
+
+	return c.JSON(http.StatusOK, response)
+}
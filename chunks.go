@@ -0,0 +1,747 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	chunkBindingOff   = "off"   // chunk URLs work for anyone who has them
+	chunkBindingIP    = "ip"    // only the client identity that ran init may download
+	chunkBindingToken = "token" // downloads must send the init's download_token, for setups behind CDNs where the edge IP differs
+)
+
+const chunkTokenHeader = "X-Chunk-Token"
+
+// chunkOmittedHeader lists the files a best-effort archive is missing, as the JSON of []archiveOmission
+const chunkOmittedHeader = "X-Chunk-Omitted"
+
+// contentCommitHeader is the commit a chunk archive was built from
+const contentCommitHeader = "X-Content-Commit"
+
+// chunkExpiresHeader is when the chunk URL stops working unless a download moves it on, RFC 3339
+const chunkExpiresHeader = "X-Chunk-Expires"
+
+// chunkEstimatedSizeHeader is a HEAD's guess at the archive size when no build has been seen
+const chunkEstimatedSizeHeader = "X-Chunk-Estimated-Size"
+
+// chunkSession is what this instance knows about a chunk, created from the claims of its URL token
+// the first time the chunk is requested. Losing one only loses the build it cached.
+type chunkSession struct {
+	Content     *contentTree // checkout the files are read from
+	Created     time.Time    // when the session was created here, not when init ran
+	Expires     time.Time    // when the chunk's URL does, the session goes with it
+	Files       []string
+	Size        int64 // uncompressed bytes of Files at init
+	Compression compressionSettings
+	Format      string            // archive container, zip or one of the tar formats
+	Owner       string            // client identity that ran init
+	Token       string            // sha256 of the secret downloads must present when CHUNK_BINDING=token
+	APIKey      string            // ID of the API key init ran under, downloads must present the same
+	BestEffort  bool              // serve archives missing files that vanished since init, listing them
+	Entries     []archiveEntry    // set once the artifact has been built, guarded by chunkStoreMu
+	Omitted     []archiveOmission // files a best-effort build left out, guarded by chunkStoreMu
+	Downloaded  bool              // a download completed in full, guarded by chunkStoreMu
+	Downloads   int               // downloads completed in full here, guarded by chunkStoreMu
+
+	streaming int // downloads in progress, guarded by chunkStoreMu
+
+	// the built artifact and the ETag it was built at, kept between the requests of a ranged or
+	// resumed download until artifactTimer removes it, guarded by chunkStoreMu
+	artifact      *builtArchive
+	artifactETag  string
+	artifactTimer *time.Timer
+	resumeUntil   time.Time // an interrupted download keeps the session alive until then
+}
+
+// archiveEntry is the central directory record of one file in a built chunk
+type archiveEntry struct {
+	Name             string `json:"name"`
+	CompressedSize   uint64 `json:"compressed_size"`
+	UncompressedSize uint64 `json:"uncompressed_size"`
+	CRC32            string `json:"crc32"`
+}
+
+var (
+	chunkStore   = make(map[string]*chunkSession) // chunkID -> session
+	chunkStoreMu sync.Mutex
+)
+
+// chunkPlanContextKey marks a request handleChunkPlan passes on as a dry run
+const chunkPlanContextKey = "chunk_plan"
+
+// POST /zip-chunks/plan plans the same chunks as init as a dry run: nothing is stored, URLs are
+// empty and it doesn't count against the init rate limit
+func handleChunkPlan(c echo.Context) error {
+	c.Set(chunkPlanContextKey, true)
+	return handleChunkInit(c)
+}
+
+// POST /zip-chunks/init?ref=<branch>. Chunks are returned in the order CHUNK_ORDER intends them to
+// be downloaded, clients fetching them one at a time should follow it.
+func handleChunkInit(c echo.Context) error {
+	content, err := contentFor(c)
+	if err != nil {
+		return err
+	}
+
+	var payload struct {
+		Files        []string            `json:"files"`
+		MaxChunkSize int64               `json:"max_chunk_size"` // bytes
+		Compression  *compressionRequest `json:"compression"`
+		Level        json.RawMessage     `json:"compression_level"` // shorthand for compression.level, or "store"
+		Format       string              `json:"format"`            // zip (default), tar.gz or tar.zst
+		BestEffort   bool                `json:"best_effort"`
+		DryRun       bool                `json:"dry_run"`
+	}
+	if err := c.Bind(&payload); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid JSON payload")
+	}
+	plan, _ := c.Get(chunkPlanContextKey).(bool)
+	dryRun := payload.DryRun || plan
+
+	// Default to 10MB if not provided
+	if payload.MaxChunkSize <= 0 {
+		payload.MaxChunkSize = 30 * 1024 * 1024 // 30MB
+	}
+
+	requested, err := withLevel(payload.Compression, payload.Level)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	compression, err := resolveCompression(formatCompression(payload.Format, requested))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	format, err := resolveFormat(payload.Format, compression)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	// the listing and the etags see one checkout, not one a pull is halfway through moving
+	release := sync.OnceFunc(readContent())
+	defer release()
+
+	// Expand file paths with size data
+	var filesWithSize []sizedFile
+	var requestedBytes int64
+	rejected := make(map[string]string)
+	skipped := make(map[string]string)
+	missing, directories := []string{}, []string{}
+	expanded, matched := make(map[string]int), make(map[string]int)
+	seen := make(map[string]bool)
+	limitErr := func() error {
+		if cfg.InitMaxFiles > 0 && len(filesWithSize) > cfg.InitMaxFiles {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Request comes to more than %d files, ask for fewer", cfg.InitMaxFiles))
+		}
+		if cfg.InitMaxBytes > 0 && requestedBytes > cfg.InitMaxBytes {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Request comes to more than %d bytes, ask for fewer files", cfg.InitMaxBytes))
+		}
+		return nil
+	}
+	// addFound adds a file a directory or pattern led to, reporting whether it's new
+	addFound := func(name string, info os.FileInfo) (bool, error) {
+		if seen[name] {
+			return false, nil
+		}
+		seen[name] = true
+		if problem := entryNameProblem(name); problem != "" {
+			rejected[name] = problem
+			return false, nil
+		}
+		filesWithSize = append(filesWithSize, sizedFile{name, info.Size()})
+		requestedBytes += info.Size()
+		return true, limitErr()
+	}
+	listFailed := func(file string, err error) error {
+		var httpErr *echo.HTTPError
+		if errors.As(err, &httpErr) {
+			return err
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to list "+file)
+	}
+	for _, file := range payload.Files {
+		// names are stored cleaned and repo relative, the download resolves them again. Spellings
+		// of a path already listed ("./a", "a\\b") are dropped, an archive must not hold a name twice.
+		rel, full, err := resolveContentFile(content.Dir, file)
+		if errors.Is(err, errOutsideRoot) {
+			rejected[file] = err.Error()
+			continue
+		}
+		if errors.Is(err, errExcluded) {
+			skipped[file] = "excluded"
+			continue
+		}
+		// a name that exists is taken literally even if it looks like a pattern
+		if err != nil && isGlob(file) {
+			count := 0
+			err := globContent(content.Dir, rel, func(name string, info os.FileInfo) error {
+				count++
+				_, err := addFound(name, info)
+				return err
+			})
+			if errors.Is(err, path.ErrBadPattern) {
+				rejected[file] = "malformed pattern"
+				continue
+			}
+			if err != nil {
+				return listFailed(file, err)
+			}
+			if count == 0 {
+				skipped[file] = "matches nothing"
+				missing = append(missing, file)
+			}
+			matched[file] = count
+			continue
+		}
+		if seen[rel] {
+			continue
+		}
+		seen[rel] = true
+		if problem := entryNameProblem(rel); problem != "" {
+			rejected[file] = problem
+			continue
+		}
+		var info os.FileInfo
+		if err == nil {
+			info, err = os.Stat(full)
+		}
+		if err != nil {
+			skipped[file] = "not found"
+			missing = append(missing, file)
+			continue
+		}
+		if info.IsDir() {
+			// a directory stands for everything below it, files already listed keep their place
+			count := 0
+			err := walkContentDir(content.Dir, rel, func(name string, info os.FileInfo) error {
+				added, err := addFound(name, info)
+				if added {
+					count++
+				}
+				return err
+			})
+			if err != nil {
+				return listFailed(file, err)
+			}
+			if count == 0 {
+				skipped[file] = "is an empty directory"
+				directories = append(directories, file)
+				continue
+			}
+			expanded[file] = count
+			continue
+		}
+		filesWithSize = append(filesWithSize, sizedFile{rel, info.Size()})
+		requestedBytes += info.Size()
+		if err := limitErr(); err != nil {
+			return err
+		}
+	}
+	// a client whose every path is wrong would otherwise install nothing and not know why
+	if len(filesWithSize) == 0 && len(payload.Files) > 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error":               "None of the requested files can be served",
+			"missing":             missing,
+			"skipped_directories": directories,
+			"skipped":             skipped,
+			"rejected":            rejected,
+		})
+	}
+
+	// nothing is stored, every chunk's URL carries its own signed claims. IDs of a repo's chunks
+	// start with its name, so sessions and artifacts of two repos never share a key.
+	chunkID := strconv.FormatInt(time.Now().UnixNano(), 10)
+	if content.Repo != "" {
+		chunkID = content.Repo + "-" + chunkID
+	}
+	owner := clientIdentity(c.Request())
+	token := randomToken()
+	expires := time.Now().Add(cfg.ChunkTTL)
+	template := chunkClaims{
+		ID:          chunkID,
+		Ref:         content.Ref,
+		Repo:        content.Repo,
+		Compression: compression,
+		Format:      format,
+		BestEffort:  payload.BestEffort,
+		Owner:       owner,
+		TokenHash:   hashDownloadToken(token),
+		APIKey:      requestAPIKey(c),
+		Expires:     expires.Unix(),
+	}
+
+	// Chunk files by max total byte size, in the order they should be downloaded. A plan splits
+	// them the same way as the init it previews.
+	chunks, err := fitChunkTokens(planChunks(filesWithSize, payload.MaxChunkSize), template)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to sign chunk URLs")
+	}
+	chunkFiles := make([][]string, len(chunks))
+	var largest int64
+	for i, chunk := range chunks {
+		for _, f := range chunk.Files {
+			chunkFiles[i] = append(chunkFiles[i], f.Path)
+		}
+		largest = max(largest, chunk.Size)
+	}
+	// a plan whose biggest chunk can't be built now is turned away before the client commits to it
+	if err := insufficientStorage(c, "init", largest); err != nil {
+		return err
+	}
+
+	type ChunkInfo struct {
+		URL                   string `json:"url"`
+		Format                string `json:"format"`                 // container the URL serves
+		ETag                  string `json:"etag"`                   // If-None-Match value once the archive is cached
+		SHA256                string `json:"sha256,omitempty"`       // when an identical archive was built before
+		Size                  int64  `json:"size,omitempty"`         // archive bytes, alongside sha256
+		ChecksumURL           string `json:"checksum_url,omitempty"` // the sha256 once the archive has been built
+		Order                 int    `json:"order"`                  // download position, 0 first
+		Critical              bool   `json:"critical"`               // holds core files the client needs to start
+		FileCount             int    `json:"file_count"`
+		TotalSizeUncompressed int64  `json:"total_size_uncompressed"` // uncompressed size in bytes
+		EstimatedSize         int64  `json:"estimated_size_compressed"`
+		Zip64                 bool   `json:"zip64,omitempty"` // the zip needs Zip64 extensions to open
+	}
+
+	var result []ChunkInfo
+	var totalBytes int64
+
+	for i, chunk := range chunks {
+		size := chunk.Size
+		totalBytes += size
+		info := ChunkInfo{
+			Format:                format,
+			Order:                 i,
+			Critical:              chunk.Critical,
+			FileCount:             len(chunk.Files),
+			TotalSizeUncompressed: size,
+			EstimatedSize:         compression.estimateCompressed(format, chunk.Files),
+			ETag:                  chunkETag(content, chunkFiles[i], compression, format),
+			Zip64:                 !isTarFormat(format) && needsZip64(chunk.Files),
+		}
+		info.SHA256, info.Size = knownChunkChecksum(info.ETag), knownChunkSize(info.ETag)
+		if dryRun {
+			result = append(result, info)
+			continue
+		}
+		claims := template
+		claims.ID, claims.Files, claims.Size = fmt.Sprintf("%s-%d", chunkID, i), chunkFiles[i], size
+		signed, err := signChunkToken(&claims)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to sign chunk URLs")
+		}
+		info.URL = content.urlPrefix() + "/zip-chunks/" + signed
+		info.ChecksumURL = info.URL + "/checksum"
+		result = append(result, info)
+		chunkEvents.record(c, fmt.Sprintf("%s-%d", chunkID, i), chunkCreated, map[string]any{
+			"file_count": len(chunk.Files),
+			"bytes":      size,
+			"ref":        content.Ref,
+		})
+	}
+	release()
+
+	response := echo.Map{
+		"chunks":            result,
+		"compression":       compression,
+		"compression_level": compression.Level,
+		"format":            format,
+	}
+	if len(rejected) > 0 {
+		response["rejected"] = rejected
+	}
+	if len(skipped) > 0 {
+		response["skipped"] = skipped
+	}
+	response["missing"] = missing
+	response["skipped_directories"] = directories
+	if len(expanded) > 0 {
+		response["expanded"] = expanded
+	}
+	if len(matched) > 0 {
+		response["matched"] = matched
+	}
+	if dryRun {
+		metricChunkInitRequests.WithLabelValues("dry_run").Inc()
+		response["dry_run"] = true
+	} else {
+		metricChunkInitRequests.WithLabelValues("init").Inc()
+		metricChunksCreated.Add(float64(len(result)))
+		slog.Info("Chunks created", "chunk_id", chunkID, "ip", c.RealIP(), "chunks", len(result), "file_count", len(filesWithSize), "bytes", totalBytes, "format", format)
+		response["expires_at"] = expires.UTC()
+		if cfg.ChunkBinding == chunkBindingToken {
+			response["download_token"] = token
+		}
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// checkChunkBinding rejects requests for a chunk from anyone but the client that created it
+func checkChunkBinding(c echo.Context, session *chunkSession) error {
+	if session.APIKey != "" && requestAPIKey(c) != session.APIKey {
+		return echo.NewHTTPError(http.StatusForbidden, "Chunk belongs to a different API key")
+	}
+	switch cfg.ChunkBinding {
+	case chunkBindingIP:
+		if clientIdentity(c.Request()) != session.Owner {
+			return echo.NewHTTPError(http.StatusForbidden, "Chunk belongs to a different client")
+		}
+	case chunkBindingToken:
+		token := c.Request().Header.Get(chunkTokenHeader)
+		if token == "" || subtle.ConstantTimeCompare([]byte(hashDownloadToken(token)), []byte(session.Token)) != 1 {
+			return echo.NewHTTPError(http.StatusForbidden, "Missing or invalid "+chunkTokenHeader)
+		}
+	}
+	return nil
+}
+
+// GET /zip-chunks/:chunkID, If-None-Match with the etag from init answers 304 while none of the
+// chunk's files changed. Range and If-Range requests resume an interrupted download from the same
+// artifact.
+func handleChunkDownload(c echo.Context) error {
+	chunkID, session, err := lookupChunk(c)
+	if err != nil {
+		return err
+	}
+	// the rest of the init stays valid while the client works through it, however long it takes
+	touchChunkInit(chunkID)
+	defer touchChunkInit(chunkID)
+	etag, unchanged := checkChunkETag(c, session)
+	if unchanged {
+		chunkEvents.record(c, chunkID, chunkNotModified, nil)
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	// a resume gets the artifact the interrupted download was reading, as long as it's still current
+	if archive, done := session.resumeArtifact(etag); archive != nil {
+		defer done()
+		return serveChunkArtifact(c, chunkID, session, archive)
+	}
+
+	// files created for the chunk from here on aren't artifacts a purge knows about until kept
+	defer markBuilding(chunkID)()
+
+	// an archive of the same files built for another init is linked in, nothing to build
+	if archive := cachedArchiveFor(session, chunkID, etag); archive != nil {
+		done := markStreaming(session, archive.Path)
+		defer done()
+		chunkStoreMu.Lock()
+		session.Entries = archive.Entries
+		session.Omitted = archive.Omitted
+		chunkStoreMu.Unlock()
+		chunkEvents.record(c, chunkID, chunkBuildFinished, map[string]any{
+			"cached":    true,
+			"zip_bytes": archive.Size,
+			"entries":   len(archive.Entries),
+			"commit":    archive.Commit,
+		})
+		slog.Info("Chunk served from the archive cache", "chunk_id", chunkID, "ip", c.RealIP(), "file_count", len(session.Files), "bytes", archive.Size)
+		session.keepArtifact(archive, etag)
+		return serveChunkArtifact(c, chunkID, session, archive)
+	}
+
+	if err := insufficientStorage(c, "download", session.Size); err != nil {
+		return err
+	}
+
+	// Ensure /tmp/patcher/ exists
+	tmpDir := chunkTempDir()
+	if err := os.MkdirAll(tmpDir, 0o755); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create temp dir")
+	}
+
+	allowed, probe := breaker.allow()
+	if !allowed {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(cfg.BreakerCooldown.Seconds())))
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Server is under heavy disk load, try again later")
+	}
+
+	// waiting for a worker holds nothing but the request
+	release, err := builds.acquire(c.Request().Context(), session.Size, cfg.BuildQueueTimeout)
+	if errors.Is(err, errBuildQueueTimeout) || errors.Is(err, errBuildQueueFull) {
+		slog.Warn("Chunk build turned away", "chunk_id", chunkID, "ip", c.RealIP(), "err", err)
+		c.Response().Header().Set("Retry-After", "30")
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Build queue is full, try again later")
+	}
+	if err != nil {
+		breaker.record(0, 0, 0, probe)
+		return err
+	}
+	buildStart := time.Now()
+	chunkEvents.record(c, chunkID, chunkBuildStarted, map[string]any{"compression": session.Compression.key()})
+	if cfg.ChunkStreamDirect {
+		defer release()
+		breaker.record(0, 0, 0, probe)
+		return streamChunk(c, chunkID, session, etag)
+	}
+	archive, err := buildChunkArchive(tmpDir, chunkID, session)
+	release()
+	if err != nil {
+		breaker.record(0, 0, 0, probe)
+		recordChunkBuild(session.Format, "failed", time.Since(buildStart))
+		chunkEvents.record(c, chunkID, chunkBuildFailed, map[string]any{
+			"duration_ms": time.Since(buildStart).Milliseconds(),
+			"error":       err.Error(),
+		})
+		slog.Error("Error building chunk", "chunk_id", chunkID, "ip", c.RealIP(), "file_count", len(session.Files), "bytes", session.Size, "duration", time.Since(buildStart), "err", err)
+		var integrityErr *integrityError
+		if errors.As(err, &integrityErr) {
+			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("%s failed integrity verification", integrityErr.Path))
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to build chunk archive")
+	}
+
+	// from here until the stream ends neither the sweep nor a delete timer removes the artifact
+	done := markStreaming(session, archive.Path)
+	defer done()
+
+	if len(archive.Omitted) > 0 && !session.BestEffort {
+		// an archive missing files leaves a partially patched install behind, the client has to
+		// init again against the current content
+		removeArtifact(archive.Path)
+		breaker.record(0, 0, 0, probe)
+		recordChunkBuild(session.Format, "incomplete", time.Since(buildStart))
+		chunkEvents.record(c, chunkID, chunkBuildFailed, map[string]any{
+			"duration_ms": time.Since(buildStart).Milliseconds(),
+			"omitted":     archive.Omitted,
+		})
+		slog.Warn("Chunk is missing files, not serving it", "chunk_id", chunkID, "ip", c.RealIP(), "missing", len(archive.Omitted), "file_count", len(session.Files))
+		return echo.NewHTTPError(http.StatusConflict, echo.Map{
+			"message": fmt.Sprintf("%d files of the chunk are no longer available, call /zip-chunks/init again", len(archive.Omitted)),
+			"omitted": archive.Omitted,
+		})
+	}
+	breaker.record(archive.SourceBytes, time.Since(buildStart), archive.WriteLatency, probe)
+	recordArchiveCompression(session, archive.Entries, archive.SourceBytes, archive.Size)
+	recordChunkBuild(session.Format, "ok", time.Since(buildStart))
+	chunkEvents.record(c, chunkID, chunkBuildFinished, map[string]any{
+		"duration_ms":  time.Since(buildStart).Milliseconds(),
+		"source_bytes": archive.SourceBytes,
+		"zip_bytes":    archive.Size,
+		"entries":      len(archive.Entries),
+		"commit":       archive.Commit,
+	})
+
+	chunkStoreMu.Lock()
+	session.Entries = archive.Entries
+	session.Omitted = archive.Omitted
+	chunkStoreMu.Unlock()
+
+	slog.Info("Chunk built", "chunk_id", chunkID, "ip", c.RealIP(), "file_count", len(session.Files), "bytes", archive.Size, "source_bytes", archive.SourceBytes, "duration", time.Since(buildStart))
+	session.keepArtifact(archive, etag)
+	cacheArchive(session, etag, archive)
+	return serveChunkArtifact(c, chunkID, session, archive)
+}
+
+// setChunkHeaders sets what both a chunk's GET and HEAD carry whatever the archive turns out as
+func setChunkHeaders(c echo.Context, chunkID string, session *chunkSession) {
+	chunkStoreMu.Lock()
+	deadline := chunkDeadlineLocked(chunkID, session.Expires)
+	chunkStoreMu.Unlock()
+	h := c.Response().Header()
+	h.Set(echo.HeaderContentType, session.format().ContentType)
+	h.Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", chunkID+session.format().Ext))
+	h.Set(chunkExpiresHeader, deadline.UTC().Format(time.RFC3339))
+}
+
+// HEAD /zip-chunks/:chunkID answers with the headers the GET would send from what is known without
+// a build: the kept artifact's or an earlier build's size and sha256, else only the estimate. It
+// takes none of the download limits and doesn't move the init's deadline, a URL that's gone gets
+// the GET's error.
+func handleChunkHead(c echo.Context) error {
+	chunkID, session, err := lookupChunk(c)
+	if err != nil {
+		return err
+	}
+	etag, unchanged := checkChunkETag(c, session)
+	if unchanged {
+		return c.NoContent(http.StatusNotModified)
+	}
+	setChunkHeaders(c, chunkID, session)
+
+	h := c.Response().Header()
+	sum, size := knownChunkChecksum(etag), knownChunkSize(etag)
+	chunkStoreMu.Lock()
+	if a := session.artifact; a != nil && session.artifactETag == etag {
+		sum, size = a.SHA256, a.Size
+		h.Set(contentCommitHeader, a.Commit)
+	}
+	chunkStoreMu.Unlock()
+	if !cfg.ChunkStreamDirect {
+		h.Set("Accept-Ranges", "bytes")
+	}
+	if sum != "" && size > 0 {
+		h.Set(chunkSHA256Header, sum)
+		h.Set(echo.HeaderContentLength, strconv.FormatInt(size, 10))
+		return c.NoContent(http.StatusOK)
+	}
+
+	files := make([]sizedFile, 0, len(session.Files))
+	for _, f := range session.Files {
+		if _, full, err := resolveContentFile(session.Content.Dir, f); err == nil {
+			if info, err := os.Stat(full); err == nil && !info.IsDir() {
+				files = append(files, sizedFile{Path: f, Size: info.Size()})
+			}
+		}
+	}
+	h.Set(chunkEstimatedSizeHeader, strconv.FormatInt(session.Compression.estimateCompressed(session.Format, files), 10))
+	return c.NoContent(http.StatusOK)
+}
+
+// chunkTempDir is where chunk artifacts are built
+func chunkTempDir() string {
+	return filepath.Join(os.TempDir(), "patcher")
+}
+
+// insufficientStorage is the 507 for a build of size bytes the temp dir can't hold with
+// BUILD_DISK_HEADROOM to spare, nil when it fits or the free space can't be read. Streamed
+// chunks never touch the disk.
+func insufficientStorage(c echo.Context, stage string, size int64) error {
+	if cfg.ChunkStreamDirect {
+		return nil
+	}
+	free, err := diskFree(os.TempDir())
+	if err != nil {
+		return nil
+	}
+	need := size + cfg.BuildDiskHeadroom
+	if free >= need {
+		return nil
+	}
+	metricBuildsNoSpace.WithLabelValues(stage).Inc()
+	slog.Warn("Not enough temp disk space for a chunk build", "stage", stage, "ip", c.RealIP(), "need", need, "free", free)
+	return echo.NewHTTPError(http.StatusInsufficientStorage, echo.Map{
+		"message":    "Not enough disk space to build the chunk, try again later",
+		"need_bytes": need,
+		"free_bytes": free,
+	})
+}
+
+// GET /zip-chunks/:chunkID/entries
+func handleChunkEntries(c echo.Context) error {
+	_, session, err := lookupChunk(c)
+	if err != nil {
+		return err
+	}
+
+	chunkStoreMu.Lock()
+	defer chunkStoreMu.Unlock()
+	if session.Entries == nil {
+		return echo.NewHTTPError(http.StatusConflict, "Chunk archive has not been built yet")
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"entries": session.Entries,
+		"omitted": session.Omitted,
+	})
+}
+
+// chunkBySize fills chunks up to maxSize in order. A file bigger than maxSize on its own still gets
+// a chunk, nothing that was requested is dropped.
+func chunkBySize(files []sizedFile, maxSize int64) [][]sizedFile {
+	var chunks [][]sizedFile
+	var current []sizedFile
+	var currentSize int64
+
+	for _, f := range files {
+		if currentSize+f.Size > maxSize && len(current) > 0 {
+			chunks = append(chunks, current)
+			current = nil
+			currentSize = 0
+		}
+		current = append(current, f)
+		currentSize += f.Size
+	}
+	if len(current) > 0 {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
+
+// GET /admin/chunks lists the live chunk sessions
+func handleAdminChunks(c echo.Context) error {
+	type chunkInfo struct {
+		ID             string              `json:"id"`
+		Ref            string              `json:"ref,omitempty"`
+		FileCount      int                 `json:"file_count"`
+		Size           int64               `json:"total_size_uncompressed"`
+		Compression    compressionSettings `json:"compression"`
+		Format         string              `json:"format"`
+		Built          bool                `json:"built"`
+		Downloaded     bool                `json:"downloaded"`
+		Downloads      int                 `json:"download_count"`
+		Streaming      int                 `json:"streaming"`
+		Created        time.Time           `json:"created_at"`
+		Expires        time.Time           `json:"expires_at"`
+		ArtifactPath   string              `json:"artifact_path,omitempty"`
+		ArtifactOnDisk bool                `json:"artifact_on_disk"`
+		ArtifactBytes  int64               `json:"artifact_bytes,omitempty"`
+	}
+
+	chunkStoreMu.Lock()
+	chunks := make([]chunkInfo, 0, len(chunkStore))
+	for id, s := range chunkStore {
+		info := chunkInfo{
+			ID:          id,
+			Ref:         s.Content.Ref,
+			FileCount:   len(s.Files),
+			Size:        s.Size,
+			Compression: s.Compression,
+			Format:      s.Format,
+			Built:       s.Entries != nil,
+			Downloaded:  s.Downloaded,
+			Downloads:   s.Downloads,
+			Streaming:   s.streaming,
+			Created:     chunkCreatedAt(id, s.Created),
+			Expires:     chunkDeadlineLocked(id, s.Expires),
+		}
+		if s.artifact != nil {
+			info.ArtifactPath = s.artifact.Path
+		}
+		chunks = append(chunks, info)
+	}
+	chunkStoreMu.Unlock()
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].ID < chunks[j].ID })
+
+	// stat outside the lock, what's on disk is checked rather than assumed from the session
+	var artifactBytes int64
+	for i := range chunks {
+		if chunks[i].ArtifactPath == "" {
+			continue
+		}
+		if fi, err := os.Stat(chunks[i].ArtifactPath); err == nil {
+			chunks[i].ArtifactOnDisk = true
+			chunks[i].ArtifactBytes = fi.Size()
+			artifactBytes += fi.Size()
+		}
+	}
+	archiveCache.Lock()
+	cacheBytes, cacheEntries := archiveCache.bytes, len(archiveCache.entries)
+	archiveCache.Unlock()
+	free, _ := diskFree(os.TempDir())
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"chunks":              chunks,
+		"count":               len(chunks),
+		"artifact_bytes":      artifactBytes,
+		"archive_cache_bytes": cacheBytes,
+		"archive_cache_count": cacheEntries,
+		"temp_dir":            chunkTempDir(),
+		"temp_bytes":          cachedDirSize(chunkTempDir()),
+		"temp_free_bytes":     free,
+	})
+}
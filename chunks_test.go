@@ -0,0 +1,297 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// zipNames returns the names in a zip, in order
+func zipNames(t *testing.T, body []byte) []string {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("not a zip: %v", err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func TestChunkInitDeduplicatesFiles(t *testing.T) {
+	useConfig(t, "TMPDIR", t.TempDir())
+	useContent(t, map[string]string{"maps/a.txt": "aaaa", "b.txt": "bb"})
+	e := chunkServer(t)
+	res := chunkInit(t, e, `{"files":["maps/a.txt","./maps/a.txt","maps\\a.txt","maps//a.txt","b.txt","./b.txt","maps/../b.txt"]}`)
+	if len(res.Chunks) != 1 || res.Chunks[0].FileCount != 2 || res.Chunks[0].TotalSizeUncompressed != 6 {
+		t.Fatalf("chunks = %+v, want one with the 2 files and 6 bytes", res.Chunks)
+	}
+
+	rec := request(e, http.MethodGet, res.Chunks[0].URL, "")
+	if names, want := zipNames(t, rec.Body.Bytes()), []string{"maps/a.txt", "b.txt"}; !slices.Equal(names, want) {
+		t.Errorf("zip holds %v, want %v in the order given", names, want)
+	}
+}
+
+func TestChunkURLsStayShort(t *testing.T) {
+	useConfig(t, "TMPDIR", t.TempDir(), "CHUNK_BINDING", "token")
+	// names that don't compress, thousands of them within one chunk's byte budget
+	files := make(map[string]string)
+	for i := range 2000 {
+		sum := sha256.Sum256([]byte(strconv.Itoa(i)))
+		files[fmt.Sprintf("Resources/spells/%x.txt", sum[:12])] = "x"
+	}
+	useContent(t, files)
+	e := chunkServer(t)
+	body := `{"files":["Resources"],"max_chunk_size":1000000000}`
+
+	res := chunkInit(t, e, body)
+	seen := make(map[string]bool)
+	for _, c := range res.Chunks {
+		// with the repo prefix and /checksum, the URL is still inside an 8KB request line
+		if len(c.URL) > maxChunkTokenLen+len("/zip-chunks/") {
+			t.Errorf("chunk URL of %d files is %d bytes long", c.FileCount, len(c.URL))
+		}
+		rec := request(e, http.MethodGet, c.URL, "", chunkTokenHeader, res.DownloadToken)
+		names := zipNames(t, rec.Body.Bytes())
+		if len(names) != c.FileCount {
+			t.Errorf("chunk of %d files holds %d", c.FileCount, len(names))
+		}
+		for _, name := range names {
+			if seen[name] {
+				t.Errorf("%s is in two chunks", name)
+			}
+			seen[name] = true
+		}
+	}
+	if len(res.Chunks) < 2 || len(seen) != len(files) {
+		t.Errorf("%d files in %d chunks, want all %d split to fit the URLs", len(seen), len(res.Chunks), len(files))
+	}
+
+	// a plan previews the same split
+	var plan initResult
+	if err := json.Unmarshal(request(e, http.MethodPost, "/zip-chunks/plan", body).Body.Bytes(), &plan); err != nil {
+		t.Fatal(err)
+	}
+	for i := range plan.Chunks {
+		if i >= len(res.Chunks) || plan.Chunks[i].FileCount != res.Chunks[i].FileCount || plan.Chunks[i].ETag != res.Chunks[i].ETag {
+			t.Errorf("plan has chunk %d of %d files, init of %v", i, plan.Chunks[i].FileCount, res.Chunks)
+			break
+		}
+	}
+	if len(plan.Chunks) != len(res.Chunks) {
+		t.Errorf("plan has %d chunks, init %d", len(plan.Chunks), len(res.Chunks))
+	}
+}
+
+func TestChunkURLsOutliveTheirTTLWhileDownloading(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits out the TTL")
+	}
+	useConfig(t, "TMPDIR", t.TempDir(), "CHUNK_TTL", "2s")
+	files := map[string]string{}
+	var names []string
+	for i := range 5 {
+		name := fmt.Sprintf("maps/zone%d.txt", i)
+		files[name] = strings.Repeat(name, 100)
+		names = append(names, strconv.Quote(name))
+	}
+	useContent(t, files)
+	e := chunkServer(t)
+	urls := initChunks(t, e, `{"max_chunk_size":1000,"files":[`+strings.Join(names, ",")+`]}`)
+	if len(urls) != 5 {
+		t.Fatalf("%d chunks, want 5", len(urls))
+	}
+
+	// the whole run takes well past the URLs' signed expiry, every download pushes it back
+	start := time.Now()
+	for i, url := range urls {
+		if i > 0 {
+			time.Sleep(1200 * time.Millisecond)
+		}
+		sweepChunks(time.Now(), false)
+		if rec := request(e, http.MethodGet, url, ""); rec.Code != http.StatusOK {
+			t.Fatalf("chunk %d after %v = %d %s", i, time.Since(start), rec.Code, rec.Body.String())
+		}
+	}
+
+	// once the client stops, the init runs out a TTL after its last download
+	time.Sleep(2200 * time.Millisecond)
+	sweepChunks(time.Now(), false)
+	if rec := request(e, http.MethodGet, urls[0], ""); rec.Code != http.StatusGone {
+		t.Errorf("chunk of an idle init = %d, want 410", rec.Code)
+	}
+}
+
+func TestChunkFilesChangedSinceInit(t *testing.T) {
+	for _, direct := range []bool{false, true} {
+		t.Run("direct="+strconv.FormatBool(direct), func(t *testing.T) {
+			useConfig(t, "TMPDIR", t.TempDir(), "CHUNK_STREAM_DIRECT", strconv.FormatBool(direct))
+			root := useContent(t, map[string]string{"a.txt": "a before", "gone.txt": "gone", "b.txt": "b"})
+			e := chunkServer(t)
+			strict := initChunks(t, e, `{"files":["a.txt","gone.txt","b.txt"]}`)[0]
+			lenient := initChunks(t, e, `{"best_effort":true,"files":["a.txt","gone.txt","b.txt"]}`)[0]
+			if err := os.Remove(filepath.Join(root, "gone.txt")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("a after the pull"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			// by default the client is told to init again instead of getting a partial install
+			rec := request(e, http.MethodGet, strict, "")
+			var conflict struct {
+				Omitted []archiveOmission `json:"omitted"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &conflict); rec.Code != http.StatusConflict || err != nil ||
+				len(conflict.Omitted) != 1 || conflict.Omitted[0].Name != "gone.txt" {
+				t.Errorf("deleted file = %d %s, want 409 naming gone.txt", rec.Code, rec.Body.String())
+			}
+
+			// best effort lists the omission in the header and the zip comment
+			rec = request(e, http.MethodGet, lenient, "")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("best effort = %d %s", rec.Code, rec.Body.String())
+			}
+			header := rec.Header().Get(chunkOmittedHeader)
+			var omitted []archiveOmission
+			if err := json.Unmarshal([]byte(header), &omitted); err != nil || len(omitted) != 1 || omitted[0].Name != "gone.txt" {
+				t.Errorf("%s = %q, want gone.txt", chunkOmittedHeader, header)
+			}
+			zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(zr.Comment, "gone.txt") {
+				t.Errorf("zip comment = %q, want the omission", zr.Comment)
+			}
+			// the modified file goes in as it is now
+			contents := make(map[string]string)
+			for _, f := range zr.File {
+				r, err := f.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := io.ReadAll(r)
+				r.Close()
+				if err != nil {
+					t.Fatalf("%s: %v", f.Name, err)
+				}
+				contents[f.Name] = string(data)
+			}
+			if want := map[string]string{"a.txt": "a after the pull", "b.txt": "b"}; !maps.Equal(contents, want) {
+				t.Errorf("zip holds %v, want %v", contents, want)
+			}
+		})
+	}
+}
+
+func TestChunkBinding(t *testing.T) {
+	// clients sit behind a trusted proxy, X-Forwarded-For is who they are
+	const owner, other = "198.51.100.1", "198.51.100.2"
+	type attempt struct {
+		ip, key string
+		token   string // "init" sends the init's download_token
+		want    int
+	}
+	tests := []struct {
+		name     string
+		env      []string
+		key      string // API key of the init
+		attempts []attempt
+	}{
+		{"off", nil, "", []attempt{
+			{owner, "", "", 200},
+			{other, "", "", 200},
+		}},
+		{"ip", []string{"CHUNK_BINDING", "ip"}, "", []attempt{
+			{owner, "", "", 200},
+			{other, "", "", 403},
+		}},
+		// behind a CDN the edge that fetches differs from the one that ran init, the token is what counts
+		{"token", []string{"CHUNK_BINDING", "token"}, "", []attempt{
+			{other, "", "init", 200},
+			{owner, "", "init", 200},
+			{owner, "", "", 403},
+			{other, "", "forged", 403},
+		}},
+		{"api key", []string{"API_KEYS", "key-one,key-two"}, "key-one", []attempt{
+			{other, "key-one", "", 200},
+			{owner, "key-two", "", 403},
+			{owner, "", "", 401},
+		}},
+		{"api key and ip", []string{"API_KEYS", "key-one", "CHUNK_BINDING", "ip"}, "key-one", []attempt{
+			{owner, "key-one", "", 200},
+			{other, "key-one", "", 403},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, append([]string{"TMPDIR", t.TempDir(), "TRUSTED_PROXIES", "192.0.2.0/24"}, tt.env...)...)
+			useContent(t, chunkFixture("1"))
+			useChunkStore(t)
+			e := chunkServer(t)
+			e.Use(apiKeyMiddleware)
+			res := chunkInit(t, e, `{"files":["spells_us.txt"]}`, "X-Forwarded-For", owner, "X-Api-Key", tt.key)
+			if (cfg.ChunkBinding == chunkBindingToken) != (res.DownloadToken != "") {
+				t.Fatalf("download_token = %q with CHUNK_BINDING=%s", res.DownloadToken, cfg.ChunkBinding)
+			}
+			url := res.Chunks[0].URL
+
+			check := func(a attempt) {
+				t.Helper()
+				headers := []string{"X-Forwarded-For", a.ip, "X-Api-Key", a.key}
+				switch a.token {
+				case "init":
+					headers = append(headers, chunkTokenHeader, res.DownloadToken)
+				case "forged":
+					headers = append(headers, chunkTokenHeader, randomToken())
+				}
+				// every way into the chunk checks the same binding
+				if rec := request(e, http.MethodHead, url, "", headers...); rec.Code != a.want {
+					t.Errorf("HEAD %+v = %d", a, rec.Code)
+				}
+				if rec := request(e, http.MethodGet, url, "", headers...); rec.Code != a.want {
+					t.Errorf("GET %+v = %d", a, rec.Code)
+				}
+				if rec := request(e, http.MethodGet, url+"/checksum", "", headers...); rec.Code != a.want {
+					t.Errorf("GET checksum %+v = %d", a, rec.Code)
+				}
+			}
+			for _, a := range tt.attempts {
+				check(a)
+			}
+			// the binding travels in the signed URL, an instance that never saw the init enforces it
+			// too, and keeps no session for the clients it turns away
+			useChunkStore(t)
+			for _, a := range tt.attempts {
+				if a.want != http.StatusOK {
+					check(a)
+				}
+			}
+			chunkStoreMu.Lock()
+			kept := len(chunkStore)
+			chunkStoreMu.Unlock()
+			if kept != 0 {
+				t.Errorf("%d sessions kept for clients the chunk isn't bound to", kept)
+			}
+			for _, a := range tt.attempts {
+				check(a)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/labstack/echo/v4"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// an interrupted download's artifact is kept this long for a resume, a completed one's goes after
+// CHUNK_CLEANUP_DELAY
+const chunkResumeWindow = 10 * time.Minute
+
+// resumeArtifact returns the artifact a previous request of this chunk built if it still matches
+// etag, marked as streaming until done is called
+func (s *chunkSession) resumeArtifact(etag string) (*builtArchive, func()) {
+	chunkStoreMu.Lock()
+	defer chunkStoreMu.Unlock()
+	a := s.artifact
+	if a == nil || s.artifactETag != etag {
+		return nil, nil
+	}
+	if _, err := os.Stat(a.Path); err != nil {
+		s.artifact = nil
+		return nil, nil
+	}
+	// a timer that already fired sees it's no longer current and leaves the artifact alone
+	if s.artifactTimer != nil {
+		s.artifactTimer.Stop()
+		s.artifactTimer = nil
+	}
+	return a, markStreamingLocked(s, a.Path)
+}
+
+// keepArtifact makes a fresh build the one later requests of the chunk are served from
+func (s *chunkSession) keepArtifact(a *builtArchive, etag string) {
+	chunkStoreMu.Lock()
+	previous := s.artifact
+	s.artifact, s.artifactETag = a, etag
+	if s.artifactTimer != nil {
+		s.artifactTimer.Stop()
+		s.artifactTimer = nil
+	}
+	chunkStoreMu.Unlock()
+	rememberChunkChecksum(etag, a.SHA256, a.Size)
+	if previous != nil && previous.Path != a.Path {
+		removeArtifact(previous.Path)
+	}
+}
+
+// releaseArtifact schedules the removal of the kept artifact. After a completed download the
+// session goes with it, after an interrupted one the session stays until the resume window closes.
+func (s *chunkSession) releaseArtifact(chunkID string, completed bool) {
+	delay := chunkResumeWindow
+	if completed {
+		delay = cfg.ChunkCleanupDelay
+	}
+	chunkStoreMu.Lock()
+	defer chunkStoreMu.Unlock()
+	a := s.artifact
+	if a == nil {
+		return
+	}
+	if !completed {
+		s.resumeUntil = time.Now().Add(chunkResumeWindow)
+	}
+	if s.artifactTimer != nil {
+		s.artifactTimer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		chunkStoreMu.Lock()
+		if s.artifactTimer != timer {
+			chunkStoreMu.Unlock()
+			return
+		}
+		s.artifact, s.artifactTimer = nil, nil
+		if completed {
+			delete(chunkStore, chunkID)
+		}
+		chunkStoreMu.Unlock()
+
+		removeArtifact(a.Path)
+		if completed {
+			slog.Debug("Deleted chunk artifact", "chunk_id", chunkID, "path", a.Path)
+			chunkEvents.record(nil, chunkID, chunkDeleted, nil)
+		}
+	})
+	s.artifactTimer = timer
+}
+
+// serveChunkArtifact sends the artifact with http.ServeContent, so Range and If-Range work against
+// the ETag. Only a response that delivered the last byte of the archive completes the download,
+// whatever was requested before it.
+func serveChunkArtifact(c echo.Context, chunkID string, session *chunkSession, a *builtArchive) error {
+	f, err := os.Open(a.Path)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Chunk archive is no longer available, try again")
+	}
+	defer f.Close()
+
+	res := c.Response()
+	res.Header().Set(contentCommitHeader, a.Commit)
+	res.Header().Set(chunkSHA256Header, a.SHA256)
+	if len(a.Omitted) > 0 {
+		omitted, _ := json.Marshal(a.Omitted)
+		res.Header().Set(chunkOmittedHeader, string(omitted))
+	}
+	setChunkHeaders(c, chunkID, session)
+	chunkEvents.record(c, chunkID, chunkDownloadStarted, map[string]any{
+		"zip_bytes": a.Size,
+		"range":     c.Request().Header.Get("Range"),
+	})
+
+	// no modtime: If-Range only matches the ETag, a date can't tell two builds apart
+	content := &rangeTracker{f: f}
+	http.ServeContent(res, c.Request(), "", time.Time{}, content)
+
+	expected, _ := strconv.ParseInt(res.Header().Get(echo.HeaderContentLength), 10, 64)
+	delivered := res.Size == expected
+	switch {
+	case res.Status != http.StatusOK && res.Status != http.StatusPartialContent:
+		session.releaseArtifact(chunkID, false)
+	case delivered && content.end == a.Size:
+		chunkStoreMu.Lock()
+		session.Downloaded = true
+		session.Downloads++
+		chunkStoreMu.Unlock()
+		chunkEvents.record(c, chunkID, chunkDownloadCompleted, map[string]any{"bytes_sent": res.Size})
+		stats.recordChunk(chunkID, session, a.Size)
+		metricChunkBytesServed.WithLabelValues("completed").Add(float64(res.Size))
+		session.releaseArtifact(chunkID, true)
+	case delivered:
+		// a range short of the end, the rest is still to come
+		metricChunkBytesServed.WithLabelValues("partial").Add(float64(res.Size))
+		session.releaseArtifact(chunkID, false)
+	default:
+		metricChunkBytesServed.WithLabelValues("aborted").Add(float64(res.Size))
+		slog.Warn("Chunk download failed", "chunk_id", chunkID, "ip", c.RealIP(), "bytes", res.Size, "expected", expected)
+		chunkEvents.record(c, chunkID, chunkDownloadAborted, map[string]any{"bytes_sent": res.Size, "expected": expected})
+		session.releaseArtifact(chunkID, false)
+	}
+	return nil
+}
+
+// rangeTracker remembers how far into the artifact ServeContent read
+type rangeTracker struct {
+	f   *os.File
+	pos int64
+	end int64 // furthest offset read
+}
+
+func (r *rangeTracker) Read(p []byte) (int, error) {
+	n, err := r.f.Read(p)
+	r.pos += int64(n)
+	r.end = max(r.end, r.pos)
+	return n, err
+}
+
+func (r *rangeTracker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.f.Seek(offset, whence)
+	if err == nil {
+		r.pos = pos
+	}
+	return pos, err
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chunkSessionFor is the session a chunk URL's download created here
+func chunkSessionFor(t *testing.T, url string) (string, *chunkSession) {
+	t.Helper()
+	claims, err := parseChunkToken(url[strings.LastIndexByte(url, '/')+1:], time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunkStoreMu.Lock()
+	defer chunkStoreMu.Unlock()
+	return claims.ID, chunkStore[claims.ID]
+}
+
+func TestChunkArtifactServing(t *testing.T) {
+	useConfig(t, "TMPDIR", t.TempDir())
+	useContent(t, chunkFixture(t.Name()))
+	e := chunkServer(t)
+	url := initChunks(t, e, `{"files":["spells_us.txt","readme.txt"]}`)[0]
+
+	rec := request(e, http.MethodGet, url, "")
+	if rec.Code != http.StatusOK || rec.Body.Len() == 0 {
+		t.Fatalf("GET = %d, %d bytes", rec.Code, rec.Body.Len())
+	}
+	full, etag := rec.Body.Bytes(), rec.Header().Get("ETag")
+	_, session := chunkSessionFor(t, url)
+	chunkStoreMu.Lock()
+	path := session.artifact.Path
+	chunkStoreMu.Unlock()
+	onDisk, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(onDisk, full) {
+		t.Fatalf("body isn't the artifact on disk (%v)", err)
+	}
+
+	// a resume of the same build through Range and If-Range
+	rec = request(e, http.MethodGet, url, "", "Range", "bytes=10-99", "If-Range", etag)
+	if rec.Code != http.StatusPartialContent || !bytes.Equal(rec.Body.Bytes(), full[10:100]) {
+		t.Errorf("range GET = %d, %d bytes", rec.Code, rec.Body.Len())
+	}
+	rec = request(e, http.MethodGet, url, "", "Range", "bytes=10-", "If-Range", `"another build"`)
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), full) {
+		t.Errorf("range GET with a stale If-Range = %d, %d bytes, want the whole archive", rec.Code, rec.Body.Len())
+	}
+
+	// what ServeContent does with it, a plain copy over Read after a Seek
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tracker := &rangeTracker{f: f}
+	var copied bytes.Buffer
+	if _, err := io.Copy(&copied, tracker); err != nil || !bytes.Equal(copied.Bytes(), full) {
+		t.Fatalf("io.Copy over Read = %d bytes, %v", copied.Len(), err)
+	}
+	if tracker.end != int64(len(full)) {
+		t.Errorf("end = %d after reading it all, want %d", tracker.end, len(full))
+	}
+	tracker = &rangeTracker{f: f}
+	if _, err := tracker.Seek(100, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if rest, err := io.ReadAll(io.LimitReader(tracker, 50)); err != nil || !bytes.Equal(rest, full[100:150]) {
+		t.Fatalf("read after seek = %d bytes, %v", len(rest), err)
+	}
+	if tracker.end != 150 {
+		t.Errorf("end = %d after reading 100-150, want 150", tracker.end)
+	}
+}
+
+// cutWriter is a client that goes away after limit bytes of the body
+type cutWriter struct {
+	*httptest.ResponseRecorder
+	limit int
+}
+
+func (w *cutWriter) Write(p []byte) (int, error) {
+	if room := w.limit - w.Body.Len(); len(p) > room {
+		n, _ := w.ResponseRecorder.Write(p[:max(room, 0)])
+		return n, errors.New("connection reset")
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestChunkDownloadOutcomes(t *testing.T) {
+	useConfig(t, "TMPDIR", t.TempDir(), "CHUNK_CLEANUP_DELAY", "200ms")
+	useContent(t, chunkFixture(t.Name()))
+	e := chunkServer(t)
+	url := initChunks(t, e, `{"files":["spells_us.txt","readme.txt"]}`)[0]
+
+	// aborted: the artifact and the session stay for the retry
+	cut := &cutWriter{ResponseRecorder: httptest.NewRecorder(), limit: 1000}
+	e.ServeHTTP(cut, httptest.NewRequest(http.MethodGet, url, nil))
+	id, session := chunkSessionFor(t, url)
+	chunkStoreMu.Lock()
+	artifact, downloaded, resumeUntil := session.artifact, session.Downloaded, session.resumeUntil
+	chunkStoreMu.Unlock()
+	if artifact == nil || downloaded || !resumeUntil.After(time.Now()) {
+		t.Fatalf("after an abort artifact = %v, downloaded = %v, resume until %v", artifact, downloaded, resumeUntil)
+	}
+	if _, err := os.Stat(artifact.Path); err != nil {
+		t.Fatalf("artifact of an aborted download is gone: %v", err)
+	}
+	sweepChunks(time.Now(), false)
+	if _, s := chunkSessionFor(t, url); s != session {
+		t.Fatal("the sweep expired the session of an interrupted download")
+	}
+
+	// the retry is served from the same artifact, nothing is built again
+	rec := request(e, http.MethodGet, url, "")
+	if rec.Code != http.StatusOK || int64(rec.Body.Len()) != artifact.Size || !bytes.HasPrefix(rec.Body.Bytes(), cut.Body.Bytes()) {
+		t.Fatalf("retry = %d, %d of %d bytes", rec.Code, rec.Body.Len(), artifact.Size)
+	}
+	var built []string
+	for _, f := range tempArtifacts(t) {
+		if filepath.Dir(f) == chunkTempDir() {
+			built = append(built, f)
+		}
+	}
+	if len(built) != 1 || built[0] != artifact.Path {
+		t.Errorf("artifacts after the retry = %v, want the one built first", built)
+	}
+	chunkStoreMu.Lock()
+	downloaded, downloads := session.Downloaded, session.Downloads
+	chunkStoreMu.Unlock()
+	if !downloaded || downloads != 1 {
+		t.Errorf("after the retry downloaded = %v, downloads = %d", downloaded, downloads)
+	}
+
+	// completed: a repeat within CHUNK_CLEANUP_DELAY is still served, then both go
+	if rec := request(e, http.MethodGet, url, ""); rec.Code != http.StatusOK || int64(rec.Body.Len()) != artifact.Size {
+		t.Errorf("repeat = %d, %d bytes", rec.Code, rec.Body.Len())
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		chunkStoreMu.Lock()
+		_, alive := chunkStore[id]
+		chunkStoreMu.Unlock()
+		_, err := os.Stat(artifact.Path)
+		if !alive && os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("CHUNK_CLEANUP_DELAY after the download the session is alive = %v, artifact %v", alive, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// and a download after that builds the chunk again
+	rec = request(e, http.MethodGet, url, "")
+	if rec.Code != http.StatusOK || int64(rec.Body.Len()) != artifact.Size {
+		t.Errorf("download after the cleanup = %d, %d bytes", rec.Code, rec.Body.Len())
+	}
+}
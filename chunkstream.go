@@ -0,0 +1,236 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// streamChunk writes the chunk's archive straight into the response, used with CHUNK_STREAM_DIRECT.
+// Nothing touches the temp dir, the price is that there's no verification before the first byte
+// and a build slot held for as long as the client takes. Files are checked up front so a chunk
+// that can't be complete still gets its 409, or with best effort the X-Chunk-Omitted header.
+// The content lock isn't held either, a slow client would stall updates: files changed by an
+// update mid-stream go in with their new content, X-Content-Commit names the commit the stream
+// started at. The sha256 follows the body as the
+// X-Chunk-SHA256 trailer, unless a build of the same ETag was seen before: then the sha256 and
+// the Content-Length go out up front. The last byte is held back until the stream has been found
+// to match them, one that came out different loses the connection short of its Content-Length
+// rather than deliver what the headers don't describe.
+func streamChunk(c echo.Context, chunkID string, session *chunkSession, etag string) error {
+	var missing []archiveOmission
+	for _, f := range session.Files {
+		if _, full, err := resolveContentFile(session.Content.Dir, f); err != nil {
+			missing = append(missing, archiveOmission{Name: f, Reason: "no longer exists"})
+		} else if info, err := os.Stat(full); err != nil || info.IsDir() {
+			missing = append(missing, archiveOmission{Name: f, Reason: "no longer exists"})
+		}
+	}
+	if len(missing) > 0 && !session.BestEffort {
+		recordChunkBuild(session.Format, "incomplete", 0)
+		return echo.NewHTTPError(http.StatusConflict, echo.Map{
+			"message": fmt.Sprintf("%d files of the chunk are no longer available, call /zip-chunks/init again", len(missing)),
+			"omitted": missing,
+		})
+	}
+
+	chunkStoreMu.Lock()
+	session.streaming++
+	chunkStoreMu.Unlock()
+	defer func() {
+		chunkStoreMu.Lock()
+		session.streaming--
+		chunkStoreMu.Unlock()
+	}()
+
+	commit, _ := headCommit(session.Content.Dir)
+	res := c.Response()
+	setChunkHeaders(c, chunkID, session)
+	res.Header().Set(contentCommitHeader, commit)
+	if len(missing) > 0 {
+		// what's missing by now, the zip comment has the final list
+		omitted, _ := json.Marshal(missing)
+		res.Header().Set(chunkOmittedHeader, string(omitted))
+	}
+	known, size := knownChunkChecksum(etag), knownChunkSize(etag)
+	announced := known != "" && size > 0
+	if announced {
+		res.Header().Set(chunkSHA256Header, known)
+		res.Header().Set(echo.HeaderContentLength, strconv.FormatInt(size, 10))
+	} else {
+		res.Header().Set("Trailer", chunkSHA256Header)
+	}
+	res.WriteHeader(http.StatusOK)
+	chunkEvents.record(c, chunkID, chunkDownloadStarted, map[string]any{"streamed": true, "commit": commit})
+
+	start := time.Now()
+	sum := sha256.New()
+	body := &heldWriter{w: res, hold: announced}
+	counter := &countingWriter{w: io.MultiWriter(body, sum)}
+	var entries []archiveEntry
+	var omitted []archiveOmission
+	var err error
+	if isTarFormat(session.Format) {
+		entries, omitted, err = writeTarEntries(c.Request().Context(), counter, session, !session.BestEffort, res.Flush)
+	} else {
+		entries, omitted, err = streamZip(c.Request().Context(), counter, session, res.Flush)
+	}
+	if err != nil {
+		slog.Warn("Chunk stream failed", "chunk_id", chunkID, "ip", c.RealIP(), "bytes", counter.n, "duration", time.Since(start), "err", err)
+		chunkEvents.record(c, chunkID, chunkDownloadAborted, map[string]any{"bytes_sent": counter.n, "error": err.Error()})
+		metricChunkBytesServed.WithLabelValues("aborted").Add(float64(counter.n))
+		recordChunkBuild(session.Format, "aborted", time.Since(start))
+		return err
+	}
+	checksum := hex.EncodeToString(sum.Sum(nil))
+	if announced && (checksum != known || counter.n != size) {
+		// the files changed since the build the headers describe, the client must not take this
+		slog.Warn("Chunk stream differs from the build it was announced as, cutting it short", "chunk_id", chunkID, "sha256", checksum, "announced", known, "bytes", counter.n, "content_length", size)
+		chunkEvents.record(c, chunkID, chunkDownloadAborted, map[string]any{"bytes_sent": counter.n - 1, "error": "archive differs from its announced checksum"})
+		metricChunkBytesServed.WithLabelValues("aborted").Add(float64(counter.n - 1))
+		recordChunkBuild(session.Format, "aborted", time.Since(start))
+		panic(http.ErrAbortHandler)
+	}
+	if err := body.release(); err != nil {
+		return err
+	}
+	if !announced {
+		res.Header().Set(chunkSHA256Header, checksum)
+	}
+	res.Flush()
+	rememberChunkChecksum(etag, checksum, counter.n)
+
+	var sourceBytes int64
+	for _, e := range entries {
+		sourceBytes += int64(e.UncompressedSize)
+	}
+	recordArchiveCompression(session, entries, sourceBytes, counter.n)
+	recordChunkBuild(session.Format, "ok", time.Since(start))
+	metricChunkBytesServed.WithLabelValues("completed").Add(float64(counter.n))
+	stats.recordChunk(chunkID, session, counter.n)
+
+	chunkStoreMu.Lock()
+	session.Entries = entries
+	session.Omitted = omitted
+	session.Downloaded = true
+	session.Downloads++
+	chunkStoreMu.Unlock()
+	chunkEvents.record(c, chunkID, chunkDownloadCompleted, map[string]any{
+		"bytes_sent":   counter.n,
+		"source_bytes": sourceBytes,
+		"duration_ms":  time.Since(start).Milliseconds(),
+	})
+	return nil
+}
+
+// heldWriter passes writes on but the last byte, with hold, until release
+type heldWriter struct {
+	w      io.Writer
+	hold   bool
+	held   [1]byte
+	isHeld bool
+}
+
+func (h *heldWriter) Write(p []byte) (int, error) {
+	if !h.hold || len(p) == 0 {
+		return h.w.Write(p)
+	}
+	if h.isHeld {
+		if _, err := h.w.Write(h.held[:]); err != nil {
+			return 0, err
+		}
+		h.isHeld = false
+	}
+	if _, err := h.w.Write(p[:len(p)-1]); err != nil {
+		return 0, err
+	}
+	h.held[0], h.isHeld = p[len(p)-1], true
+	return len(p), nil
+}
+
+// release writes the byte held back
+func (h *heldWriter) release() error {
+	if !h.isHeld {
+		return nil
+	}
+	h.isHeld = false
+	_, err := h.w.Write(h.held[:])
+	return err
+}
+
+// streamZip streams the zip and turns its headers into entries, with the per-extension tallies
+func streamZip(ctx context.Context, w *countingWriter, session *chunkSession, flush func()) ([]archiveEntry, []archiveOmission, error) {
+	headers, elapsed, omitted, err := streamEntries(ctx, w, session, flush)
+	if err != nil {
+		return nil, nil, err
+	}
+	entries := make([]archiveEntry, 0, len(headers))
+	tallies := make(map[string]*compressionTally)
+	for i, h := range headers {
+		tallyEntry(tallies, h, elapsed[i])
+		entries = append(entries, archiveEntry{
+			Name:             h.Name,
+			CompressedSize:   h.CompressedSize64,
+			UncompressedSize: h.UncompressedSize64,
+			CRC32:            fmt.Sprintf("%08x", h.CRC32),
+		})
+	}
+	stats.recordCompression(tallies)
+	return entries, omitted, nil
+}
+
+// streamEntries writes the zip to w, stopping as soon as the client goes away
+func streamEntries(ctx context.Context, w *countingWriter, session *chunkSession, flush func()) ([]*zip.FileHeader, []time.Duration, []archiveOmission, error) {
+	zipWriter := zip.NewWriter(w)
+	session.Compression.register(zipWriter)
+	var headers []*zip.FileHeader
+	var elapsed []time.Duration
+	var omitted []archiveOmission
+
+	for _, f := range session.Files {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, nil, err
+		}
+		start := time.Now()
+		header, err := writeArchiveEntry(zipWriter, session, f)
+		var omission *omissionError
+		if errors.As(err, &omission) {
+			if !session.BestEffort {
+				// the client was promised every file, a truncated zip fails its extraction
+				return nil, nil, nil, fmt.Errorf("%s: %s", f, omission.reason)
+			}
+			omitted = append(omitted, archiveOmission{Name: f, Reason: omission.reason})
+			continue
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		headers = append(headers, header)
+		elapsed = append(elapsed, time.Since(start))
+		// push what the zip writer buffered to the client instead of letting it pile up
+		if err := zipWriter.Flush(); err != nil {
+			return nil, nil, nil, err
+		}
+		flush()
+	}
+	if len(omitted) > 0 {
+		if comment, err := json.Marshal(echo.Map{"omitted": omitted}); err == nil && len(comment) <= 0xffff {
+			_ = zipWriter.SetComment(string(comment))
+		}
+	}
+	if err := zipWriter.Close(); err != nil {
+		return nil, nil, nil, err
+	}
+	return headers, elapsed, omitted, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// chunkFixture is content that compresses some but not to nothing
+func chunkFixture(seed string) map[string]string {
+	var spells strings.Builder
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&spells, "%s^%d^Spell %d^%d\n", seed, i, i*7919%10007, i*31)
+	}
+	return map[string]string{"spells_us.txt": spells.String(), "readme.txt": "readme " + seed}
+}
+
+// tempArtifacts lists what chunk builds left in the temp dir
+func tempArtifacts(t *testing.T) []string {
+	t.Helper()
+	var files []string
+	_ = filepath.Walk(chunkTempDir(), func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, p)
+		}
+		return nil
+	})
+	return files
+}
+
+func TestChunkDownloadContentLength(t *testing.T) {
+	for _, direct := range []bool{false, true} {
+		t.Run("direct="+strconv.FormatBool(direct), func(t *testing.T) {
+			useConfig(t, "TMPDIR", t.TempDir(), "CHUNK_STREAM_DIRECT", strconv.FormatBool(direct))
+			useContent(t, chunkFixture(t.Name()))
+			e := chunkServer(t)
+			init := `{"files":["spells_us.txt","readme.txt"]}`
+			url := initChunks(t, e, init)[0]
+
+			// nothing has been built, a HEAD has the estimate and builds nothing
+			rec := request(e, http.MethodHead, url, "")
+			if rec.Code != http.StatusOK || rec.Header().Get(echo.HeaderContentLength) != "" || rec.Header().Get(chunkEstimatedSizeHeader) == "" {
+				t.Fatalf("HEAD before a build = %d %v", rec.Code, rec.Header())
+			}
+			if files := tempArtifacts(t); len(files) > 0 {
+				t.Fatalf("HEAD built %v", files)
+			}
+
+			rec = request(e, http.MethodGet, url, "")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("GET = %d %s", rec.Code, rec.Body.String())
+			}
+			body := rec.Body.Bytes()
+			sum := sha256.Sum256(body)
+			checksum := hex.EncodeToString(sum[:])
+			if _, err := zip.NewReader(bytes.NewReader(body), int64(len(body))); err != nil {
+				t.Fatalf("GET isn't a zip: %v", err)
+			}
+			if direct {
+				// the first stream can't know its size, the checksum follows as a trailer
+				if cl := rec.Header().Get(echo.HeaderContentLength); cl != "" {
+					t.Errorf("first stream has Content-Length %s", cl)
+				}
+				if got := rec.Result().Trailer.Get(chunkSHA256Header); got != checksum {
+					t.Errorf("trailer sha256 = %q, want %q", got, checksum)
+				}
+			} else {
+				if cl := rec.Header().Get(echo.HeaderContentLength); cl != strconv.Itoa(len(body)) {
+					t.Errorf("Content-Length = %q, body is %d bytes", cl, len(body))
+				}
+				if got := rec.Header().Get(chunkSHA256Header); got != checksum {
+					t.Errorf("sha256 = %q, want %q", got, checksum)
+				}
+			}
+
+			// now every response of the same archive has its size up front
+			url = initChunks(t, e, init)[0]
+			rec = request(e, http.MethodHead, url, "")
+			if cl := rec.Header().Get(echo.HeaderContentLength); cl != strconv.Itoa(len(body)) || rec.Header().Get(chunkSHA256Header) != checksum {
+				t.Errorf("HEAD after a build = Content-Length %q sha256 %q, want %d %s", cl, rec.Header().Get(chunkSHA256Header), len(body), checksum)
+			}
+			rec = request(e, http.MethodGet, url, "")
+			if cl := rec.Header().Get(echo.HeaderContentLength); cl != strconv.Itoa(rec.Body.Len()) || !bytes.Equal(rec.Body.Bytes(), body) {
+				t.Errorf("second GET = Content-Length %q for %d bytes", cl, rec.Body.Len())
+			}
+			if got := rec.Header().Get(chunkSHA256Header); got != checksum {
+				t.Errorf("second GET sha256 = %q, want %q", got, checksum)
+			}
+		})
+	}
+}
+
+func TestChunkStreamCutShortWhenItDiffers(t *testing.T) {
+	useConfig(t, "TMPDIR", t.TempDir(), "CHUNK_STREAM_DIRECT", "true")
+	useContent(t, chunkFixture(t.Name()))
+	e := chunkServer(t)
+	init := `{"files":["spells_us.txt","readme.txt"]}`
+	rec := request(e, http.MethodGet, initChunks(t, e, init)[0], "")
+	size := rec.Body.Len()
+	// as if the files had changed since the build that was remembered
+	rememberChunkChecksum(rec.Header().Get("ETag"), strings.Repeat("0", 64), int64(size))
+
+	url := initChunks(t, e, init)[0]
+	rec = httptest.NewRecorder()
+	func() {
+		defer func() {
+			if r := recover(); r != http.ErrAbortHandler {
+				t.Errorf("stream that differs ended with %v, want http.ErrAbortHandler", r)
+			}
+		}()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	}()
+	if cl := rec.Header().Get(echo.HeaderContentLength); cl != strconv.Itoa(size) {
+		t.Errorf("Content-Length = %q, want %d", cl, size)
+	}
+	if rec.Body.Len() >= size {
+		t.Errorf("%d of %d bytes went out, the last must be held back", rec.Body.Len(), size)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errChunkTokenInvalid = errors.New("invalid chunk token")
+	errChunkTokenExpired = errors.New("chunk token expired")
+)
+
+// chunkTokenKey signs chunk URLs, from CHUNK_TOKEN_SECRET or generated and kept in
+// CHUNK_TOKEN_KEY_PATH
+var chunkTokenKey []byte
+
+// chunkTokenMaxLen bounds what's decompressed from a token, far above any real chunk's file list
+const chunkTokenMaxLen = 4 << 20
+
+// maxChunkTokenLen is the longest token a chunk URL carries, so URLs stay inside the 8KB request
+// line nginx and most CDNs accept. Chunks whose file list would sign to more are split.
+const maxChunkTokenLen = 6 << 10
+
+// chunkClaims is everything a download needs to know about a chunk, carried in its URL so any
+// instance can serve it, before or after a restart
+type chunkClaims struct {
+	ID          string              `json:"id"` // [<repo>-]<init nanos>-<index>, names the chunk in logs and events
+	Ref         string              `json:"r,omitempty"`
+	Repo        string              `json:"repo,omitempty"`
+	Files       []string            `json:"f"`
+	Size        int64               `json:"s"`
+	Compression compressionSettings `json:"c"`
+	Format      string              `json:"fmt"`
+	BestEffort  bool                `json:"be,omitempty"`
+	Owner       string              `json:"o,omitempty"`
+	TokenHash   string              `json:"t,omitempty"` // sha256 of the download token
+	APIKey      string              `json:"k,omitempty"` // ID of the API key init ran under
+	Expires     int64               `json:"exp"`         // unix seconds
+}
+
+// configureChunkTokens sets the signing key. Without a secret the one generated by an earlier run
+// is loaded from keyPath, so the URLs it handed out keep working across a deploy or crash. A key
+// that can't be kept only holds until the next restart.
+func configureChunkTokens(secret, keyPath string) {
+	if secret != "" {
+		chunkTokenKey = []byte(secret)
+		return
+	}
+	if keyPath != "" {
+		if data, err := os.ReadFile(keyPath); err == nil {
+			if key, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil && len(key) >= 32 {
+				chunkTokenKey = key
+				slog.Info("Loaded the chunk URL signing key", "path", keyPath)
+				return
+			}
+			slog.Warn("Chunk URL signing key is invalid, generating a new one", "path", keyPath)
+		}
+	}
+
+	chunkTokenKey = make([]byte, 32)
+	_, _ = rand.Read(chunkTokenKey)
+	if keyPath != "" {
+		// through a rename, a crash mid-write can't leave a truncated key behind
+		tmp := keyPath + ".tmp"
+		err := os.WriteFile(tmp, []byte(hex.EncodeToString(chunkTokenKey)+"\n"), 0o600)
+		if err == nil {
+			err = os.Rename(tmp, keyPath)
+		}
+		if err == nil {
+			slog.Info("Generated a chunk URL signing key", "path", keyPath)
+			return
+		}
+		slog.Error("Error saving the chunk URL signing key", "path", keyPath, "err", err)
+	}
+	slog.Warn("CHUNK_TOKEN_SECRET is not set, chunk URLs stop working on restart and can't be shared between instances")
+}
+
+// signChunkToken encodes the claims as deflated JSON, base64url, a dot and the base64url HMAC
+func signChunkToken(claims *chunkClaims) (string, error) {
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestCompression)
+	fw.Write(data)
+	if err := fw.Close(); err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(buf.Bytes())
+	return payload + "." + base64.RawURLEncoding.EncodeToString(chunkTokenMAC(payload)), nil
+}
+
+// fitChunkTokens splits chunks, in halves and in place of the original, until each one's token
+// signs to at most maxChunkTokenLen with the claims of template. A single file always gets a chunk
+// of its own, however long its name.
+func fitChunkTokens(chunks []plannedChunk, template chunkClaims) ([]plannedChunk, error) {
+	// the longest ID an index can give, the real ones are no longer
+	template.ID += "-" + strconv.Itoa(math.MaxInt32)
+	var fitted []plannedChunk
+	for len(chunks) > 0 {
+		chunk := chunks[0]
+		chunks = chunks[1:]
+		claims := template
+		claims.Files, claims.Size = nil, chunk.Size
+		for _, f := range chunk.Files {
+			claims.Files = append(claims.Files, f.Path)
+		}
+		signed, err := signChunkToken(&claims)
+		if err != nil {
+			return nil, err
+		}
+		if len(signed) <= maxChunkTokenLen || len(chunk.Files) == 1 {
+			fitted = append(fitted, chunk)
+			continue
+		}
+		half := len(chunk.Files) / 2
+		first := plannedChunk{Files: chunk.Files[:half], Critical: chunk.Critical}
+		second := plannedChunk{Files: chunk.Files[half:], Critical: chunk.Critical}
+		for _, f := range first.Files {
+			first.Size += f.Size
+		}
+		second.Size = chunk.Size - first.Size
+		chunks = append([]plannedChunk{first, second}, chunks...)
+	}
+	return fitted, nil
+}
+
+func chunkTokenMAC(payload string) []byte {
+	mac := hmac.New(sha256.New, chunkTokenKey)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// parseChunkToken checks the signature before anything in the token is looked at
+func parseChunkToken(token string, now time.Time) (*chunkClaims, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errChunkTokenInvalid
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, chunkTokenMAC(payload)) {
+		return nil, errChunkTokenInvalid
+	}
+	compressed, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errChunkTokenInvalid
+	}
+	data, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(compressed)), chunkTokenMaxLen))
+	if err != nil {
+		return nil, errChunkTokenInvalid
+	}
+	var claims chunkClaims
+	if err := json.Unmarshal(data, &claims); err != nil || claims.ID == "" {
+		return nil, errChunkTokenInvalid
+	}
+	if now.Unix() >= claims.Expires {
+		// the claims still name the chunk, its init may have been kept alive
+		return &claims, errChunkTokenExpired
+	}
+	return &claims, nil
+}
+
+// initDeadlines extend the chunk URLs of an init past their signed expiry while the client keeps
+// downloading: every download of one of them moves the deadline of all of them to CHUNK_TTL from
+// then. By init ID, guarded by chunkStoreMu, and like sessions lost on restart.
+var initDeadlines = make(map[string]time.Time)
+
+// chunkInitID is the init a chunk came from, its ID without the index
+func chunkInitID(chunkID string) string {
+	if i := strings.LastIndexByte(chunkID, '-'); i > 0 {
+		return chunkID[:i]
+	}
+	return chunkID
+}
+
+// chunkCreatedAt is when the chunk's init ran, from the nanoseconds in its ID, or the session's
+// creation here for an ID that doesn't have them
+func chunkCreatedAt(chunkID string, fallback time.Time) time.Time {
+	id := chunkInitID(chunkID)
+	if i := strings.LastIndexByte(id, '-'); i >= 0 {
+		id = id[i+1:]
+	}
+	if nanos, err := strconv.ParseInt(id, 10, 64); err == nil {
+		return time.Unix(0, nanos)
+	}
+	return fallback
+}
+
+// touchChunkInit refreshes the deadline of the chunk's init
+func touchChunkInit(chunkID string) {
+	chunkStoreMu.Lock()
+	defer chunkStoreMu.Unlock()
+	initDeadlines[chunkInitID(chunkID)] = time.Now().Add(cfg.ChunkTTL)
+}
+
+// chunkDeadlineLocked is when the chunk expires, its URL's expiry or its init's later deadline
+func chunkDeadlineLocked(chunkID string, expires time.Time) time.Time {
+	if d, ok := initDeadlines[chunkInitID(chunkID)]; ok && d.After(expires) {
+		return d
+	}
+	return expires
+}
+
+// hashDownloadToken is what a chunk token keeps of the download token, the URL alone mustn't be
+// enough to pass CHUNK_BINDING=token
+func hashDownloadToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// lookupChunk validates the token in the URL and the client's binding to it, then returns the
+// chunk's session. Sessions only cache what this instance did with a chunk, one is created from
+// the claims the first time a client it's bound to asks for it.
+func lookupChunk(c echo.Context) (string, *chunkSession, error) {
+	now := time.Now()
+	claims, err := parseChunkToken(c.Param("chunkID"), now)
+	if errors.Is(err, errChunkTokenExpired) {
+		chunkStoreMu.Lock()
+		deadline := chunkDeadlineLocked(claims.ID, time.Unix(claims.Expires, 0))
+		chunkStoreMu.Unlock()
+		if !now.Before(deadline) {
+			return "", nil, echo.NewHTTPError(http.StatusGone, "Chunk URL has expired, call /zip-chunks/init again")
+		}
+		err = nil
+	}
+	if err != nil {
+		return "", nil, echo.NewHTTPError(http.StatusUnauthorized, "Invalid chunk URL")
+	}
+
+	// a chunk is only served under the prefix of the repo it was created for
+	content := defaultContent
+	if t := repoFor(c); t != nil || claims.Repo != "" {
+		if t == nil || t.Repo != claims.Repo {
+			return "", nil, echo.NewHTTPError(http.StatusNotFound, "Chunk belongs to a different repo")
+		}
+		content = t
+	} else if claims.Ref != "" {
+		t, ok := branchContent[claims.Ref]
+		if !ok {
+			return "", nil, echo.NewHTTPError(http.StatusGone, "The chunk's ref is no longer served")
+		}
+		content = t
+	}
+
+	chunkStoreMu.Lock()
+	s, ok := chunkStore[claims.ID]
+	chunkStoreMu.Unlock()
+	if ok {
+		if err := checkChunkBinding(c, s); err != nil {
+			return "", nil, err
+		}
+		return claims.ID, s, nil
+	}
+	s = &chunkSession{
+		Content:     content,
+		Created:     time.Now(),
+		Expires:     time.Unix(claims.Expires, 0),
+		Files:       claims.Files,
+		Size:        claims.Size,
+		Compression: claims.Compression,
+		Format:      claims.Format,
+		Owner:       claims.Owner,
+		Token:       claims.TokenHash,
+		APIKey:      claims.APIKey,
+		BestEffort:  claims.BestEffort,
+	}
+	// nothing is kept for a client the chunk isn't bound to
+	if err := checkChunkBinding(c, s); err != nil {
+		return "", nil, err
+	}
+	chunkStoreMu.Lock()
+	defer chunkStoreMu.Unlock()
+	if existing, ok := chunkStore[claims.ID]; ok {
+		return claims.ID, existing, nil
+	}
+	chunkStore[claims.ID] = s
+	return claims.ID, s, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"github.com/labstack/echo/v4"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	chunkArtifactMaxAge = 10 * time.Minute // leftover artifacts nothing is streaming are removed after this
+	chunkCleanupEvery   = 1 * time.Minute
+)
+
+// artifactRef counts the streams reading an artifact, removal waits until the last one ends
+type artifactRef struct {
+	refs   int
+	remove bool // a removal was requested while streams were running
+}
+
+// artifacts in use, by path, guarded by chunkStoreMu
+var artifactRefs = make(map[string]*artifactRef)
+
+// markStreaming flags a session and its artifact as in use until the returned func is called
+func markStreaming(session *chunkSession, path string) func() {
+	chunkStoreMu.Lock()
+	defer chunkStoreMu.Unlock()
+	return markStreamingLocked(session, path)
+}
+
+// markStreamingLocked is markStreaming with chunkStoreMu already held
+func markStreamingLocked(session *chunkSession, path string) func() {
+	session.streaming++
+	ref, ok := artifactRefs[path]
+	if !ok {
+		ref = &artifactRef{}
+		artifactRefs[path] = ref
+	}
+	ref.refs++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			chunkStoreMu.Lock()
+			defer chunkStoreMu.Unlock()
+			session.streaming--
+			ref.refs--
+			if ref.refs > 0 {
+				return
+			}
+			delete(artifactRefs, path)
+			if ref.remove {
+				_ = os.Remove(path)
+			}
+		})
+	}
+}
+
+// removeArtifact deletes an artifact now, or once the last stream reading it ends, reporting
+// whether it's gone now. Every path that deletes artifacts goes through here or removeCounted. The
+// file is removed under chunkStoreMu, a stream can't start on it between the check and the removal.
+func removeArtifact(path string) bool {
+	chunkStoreMu.Lock()
+	defer chunkStoreMu.Unlock()
+	if ref, ok := artifactRefs[path]; ok {
+		ref.remove = true
+		return false
+	}
+	return os.Remove(path) == nil
+}
+
+// chunks with a build writing into the temp dir, by ID, guarded by chunkStoreMu. Their files
+// aren't artifacts yet, only a purge has to know about them.
+var chunksBuilding = make(map[string]int)
+
+// markBuilding keeps a purge away from the chunk's files until the returned func is called
+func markBuilding(chunkID string) func() {
+	chunkStoreMu.Lock()
+	chunksBuilding[chunkID]++
+	chunkStoreMu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			chunkStoreMu.Lock()
+			if chunksBuilding[chunkID]--; chunksBuilding[chunkID] <= 0 {
+				delete(chunksBuilding, chunkID)
+			}
+			chunkStoreMu.Unlock()
+		})
+	}
+}
+
+// cleanupSummary is what a sweep reclaimed
+type cleanupSummary struct {
+	Sessions     int   `json:"sessions_expired"`
+	Files        int   `json:"files_removed"`
+	Bytes        int64 `json:"bytes_reclaimed"`
+	InUse        int   `json:"files_in_use"` // being streamed or built, left alone
+	CacheEntries int   `json:"cache_entries_removed"`
+	CacheBytes   int64 `json:"cache_bytes_removed"`
+}
+
+// removeCounted removes an artifact and adds it to the summary. One being streamed is left
+// alone rather than marked for removal, its session may still resume from it, and so is one of a
+// chunk being built: a cached archive is linked in with the cache entry's old mtime before its
+// stream starts. Both are checked and the file removed under chunkStoreMu.
+func (s *cleanupSummary) removeCounted(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	chunkStoreMu.Lock()
+	defer chunkStoreMu.Unlock()
+	if _, streamed := artifactRefs[path]; streamed || chunksBuilding[artifactChunkID(filepath.Base(path))] > 0 {
+		s.InUse++
+		return
+	}
+	if os.Remove(path) != nil {
+		return
+	}
+	s.Files++
+	s.Bytes += info.Size()
+}
+
+func runChunkCleanup(ctx context.Context) {
+	ticker := time.NewTicker(chunkCleanupEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			sweepChunks(now, false)
+			sweepArchiveCache(now)
+			sweepDeltas(now)
+		}
+	}
+}
+
+// sweepChunks expires sessions with their URL, or with their init's deadline when a download of the
+// init extended it, and removes artifacts that outlived them.
+// Sessions with an interrupted download stay until its resume window closes, the artifacts they
+// keep aren't touched. A temp dir that doesn't exist yet just means nothing has been built.
+// With all every session and file goes whatever its age, except what's being streamed or built.
+func sweepChunks(now time.Time, all bool) cleanupSummary {
+	var summary cleanupSummary
+	var expired, orphaned []string
+	kept := make(map[string]bool)
+	chunkStoreMu.Lock()
+	for id, s := range chunkStore {
+		due := now.After(chunkDeadlineLocked(id, s.Expires)) && now.After(s.resumeUntil)
+		if s.streaming == 0 && chunksBuilding[id] == 0 && (due || all) {
+			slog.Debug("Expired chunk session", "chunk_id", id)
+			delete(chunkStore, id)
+			expired = append(expired, id)
+			if s.artifact != nil {
+				orphaned = append(orphaned, s.artifact.Path)
+			}
+			continue
+		}
+		if s.artifact != nil {
+			kept[s.artifact.Path] = true
+		}
+	}
+	for id, deadline := range initDeadlines {
+		if now.After(deadline) {
+			delete(initDeadlines, id)
+		}
+	}
+	chunkStoreMu.Unlock()
+
+	summary.Sessions = len(expired)
+	for _, id := range expired {
+		chunkEvents.record(nil, id, chunkExpired, nil)
+	}
+	for _, path := range orphaned {
+		summary.removeCounted(path)
+	}
+
+	dir := chunkTempDir()
+	for _, d := range []string{dir, filepath.Join(dir, "quarantine")} {
+		entries, err := os.ReadDir(d)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				slog.Error("Error during temp file cleanup", "dir", d, "err", err)
+			}
+			continue
+		}
+		for _, e := range entries {
+			path := filepath.Join(d, e.Name())
+			if e.IsDir() || !isArtifactName(e.Name()) || kept[path] && !all {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil || !all && now.Sub(info.ModTime()) <= chunkArtifactMaxAge {
+				continue
+			}
+			slog.Debug("Removing old temp file", "path", path)
+			summary.removeCounted(path)
+		}
+	}
+	return summary
+}
+
+// POST /admin/cleanup?all=true runs the chunk sweep now. With all it expires every session and
+// removes every temp archive and cached build whatever their age, except those being streamed.
+func handleAdminCleanup(c echo.Context) error {
+	all := c.QueryParam("all") == "true" || c.FormValue("all") == "true"
+	now := time.Now()
+	summary := sweepChunks(now, all)
+	if all {
+		summary.CacheEntries, summary.CacheBytes = clearArchiveCache()
+	} else {
+		sweepArchiveCache(now)
+	}
+	sweepDeltas(now)
+	slog.Info("Cleanup run from admin", "all", all, "sessions", summary.Sessions, "files", summary.Files, "bytes", summary.Bytes, "in_use", summary.InUse)
+	return c.JSON(http.StatusOK, echo.Map{"all": all, "summary": summary, "temp_bytes": dirSize(chunkTempDir())})
+}
+
+// artifactChunkID is the chunk an artifact was built for, from <chunk ID>-<compression>-<random><ext>
+func artifactChunkID(name string) string {
+	for range 2 {
+		if i := strings.LastIndexByte(name, '-'); i > 0 {
+			name = name[:i]
+		}
+	}
+	return name
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useChunkStore gives the test empty sessions and init deadlines and puts the previous ones back
+func useChunkStore(t *testing.T) {
+	t.Helper()
+	chunkStoreMu.Lock()
+	store, deadlines := chunkStore, initDeadlines
+	chunkStore, initDeadlines = make(map[string]*chunkSession), make(map[string]time.Time)
+	chunkStoreMu.Unlock()
+	t.Cleanup(func() {
+		chunkStoreMu.Lock()
+		chunkStore, initDeadlines = store, deadlines
+		chunkStoreMu.Unlock()
+	})
+}
+
+// tempFile creates a file in dir with its mtime age ago
+func tempFile(t *testing.T, dir, name string, age time.Duration) string {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, []byte(name), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-age)
+	if err := os.Chtimes(p, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestSweepChunks(t *testing.T) {
+	useConfig(t, "TMPDIR", t.TempDir())
+	useChunkStore(t)
+	dir := chunkTempDir()
+	now := time.Now()
+	old := 20 * time.Minute
+	session := func(id string, expires time.Time) *chunkSession {
+		s := &chunkSession{Expires: expires}
+		s.artifact = &builtArchive{Path: tempFile(t, dir, id+"-deflate6-1.zip", old)}
+		chunkStore[id] = s
+		return s
+	}
+	expired := session("901-0", now.Add(-time.Minute))
+	live := session("902-0", now.Add(time.Minute))
+	streamed := session("903-0", now.Add(-time.Minute))
+	done := markStreaming(streamed, streamed.artifact.Path)
+	defer done()
+	interrupted := session("904-0", now.Add(-time.Minute))
+	interrupted.resumeUntil = now.Add(time.Minute)
+	extended := session("905-0", now.Add(-time.Minute))
+	initDeadlines["905"] = now.Add(time.Minute)
+	initDeadlines["906"] = now.Add(-time.Minute)
+
+	oldOrphan := tempFile(t, dir, "906-0-zstd3-2.tar.zst", old)
+	freshOrphan := tempFile(t, dir, "907-0-deflate6-3.zip", time.Minute)
+	notOurs := tempFile(t, dir, "notes.txt", old)
+	quarantined := tempFile(t, filepath.Join(dir, "quarantine"), "908-0-deflate6-4.zip", old)
+
+	summary := sweepChunks(now, false)
+	if summary.Sessions != 1 || summary.Files != 3 || summary.InUse != 0 {
+		t.Errorf("summary = %+v, want 1 session and 3 files", summary)
+	}
+	for id, want := range map[string]bool{"901-0": false, "902-0": true, "903-0": true, "904-0": true, "905-0": true} {
+		if _, ok := chunkStore[id]; ok != want {
+			t.Errorf("session %s kept = %v, want %v", id, ok, want)
+		}
+	}
+	if _, ok := initDeadlines["906"]; ok {
+		t.Error("a passed init deadline is kept")
+	}
+	for path, want := range map[string]bool{
+		expired.artifact.Path:     false,
+		live.artifact.Path:        true,
+		streamed.artifact.Path:    true,
+		interrupted.artifact.Path: true,
+		extended.artifact.Path:    true,
+		oldOrphan:                 false,
+		freshOrphan:               true,
+		notOurs:                   true,
+		quarantined:               false,
+	} {
+		if _, err := os.Stat(path); (err == nil) != want {
+			t.Errorf("%s kept = %v, want %v", filepath.Base(path), err == nil, want)
+		}
+	}
+
+	// all takes everything but what's being streamed
+	summary = sweepChunks(now, true)
+	if len(chunkStore) != 1 || chunkStore["903-0"] != streamed || summary.InUse != 1 {
+		t.Errorf("after a sweep of all %d sessions are left, summary %+v, want the streamed one", len(chunkStore), summary)
+	}
+	for _, path := range []string{live.artifact.Path, freshOrphan} {
+		if _, err := os.Stat(path); err == nil {
+			t.Errorf("%s survived a sweep of all", filepath.Base(path))
+		}
+	}
+	if _, err := os.Stat(streamed.artifact.Path); err != nil {
+		t.Errorf("artifact being streamed was removed: %v", err)
+	}
+}
+
+func TestSweepChunksWithoutTempDir(t *testing.T) {
+	useConfig(t, "TMPDIR", filepath.Join(t.TempDir(), "missing"))
+	useChunkStore(t)
+	if summary := sweepChunks(time.Now(), true); summary != (cleanupSummary{}) {
+		t.Errorf("sweep of a temp dir that doesn't exist = %+v", summary)
+	}
+}
+
+func TestArtifactChunkID(t *testing.T) {
+	for name, want := range map[string]string{
+		"1791961608427412169-0-deflate6-417046810.zip": "1791961608427412169-0",
+		"1791961608427412169-12-zstd3-1.tar.zst":       "1791961608427412169-12",
+		"assets-1791961608427412169-3-store0-9.tar.gz": "assets-1791961608427412169-3",
+	} {
+		if got := artifactChunkID(name); got != want {
+			t.Errorf("artifactChunkID(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestArtifactsOutliveTheirStreams(t *testing.T) {
+	useConfig(t, "TMPDIR", t.TempDir(), "CHUNK_CLEANUP_DELAY", "0s")
+	useChunkStore(t)
+	useContent(t, chunkFixture(t.Name()))
+	e := chunkServer(t)
+	init := `{"files":["spells_us.txt","readme.txt"]}`
+	urls := initChunks(t, e, init)
+	urls = append(urls, initChunks(t, e, init)...)
+
+	stop := make(chan struct{})
+	var background sync.WaitGroup
+	var removedWhileStreamed atomic.Value
+	background.Add(2)
+	go func() {
+		// the sweeps as aggressive as they get, as if everything had long expired
+		defer background.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			sweepChunks(time.Now().Add(time.Hour), i%2 == 0)
+			sweepArchiveCache(time.Now().Add(time.Hour))
+		}
+	}()
+	go func() {
+		// a file a stream holds a reference to is never gone
+		defer background.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			chunkStoreMu.Lock()
+			for path := range artifactRefs {
+				if _, err := os.Stat(path); err != nil {
+					removedWhileStreamed.Store(path)
+				}
+			}
+			chunkStoreMu.Unlock()
+		}
+	}()
+
+	var clients sync.WaitGroup
+	failures := make(chan string, 1000)
+	for i := range 16 {
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			for j := range 25 {
+				url := urls[(i+j)%len(urls)]
+				var rec *httptest.ResponseRecorder
+				if j%3 == 0 {
+					rec = request(e, http.MethodGet, url, "", "Range", "bytes=100-")
+				} else {
+					rec = request(e, http.MethodGet, url, "")
+				}
+				switch {
+				case rec.Code == http.StatusPartialContent:
+				case rec.Code != http.StatusOK:
+					failures <- fmt.Sprintf("GET = %d %s", rec.Code, rec.Body.String())
+				case rec.Header().Get(chunkSHA256Header) != fmt.Sprintf("%x", sha256.Sum256(rec.Body.Bytes())):
+					failures <- fmt.Sprintf("body of %d bytes doesn't match its sha256", rec.Body.Len())
+				}
+			}
+		}()
+	}
+	clients.Wait()
+	close(stop)
+	background.Wait()
+	close(failures)
+	for f := range failures {
+		t.Error(f)
+	}
+	if path := removedWhileStreamed.Load(); path != nil {
+		t.Errorf("%s was removed while a stream held it", path)
+	}
+
+	// once every stream is over the sweep leaves nothing behind
+	sweepChunks(time.Now().Add(time.Hour), true)
+	clearArchiveCache()
+	if files := tempArtifacts(t); len(files) > 0 {
+		t.Errorf("left behind: %v", files)
+	}
+}
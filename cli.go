@@ -0,0 +1,18 @@
+package main
+
+import "fmt"
+
+// runCommand dispatches the command line subcommands, the server runs when none is given
+func runCommand(name string, args []string) error {
+	switch name {
+	case "keygen":
+		return runKeygen(args)
+	case "verify":
+		return runVerify(args)
+	case "bench":
+		return runBench(args)
+	case "apply-delta":
+		return runApplyDelta(args)
+	}
+	return fmt.Errorf("unknown command %q, expected keygen, verify, bench or apply-delta", name)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/zeebo/xxh3"
+	"math"
+	"math/bits"
+)
+
+// clientSketchBits sets the HyperLogLog's size: 2^10 one-byte registers, about 3% error
+const clientSketchBits = 10
+
+// clientSketch estimates how many distinct clients it has seen in a fixed 1KB however many there
+// are. Sketches merge by taking the larger register, so an hour's add up to any window. It's
+// nil until the first client, and marshals to base64 in stats.json.
+type clientSketch []byte
+
+func (s *clientSketch) add(client string) {
+	if len(*s) != 1<<clientSketchBits {
+		*s = make(clientSketch, 1<<clientSketchBits)
+	}
+	h := xxh3.HashString(client)
+	i := h >> (64 - clientSketchBits)
+	rank := byte(bits.LeadingZeros64(h<<clientSketchBits|1<<(clientSketchBits-1)) + 1)
+	if rank > (*s)[i] {
+		(*s)[i] = rank
+	}
+}
+
+func (s *clientSketch) merge(o clientSketch) {
+	if len(o) != 1<<clientSketchBits {
+		return
+	}
+	if len(*s) != 1<<clientSketchBits {
+		*s = make(clientSketch, 1<<clientSketchBits)
+	}
+	for i, r := range o {
+		if r > (*s)[i] {
+			(*s)[i] = r
+		}
+	}
+}
+
+// estimate is the HyperLogLog estimate, with linear counting while registers are still empty
+func (s clientSketch) estimate() int64 {
+	if len(s) != 1<<clientSketchBits {
+		return 0
+	}
+	m := float64(len(s))
+	sum, zeros := 0.0, 0
+	for _, r := range s {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return int64(math.Round(e))
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"encoding/json"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"slices"
+	"sync"
+)
+
+const (
+	methodDeflate = "deflate"
+	methodStore   = "store"
+	methodZstd    = "zstd"
+)
+
+// zipMethodZstd is the zip compression method ID assigned to zstd by APPNOTE 6.3.7
+const zipMethodZstd uint16 = 93
+
+// absolute level limits of each method, server configured bounds must sit inside these
+var compressionLevelLimits = map[string][2]int{
+	methodDeflate: {0, 9},
+	methodStore:   {0, 0},
+	methodZstd:    {1, 22},
+}
+
+// default level per method when a client only sends the method
+var compressionDefaultLevels = map[string]int{
+	methodDeflate: 6,
+	methodStore:   0,
+	methodZstd:    3,
+}
+
+// compressionRequest is the optional "compression" object of the init payload
+type compressionRequest struct {
+	Method string `json:"method"`
+	Level  *int   `json:"level"`
+}
+
+// compressionSettings are the effective settings a chunk is built with
+type compressionSettings struct {
+	Method string `json:"method"`
+	Level  int    `json:"level"`
+}
+
+// withLevel folds the init payload's "compression_level" shorthand into req: a number is the level
+// of whatever method applies, "store" picks the store method. It must agree with a "compression"
+// object that says otherwise.
+func withLevel(req *compressionRequest, raw json.RawMessage) (*compressionRequest, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return req, nil
+	}
+	merged := compressionRequest{}
+	if req != nil {
+		merged = *req
+	}
+	var level int
+	var name string
+	switch {
+	case json.Unmarshal(raw, &level) == nil:
+		if merged.Level != nil && *merged.Level != level {
+			return nil, fmt.Errorf("compression_level %d contradicts compression.level %d", level, *merged.Level)
+		}
+		merged.Level = &level
+	case json.Unmarshal(raw, &name) == nil && name == methodStore:
+		if merged.Method != "" && merged.Method != methodStore {
+			return nil, fmt.Errorf("compression_level \"store\" contradicts compression.method %q", merged.Method)
+		}
+		merged.Method = methodStore
+	default:
+		return nil, fmt.Errorf("compression_level must be a number or \"store\"")
+	}
+	return &merged, nil
+}
+
+func isCompressionMethod(m string) bool {
+	_, ok := compressionLevelLimits[m]
+	return ok
+}
+
+func checkLevelRange(method string, lo, hi int) error {
+	limits := compressionLevelLimits[method]
+	if lo > hi || lo < limits[0] || hi > limits[1] {
+		return fmt.Errorf("%s level range %d-%d must be within %d-%d", method, lo, hi, limits[0], limits[1])
+	}
+	return nil
+}
+
+// serverLevelRange returns the configured level bounds for a method
+func serverLevelRange(method string) (int, int) {
+	switch method {
+	case methodDeflate:
+		return cfg.DeflateLevelMin, cfg.DeflateLevelMax
+	case methodZstd:
+		return cfg.ZstdLevelMin, cfg.ZstdLevelMax
+	}
+	return 0, 0
+}
+
+// resolveCompression validates a client request against the server configuration and returns the
+// settings that will actually be used. Levels outside the server bounds are clamped, levels outside
+// what the method supports at all are rejected.
+func resolveCompression(req *compressionRequest) (compressionSettings, error) {
+	method := cfg.DefaultCompression
+	if req != nil && req.Method != "" {
+		method = req.Method
+	}
+	if !isCompressionMethod(method) {
+		return compressionSettings{}, fmt.Errorf("unknown compression method %q", method)
+	}
+	if !slices.Contains(cfg.CompressionMethods, method) {
+		return compressionSettings{}, fmt.Errorf("compression method %q is not allowed on this server", method)
+	}
+
+	level := compressionDefaultLevels[method]
+	if req != nil && req.Level != nil {
+		level = *req.Level
+		limits := compressionLevelLimits[method]
+		if level < limits[0] || level > limits[1] {
+			return compressionSettings{}, fmt.Errorf("compression level %d is out of range for %s (%d-%d)", level, method, limits[0], limits[1])
+		}
+	}
+
+	lo, hi := serverLevelRange(method)
+	level = max(lo, min(level, hi))
+
+	return compressionSettings{Method: method, Level: level}, nil
+}
+
+// key identifies the settings in artifact names so differently compressed builds never collide
+func (s compressionSettings) key() string {
+	return fmt.Sprintf("%s%d", s.Method, s.Level)
+}
+
+// zipMethod returns the zip entry method for these settings
+func (s compressionSettings) zipMethod() uint16 {
+	switch s.Method {
+	case methodStore:
+		return zip.Store
+	case methodZstd:
+		return zipMethodZstd
+	}
+	return zip.Deflate
+}
+
+// register installs compressors on the writer honoring the configured level
+func (s compressionSettings) register(zw *zip.Writer) {
+	level := s.Level
+	switch s.Method {
+	case methodDeflate:
+		zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		})
+	case methodZstd:
+		zw.RegisterCompressor(zipMethodZstd, func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w,
+				zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+				zstd.WithEncoderConcurrency(1),
+			)
+		})
+	}
+}
+
+// observed output of finished builds per format and settings key, the basis of size estimates
+var compressionObserved = struct {
+	sync.Mutex
+	in, out map[string]int64
+}{in: make(map[string]int64), out: make(map[string]int64)}
+
+// recordCompression feeds the source and archive bytes of a finished build into the estimates
+func recordCompression(s compressionSettings, format string, source, zipped int64) {
+	if source <= 0 {
+		return
+	}
+	key := estimateKey(s, format)
+	compressionObserved.Lock()
+	defer compressionObserved.Unlock()
+	compressionObserved.in[key] += source
+	compressionObserved.out[key] += zipped
+}
+
+// estimateKey keeps the formats apart, a tar compressed as a whole comes out smaller than a zip
+// of the same files and settings
+func estimateKey(s compressionSettings, format string) string {
+	if !isTarFormat(format) {
+		return s.key()
+	}
+	return format + "-" + s.key()
+}
+
+// recordArchiveCompression feeds a finished chunk into the estimates. A tar is compressed as a
+// whole, a zip only counts the entries that went through the compressor since stored ones come
+// out as they went in.
+func recordArchiveCompression(session *chunkSession, entries []archiveEntry, source, size int64) {
+	s := session.Compression
+	if isTarFormat(session.Format) {
+		recordCompression(s, session.Format, source, size)
+		return
+	}
+	var in, out int64
+	for _, e := range entries {
+		if s.Method != methodStore && storesExtension(e.Name) {
+			continue
+		}
+		in += int64(e.UncompressedSize)
+		out += int64(e.CompressedSize)
+	}
+	recordCompression(s, session.Format, in, out)
+}
+
+// estimateCompressed guesses the archive size of files from what builds with the same settings
+// and format produced so far. Files a zip stores count at their size, the rest at the observed
+// ratio, and without history it assumes nothing compresses.
+func (s compressionSettings) estimateCompressed(format string, files []sizedFile) int64 {
+	key := estimateKey(s, format)
+	compressionObserved.Lock()
+	in, out := compressionObserved.in[key], compressionObserved.out[key]
+	compressionObserved.Unlock()
+	ratio := 1.0
+	if in > 0 {
+		ratio = float64(out) / float64(in)
+	}
+	perEntry := !isTarFormat(format) && s.Method != methodStore
+	var estimate float64
+	for _, f := range files {
+		if perEntry && storesExtension(f.Path) {
+			estimate += float64(f.Size)
+			continue
+		}
+		estimate += float64(f.Size) * ratio
+	}
+	return int64(estimate)
+}
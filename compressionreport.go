@@ -0,0 +1,227 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"log/slog"
+	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	compressionNoExtension = "(none)"
+	compressionSuggestMin  = 1 << 20 // extensions with less input than this are too noisy to suggest
+	compressionTuneEvery   = time.Hour
+	compressionTuneWindow  = 24 * time.Hour
+)
+
+// compressionTally sums what compressing one extension cost and saved
+type compressionTally struct {
+	Files  int64 `json:"files"`
+	In     int64 `json:"in"`
+	Out    int64 `json:"out"`
+	Nanos  int64 `json:"nanos"` // time spent reading and compressing the entries
+	Stored int64 `json:"stored,omitempty"`
+}
+
+func (t *compressionTally) merge(o *compressionTally) {
+	t.Files += o.Files
+	t.In += o.In
+	t.Out += o.Out
+	t.Nanos += o.Nanos
+	t.Stored += o.Stored
+}
+
+// entryExtension is the lower-cased extension an entry is tallied and matched under
+func entryExtension(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if ext == "" {
+		return compressionNoExtension
+	}
+	return ext
+}
+
+// defaultStoreExtensions are the EverQuest containers, compressed on the inside already, and the
+// usual compressed media. Deflating them again costs a lot of CPU for about a percent.
+var defaultStoreExtensions = []string{
+	".eqg", ".s3d", ".pfs", ".zip", ".7z", ".gz", ".mp3", ".ogg", ".png", ".jpg",
+}
+
+// storeExtensions are written without compression whatever method the chunk asked for. The
+// configured set is fixed, the tuned one is replaced by the autotune loop.
+var storeExtensions = struct {
+	sync.RWMutex
+	configured, tuned map[string]bool
+}{configured: make(map[string]bool), tuned: make(map[string]bool)}
+
+func configureStoreExtensions(exts []string) {
+	storeExtensions.Lock()
+	defer storeExtensions.Unlock()
+	for _, ext := range exts {
+		storeExtensions.configured[ext] = true
+	}
+}
+
+// storesExtension reports whether entries with this name skip compression
+func storesExtension(name string) bool {
+	ext := entryExtension(name)
+	storeExtensions.RLock()
+	defer storeExtensions.RUnlock()
+	return storeExtensions.configured[ext] || storeExtensions.tuned[ext]
+}
+
+// currentStoreExtensions returns the configured and tuned sets, sorted
+func currentStoreExtensions() (configured, tuned []string) {
+	storeExtensions.RLock()
+	defer storeExtensions.RUnlock()
+	return sortedKeys(storeExtensions.configured), sortedKeys(storeExtensions.tuned)
+}
+
+// compressionTotals merges the per-extension tallies of every hour since from
+func (s *downloadStats) compressionTotals(from time.Time) map[string]*compressionTally {
+	totals := make(map[string]*compressionTally)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, h := range s.hours {
+		if h.Hour.Before(from) {
+			continue
+		}
+		for ext, t := range h.Compression {
+			dst, ok := totals[ext]
+			if !ok {
+				dst = &compressionTally{}
+				totals[ext] = dst
+			}
+			dst.merge(t)
+		}
+	}
+	return totals
+}
+
+// compressionRow is one extension of the compression report
+type compressionRow struct {
+	Extension string  `json:"extension"`
+	Files     int64   `json:"files"`
+	Stored    int64   `json:"stored_files"`
+	In        int64   `json:"input_bytes"`
+	Out       int64   `json:"output_bytes"`
+	Ratio     float64 `json:"ratio"`    // output over input, 1 means nothing was saved
+	Seconds   float64 `json:"seconds"`  // reading and compressing
+	MBps      float64 `json:"mb_per_s"` // of input
+}
+
+// compressionRows turns totals into rows, the extensions with the most input first
+func compressionRows(totals map[string]*compressionTally) []compressionRow {
+	rows := make([]compressionRow, 0, len(totals))
+	for ext, t := range totals {
+		r := compressionRow{Extension: ext, Files: t.Files, Stored: t.Stored, In: t.In, Out: t.Out,
+			Seconds: time.Duration(t.Nanos).Seconds()}
+		if t.In > 0 {
+			r.Ratio = float64(t.Out) / float64(t.In)
+		}
+		if r.Seconds > 0 {
+			r.MBps = float64(t.In) / r.Seconds / (1 << 20)
+		}
+		rows = append(rows, r)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].In != rows[j].In {
+			return rows[i].In > rows[j].In
+		}
+		return rows[i].Extension < rows[j].Extension
+	})
+	return rows
+}
+
+// suggestStore picks the extensions whose compressed entries barely shrank. Stored entries don't
+// count, an extension already being stored has no compressed output left to judge.
+func suggestStore(rows []compressionRow) []string {
+	out := []string{}
+	for _, r := range rows {
+		if r.Extension != statsOther && r.In >= compressionSuggestMin && r.Ratio >= cfg.CompressionStoreRatio {
+			out = append(out, r.Extension)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// runCompressionAutotune feeds the store suggestion back into the builder every
+// compressionTuneEvery. A tuned extension stays tuned while it has no compressed samples, since
+// storing it means no new samples arrive.
+func runCompressionAutotune() {
+	ticker := time.NewTicker(compressionTuneEvery)
+	defer ticker.Stop()
+	for {
+		tuneStoreExtensions()
+		<-ticker.C
+	}
+}
+
+func tuneStoreExtensions() {
+	rows := compressionRows(stats.compressionTotals(time.Now().Add(-compressionTuneWindow)))
+	tuned := make(map[string]bool)
+	for _, ext := range suggestStore(rows) {
+		tuned[ext] = true
+	}
+	sampled := make(map[string]bool)
+	for _, r := range rows {
+		if r.In >= compressionSuggestMin {
+			sampled[r.Extension] = true
+		}
+	}
+
+	storeExtensions.Lock()
+	for ext := range storeExtensions.tuned {
+		if !sampled[ext] {
+			tuned[ext] = true
+		}
+	}
+	before := sortedKeys(storeExtensions.tuned)
+	storeExtensions.tuned = tuned
+	storeExtensions.Unlock()
+
+	if after := sortedKeys(tuned); !slices.Equal(before, after) {
+		slog.Info("Compression autotune changed the stored extensions", "extensions", strings.Join(after, ","))
+	}
+}
+
+// GET /admin/reports/compression?window=24h&format=csv
+func handleCompressionReport(c echo.Context) error {
+	window, label := 24*time.Hour, "24h"
+	if v := c.QueryParam("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid window, expected a duration like 24h")
+		}
+		window, label = d, v
+	}
+	from := time.Now().Add(-window).Truncate(time.Hour)
+	rows := compressionRows(stats.compressionTotals(from))
+	suggested := suggestStore(rows)
+	configured, tuned := currentStoreExtensions()
+
+	if !wantsCSV(c) {
+		return c.JSON(http.StatusOK, echo.Map{
+			"window":           window.String(),
+			"from":             from,
+			"store_ratio":      cfg.CompressionStoreRatio,
+			"extensions":       rows,
+			"suggested_store":  suggested,
+			"store_configured": configured,
+			"store_tuned":      tuned,
+			"autotune":         cfg.CompressionAutotune,
+		})
+	}
+
+	out := startCSV(c, "compression", label,
+		"extension", "files", "stored_files", "input_bytes", "output_bytes", "ratio", "seconds", "mb_per_s", "suggest_store")
+	for _, r := range rows {
+		out.row(r.Extension, r.Files, r.Stored, r.In, r.Out, r.Ratio, r.Seconds, r.MBps, slices.Contains(suggested, r.Extension))
+	}
+	return out.close()
+}
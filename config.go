@@ -0,0 +1,990 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"log/slog"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config holds the settings read from the environment at startup
+type config struct {
+	// CompressionMethods are the archive compression methods clients may request
+	CompressionMethods []string
+	// DefaultCompression is used when the init payload doesn't ask for a method
+	DefaultCompression string
+	// Level bounds per method, client requested levels are clamped into these
+	DeflateLevelMin int
+	DeflateLevelMax int
+	ZstdLevelMin    int
+	ZstdLevelMax    int
+
+	// StoreExtensions are archived without compression. CompressionStoreRatio is the output over
+	// input ratio from which /admin/reports/compression suggests storing an extension, and
+	// CompressionAutotune adds those suggestions to the stored set hourly.
+	StoreExtensions       []string
+	CompressionStoreRatio float64
+	CompressionAutotune   bool
+
+	// IntegrityMode controls verification of served bytes against the manifest (off, log, fail)
+	IntegrityMode string
+
+	// SigningKeyPath points at an ed25519 key created with the keygen command, empty disables signing
+	SigningKeyPath string
+
+	// MaxConcurrentDownloads caps downloads in flight (0 is unlimited), requests over it wait in a
+	// queue of DownloadQueueSize for at most DownloadQueueTimeout
+	MaxConcurrentDownloads int
+	DownloadQueueSize      int
+	DownloadQueueTimeout   time.Duration
+
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For and X-Real-IP name the client,
+	// the headers of anyone else are ignored
+	TrustedProxies []*net.IPNet
+
+	// MaxStreamsPerIP caps simultaneous download streams per client (0 is unlimited), clients in
+	// StreamAllowlist or presenting one of StreamAllowlistKeys get AllowlistMaxStreamsPerIP
+	// instead (0 exempts them). Static files count as streams from LargeFileThreshold bytes up.
+	MaxStreamsPerIP          int
+	StreamAllowlist          []*net.IPNet
+	StreamAllowlistKeys      []string
+	AllowlistMaxStreamsPerIP int
+	// MaxStreamBytesPerSec throttles each download, MaxTotalBytesPerSec all of them together
+	// (0 is unlimited)
+	MaxStreamBytesPerSec int
+	MaxTotalBytesPerSec  int
+	// MaxChunkStreamsPerIP caps how many of a client's streams may be chunk downloads (0 is no
+	// cap of its own), allowlisted clients aren't held to it
+	MaxChunkStreamsPerIP int
+	LargeFileThreshold   int64
+
+	// WebhookSecret verifies the X-Hub-Signature-256 of /gh-update deliveries, the ?key=WEBHOOK_KEY
+	// query is only accepted with WebhookAllowQueryKey. WebhookKey also lets callers into
+	// /gh-update/status.
+	WebhookSecret        string
+	WebhookKey           string
+	WebhookAllowQueryKey bool
+
+	// AdminKey guards the /admin endpoints, defaults to WEBHOOK_KEY
+	AdminKey string
+
+	// SpeedtestMaxBytes caps /speedtest transfers, 0 disables the endpoint. Runs are limited per client.
+	SpeedtestMaxBytes  int64
+	SpeedtestPerMinute int
+
+	// Mirrors are listed on /mirrors, their /latest is probed every MirrorProbeInterval
+	Mirrors             []mirrorConfig
+	MirrorProbeInterval time.Duration
+	MirrorProbeTimeout  time.Duration
+
+	// ZipAll builds the full client archive of every new commit into ZipAllDir, served on /zip-all
+	// with a torrent of ZipAllPieceSize pieces. PublicURL is this server's address as clients see
+	// it, the torrent lists it and the mirrors as webseeds.
+	ZipAll          bool
+	ZipAllDir       string
+	ZipAllPieceSize int64
+	ZipAllTrackers  []string
+	ZipAllPartSize  int64 // split volumes on /zip-all/parts, 0 disables them
+	PublicURL       string
+
+	// NewsFile is the repo relative news.json or changelog.md served on /news, "" disables it
+	NewsFile string
+
+	// GitTimeout bounds every git command but the transfers, GitTransferIdleTimeout is how long a
+	// clone, fetch or pull may go without progress before it counts as hung
+	GitTimeout             time.Duration
+	GitTransferIdleTimeout time.Duration
+
+	// UpdateLockTimeout is how long an update waits for running archive builds before it gives up
+	UpdateLockTimeout time.Duration
+
+	// PinCommit holds the default checkout at one commit, updates fetch but never move it
+	PinCommit string
+
+	// RepoBranch is the branch or tag the default checkout follows, "" for origin's default branch
+	RepoBranch string
+
+	// CloneDepth makes the default checkout a shallow clone of that many commits, 0 is full history
+	CloneDepth int
+
+	// TrustedSigners, when set, only lets commits signed by these keys be served
+	TrustedSigners *trustedSigners
+
+	// ChunkEventLog is the JSON lines file chunk lifecycle events go to, "" disables it
+	ChunkEventLog         string
+	ChunkEventLogMaxBytes int64
+	// AccessLogPath is the JSON lines file every request goes to, "" disables it. It's rotated by
+	// size and/or age, AccessLogMaxFiles rotated files are kept.
+	AccessLogPath           string
+	AccessLogMaxBytes       int64
+	AccessLogRotateInterval time.Duration
+	AccessLogMaxFiles       int
+
+	// StatsPath persists the hourly download counters, kept for StatsRetention
+	StatsPath      string
+	StatsRetention time.Duration
+
+	// NotifyWebhookURL receives alert state changes, rules with a zero threshold are disabled
+	NotifyWebhookURL      string
+	AlertInterval         time.Duration
+	AlertCooldown         time.Duration
+	AlertErrorRate        float64 // fraction of 5xx responses
+	AlertErrorWindow      time.Duration
+	AlertErrorMinRequests int
+	AlertBuildQueueWait   time.Duration
+	TempDirQuota          int64
+	AlertTempDirPercent   float64
+	AlertPullStale        time.Duration
+
+	// MetricsAddr moves /metrics from the public server to a listener of its own, e.g. 127.0.0.1:9100
+	MetricsAddr string
+	// ResponseCompression compresses responses of ResponseCompressionMinSize bytes up, except for
+	// the extensions (".eqg") and MIME types ("image/*") in ResponseCompressionSkip
+	ResponseCompression        bool
+	ResponseCompressionMinSize int64
+	ResponseCompressionSkip    []string
+	// CORSAllowedOrigins may call the public endpoints from a browser, "*" is any origin and none
+	// leaves CORS off. Preflights are cached for CORSMaxAge.
+	CORSAllowedOrigins []string
+	CORSMaxAge         time.Duration
+	// ListenAddr is the public listener. AdminListenAddr moves /admin, and /metrics unless
+	// MetricsAddr has it, to a listener of their own.
+	ListenAddr      string
+	AdminListenAddr string
+
+	// LatencyBuckets are the upper bounds in seconds of the request latency histograms
+	LatencyBuckets []float64
+
+	// LogBufferSize is how many recent log records /admin/logs keeps in memory
+	LogBufferSize int
+
+	// LogLevel is the least severe level logged, LogFormat the output encoding (json, text)
+	LogLevel  slog.Level
+	LogFormat string
+
+	// Branches are served from their own worktrees next to the default checkout, picked with ?ref=
+	Branches []string
+
+	// Repos are additional repositories, each cloned under repos/ and served under /<name>/
+	Repos []repoConfig
+
+	// ExcludePatterns are checkout paths never served, by any endpoint or in the manifest.
+	// Dotfiles are left out too unless ServeDotfiles, .git always is.
+	ExcludePatterns []string
+	ServeDotfiles   bool
+
+	// ChunkOrder is the order init returns chunks in (none, smallest, critical), CriticalFiles are
+	// the patterns of core files that mark a chunk critical
+	ChunkOrder    string
+	CriticalFiles []string
+
+	// ChunkStreamDirect writes chunk zips straight into the response instead of building an
+	// artifact in the temp dir first
+	ChunkStreamDirect bool
+
+	// ChunkBinding ties chunk URLs to the client that created them (off, ip, token)
+	ChunkBinding string
+	// APIKeys are required for init and chunk downloads when set, with APIKeysStatic for static
+	// files, /file and /zip-all as well
+	APIKeys       []string
+	APIKeysStatic bool
+
+	// ChunkTokenSecret signs the chunk URLs init hands out, instances behind one load balancer
+	// share it. ChunkTTL is how long a URL and its session stay valid, ChunkCleanupDelay how long
+	// a fully downloaded chunk's archive is kept for repeat requests.
+	ChunkTokenSecret  string
+	ChunkTTL          time.Duration
+	ChunkCleanupDelay time.Duration
+	// ChunkTokenKeyPath keeps the generated secret when CHUNK_TOKEN_SECRET is unset, "" doesn't
+	ChunkTokenKeyPath string
+	// an init whose files, directories expanded, go past either is rejected, 0 is unlimited
+	InitMaxFiles int
+	InitMaxBytes int64
+
+	// per client request budgets of the init and download endpoints
+	RateLimitInit     rateLimitConfig
+	RateLimitDownload rateLimitConfig
+
+	// VisitorIdleTimeout is how long a client's rate limiter is kept after its last request
+	VisitorIdleTimeout time.Duration
+
+	// MaxConcurrentBuilds limits archive builds (0 is unlimited), jobs are classed small/medium/large
+	// by the BuildSmallMaxBytes and BuildMediumMaxBytes thresholds and jump the line after BuildAging
+	MaxConcurrentBuilds int
+	BuildSmallMaxBytes  int64
+	BuildMediumMaxBytes int64
+	BuildAging          time.Duration
+	BuildQueueTimeout   time.Duration
+	BuildQueueSize      int   // waiting builds beyond this are turned away, 0 is unbounded
+	BuildDiskHeadroom   int64 // free temp space a build must leave on top of the chunk's size
+
+	// built archives shared between inits of the same files, 0 bytes disables the cache
+	ArchiveCacheMaxBytes int64
+	ArchiveCacheTTL      time.Duration
+
+	// the IO pressure breaker opens when rolling build throughput drops below BreakerMinThroughput
+	// MB/s or temp write latency exceeds BreakerMaxWriteLatency, both 0 disables it
+	BreakerMinThroughput   float64
+	BreakerMaxWriteLatency time.Duration
+	BreakerCooldown        time.Duration
+
+	// ShutdownTimeout is how long SIGINT/SIGTERM waits for in-flight requests before closing them
+	ShutdownTimeout time.Duration
+
+	// TLS on the public listener, from certificate files or autocert for AutocertDomains. With either
+	// a plain listener on HTTPAddr answers the HTTP-01 challenges and redirects to https, or serves
+	// everything like before when HTTPRedirect is off.
+	TLSCertFile      string
+	TLSKeyFile       string
+	AutocertDomains  []string
+	AutocertCacheDir string
+	AutocertEmail    string
+	HTTPAddr         string
+	HTTPRedirect     bool
+
+	// deltas between commits of a file on /delta, files outside the sizes get none
+	DeltaMinSize  int64
+	DeltaMaxSize  int64
+	DeltaCacheTTL time.Duration // a cached delta not served for this long is removed
+}
+
+var cfg config
+
+// loadConfig reads the configuration from the environment, returning an error for invalid values
+func loadConfig() (config, error) {
+	var c config
+	var err error
+
+	c.CompressionMethods = envList("COMPRESSION_METHODS", []string{methodDeflate, methodStore, methodZstd})
+	for _, m := range c.CompressionMethods {
+		if !isCompressionMethod(m) {
+			return c, fmt.Errorf("COMPRESSION_METHODS: unknown method %q", m)
+		}
+	}
+
+	c.DefaultCompression = envString("COMPRESSION_DEFAULT_METHOD", methodDeflate)
+	if !slices.Contains(c.CompressionMethods, c.DefaultCompression) {
+		return c, fmt.Errorf("COMPRESSION_DEFAULT_METHOD: %q is not in COMPRESSION_METHODS", c.DefaultCompression)
+	}
+
+	if c.DeflateLevelMin, err = envInt("DEFLATE_LEVEL_MIN", 1); err != nil {
+		return c, err
+	}
+	if c.DeflateLevelMax, err = envInt("DEFLATE_LEVEL_MAX", 9); err != nil {
+		return c, err
+	}
+	if err = checkLevelRange(methodDeflate, c.DeflateLevelMin, c.DeflateLevelMax); err != nil {
+		return c, err
+	}
+
+	if c.ZstdLevelMin, err = envInt("ZSTD_LEVEL_MIN", 1); err != nil {
+		return c, err
+	}
+	if c.ZstdLevelMax, err = envInt("ZSTD_LEVEL_MAX", 19); err != nil {
+		return c, err
+	}
+	if err = checkLevelRange(methodZstd, c.ZstdLevelMin, c.ZstdLevelMax); err != nil {
+		return c, err
+	}
+
+	storeList := envList("COMPRESSION_STORE_EXTENSIONS", defaultStoreExtensions)
+	if len(storeList) == 1 && strings.EqualFold(storeList[0], "none") {
+		storeList = nil
+	}
+	for _, ext := range storeList {
+		ext = strings.ToLower(ext)
+		if ext != compressionNoExtension && !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		c.StoreExtensions = append(c.StoreExtensions, ext)
+	}
+	if c.CompressionStoreRatio, err = envFloat("COMPRESSION_STORE_RATIO", 0.95); err != nil {
+		return c, err
+	}
+	if c.CompressionStoreRatio <= 0 {
+		return c, fmt.Errorf("COMPRESSION_STORE_RATIO: must be positive")
+	}
+	if c.CompressionAutotune, err = envBool("COMPRESSION_AUTOTUNE", false); err != nil {
+		return c, err
+	}
+
+	c.IntegrityMode = envString("INTEGRITY_MODE", integrityOff)
+	switch c.IntegrityMode {
+	case integrityOff, integrityLog, integrityFail:
+	default:
+		return c, fmt.Errorf("INTEGRITY_MODE: must be off, log or fail, got %q", c.IntegrityMode)
+	}
+
+	c.SigningKeyPath = envString("SIGNING_KEY_PATH", "")
+
+	if c.MaxConcurrentDownloads, err = envInt("MAX_CONCURRENT_DOWNLOADS", 0); err != nil {
+		return c, err
+	}
+	if c.DownloadQueueSize, err = envInt("DOWNLOAD_QUEUE_SIZE", 100); err != nil {
+		return c, err
+	}
+	if c.DownloadQueueTimeout, err = envDuration("DOWNLOAD_QUEUE_TIMEOUT", 2*time.Minute); err != nil {
+		return c, err
+	}
+	if c.MaxConcurrentDownloads < 0 || c.DownloadQueueSize < 0 {
+		return c, fmt.Errorf("MAX_CONCURRENT_DOWNLOADS and DOWNLOAD_QUEUE_SIZE must not be negative")
+	}
+
+	if c.TrustedProxies, err = envCIDRList("TRUSTED_PROXIES"); err != nil {
+		return c, err
+	}
+	if c.MaxStreamsPerIP, err = envInt("MAX_STREAMS_PER_IP", 0); err != nil {
+		return c, err
+	}
+	if c.StreamAllowlist, err = envCIDRList("STREAM_LIMIT_ALLOWLIST"); err != nil {
+		return c, err
+	}
+	c.StreamAllowlistKeys = envList("STREAM_LIMIT_ALLOWLIST_KEYS", nil)
+	if c.AllowlistMaxStreamsPerIP, err = envInt("ALLOWLIST_MAX_STREAMS_PER_IP", 0); err != nil {
+		return c, err
+	}
+	if c.MaxChunkStreamsPerIP, err = envInt("MAX_CHUNK_STREAMS_PER_IP", 0); err != nil {
+		return c, err
+	}
+	if c.MaxStreamBytesPerSec, err = envInt("MAX_STREAM_BYTES_PER_SEC", 0); err != nil {
+		return c, err
+	}
+	if c.MaxTotalBytesPerSec, err = envInt("MAX_TOTAL_BYTES_PER_SEC", 0); err != nil {
+		return c, err
+	}
+	if c.MaxStreamBytesPerSec < 0 || c.MaxTotalBytesPerSec < 0 {
+		return c, fmt.Errorf("MAX_STREAM_BYTES_PER_SEC and MAX_TOTAL_BYTES_PER_SEC must not be negative")
+	}
+	threshold, err := envInt("LARGE_FILE_THRESHOLD", 10*1024*1024)
+	if err != nil {
+		return c, err
+	}
+	c.LargeFileThreshold = int64(threshold)
+
+	if c.MaxConcurrentBuilds, err = envInt("MAX_CONCURRENT_BUILDS", 0); err != nil {
+		return c, err
+	}
+	small, err := envInt("BUILD_SMALL_MAX_BYTES", 50*1024*1024)
+	if err != nil {
+		return c, err
+	}
+	medium, err := envInt("BUILD_MEDIUM_MAX_BYTES", 500*1024*1024)
+	if err != nil {
+		return c, err
+	}
+	if small > medium {
+		return c, fmt.Errorf("BUILD_SMALL_MAX_BYTES must not exceed BUILD_MEDIUM_MAX_BYTES")
+	}
+	c.BuildSmallMaxBytes, c.BuildMediumMaxBytes = int64(small), int64(medium)
+	if c.BuildAging, err = envDuration("BUILD_AGING", 30*time.Second); err != nil {
+		return c, err
+	}
+	if c.BuildQueueTimeout, err = envDuration("BUILD_QUEUE_TIMEOUT", 5*time.Minute); err != nil {
+		return c, err
+	}
+	if c.BuildQueueSize, err = envInt("BUILD_QUEUE_SIZE", 100); err != nil {
+		return c, err
+	}
+	if c.BuildQueueSize < 0 {
+		return c, fmt.Errorf("BUILD_QUEUE_SIZE: must not be negative")
+	}
+	headroom, err := envInt("BUILD_DISK_HEADROOM", 256*1024*1024)
+	if err != nil {
+		return c, err
+	}
+	if headroom < 0 {
+		return c, fmt.Errorf("BUILD_DISK_HEADROOM: must not be negative")
+	}
+	c.BuildDiskHeadroom = int64(headroom)
+	cacheBytes, err := envInt("ARCHIVE_CACHE_MAX_BYTES", 5*1024*1024*1024)
+	if err != nil {
+		return c, err
+	}
+	if cacheBytes < 0 {
+		return c, fmt.Errorf("ARCHIVE_CACHE_MAX_BYTES: must not be negative")
+	}
+	c.ArchiveCacheMaxBytes = int64(cacheBytes)
+	if c.ArchiveCacheTTL, err = envDuration("ARCHIVE_CACHE_TTL", time.Hour); err != nil {
+		return c, err
+	}
+
+	if c.BreakerMinThroughput, err = envFloat("BREAKER_MIN_THROUGHPUT_MBPS", 0); err != nil {
+		return c, err
+	}
+	if c.BreakerMaxWriteLatency, err = envDuration("BREAKER_MAX_WRITE_LATENCY", 0); err != nil {
+		return c, err
+	}
+	if c.BreakerCooldown, err = envDuration("BREAKER_COOLDOWN", 30*time.Second); err != nil {
+		return c, err
+	}
+
+	c.WebhookSecret = envString("WEBHOOK_SECRET", "")
+	c.WebhookKey = envString("WEBHOOK_KEY", "")
+	if c.WebhookAllowQueryKey, err = envBool("WEBHOOK_ALLOW_QUERY_KEY", false); err != nil {
+		return c, err
+	}
+	if c.WebhookAllowQueryKey && c.WebhookKey == "" {
+		return c, fmt.Errorf("WEBHOOK_ALLOW_QUERY_KEY needs a WEBHOOK_KEY to compare against")
+	}
+
+	c.AdminKey = envString("ADMIN_KEY", c.WebhookKey)
+
+	speedtestMax, err := envInt("SPEEDTEST_MAX_BYTES", 8<<20)
+	if err != nil {
+		return c, err
+	}
+	c.SpeedtestMaxBytes = int64(speedtestMax)
+	if c.SpeedtestPerMinute, err = envInt("SPEEDTEST_PER_MINUTE", 6); err != nil {
+		return c, err
+	}
+	if c.SpeedtestPerMinute < 1 {
+		return c, fmt.Errorf("SPEEDTEST_PER_MINUTE: must be at least 1")
+	}
+
+	if c.Mirrors, err = parseMirrors(envList("MIRRORS", nil)); err != nil {
+		return c, fmt.Errorf("MIRRORS: %w", err)
+	}
+	if c.MirrorProbeInterval, err = envDuration("MIRROR_PROBE_INTERVAL", time.Minute); err != nil {
+		return c, err
+	}
+	if len(c.Mirrors) > 0 && c.MirrorProbeInterval <= 0 {
+		return c, fmt.Errorf("MIRROR_PROBE_INTERVAL: must be positive")
+	}
+	if c.MirrorProbeTimeout, err = envDuration("MIRROR_PROBE_TIMEOUT", 5*time.Second); err != nil {
+		return c, err
+	}
+
+	if c.ZipAll, err = envBool("ZIP_ALL", false); err != nil {
+		return c, err
+	}
+	c.ZipAllDir = envString("ZIP_ALL_DIR", filepath.Join(os.TempDir(), "patcher-zip-all"))
+	pieceSize, err := envInt("ZIP_ALL_PIECE_SIZE", 4<<20)
+	if err != nil {
+		return c, err
+	}
+	if pieceSize < 16<<10 || pieceSize&(pieceSize-1) != 0 {
+		return c, fmt.Errorf("ZIP_ALL_PIECE_SIZE: must be a power of two of at least 16384")
+	}
+	c.ZipAllPieceSize = int64(pieceSize)
+	c.ZipAllTrackers = envList("ZIP_ALL_TRACKERS", nil)
+	partSize, err := envInt("ZIP_ALL_PART_SIZE", 0)
+	if err != nil {
+		return c, err
+	}
+	if partSize < 0 {
+		return c, fmt.Errorf("ZIP_ALL_PART_SIZE: must not be negative")
+	}
+	c.ZipAllPartSize = int64(partSize)
+	c.PublicURL = envString("PUBLIC_URL", "")
+	if c.PublicURL != "" {
+		if u, err := url.Parse(c.PublicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return c, fmt.Errorf("PUBLIC_URL: expected an http(s) URL, got %q", c.PublicURL)
+		}
+	}
+
+	c.NewsFile = envString("NEWS_FILE", "")
+	if c.NewsFile != "" {
+		if _, _, err := resolveRepoPath(".", c.NewsFile); err != nil {
+			return c, fmt.Errorf("NEWS_FILE: %w", err)
+		}
+	}
+
+	if c.GitTimeout, err = envDuration("GIT_TIMEOUT", 10*time.Minute); err != nil {
+		return c, err
+	}
+	if c.GitTransferIdleTimeout, err = envDuration("GIT_TRANSFER_IDLE_TIMEOUT", 5*time.Minute); err != nil {
+		return c, err
+	}
+
+	if c.UpdateLockTimeout, err = envDuration("UPDATE_LOCK_TIMEOUT", 2*time.Minute); err != nil {
+		return c, err
+	}
+
+	c.RepoBranch = envString("REPO_BRANCH", "")
+	if b := c.RepoBranch; strings.HasPrefix(b, "-") || strings.Contains(b, "..") || strings.ContainsAny(b, " ~^:?*[\\") {
+		return c, fmt.Errorf("REPO_BRANCH: invalid branch or tag name %q", b)
+	}
+
+	if c.CloneDepth, err = envInt("CLONE_DEPTH", 0); err != nil {
+		return c, err
+	}
+	if c.CloneDepth < 0 {
+		return c, fmt.Errorf("CLONE_DEPTH: must not be negative")
+	}
+
+	c.PinCommit = envString("PIN_COMMIT", "")
+	if c.PinCommit != "" && !isHexSHA(c.PinCommit) {
+		return c, fmt.Errorf("PIN_COMMIT: expected a commit SHA, got %q", c.PinCommit)
+	}
+
+	if c.TrustedSigners, err = parseTrustedSigners(os.Getenv("TRUSTED_SIGNERS")); err != nil {
+		return c, fmt.Errorf("TRUSTED_SIGNERS: %w", err)
+	}
+
+	c.ChunkEventLog = envString("CHUNK_EVENT_LOG", "chunk-events.jsonl")
+	eventLogMax, err := envInt("CHUNK_EVENT_LOG_MAX_BYTES", 50*1024*1024)
+	if err != nil {
+		return c, err
+	}
+	c.ChunkEventLogMaxBytes = int64(eventLogMax)
+
+	c.AccessLogPath = envString("ACCESS_LOG_PATH", "")
+	accessLogMax, err := envInt("ACCESS_LOG_MAX_BYTES", 100*1024*1024)
+	if err != nil {
+		return c, err
+	}
+	if accessLogMax < 0 {
+		return c, fmt.Errorf("ACCESS_LOG_MAX_BYTES: must not be negative")
+	}
+	c.AccessLogMaxBytes = int64(accessLogMax)
+	if c.AccessLogRotateInterval, err = envDuration("ACCESS_LOG_ROTATE_INTERVAL", 0); err != nil {
+		return c, err
+	}
+	if c.AccessLogMaxFiles, err = envInt("ACCESS_LOG_MAX_FILES", 7); err != nil {
+		return c, err
+	}
+	if c.AccessLogMaxFiles < 0 {
+		return c, fmt.Errorf("ACCESS_LOG_MAX_FILES: must not be negative")
+	}
+
+	c.StatsPath = envString("STATS_PATH", "stats.json")
+	if c.StatsRetention, err = envDuration("STATS_RETENTION", 30*24*time.Hour); err != nil {
+		return c, err
+	}
+
+	c.NotifyWebhookURL = envString("NOTIFY_WEBHOOK_URL", "")
+	if c.AlertInterval, err = envDuration("ALERT_INTERVAL", 30*time.Second); err != nil {
+		return c, err
+	}
+	if c.AlertInterval <= 0 {
+		return c, fmt.Errorf("ALERT_INTERVAL: must be positive")
+	}
+	if c.AlertCooldown, err = envDuration("ALERT_COOLDOWN", 15*time.Minute); err != nil {
+		return c, err
+	}
+	if c.AlertErrorRate, err = envFloat("ALERT_ERROR_RATE", 0); err != nil {
+		return c, err
+	}
+	if c.AlertErrorWindow, err = envDuration("ALERT_ERROR_WINDOW", 5*time.Minute); err != nil {
+		return c, err
+	}
+	if c.AlertErrorWindow < time.Minute || c.AlertErrorWindow > time.Hour {
+		return c, fmt.Errorf("ALERT_ERROR_WINDOW: must be between 1m and 1h")
+	}
+	if c.AlertErrorMinRequests, err = envInt("ALERT_ERROR_MIN_REQUESTS", 20); err != nil {
+		return c, err
+	}
+	if c.AlertBuildQueueWait, err = envDuration("ALERT_BUILD_QUEUE_WAIT", 0); err != nil {
+		return c, err
+	}
+	quota, err := envInt("TEMP_DIR_QUOTA", 0)
+	if err != nil {
+		return c, err
+	}
+	c.TempDirQuota = int64(quota)
+	if c.AlertTempDirPercent, err = envFloat("ALERT_TEMP_DIR_PERCENT", 90); err != nil {
+		return c, err
+	}
+	if c.AlertPullStale, err = envDuration("ALERT_PULL_STALE", 0); err != nil {
+		return c, err
+	}
+
+	c.MetricsAddr = envString("METRICS_ADDR", "")
+	if c.ResponseCompression, err = envBool("RESPONSE_COMPRESSION", true); err != nil {
+		return c, err
+	}
+	minSize, err := envInt("RESPONSE_COMPRESSION_MIN_SIZE", 1024)
+	if err != nil {
+		return c, err
+	}
+	if minSize < 0 {
+		return c, fmt.Errorf("RESPONSE_COMPRESSION_MIN_SIZE: must not be negative")
+	}
+	c.ResponseCompressionMinSize = int64(minSize)
+	skipList := envList("RESPONSE_COMPRESSION_SKIP", defaultResponseCompressionSkip)
+	if len(skipList) == 1 && strings.EqualFold(skipList[0], "none") {
+		skipList = nil
+	}
+	for _, skip := range skipList {
+		skip = strings.ToLower(skip)
+		if !strings.HasPrefix(skip, ".") && !strings.Contains(skip, "/") {
+			skip = "." + skip
+		}
+		c.ResponseCompressionSkip = append(c.ResponseCompressionSkip, skip)
+	}
+	c.CORSAllowedOrigins = envList("CORS_ALLOWED_ORIGINS", nil)
+	if c.CORSMaxAge, err = envDuration("CORS_MAX_AGE", 10*time.Minute); err != nil {
+		return c, err
+	}
+	c.ListenAddr = envString("LISTEN_ADDR", ":4444")
+	c.AdminListenAddr = envString("ADMIN_LISTEN_ADDR", "")
+	for key, addr := range map[string]string{"LISTEN_ADDR": c.ListenAddr, "ADMIN_LISTEN_ADDR": c.AdminListenAddr, "METRICS_ADDR": c.MetricsAddr} {
+		if err := checkListenAddr(addr); err != nil {
+			return c, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	if c.AdminListenAddr != "" && c.AdminListenAddr == c.ListenAddr {
+		return c, fmt.Errorf("ADMIN_LISTEN_ADDR must differ from LISTEN_ADDR")
+	}
+
+	c.LatencyBuckets = prometheus.DefBuckets
+	if v := envList("LATENCY_BUCKETS", nil); v != nil {
+		c.LatencyBuckets = nil
+		for _, item := range v {
+			b, err := strconv.ParseFloat(item, 64)
+			if err != nil || b <= 0 || len(c.LatencyBuckets) > 0 && b <= c.LatencyBuckets[len(c.LatencyBuckets)-1] {
+				return c, fmt.Errorf("LATENCY_BUCKETS: expected increasing positive seconds, got %q", item)
+			}
+			c.LatencyBuckets = append(c.LatencyBuckets, b)
+		}
+	}
+
+	if c.LogBufferSize, err = envInt("LOG_BUFFER_SIZE", 2000); err != nil {
+		return c, err
+	}
+	if c.LogBufferSize <= 0 {
+		return c, fmt.Errorf("LOG_BUFFER_SIZE: must be positive")
+	}
+	if err := c.LogLevel.UnmarshalText([]byte(envString("LOG_LEVEL", "info"))); err != nil {
+		return c, fmt.Errorf("LOG_LEVEL: expected debug, info, warn or error, got %q", os.Getenv("LOG_LEVEL"))
+	}
+	c.LogFormat = strings.ToLower(envString("LOG_FORMAT", "json"))
+	if c.LogFormat != "json" && c.LogFormat != "text" {
+		return c, fmt.Errorf("LOG_FORMAT: expected json or text, got %q", c.LogFormat)
+	}
+
+	c.Branches = envList("BRANCHES", nil)
+	for _, b := range c.Branches {
+		if strings.HasPrefix(b, "-") || strings.Contains(b, "..") || strings.ContainsAny(b, " ~^:?*[\\") {
+			return c, fmt.Errorf("BRANCHES: invalid branch name %q", b)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, item := range envList("REPOS", nil) {
+		name, repoURL, ok := strings.Cut(item, "=")
+		name, repoURL = strings.TrimSpace(name), strings.TrimSpace(repoURL)
+		switch {
+		case !ok || repoURL == "":
+			return c, fmt.Errorf("REPOS: expected name=url, got %q", item)
+		case !repoNamePattern.MatchString(name) || reservedRepoNames[strings.ToLower(name)]:
+			return c, fmt.Errorf("REPOS: %q can't be used as a repo name", name)
+		case seen[name]:
+			return c, fmt.Errorf("REPOS: %q is listed twice", name)
+		}
+		seen[name] = true
+		c.Repos = append(c.Repos, repoConfig{Name: name, URL: repoURL})
+	}
+
+	c.ExcludePatterns = envList("EXCLUDE_PATTERNS", nil)
+	for _, p := range c.ExcludePatterns {
+		for _, s := range strings.Split(strings.TrimSuffix(p, "/"), "/") {
+			if _, err := path.Match(s, ""); err != nil {
+				return c, fmt.Errorf("EXCLUDE_PATTERNS: invalid pattern %q", p)
+			}
+		}
+	}
+
+	if c.ServeDotfiles, err = envBool("SERVE_DOTFILES", false); err != nil {
+		return c, err
+	}
+
+	c.ChunkOrder = envString("CHUNK_ORDER", chunkOrderNone)
+	switch c.ChunkOrder {
+	case chunkOrderNone, chunkOrderSmallest, chunkOrderCritical:
+	default:
+		return c, fmt.Errorf("CHUNK_ORDER: must be none, smallest or critical, got %q", c.ChunkOrder)
+	}
+	c.CriticalFiles = envList("CRITICAL_FILES", nil)
+	for _, p := range c.CriticalFiles {
+		if _, err := path.Match(p, ""); err != nil {
+			return c, fmt.Errorf("CRITICAL_FILES: invalid pattern %q", p)
+		}
+	}
+
+	if c.ChunkStreamDirect, err = envBool("CHUNK_STREAM_DIRECT", false); err != nil {
+		return c, err
+	}
+
+	c.APIKeys = envList("API_KEYS", nil)
+	if c.APIKeysStatic, err = envBool("API_KEYS_STATIC", false); err != nil {
+		return c, err
+	}
+	c.ChunkBinding = envString("CHUNK_BINDING", chunkBindingOff)
+	switch c.ChunkBinding {
+	case chunkBindingOff, chunkBindingIP, chunkBindingToken:
+	default:
+		return c, fmt.Errorf("CHUNK_BINDING: must be off, ip or token, got %q", c.ChunkBinding)
+	}
+
+	c.ChunkTokenSecret = envString("CHUNK_TOKEN_SECRET", "")
+	c.ChunkTokenKeyPath = envString("CHUNK_TOKEN_KEY_PATH", "chunk-token.key")
+	// CHUNK_TOKEN_TTL is the old name of CHUNK_TTL
+	ttlDefault := 30 * time.Minute
+	if ttlDefault, err = envDuration("CHUNK_TOKEN_TTL", ttlDefault); err != nil {
+		return c, err
+	}
+	if c.ChunkTTL, err = envDuration("CHUNK_TTL", ttlDefault); err != nil {
+		return c, err
+	}
+	if c.ChunkTTL <= 0 {
+		return c, fmt.Errorf("CHUNK_TTL: must be positive")
+	}
+	if c.ChunkCleanupDelay, err = envDuration("CHUNK_CLEANUP_DELAY", 3*time.Minute); err != nil {
+		return c, err
+	}
+	if c.ChunkCleanupDelay < 0 {
+		return c, fmt.Errorf("CHUNK_CLEANUP_DELAY: must not be negative")
+	}
+	if c.InitMaxFiles, err = envInt("INIT_MAX_FILES", 50000); err != nil {
+		return c, err
+	}
+	maxBytes, err := envInt("INIT_MAX_BYTES", 0)
+	if err != nil {
+		return c, err
+	}
+	if c.InitMaxFiles < 0 || maxBytes < 0 {
+		return c, fmt.Errorf("INIT_MAX_FILES and INIT_MAX_BYTES must not be negative")
+	}
+	c.InitMaxBytes = int64(maxBytes)
+
+	if c.RateLimitInit, err = envRateLimit("RATE_LIMIT_INIT", rateLimitConfig{Requests: 10, Interval: time.Minute}); err != nil {
+		return c, err
+	}
+	if c.RateLimitDownload, err = envRateLimit("RATE_LIMIT_DOWNLOAD", rateLimitConfig{Requests: 600, Interval: time.Minute, Burst: 120}); err != nil {
+		return c, err
+	}
+	if c.VisitorIdleTimeout, err = envDuration("VISITOR_IDLE_TIMEOUT", 10*time.Minute); err != nil {
+		return c, err
+	}
+	if c.VisitorIdleTimeout <= 0 {
+		return c, fmt.Errorf("VISITOR_IDLE_TIMEOUT: must be positive")
+	}
+	if c.ShutdownTimeout, err = envDuration("SHUTDOWN_TIMEOUT", 30*time.Second); err != nil {
+		return c, err
+	}
+	if c.ShutdownTimeout < 0 {
+		return c, fmt.Errorf("SHUTDOWN_TIMEOUT: must not be negative")
+	}
+
+	c.TLSCertFile = envString("TLS_CERT_FILE", "")
+	c.TLSKeyFile = envString("TLS_KEY_FILE", "")
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return c, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	c.AutocertDomains = envList("AUTOCERT_DOMAINS", nil)
+	if len(c.AutocertDomains) > 0 && c.TLSCertFile != "" {
+		return c, fmt.Errorf("AUTOCERT_DOMAINS and TLS_CERT_FILE are mutually exclusive")
+	}
+	c.AutocertCacheDir = envString("AUTOCERT_CACHE_DIR", "autocert")
+	c.AutocertEmail = envString("AUTOCERT_EMAIL", "")
+	httpAddr := ""
+	if len(c.AutocertDomains) > 0 {
+		httpAddr = ":80" // the HTTP-01 challenge always comes in on port 80
+	}
+	c.HTTPAddr = envString("HTTP_ADDR", httpAddr)
+	if err := checkListenAddr(c.HTTPAddr); err != nil {
+		return c, fmt.Errorf("HTTP_ADDR: %w", err)
+	}
+	if c.HTTPRedirect, err = envBool("HTTP_REDIRECT", true); err != nil {
+		return c, err
+	}
+
+	deltaMin, err := envInt("DELTA_MIN_SIZE", 1<<20)
+	if err != nil {
+		return c, err
+	}
+	deltaMax, err := envInt("DELTA_MAX_SIZE", 1<<30)
+	if err != nil {
+		return c, err
+	}
+	if deltaMin < 0 || deltaMax < deltaMin {
+		return c, fmt.Errorf("DELTA_MIN_SIZE, DELTA_MAX_SIZE: need 0 <= min <= max")
+	}
+	if deltaMax > math.MaxInt32 {
+		// the block index keeps source offsets as int32
+		return c, fmt.Errorf("DELTA_MAX_SIZE: at most %d", math.MaxInt32)
+	}
+	c.DeltaMinSize, c.DeltaMaxSize = int64(deltaMin), int64(deltaMax)
+	if c.DeltaCacheTTL, err = envDuration("DELTA_CACHE_TTL", 7*24*time.Hour); err != nil {
+		return c, err
+	}
+	if c.DeltaCacheTTL <= 0 {
+		return c, fmt.Errorf("DELTA_CACHE_TTL: must be positive")
+	}
+
+	return c, nil
+}
+
+func envString(key, def string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return def
+}
+
+func envInt(key string, def int) (int, error) {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid integer %q", key, v)
+	}
+	return n, nil
+}
+
+func envFloat(key string, def float64) (float64, error) {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("%s: invalid number %q", key, v)
+	}
+	return f, nil
+}
+
+func envBool(key string, def bool) (bool, error) {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s: invalid boolean %q", key, v)
+	}
+	return b, nil
+}
+
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%s: invalid duration %q", key, v)
+	}
+	return d, nil
+}
+
+// envRateLimit reads "<requests>/<interval>" (e.g. 10/1m) from key and the burst from key_BURST,
+// which defaults to the request count. "off" or 0 requests disables the limit.
+func envRateLimit(key string, def rateLimitConfig) (rateLimitConfig, error) {
+	l := def
+	if v := strings.TrimSpace(os.Getenv(key)); v == "off" || v == "0" {
+		return rateLimitConfig{}, nil
+	} else if v != "" {
+		n, interval, ok := strings.Cut(v, "/")
+		requests, err := strconv.Atoi(strings.TrimSpace(n))
+		if !ok || err != nil || requests < 0 {
+			return l, fmt.Errorf("%s: expected <requests>/<interval> like 10/1m, got %q", key, v)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(interval))
+		if err != nil || d <= 0 {
+			return l, fmt.Errorf("%s: invalid interval %q", key, interval)
+		}
+		l = rateLimitConfig{Requests: requests, Interval: d}
+	}
+	burst, err := envInt(key+"_BURST", l.Burst)
+	if err != nil {
+		return l, err
+	}
+	if burst < 0 {
+		return l, fmt.Errorf("%s_BURST: must not be negative", key)
+	}
+	l.Burst = burst
+	if l.Burst == 0 {
+		l.Burst = l.Requests
+	}
+	return l, nil
+}
+
+// envCIDRList reads a comma separated list of CIDRs or bare IPs
+func envCIDRList(key string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range envList(key, nil) {
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid CIDR %q", key, item)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isHexSHA accepts full or abbreviated (at least 7 digit) commit SHAs
+func isHexSHA(s string) bool {
+	if len(s) < 7 || len(s) > 64 {
+		return false
+	}
+	for _, r := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// envList reads a comma separated list, dropping empty items
+// checkListenAddr validates a host:port to listen on, "" is a listener that's off
+func checkListenAddr(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		if _, err := net.LookupHost(host); err != nil {
+			return fmt.Errorf("unknown host %q", host)
+		}
+	}
+	return nil
+}
+
+func envList(key string, def []string) []string {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
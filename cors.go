@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"net/http"
+)
+
+// corsExposedHeaders are the response headers browser clients get to read cross origin, the
+// checksums and metadata the chunk, file and delta endpoints send along with the bodies
+var corsExposedHeaders = []string{
+	chunkSHA256Header, chunkOmittedHeader, chunkExpiresHeader, chunkEstimatedSizeHeader, contentCommitHeader,
+	deltaSHA256Header, deltaTargetMD5Header, deltaTargetSizeHeader, deltaEndpointHeader,
+	"X-Content-Tree-Hash", "X-Queue-Position", "X-Queue-Wait",
+	"ETag", echo.HeaderContentLength, echo.HeaderContentDisposition, "Content-Range", echo.HeaderRetryAfter,
+}
+
+// corsMiddleware answers preflights and tags responses for the CORS_ALLOWED_ORIGINS, "*" allows
+// any. It runs ahead of routing, so a preflight never reaches the route's rate limiter.
+func corsMiddleware(origins []string) echo.MiddlewareFunc {
+	return middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins:  origins,
+		AllowMethods:  []string{http.MethodGet, http.MethodHead, http.MethodPost},
+		ExposeHeaders: corsExposedHeaders,
+		MaxAge:        int(cfg.CORSMaxAge.Seconds()),
+	})
+}
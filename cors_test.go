@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCORSExposesChunkHeaders(t *testing.T) {
+	useConfig(t)
+	e := echo.New()
+	e.Use(corsMiddleware([]string{"https://patcher.example"}))
+	e.GET("/zip-chunks/:chunkID", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+
+	rec := request(e, http.MethodGet, "/zip-chunks/1-0", "", echo.HeaderOrigin, "https://patcher.example")
+	exposed := strings.Split(rec.Header().Get(echo.HeaderAccessControlExposeHeaders), ",")
+	for _, want := range []string{
+		chunkSHA256Header, chunkOmittedHeader, chunkExpiresHeader, chunkEstimatedSizeHeader, contentCommitHeader,
+	} {
+		found := false
+		for _, h := range exposed {
+			found = found || strings.EqualFold(strings.TrimSpace(h), want)
+		}
+		if !found {
+			t.Errorf("%s isn't exposed: %q", want, exposed)
+		}
+	}
+}
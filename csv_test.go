@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWantsCSV(t *testing.T) {
+	e := echo.New()
+	tests := []struct {
+		target, accept string
+		want           bool
+	}{
+		{"/report", "", false},
+		{"/report", "application/json", false},
+		{"/report?format=csv", "", true},
+		{"/report", "text/csv", true},
+		{"/report", "text/csv;q=0.9, application/json", true},
+		// an explicit format wins over the Accept header
+		{"/report?format=json", "text/csv", false},
+		{"/report?format=CSV", "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		if tt.accept != "" {
+			r.Header.Set(echo.HeaderAccept, tt.accept)
+		}
+		if got := wantsCSV(e.NewContext(r, nil)); got != tt.want {
+			t.Errorf("wantsCSV(%s, Accept %q) = %v, want %v", tt.target, tt.accept, got, tt.want)
+		}
+	}
+}
+
+// csvRecords parses a CSV response body
+func csvRecords(t *testing.T, body string) [][]string {
+	t.Helper()
+	records, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatalf("CSV body %q: %v", body, err)
+	}
+	return records
+}
+
+func TestCSVExport(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 30, 0, 0, time.FixedZone("CEST", 2*60*60))
+	e := echo.New()
+	e.GET("/report", func(c echo.Context) error {
+		out := startCSV(c, "values", "24h", "text", "int", "int64", "float", "bool", "time", "other")
+		out.row("plain", 3, int64(1<<40), 0.25, true, at, time.Minute)
+		out.flush()
+		out.row(`a "quoted", multi`+"\nline value", 0, int64(0), 1e21, false, time.Time{}, nil)
+		return out.close()
+	})
+
+	rec := request(e, http.MethodGet, "/report", "")
+	if ct := rec.Header().Get(echo.HeaderContentType); ct != "text/csv; charset=utf-8" {
+		t.Errorf("Content-Type %q", ct)
+	}
+	if cd := rec.Header().Get(echo.HeaderContentDisposition); cd != `attachment; filename="values-24h.csv"` {
+		t.Errorf("Content-Disposition %q", cd)
+	}
+	want := [][]string{
+		{"text", "int", "int64", "float", "bool", "time", "other"},
+		{"plain", "3", "1099511627776", "0.25", "true", "2024-05-01T10:30:00Z", "1m0s"},
+		{`a "quoted", multi` + "\nline value", "0", "0", "1000000000000000000000", "false", "", "<nil>"},
+	}
+	got := csvRecords(t, rec.Body.String())
+	if !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("CSV records = %q, want %q", got, want)
+	}
+}
+
+func TestReportsExportCSV(t *testing.T) {
+	useUpdateState(t)
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	lastUpdateMu.Lock()
+	updateHistory = []updateResult{
+		{At: at, OK: true, Before: "aaa", Commit: "bbb", Remote: "https://example.com/repo.git"},
+		{At: at.Add(time.Hour), Before: "bbb", Commit: "bbb", Remote: "https://example.com/repo.git", Error: "git pull: exit status 1, \"conflict\""},
+	}
+	lastUpdateMu.Unlock()
+	e := echo.New()
+	e.GET("/admin/reports/updates", handleUpdateReport)
+
+	// rows come newest first, the same as the JSON
+	want := [][]string{
+		{"at", "ok", "before", "commit", "remote", "error"},
+		{"2024-05-01T13:00:00Z", "false", "bbb", "bbb", "https://example.com/repo.git", "git pull: exit status 1, \"conflict\""},
+		{"2024-05-01T12:00:00Z", "true", "aaa", "bbb", "https://example.com/repo.git", ""},
+	}
+	for _, headers := range [][]string{nil, {"Accept", "text/csv"}} {
+		target := "/admin/reports/updates"
+		if headers == nil {
+			target += "?format=csv"
+		}
+		rec := request(e, http.MethodGet, target, "", headers...)
+		if got := csvRecords(t, rec.Body.String()); rec.Code != http.StatusOK || !slices.EqualFunc(got, want, slices.Equal) {
+			t.Errorf("GET %s %v = %d %q, want %q", target, headers, rec.Code, got, want)
+		}
+		if cd := rec.Header().Get(echo.HeaderContentDisposition); cd != `attachment; filename="updates.csv"` {
+			t.Errorf("Content-Disposition %q", cd)
+		}
+	}
+
+	rec := request(e, http.MethodGet, "/admin/reports/updates", "")
+	var res struct {
+		Updates []updateResult `json:"updates"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || len(res.Updates) != 2 || res.Updates[0].OK {
+		t.Errorf("GET /admin/reports/updates without a format = %d %s", rec.Code, rec.Body.String())
+	}
+}
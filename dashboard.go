@@ -0,0 +1,72 @@
+package main
+
+import (
+	_ "embed"
+	"github.com/labstack/echo/v4"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// GET /admin/
+func handleDashboard(c echo.Context) error {
+	return c.HTMLBlob(http.StatusOK, dashboardHTML)
+}
+
+// GET /admin/status is everything the dashboard shows in one call
+func handleAdminStatus(c echo.Context) error {
+	commit, _ := headCommit(cloneDir)
+
+	branches := echo.Map{}
+	for _, t := range branchOrder {
+		branches[t.Ref] = manifestInfo(t)
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"commit":      commit,
+		"pin_commit":  currentPin(),
+		"update":      getLastUpdate(),
+		"pull":        getPullProgress(""),
+		"manifest":    manifestInfo(defaultContent),
+		"branches":    branches,
+		"downloads":   downloads.snapshot(),
+		"builds":      builds.snapshot(),
+		"temp_bytes":  cachedDirSize(chunkTempDir()),
+		"integrity":   integrityStatus(),
+		"breaker":     breaker.status(),
+		"streams":     streamsSnapshot(),
+		"maintenance": getMaintenance(),
+		"news":        newsInfo(defaultContent),
+	})
+}
+
+// newsInfo is the news feed the tree serves at /news, nil without one
+func newsInfo(t *contentTree) echo.Map {
+	newsFeedsMu.Lock()
+	feed := newsFeeds[t]
+	newsFeedsMu.Unlock()
+	if feed == nil {
+		return nil
+	}
+	return echo.Map{"file": cfg.NewsFile, "commit": feed.Commit, "content_type": feed.ContentType, "bytes": len(feed.Body)}
+}
+
+// dirSize sums the sizes of the regular files under dir
+func dirSize(dir string) int64 {
+	var total int64
+	_ = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
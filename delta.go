@@ -0,0 +1,608 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/labstack/echo/v4"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A delta turns the blob a file had at one commit into the blob it has at another. The format is
+// the magic "EQDELTA1" followed by a zstd stream of uvarint source and target sizes and then
+// operations until 'E':
+//
+//	'C' uvarint offset, uvarint length   copy length bytes of the source from offset
+//	'A' uvarint length, the bytes        append literal bytes
+//	'E'                                  end, the output has the target size
+//
+// Copies are found by matching blocks of the source against every offset of the target with a
+// rolling checksum and extending each match as far as the bytes agree in both directions, so an
+// insertion only costs its own bytes. What isn't matched compresses in the zstd stream. Clients
+// decode it with applyDelta, or the apply-delta command of this binary.
+const (
+	deltaMagic     = "EQDELTA1"
+	deltaBlockSize = 2048
+	deltaMaxProbes = 8 // candidate blocks compared per checksum hit, zeroed regions all collide
+)
+
+const (
+	deltaSHA256Header     = "X-Delta-SHA256"
+	deltaTargetMD5Header  = "X-Delta-Target-MD5"
+	deltaTargetSizeHeader = "X-Delta-Target-Size"
+	deltaEndpointHeader   = "X-Delta-Endpoint" // on manifest responses
+)
+
+// deltaInfo is kept next to a cached delta
+type deltaInfo struct {
+	SHA256     string `json:"sha256"` // of the delta itself
+	TargetMD5  string `json:"target_md5"`
+	TargetSize int64  `json:"target_size"`
+	SourceSize int64  `json:"source_size"`
+}
+
+// deltaDir holds the cached deltas, named by the source and target blob so a file that changed the
+// same way under other commits shares them
+func deltaDir() string {
+	return filepath.Join(chunkTempDir(), "deltas")
+}
+
+// deltaBuilds are the deltas being built, by name, every request for one waits on its build.
+// deltaSlot allows one build at a time, both blobs are held in memory while it runs, and the build
+// takes a slot of the build scheduler like a chunk of their size would.
+var (
+	deltaBuildsMu sync.Mutex
+	deltaBuilds   = make(map[string]*deltaBuild)
+	deltaSlot     = make(chan struct{}, 1)
+)
+
+type deltaBuild struct {
+	done chan struct{}
+	info deltaInfo
+	err  error
+}
+
+// errDeltaTooLarge refuses blobs above DELTA_MAX_SIZE, the client downloads those in full
+var errDeltaTooLarge = errors.New("file is too large for a delta")
+
+// GET /delta?file=<path>&from=<sha>&to=<sha>&ref=<branch> returns the delta from the file at one
+// commit to the file at another, to defaults to the served commit. 404 when the file doesn't exist
+// at either, the client then downloads it in full.
+func handleDelta(c echo.Context) error {
+	t, err := contentFor(c)
+	if err != nil {
+		return err
+	}
+	rel, _, err := resolveRepoPath(t.Dir, c.QueryParam("file"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid file")
+	}
+	// only what the manifest serves, tracked files it leaves out stay out
+	if _, ok := t.manifestEntryFor(rel); !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "File not found")
+	}
+	from, to := c.QueryParam("from"), c.QueryParam("to")
+	if to == "" {
+		if m := t.getManifest(); m != nil {
+			to = m.Commit
+		}
+	}
+	if !isHexSHA(from) || !isHexSHA(to) {
+		return echo.NewHTTPError(http.StatusBadRequest, "from and to must be commit SHAs")
+	}
+	fromBlob, err := blobAt(t.Dir, from, rel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("File does not exist at %s", from))
+	}
+	toBlob, err := blobAt(t.Dir, to, rel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("File does not exist at %s", to))
+	}
+
+	name := fromBlob + "-" + toBlob
+	info, err := cachedDelta(c.Request().Context(), t.Dir, name, fromBlob, toBlob)
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		// the client went away, the build goes on for whoever asks next
+		return err
+	}
+	if errors.Is(err, errDeltaTooLarge) {
+		return echo.NewHTTPError(http.StatusNotFound, "File is too large for a delta, download it in full")
+	}
+	if errors.Is(err, errBuildQueueTimeout) || errors.Is(err, errBuildQueueFull) {
+		c.Response().Header().Set("Retry-After", "30")
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Build queue is full, try again later")
+	}
+	if err != nil {
+		slog.Error("Error building delta", "file", rel, "from", from, "to", to, "err", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to build the delta")
+	}
+
+	deltaPath := filepath.Join(deltaDir(), name+".delta")
+	f, err := os.Open(deltaPath)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Delta is no longer available, try again")
+	}
+	defer f.Close()
+	// the cache expires by last use
+	now := time.Now()
+	_ = os.Chtimes(deltaPath, now, now)
+
+	res := c.Response()
+	res.Header().Set("ETag", `"`+name+`"`)
+	res.Header().Set(deltaSHA256Header, info.SHA256)
+	res.Header().Set(deltaTargetMD5Header, info.TargetMD5)
+	res.Header().Set(deltaTargetSizeHeader, strconv.FormatInt(info.TargetSize, 10))
+	res.Header().Set(echo.HeaderContentType, echo.MIMEOctetStream)
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", path.Base(rel)+".delta"))
+	http.ServeContent(res, c.Request(), "", time.Time{}, f)
+	return nil
+}
+
+// blobAt returns the blob the file has at commit
+func blobAt(dir, commit, rel string) (string, error) {
+	return gitOutput("-C", dir, "rev-parse", "--verify", "--quiet", commit+"^{commit}:"+rel)
+}
+
+// cachedDelta returns the info of the named delta, building it first if it isn't cached. The
+// build runs on its own, a request waits for it until ctx is done and the build carries on for
+// the others waiting and the cache.
+func cachedDelta(ctx context.Context, dir, name, fromBlob, toBlob string) (deltaInfo, error) {
+	if info, err := readDeltaInfo(name); err == nil {
+		return info, nil
+	}
+
+	deltaBuildsMu.Lock()
+	b, ok := deltaBuilds[name]
+	if !ok {
+		b = &deltaBuild{done: make(chan struct{})}
+		deltaBuilds[name] = b
+		go b.run(dir, name, fromBlob, toBlob)
+	}
+	deltaBuildsMu.Unlock()
+
+	select {
+	case <-b.done:
+		return b.info, b.err
+	case <-ctx.Done():
+		return deltaInfo{}, ctx.Err()
+	}
+}
+
+// run builds the delta once deltaSlot has room, then lets the waiters have it
+func (b *deltaBuild) run(dir, name, fromBlob, toBlob string) {
+	deltaSlot <- struct{}{}
+	start := time.Now()
+	b.info, b.err = buildDelta(dir, name, fromBlob, toBlob)
+	<-deltaSlot
+	if b.err == nil {
+		slog.Info("Delta built", "name", name, "source_size", b.info.SourceSize, "target_size", b.info.TargetSize, "duration", time.Since(start))
+	}
+
+	deltaBuildsMu.Lock()
+	delete(deltaBuilds, name)
+	deltaBuildsMu.Unlock()
+	close(b.done)
+}
+
+func readDeltaInfo(name string) (deltaInfo, error) {
+	var info deltaInfo
+	if _, err := os.Stat(filepath.Join(deltaDir(), name+".delta")); err != nil {
+		return info, err
+	}
+	data, err := os.ReadFile(filepath.Join(deltaDir(), name+".json"))
+	if err != nil {
+		return info, err
+	}
+	return info, json.Unmarshal(data, &info)
+}
+
+// buildDelta writes the delta and its info to the cache. The info goes first and the delta is
+// renamed into place last, a delta on disk always has its info.
+func buildDelta(dir, name, fromBlob, toBlob string) (deltaInfo, error) {
+	var info deltaInfo
+	sourceSize, err := blobSize(dir, fromBlob)
+	if err != nil {
+		return info, err
+	}
+	targetSize, err := blobSize(dir, toBlob)
+	if err != nil {
+		return info, err
+	}
+	// waiters for the same delta share this build, no one request's context decides it
+	release, err := builds.acquire(context.Background(), sourceSize+targetSize, cfg.BuildQueueTimeout)
+	if err != nil {
+		return info, err
+	}
+	defer release()
+	source, err := readBlob(dir, fromBlob, sourceSize)
+	if err != nil {
+		return info, err
+	}
+	target, err := readBlob(dir, toBlob, targetSize)
+	if err != nil {
+		return info, err
+	}
+	if err := os.MkdirAll(deltaDir(), 0o755); err != nil {
+		return info, err
+	}
+	tmp, err := os.CreateTemp(deltaDir(), name+".*.tmp")
+	if err != nil {
+		return info, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	sum := sha256.New()
+	if err := writeDelta(io.MultiWriter(tmp, sum), source, target); err != nil {
+		return info, err
+	}
+	if err := tmp.Close(); err != nil {
+		return info, err
+	}
+	targetMD5 := md5.Sum(target)
+	info = deltaInfo{
+		SHA256:     hex.EncodeToString(sum.Sum(nil)),
+		TargetMD5:  hex.EncodeToString(targetMD5[:]),
+		TargetSize: int64(len(target)),
+		SourceSize: int64(len(source)),
+	}
+	data, _ := json.Marshal(info)
+	if err := os.WriteFile(filepath.Join(deltaDir(), name+".json"), data, 0o644); err != nil {
+		return info, err
+	}
+	return info, os.Rename(tmp.Name(), filepath.Join(deltaDir(), name+".delta"))
+}
+
+// blobSize is the size of a blob of the repo, errDeltaTooLarge above DELTA_MAX_SIZE
+func blobSize(dir, blob string) (int64, error) {
+	size, err := gitOutput("-C", dir, "cat-file", "-s", blob)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n > cfg.DeltaMaxSize {
+		return 0, errDeltaTooLarge
+	}
+	return n, nil
+}
+
+// readBlob loads a blob of the repo into a buffer of exactly its size
+func readBlob(dir, blob string, size int64) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, size))
+	if err := runGit(out, nil, "-C", dir, "cat-file", "blob", blob); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// writeDelta encodes target against source, see the format at the top of the file
+func writeDelta(w io.Writer, source, target []byte) error {
+	if _, err := io.WriteString(w, deltaMagic); err != nil {
+		return err
+	}
+	zw, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(zw)
+	var scratch [binary.MaxVarintLen64]byte
+	uvarint := func(v int) {
+		out.Write(scratch[:binary.PutUvarint(scratch[:], uint64(v))])
+	}
+	uvarint(len(source))
+	uvarint(len(target))
+
+	blocks := make(map[uint32][]int32, len(source)/deltaBlockSize+1)
+	for i := 0; i+deltaBlockSize <= len(source); i += deltaBlockSize {
+		sum := newRollingSum(source[i : i+deltaBlockSize]).sum()
+		blocks[sum] = append(blocks[sum], int32(i))
+	}
+
+	literal := 0 // start of the target bytes not yet written
+	flushLiteral := func(end int) {
+		if end > literal {
+			out.WriteByte('A')
+			uvarint(end - literal)
+			out.Write(target[literal:end])
+		}
+	}
+
+	pos := 0
+	var roll rollingSum
+	if len(target) >= deltaBlockSize {
+		roll = newRollingSum(target[:deltaBlockSize])
+	}
+	for pos+deltaBlockSize <= len(target) {
+		match := -1
+		for i, candidate := range blocks[roll.sum()] {
+			if i == deltaMaxProbes {
+				break
+			}
+			if bytes.Equal(source[candidate:int(candidate)+deltaBlockSize], target[pos:pos+deltaBlockSize]) {
+				match = int(candidate)
+				break
+			}
+		}
+		if match < 0 {
+			if pos+deltaBlockSize < len(target) {
+				roll.roll(target[pos], target[pos+deltaBlockSize])
+			}
+			pos++
+			continue
+		}
+
+		// grow the block back into the pending literal and forward as far as both agree
+		start, from := pos, match
+		for start > literal && from > 0 && source[from-1] == target[start-1] {
+			start--
+			from--
+		}
+		end, sourceEnd := pos+deltaBlockSize, match+deltaBlockSize
+		for end < len(target) && sourceEnd < len(source) && source[sourceEnd] == target[end] {
+			end++
+			sourceEnd++
+		}
+		flushLiteral(start)
+		out.WriteByte('C')
+		uvarint(from)
+		uvarint(end - start)
+		literal, pos = end, end
+		if pos+deltaBlockSize <= len(target) {
+			roll = newRollingSum(target[pos : pos+deltaBlockSize])
+		}
+	}
+	flushLiteral(len(target))
+	out.WriteByte('E')
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// errInvalidDelta is a delta that doesn't decode against the source it was given
+var errInvalidDelta = errors.New("invalid delta")
+
+// applyDelta decodes a delta against source, the file as it was at the delta's from commit, and
+// writes the file as it is at to. The sizes in the delta are checked against both ends, a delta
+// for another source or one cut short fails instead of writing something else.
+func applyDelta(w io.Writer, source io.ReaderAt, sourceSize int64, delta io.Reader) error {
+	magic := make([]byte, len(deltaMagic))
+	if _, err := io.ReadFull(delta, magic); err != nil || string(magic) != deltaMagic {
+		return fmt.Errorf("%w: not an %s stream", errInvalidDelta, deltaMagic)
+	}
+	zr, err := zstd.NewReader(delta, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	in := bufio.NewReader(zr)
+	uvarint := func() (int64, error) {
+		v, err := binary.ReadUvarint(in)
+		if err != nil || v > math.MaxInt64 {
+			return 0, fmt.Errorf("%w: truncated", errInvalidDelta)
+		}
+		return int64(v), nil
+	}
+
+	wantSource, err := uvarint()
+	if err != nil {
+		return err
+	}
+	if wantSource != sourceSize {
+		return fmt.Errorf("%w: made for a source of %d bytes, not %d", errInvalidDelta, wantSource, sourceSize)
+	}
+	targetSize, err := uvarint()
+	if err != nil {
+		return err
+	}
+	var written int64
+	for {
+		op, err := in.ReadByte()
+		if err != nil {
+			return fmt.Errorf("%w: truncated", errInvalidDelta)
+		}
+		var n int64
+		switch op {
+		case 'C':
+			offset, err := uvarint()
+			if err != nil {
+				return err
+			}
+			length, err := uvarint()
+			if err != nil {
+				return err
+			}
+			if offset > sourceSize || length > sourceSize-offset {
+				return fmt.Errorf("%w: copy of %d bytes at %d is outside the source", errInvalidDelta, length, offset)
+			}
+			n, err = io.Copy(w, io.NewSectionReader(source, offset, length))
+			if err != nil {
+				return err
+			}
+		case 'A':
+			length, err := uvarint()
+			if err != nil {
+				return err
+			}
+			if n, err = io.CopyN(w, in, length); err != nil {
+				if errors.Is(err, io.EOF) {
+					return fmt.Errorf("%w: truncated", errInvalidDelta)
+				}
+				return err
+			}
+		case 'E':
+			if written != targetSize {
+				return fmt.Errorf("%w: wrote %d bytes of %d", errInvalidDelta, written, targetSize)
+			}
+			return nil
+		default:
+			return fmt.Errorf("%w: unknown operation %q", errInvalidDelta, op)
+		}
+		if written += n; written > targetSize {
+			return fmt.Errorf("%w: more than the %d bytes of the target", errInvalidDelta, targetSize)
+		}
+	}
+}
+
+// runApplyDelta is the apply-delta command, for clients that don't ship their own decoder:
+// apply-delta <source> <delta> <output> [--md5 <X-Delta-Target-MD5>]
+func runApplyDelta(args []string) error {
+	var files []string
+	var wantMD5 string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--md5" && i+1 < len(args) {
+			wantMD5 = strings.ToLower(args[i+1])
+			i++
+			continue
+		}
+		files = append(files, args[i])
+	}
+	if len(files) != 3 {
+		return errors.New("usage: apply-delta <source> <delta> <output> [--md5 <target md5>]")
+	}
+	source, err := os.Open(files[0])
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	delta, err := os.Open(files[1])
+	if err != nil {
+		return err
+	}
+	defer delta.Close()
+
+	// through a temp file, the output can be the source itself
+	out, err := os.CreateTemp(filepath.Dir(files[2]), filepath.Base(files[2])+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	sum := md5.New()
+	if err := applyDelta(io.MultiWriter(out, sum), source, info.Size(), bufio.NewReader(delta)); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	got := hex.EncodeToString(sum.Sum(nil))
+	if wantMD5 != "" && got != wantMD5 {
+		return fmt.Errorf("output md5 is %s, expected %s", got, wantMD5)
+	}
+	if err := os.Rename(out.Name(), files[2]); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s (md5 %s)\n", files[2], got)
+	return nil
+}
+
+// rollingSum is rsync's weak checksum over a deltaBlockSize window
+type rollingSum struct {
+	a, b uint32
+}
+
+func newRollingSum(window []byte) rollingSum {
+	var r rollingSum
+	for i, c := range window {
+		r.a += uint32(c)
+		r.b += uint32(len(window)-i) * uint32(c)
+	}
+	return r
+}
+
+// roll slides the window one byte, out leaves it and in enters it
+func (r *rollingSum) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - deltaBlockSize*uint32(out)
+}
+
+func (r rollingSum) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+// deltaURL is where the delta of a changed file from a client's commit to the served one is, ""
+// when the file didn't exist at from. blobs are the file blobs at from, as listed by fromBlobs.
+func deltaURL(t *contentTree, m *manifest, rel, from string, blobs map[string]string) string {
+	if _, ok := blobs[rel]; !ok {
+		return ""
+	}
+	q := url.Values{"file": {rel}, "from": {from}, "to": {m.Commit}}
+	if t.Ref != "" {
+		q.Set("ref", t.Ref)
+	}
+	return t.urlPrefix() + "/delta?" + q.Encode()
+}
+
+// fromBlobs lists the file blobs of the commit a client is on, nil if it isn't in the repo
+func fromBlobs(t *contentTree, commit string) map[string]string {
+	if !isHexSHA(commit) {
+		return nil
+	}
+	var out bytes.Buffer
+	if err := runGit(&out, nil, "-C", t.Dir, "ls-tree", "-r", "-z", "--full-tree", commit+"^{commit}"); err != nil {
+		return nil
+	}
+	blobs := make(map[string]string)
+	for _, line := range strings.Split(out.String(), "\x00") {
+		// <mode> SP <type> SP <object> TAB <path>
+		meta, p, ok := strings.Cut(line, "\t")
+		fields := strings.Fields(meta)
+		if ok && len(fields) == 3 && fields[1] == "blob" {
+			blobs[p] = fields[2]
+		}
+	}
+	return blobs
+}
+
+// sweepDeltas removes cached deltas that haven't been served for DELTA_CACHE_TTL, and builds
+// that were cut short
+func sweepDeltas(now time.Time) {
+	entries, err := os.ReadDir(deltaDir())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Error during delta cleanup", "dir", deltaDir(), "err", err)
+		}
+		return
+	}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".delta")
+		if !ok {
+			if strings.HasSuffix(e.Name(), ".tmp") {
+				if info, err := e.Info(); err == nil && now.Sub(info.ModTime()) > time.Hour {
+					_ = os.Remove(filepath.Join(deltaDir(), e.Name()))
+				}
+			}
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || now.Sub(info.ModTime()) <= cfg.DeltaCacheTTL {
+			continue
+		}
+		slog.Debug("Removing old delta", "name", name)
+		_ = os.Remove(filepath.Join(deltaDir(), e.Name()))
+		_ = os.Remove(filepath.Join(deltaDir(), name+".json"))
+	}
+}
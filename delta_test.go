@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/labstack/echo/v4"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func deltaRoundTrip(t *testing.T, source, target []byte) []byte {
+	t.Helper()
+	var delta bytes.Buffer
+	if err := writeDelta(&delta, source, target); err != nil {
+		t.Fatalf("writeDelta: %v", err)
+	}
+	var out bytes.Buffer
+	if err := applyDelta(&out, bytes.NewReader(source), int64(len(source)), bytes.NewReader(delta.Bytes())); err != nil {
+		t.Fatalf("applyDelta: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), target) {
+		t.Fatalf("applied delta gives %d bytes that differ from the %d byte target", out.Len(), len(target))
+	}
+	return delta.Bytes()
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rng.Read(b)
+		return b
+	}
+	source := random(1 << 20)
+
+	edited := append([]byte{}, source...)
+	copy(edited[300000:], random(5000))                                                    // changed in place
+	edited = append(edited[:600000], append(random(777), edited[600000:]...)...)           // inserted
+	edited = append(edited[:800000], edited[812345:]...)                                   // removed
+	edited = append(append(append([]byte{}, edited[900000:]...), edited[:100000]...), 'x') // moved
+
+	tests := []struct {
+		name           string
+		source, target []byte
+	}{
+		{"identical", source, source},
+		{"edited", source, edited},
+		{"unrelated", source, random(100000)},
+		{"empty source", nil, random(5000)},
+		{"empty target", source, nil},
+		{"both empty", nil, nil},
+		{"shorter than a block", source[:100], source[50:90]},
+		{"zeroes", make([]byte, 1<<18), append(make([]byte, 1<<18), 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deltaRoundTrip(t, tt.source, tt.target)
+		})
+	}
+
+	if delta := deltaRoundTrip(t, source, edited); len(delta) > 20000 {
+		t.Errorf("delta of a few edits is %d bytes", len(delta))
+	}
+}
+
+func TestApplyDeltaRejects(t *testing.T) {
+	source := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	target := append(append([]byte{}, source[4000:]...), "tail"...)
+	var delta bytes.Buffer
+	if err := writeDelta(&delta, source, target); err != nil {
+		t.Fatal(err)
+	}
+	valid := delta.Bytes()
+
+	// a hand written delta copying past the end of its 2000 byte source
+	var outside bytes.Buffer
+	outside.WriteString(deltaMagic)
+	zw, _ := zstd.NewWriter(&outside)
+	uvarints := func(vs ...uint64) {
+		for _, v := range vs {
+			zw.Write(binary.AppendUvarint(nil, v))
+		}
+	}
+	uvarints(2000, 10)
+	zw.Write([]byte{'C'})
+	uvarints(1995, 10)
+	zw.Write([]byte{'E'})
+	zw.Close()
+
+	tests := []struct {
+		name   string
+		source []byte
+		delta  []byte
+	}{
+		{"other source", source[:len(source)-1], valid},
+		{"truncated", source, valid[:len(valid)-4]},
+		{"bad magic", source, append([]byte("EQDELTA0"), valid[len(deltaMagic):]...)},
+		{"copy past the source", source[:2000], outside.Bytes()},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if err := applyDelta(&out, bytes.NewReader(tt.source), int64(len(tt.source)), bytes.NewReader(tt.delta)); !errors.Is(err, errInvalidDelta) {
+			t.Errorf("%s: applyDelta = %v, want errInvalidDelta", tt.name, err)
+		}
+	}
+}
+
+func TestDeltaMaxSizeFitsOffsets(t *testing.T) {
+	t.Setenv("DELTA_MAX_SIZE", "3000000000")
+	if _, err := loadConfig(); err == nil {
+		t.Error("loadConfig accepted a DELTA_MAX_SIZE past int32 offsets")
+	}
+}
+
+func TestRunApplyDelta(t *testing.T) {
+	dir := t.TempDir()
+	source := bytes.Repeat([]byte("patch day "), 1000)
+	target := append(append([]byte{}, source[:5000]...), "new spells"...)
+	var delta bytes.Buffer
+	if err := writeDelta(&delta, source, target); err != nil {
+		t.Fatal(err)
+	}
+	sum := md5.Sum(target)
+	writeTree(t, dir, map[string]string{"spells.txt": string(source), "spells.delta": delta.String()})
+	src, dlt := filepath.Join(dir, "spells.txt"), filepath.Join(dir, "spells.delta")
+
+	if err := runApplyDelta([]string{src, dlt, src, "--md5", "00" + hex.EncodeToString(sum[1:])}); err == nil {
+		t.Error("apply-delta accepted the wrong md5")
+	}
+	if data, _ := os.ReadFile(src); !bytes.Equal(data, source) {
+		t.Fatal("a failed apply-delta changed the source")
+	}
+	// in place, the way a patcher updates a file
+	if err := runApplyDelta([]string{src, dlt, src, "--md5", hex.EncodeToString(sum[:])}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(src); !bytes.Equal(data, target) {
+		t.Error("apply-delta didn't write the target")
+	}
+}
+
+func TestHandleDelta(t *testing.T) {
+	useConfig(t, "TMPDIR", t.TempDir(), "DELTA_MIN_SIZE", "0", "DELTA_MAX_SIZE", "100000", "EXCLUDE_PATTERNS", "*.psd")
+	random := func(n int) string {
+		b := make([]byte, n)
+		rand.Read(b)
+		return hex.EncodeToString(b)
+	}
+	base := random(20000)
+	source := gitFixture(t)
+	from := commitFiles(t, source, map[string]string{"maps/a.txt": base, "maps/b.txt": "b", "big.txt": random(60000), "art.psd": "v1"})
+	target := base[:10000] + "inserted" + base[10000:]
+	to := commitFiles(t, source, map[string]string{"maps/a.txt": target, "maps/b.txt": "b changed", "big.txt": random(60000), "art.psd": "v2"})
+	previous := defaultContent
+	defaultContent = newContentTree("", source)
+	t.Cleanup(func() { defaultContent = previous })
+	defaultContent.rebuildManifest()
+
+	e := echo.New()
+	e.GET("/delta", handleDelta)
+	statuses := map[string]int{
+		"/delta?file=art.psd&from=" + from:                       http.StatusNotFound, // not in the manifest
+		"/delta?file=nowhere.txt&from=" + from:                   http.StatusNotFound,
+		"/delta?file=big.txt&from=" + from:                       http.StatusNotFound, // over DELTA_MAX_SIZE
+		"/delta?file=maps/a.txt&from=" + from[:6]:                http.StatusBadRequest,
+		"/delta?file=maps/a.txt&from=" + from + "&to=nothex!":    http.StatusBadRequest,
+		"/delta?file=maps/a.txt&from=" + strings.Repeat("0", 40): http.StatusNotFound,
+	}
+	for target, want := range statuses {
+		if rec := request(e, http.MethodGet, target, ""); rec.Code != want {
+			t.Errorf("GET %s = %d %s, want %d", target, rec.Code, rec.Body.String(), want)
+		}
+	}
+
+	fromBlob, _ := blobAt(source, from, "maps/a.txt")
+	toBlob, _ := blobAt(source, to, "maps/a.txt")
+	check := func(rec *httptest.ResponseRecorder) {
+		t.Helper()
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET the delta = %d %s", rec.Code, rec.Body.String())
+		}
+		h := rec.Header()
+		deltaSum := sha256.Sum256(rec.Body.Bytes())
+		targetSum := md5.Sum([]byte(target))
+		if h.Get("ETag") != `"`+fromBlob+"-"+toBlob+`"` || h.Get(deltaSHA256Header) != hex.EncodeToString(deltaSum[:]) ||
+			h.Get(deltaTargetMD5Header) != hex.EncodeToString(targetSum[:]) || h.Get(deltaTargetSizeHeader) != strconv.Itoa(len(target)) {
+			t.Errorf("delta headers = %v", h)
+		}
+		var out bytes.Buffer
+		if err := applyDelta(&out, strings.NewReader(base), int64(len(base)), rec.Body); err != nil || out.String() != target {
+			t.Errorf("applying the delta = %v, %d bytes", err, out.Len())
+		}
+	}
+	url := "/delta?file=maps/a.txt&from=" + from
+	check(request(e, http.MethodGet, url, ""))
+	if rec := request(e, http.MethodGet, url, "", "If-None-Match", `"`+fromBlob+"-"+toBlob+`"`); rec.Code != http.StatusNotModified {
+		t.Errorf("GET with the ETag = %d, want 304", rec.Code)
+	}
+
+	// with no build able to run, the second request is served from the cache
+	deltaSlot <- struct{}{}
+	check(request(e, http.MethodGet, url+"&to="+to, ""))
+
+	// a client that goes away while its delta waits for the build slot isn't held there
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, "/delta?file=maps/b.txt&from="+from, nil).WithContext(ctx)
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		done <- rec
+	}()
+	select {
+	case rec := <-done:
+		if rec.Code == http.StatusOK {
+			t.Error("delta served without a build slot")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request stayed blocked behind the build slot after its client left")
+	}
+	// the build goes on once the slot frees, for whoever asks next
+	<-deltaSlot
+	fromB, _ := blobAt(source, from, "maps/b.txt")
+	toB, _ := blobAt(source, to, "maps/b.txt")
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := readDeltaInfo(fromB + "-" + toB); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the abandoned delta was never built")
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// deletedPaths caches, per tree, the paths deleted anywhere in the history of the commit it
+// was listed for
+var deletedPaths = struct {
+	sync.Mutex
+	byTree map[*contentTree]deletedPathList
+}{byTree: make(map[*contentTree]deletedPathList)}
+
+type deletedPathList struct {
+	commit string
+	paths  map[string]bool
+}
+
+// POST /diff?algo=md5&commit=<sha>&ref=<branch> {"<path>": "<hash>", ...} compares the client's
+// files with the manifest in one round trip: what to download, what was deleted upstream, what
+// matches, and "not_tracked" for paths the repo has never had, like the client's own settings.
+// With the commit the client is on, downloads that have a delta from it link to it.
+func handleDiff(c echo.Context) error {
+	var local map[string]string
+	if err := c.Bind(&local); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid JSON payload, expected an object of path to hash")
+	}
+	algo := c.QueryParam("algo")
+	if algo == "" {
+		algo = "md5"
+	}
+	digest, ok := manifestAlgorithms[algo]
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown algo, expected md5, sha256, xxh3 or xxh64")
+	}
+	t, err := contentFor(c)
+	if err != nil {
+		return err
+	}
+	m := t.getManifest()
+	if m == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Manifest is still being built")
+	}
+
+	// client paths in repo form, Windows clients send backslashes
+	have := make(map[string]string, len(local))
+	download, remove, match, untracked := []syncFile{}, []string{}, []string{}, []string{}
+	var deleted map[string]bool
+	for p, hash := range local {
+		rel, _, err := resolveRepoPath(t.Dir, p)
+		if err != nil {
+			untracked = append(untracked, p)
+			continue
+		}
+		if _, ok := m.Files[rel]; ok {
+			have[rel] = hash
+			continue
+		}
+		if deleted == nil {
+			deleted = t.deletedPaths(m.Commit)
+		}
+		if deleted[rel] {
+			remove = append(remove, p)
+		} else {
+			untracked = append(untracked, p)
+		}
+	}
+	for rel, entry := range m.Files {
+		if hash, ok := have[rel]; ok && strings.EqualFold(hash, digest(entry)) {
+			match = append(match, rel)
+			continue
+		}
+		download = append(download, syncFile{Path: rel, Size: entry.Size, Hash: digest(entry), Modified: entry.Modified})
+	}
+	sort.Slice(download, func(i, j int) bool { return download[i].Path < download[j].Path })
+	sort.Strings(remove)
+	sort.Strings(match)
+	sort.Strings(untracked)
+	linkDeltas(c, m, download, c.QueryParam("commit"))
+
+	var downloadBytes int64
+	for _, f := range download {
+		downloadBytes += f.Size
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"commit":         m.Commit,
+		"download":       download,
+		"download_bytes": downloadBytes,
+		"delete":         remove,
+		"match":          match,
+		"not_tracked":    untracked,
+	})
+}
+
+// deletedPaths lists the paths deleted in the history of commit, they're the client files that
+// can go. Listed once per commit, a shallow checkout only knows its own history.
+func (t *contentTree) deletedPaths(commit string) map[string]bool {
+	deletedPaths.Lock()
+	defer deletedPaths.Unlock()
+	if l, ok := deletedPaths.byTree[t]; ok && l.commit == commit {
+		return l.paths
+	}
+	paths := make(map[string]bool)
+	var out bytes.Buffer
+	if err := runGit(&out, nil, "-C", t.Dir, "log", "--format=", "--name-only", "--diff-filter=D", "-z", commit); err == nil {
+		for _, p := range strings.Split(out.String(), "\x00") {
+			if p = strings.TrimSpace(p); p != "" {
+				paths[p] = true
+			}
+		}
+	}
+	deletedPaths.byTree[t] = deletedPathList{commit: commit, paths: paths}
+	return paths
+}
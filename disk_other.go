@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+// diskFree isn't implemented here, callers treat the free space as unknown
+func diskFree(path string) (int64, error) {
+	return 0, errors.New("free disk space is not available on this platform")
+}
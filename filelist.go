@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// filelistName is the file the EQEmu patcher fetches, a committed copy in the repo is shadowed by
+// the generated one and left out of it
+const filelistName = "filelist.yml"
+
+// GET /manifest and /filelist.yml render the default checkout's manifest in the EQEmu patcher
+// format: version, downloadprefix and one downloads entry per file with md5, date and size. It
+// comes from the manifest, so hashes are only recomputed for files that changed in a pull. Under a
+// repo prefix it's that repo's manifest, with the prefix in downloadprefix.
+func handleFilelist(c echo.Context) error {
+	t := defaultContent
+	if r := repoFor(c); r != nil {
+		t = r
+	}
+	m := t.getManifest()
+	if m == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Manifest is still being built")
+	}
+
+	etag := `"` + m.Tree.Hash + `"`
+	c.Response().Header().Set("ETag", etag)
+	c.Response().Header().Set(contentCommitHeader, m.Commit)
+	if inm := c.Request().Header.Get("If-None-Match"); inm != "" && strings.Contains(inm, etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	var b strings.Builder
+	b.WriteString("version: " + yamlString(m.Tree.Hash) + "\n")
+	b.WriteString("downloadprefix: " + yamlString(filelistPrefix(c)+strings.TrimPrefix(t.urlPrefix()+"/", "/")) + "\n")
+	b.WriteString("downloads:\n")
+	for _, rel := range sortedKeys(m.Files) {
+		if rel == filelistName {
+			continue
+		}
+		e := m.Files[rel]
+		b.WriteString("- name: " + yamlString(rel) + "\n")
+		b.WriteString("  md5: " + e.MD5 + "\n")
+		b.WriteString("  date: \"" + e.Modified.UTC().Format("20060102") + "\"\n")
+		b.WriteString("  size: " + strconv.FormatInt(e.Size, 10) + "\n")
+	}
+	return c.Blob(http.StatusOK, "application/yaml; charset=utf-8", []byte(b.String()))
+}
+
+// filelistPrefix is the base URL the patcher appends file names to, the static root of this
+// server as PUBLIC_URL or the request itself names it
+func filelistPrefix(c echo.Context) string {
+	if cfg.PublicURL != "" {
+		return strings.TrimRight(cfg.PublicURL, "/") + "/"
+	}
+	return c.Scheme() + "://" + c.Request().Host + "/"
+}
+
+// yamlString quotes s as a YAML double-quoted scalar, whose escapes are a superset of JSON's
+func yamlString(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var errOutsideRoot = errors.New("path escapes the content root")
+
+// errExcluded is a path EXCLUDE_PATTERNS keeps from being served, it reads as not found
+var errExcluded = fmt.Errorf("path is excluded: %w", fs.ErrNotExist)
+
+// wildcard routes the static middleware must leave alone, it otherwise serves c.Param("*") itself
+var staticSkipPrefixes = []string{"/file/", "/admin/", "/sync/", "/zip-all/"}
+
+func staticSkipper(c echo.Context) bool {
+	if c.Request().URL.Path == "/"+filelistName {
+		return true
+	}
+	for _, prefix := range staticSkipPrefixes {
+		if strings.HasPrefix(c.Request().URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveRepoPath cleans a client supplied path and returns it repo relative (forward slashes)
+// along with the on-disk path, rejecting anything that would resolve outside root
+func resolveRepoPath(root, p string) (string, string, error) {
+	p = strings.ReplaceAll(p, "\\", "/")
+	if strings.HasPrefix(p, "/") || filepath.IsAbs(p) || filepath.VolumeName(p) != "" {
+		return "", "", errOutsideRoot
+	}
+	rel := filepath.ToSlash(filepath.Clean(p))
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", "", errOutsideRoot
+	}
+	return rel, filepath.Join(root, filepath.FromSlash(rel)), nil
+}
+
+// resolveContentFile is resolveRepoPath for files that are about to be read and served: the git
+// metadata isn't reachable and symlinks mustn't lead outside root. A file that doesn't exist is
+// returned with the os error so callers can tell it apart from errOutsideRoot.
+func resolveContentFile(root, p string) (string, string, error) {
+	rel, full, err := resolveRepoPath(root, p)
+	if err != nil {
+		return "", "", err
+	}
+	for _, part := range strings.Split(rel, "/") {
+		if part == ".git" {
+			return "", "", errOutsideRoot
+		}
+	}
+	if isExcluded(rel) || (!cfg.ServeDotfiles && isHiddenPath(rel)) {
+		return rel, full, errExcluded
+	}
+	real, err := filepath.EvalSymlinks(full)
+	if err != nil {
+		return rel, full, err
+	}
+	base, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return rel, full, err
+	}
+	inside, err := filepath.Rel(base, real)
+	if err != nil || inside == ".." || strings.HasPrefix(inside, ".."+string(filepath.Separator)) {
+		return "", "", errOutsideRoot
+	}
+	return rel, full, nil
+}
+
+// isHiddenPath reports whether any segment of a repo relative path is a dotfile or dot directory
+func isHiddenPath(rel string) bool {
+	for _, part := range strings.Split(rel, "/") {
+		if strings.HasPrefix(part, ".") && part != "." {
+			return true
+		}
+	}
+	return false
+}
+
+// servedPath reports whether the static files may show a repo relative path: never anything of
+// .git, dotfiles only with SERVE_DOTFILES, nothing EXCLUDE_PATTERNS matches
+func servedPath(rel string) bool {
+	if rel == "" || rel == "." {
+		return true
+	}
+	for _, part := range strings.Split(rel, "/") {
+		if part == ".git" {
+			return false
+		}
+	}
+	return (cfg.ServeDotfiles || !isHiddenPath(rel)) && !isExcluded(rel)
+}
+
+// servedFS is the checkout as the static middleware sees it, paths servedPath refuses don't exist
+// and are left out of directory listings
+type servedFS struct {
+	http.FileSystem
+}
+
+func (s servedFS) Open(name string) (http.File, error) {
+	rel := strings.Trim(path.Clean("/"+name), "/")
+	if !servedPath(rel) {
+		return nil, os.ErrNotExist
+	}
+	f, err := s.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return servedFile{File: f, rel: rel}, nil
+}
+
+type servedFile struct {
+	http.File
+	rel string
+}
+
+func (f servedFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	kept := infos[:0]
+	for _, info := range infos {
+		if servedPath(path.Join(f.rel, info.Name())) {
+			kept = append(kept, info)
+		}
+	}
+	return kept, err
+}
+
+// isExcluded matches a repo relative path against EXCLUDE_PATTERNS. A pattern without a slash is
+// tried against every segment, one with a slash against the path and each of its parents, so an
+// excluded directory takes everything below it along.
+func isExcluded(rel string) bool {
+	if rel == "" || len(cfg.ExcludePatterns) == 0 {
+		return false
+	}
+	segments := strings.Split(rel, "/")
+	for _, p := range cfg.ExcludePatterns {
+		p = strings.TrimSuffix(p, "/")
+		if !strings.Contains(p, "/") {
+			for _, s := range segments {
+				if ok, _ := path.Match(p, s); ok {
+					return true
+				}
+			}
+			continue
+		}
+		pattern := strings.Split(p, "/")
+		for i := 1; i <= len(segments); i++ {
+			if matchSegments(pattern, segments[:i]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// walkContentDir calls visit with every regular file below the directory rel, repo relative and in
+// lexical order. Hidden files and directories (.git among them) and excluded ones are left out, and
+// symlinks aren't followed. An error from visit stops the walk and is returned.
+func walkContentDir(root, rel string, visit func(rel string, info os.FileInfo) error) error {
+	dir := filepath.Join(root, filepath.FromSlash(rel))
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		sub, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(sub)
+		if rel != "" {
+			name = rel + "/" + name
+		}
+		if strings.HasPrefix(d.Name(), ".") || isExcluded(name) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return visit(name, info)
+	})
+}
+
+// isGlob reports whether an init entry is a pattern rather than a path
+func isGlob(p string) bool {
+	return strings.ContainsAny(p, "*?[")
+}
+
+// globContent calls visit with every file matching a repo relative pattern, in lexical order. "**"
+// matches any number of directories, other segments are path.Match patterns. The walk starts at
+// the pattern's literal directories and leaves out what walkContentDir does.
+func globContent(root, pattern string, visit func(rel string, info os.FileInfo) error) error {
+	segments := strings.Split(pattern, "/")
+	for _, s := range segments {
+		if _, err := path.Match(s, ""); err != nil {
+			return err
+		}
+	}
+	literal := 0
+	for literal < len(segments)-1 && !isGlob(segments[literal]) {
+		literal++
+	}
+	err := walkContentDir(root, strings.Join(segments[:literal], "/"), func(rel string, info os.FileInfo) error {
+		if matchSegments(segments, strings.Split(rel, "/")) {
+			return visit(rel, info)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// fileETag returns the quoted digest of a file in the ?algo= format (md5 by default, like the
+// manifest), and whether the client already has that content: If-None-Match or ?if_hash_not= may
+// carry any digest the manifest advertises. Files changed since the manifest was built get no ETag.
+func fileETag(c echo.Context, t *contentTree, rel string, info os.FileInfo) (string, bool, error) {
+	algo := c.QueryParam("algo")
+	if algo == "" {
+		algo = "md5"
+	}
+	digest, ok := manifestAlgorithms[algo]
+	if !ok {
+		return "", false, echo.NewHTTPError(http.StatusBadRequest, "Unknown algo, expected md5, sha256, xxh3 or xxh64")
+	}
+	entry, ok := t.manifestEntryFor(rel)
+	if !ok || entry.Size != info.Size() || !entry.Modified.Equal(info.ModTime()) {
+		return "", false, nil
+	}
+
+	var have []string
+	if v := c.QueryParam("if_hash_not"); v != "" {
+		have = append(have, v)
+	}
+	for _, tag := range strings.Split(c.Request().Header.Get("If-None-Match"), ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag != "" {
+			have = append(have, strings.Trim(tag, `"`))
+		}
+	}
+	for _, h := range have {
+		for _, d := range manifestAlgorithms {
+			if strings.EqualFold(h, d(entry)) {
+				return `"` + digest(entry) + `"`, true, nil
+			}
+		}
+	}
+	return `"` + digest(entry) + `"`, false, nil
+}
+
+// GET /file/*?ref=<branch>&algo=md5|sha256, conditional on If-None-Match or ?if_hash_not=
+func handleFile(c echo.Context) error {
+	t, err := contentFor(c)
+	if err != nil {
+		return err
+	}
+	p, err := url.PathUnescape(c.Param("*"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid path")
+	}
+	rel, full, err := resolveContentFile(t.Dir, p)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "File not found")
+	}
+	info, err := os.Stat(full)
+	if err != nil || !info.Mode().IsRegular() {
+		return echo.NewHTTPError(http.StatusNotFound, "File not found")
+	}
+
+	etag, unchanged, err := fileETag(c, t, rel, info)
+	if err != nil {
+		return err
+	}
+	if etag != "" {
+		c.Response().Header().Set("ETag", etag)
+	}
+	if unchanged {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	check := newIntegrityCheck(t, rel, info)
+	if check == nil {
+		return c.File(full)
+	}
+
+	// in fail mode the file is verified before a single byte goes out
+	if cfg.IntegrityMode == integrityFail {
+		if err := check.verifyFile(full); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "File failed integrity verification")
+		}
+		return c.File(full)
+	}
+
+	f, err := os.Open(full)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "File not found")
+	}
+	defer f.Close()
+
+	// hash while serving, ranged requests never read the file sequentially so they're not verified
+	content := check.seeker(f)
+	http.ServeContent(c.Response(), c.Request(), info.Name(), info.ModTime(), content)
+	if content.complete(info.Size()) {
+		_ = check.verify()
+	}
+	return nil
+}
+
+// sequentialReadSeeker feeds a hash while the content is read from offset 0 to the end
+type sequentialReadSeeker struct {
+	f      io.ReadSeeker
+	check  *integrityCheck
+	offset int64
+	valid  bool
+}
+
+func (s *sequentialReadSeeker) Read(p []byte) (int, error) {
+	n, err := s.f.Read(p)
+	if s.valid && n > 0 {
+		s.check.write(p[:n])
+	}
+	s.offset += int64(n)
+	return n, err
+}
+
+func (s *sequentialReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := s.f.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	if pos == 0 {
+		s.check.reset()
+		s.valid = true
+	} else if pos != s.offset {
+		s.valid = false
+	}
+	s.offset = pos
+	return pos, nil
+}
+
+func (s *sequentialReadSeeker) complete(size int64) bool {
+	return s.valid && s.check.n == size
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestResolveRepoPath(t *testing.T) {
+	root := t.TempDir()
+	tests := []struct {
+		path string
+		rel  string // "" when the path must be rejected
+	}{
+		{"maps/a.txt", "maps/a.txt"},
+		{"./maps//a.txt", "maps/a.txt"},
+		{"maps\\a.txt", "maps/a.txt"},
+		{"maps/../a.txt", "a.txt"},
+		{"..", ""},
+		{"../.env", ""},
+		{"maps/../../.env", ""},
+		{"..\\..\\.env", ""},
+		{"/etc/passwd", ""},
+		{"\\etc\\passwd", ""},
+		{".", ""},
+		// not decoded here, a name with percent signs in it stays below root
+		{"%2e%2e/.env", "%2e%2e/.env"},
+	}
+	for _, tt := range tests {
+		rel, full, err := resolveRepoPath(root, tt.path)
+		if tt.rel == "" {
+			if !errors.Is(err, errOutsideRoot) {
+				t.Errorf("resolveRepoPath(%q) = %q, %v, want errOutsideRoot", tt.path, rel, err)
+			}
+			continue
+		}
+		if err != nil || rel != tt.rel || full != filepath.Join(root, filepath.FromSlash(tt.rel)) {
+			t.Errorf("resolveRepoPath(%q) = %q, %q, %v, want %q", tt.path, rel, full, err, tt.rel)
+		}
+	}
+}
+
+func TestResolveContentFile(t *testing.T) {
+	useConfig(t, "EXCLUDE_PATTERNS", "tools/,*.psd")
+	base := t.TempDir()
+	root := filepath.Join(base, "content")
+	writeTree(t, base, map[string]string{
+		"secret.txt":             "outside",
+		"content/maps/a.txt":     "a",
+		"content/.git/config":    "[remote]",
+		"content/.gitattributes": "* binary",
+		"content/tools/build.sh": "#!/bin/sh",
+		"content/art/logo.psd":   "psd",
+	})
+	if err := os.Symlink(filepath.Join(base, "secret.txt"), filepath.Join(root, "escape.txt")); err != nil {
+		t.Skipf("symlinks not available: %v", err)
+	}
+	if err := os.Symlink(base, filepath.Join(root, "up")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("maps/a.txt", filepath.Join(root, "inside.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want error // nil when the file is served
+	}{
+		{"maps/a.txt", nil},
+		{"inside.txt", nil},
+		{"escape.txt", errOutsideRoot},
+		{"up/secret.txt", errOutsideRoot},
+		{"../secret.txt", errOutsideRoot},
+		{filepath.Join(base, "secret.txt"), errOutsideRoot},
+		{".git/config", errOutsideRoot},
+		{"maps/../.git/config", errOutsideRoot},
+		{".gitattributes", errExcluded},
+		{"tools/build.sh", errExcluded},
+		{"art/logo.psd", errExcluded},
+		{"maps/missing.txt", fs.ErrNotExist},
+	}
+	for _, tt := range tests {
+		_, _, err := resolveContentFile(root, tt.path)
+		switch {
+		case tt.want == nil && err != nil:
+			t.Errorf("resolveContentFile(%q) = %v, want it served", tt.path, err)
+		case tt.want != nil && !errors.Is(err, tt.want):
+			t.Errorf("resolveContentFile(%q) = %v, want %v", tt.path, err, tt.want)
+		}
+	}
+}
+
+func TestStaticHidesGitAndDotfiles(t *testing.T) {
+	useConfig(t, "EXCLUDE_PATTERNS", "tools/,*.psd")
+	root := useContent(t, map[string]string{
+		".git/config":    "[remote \"origin\"]",
+		".git/HEAD":      "ref: refs/heads/main",
+		".hidden":        "hidden",
+		"maps/.secret":   "hidden",
+		"maps/a.txt":     "a",
+		"tools/build.sh": "#!/bin/sh",
+		"art/logo.psd":   "psd",
+		"readme.txt":     "readme",
+	})
+	e := echo.New()
+	serveStatic(e, root)
+
+	for _, target := range []string{
+		"/.git/config", "/.git/HEAD", "/.git/", "/.git", "/%2egit/config",
+		"/.hidden", "/maps/.secret", "/tools/build.sh", "/tools/", "/art/logo.psd",
+	} {
+		if rec := request(e, http.MethodGet, target, ""); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", target, rec.Code)
+		}
+	}
+	if rec := request(e, http.MethodGet, "/readme.txt", ""); rec.Code != http.StatusOK || rec.Body.String() != "readme" {
+		t.Errorf("GET /readme.txt = %d %q", rec.Code, rec.Body.String())
+	}
+
+	for target, hidden := range map[string][]string{
+		"/":      {".git", ".hidden", "tools"},
+		"/maps/": {".secret"},
+		"/art/":  {"logo.psd"},
+	} {
+		rec := request(e, http.MethodGet, target, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d, want the listing", target, rec.Code)
+		}
+		for _, name := range hidden {
+			if strings.Contains(rec.Body.String(), name) {
+				t.Errorf("listing of %s shows %s", target, name)
+			}
+		}
+	}
+	if rec := request(e, http.MethodGet, "/", ""); !strings.Contains(rec.Body.String(), "readme.txt") {
+		t.Errorf("listing of / leaves out readme.txt: %s", rec.Body.String())
+	}
+}
+
+func TestServeDotfilesKeepsGitHidden(t *testing.T) {
+	useConfig(t, "SERVE_DOTFILES", "true")
+	root := useContent(t, map[string]string{
+		".git/config": "[core]",
+		".hidden":     "hidden",
+	})
+	e := echo.New()
+	serveStatic(e, root)
+	if rec := request(e, http.MethodGet, "/.hidden", ""); rec.Code != http.StatusOK {
+		t.Errorf("GET /.hidden with SERVE_DOTFILES = %d, want 200", rec.Code)
+	}
+	if rec := request(e, http.MethodGet, "/.git/config", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("GET /.git/config with SERVE_DOTFILES = %d, want 404", rec.Code)
+	}
+}
+
+func TestChunkInitSkipsGit(t *testing.T) {
+	useConfig(t, "TMPDIR", t.TempDir())
+	useContent(t, map[string]string{
+		".git/config": "[core]",
+		".env":        "WEBHOOK_KEY=x",
+		"maps/a.txt":  "a",
+	})
+	configureChunkTokens("test-secret", "")
+	e := echo.New()
+	e.POST("/zip-chunks/init", handleChunkInit)
+
+	rec := request(e, http.MethodPost, "/zip-chunks/init", `{"files":[".git/config",".env","maps/a.txt"]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("init = %d %s", rec.Code, rec.Body.String())
+	}
+	var res struct {
+		Chunks []struct {
+			FileCount int `json:"file_count"`
+		} `json:"chunks"`
+		Rejected map[string]string `json:"rejected"`
+		Skipped  map[string]string `json:"skipped"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Chunks) != 1 || res.Chunks[0].FileCount != 1 {
+		t.Errorf("chunks = %+v, want maps/a.txt alone", res.Chunks)
+	}
+	if _, ok := res.Rejected[".git/config"]; !ok {
+		t.Errorf(".git/config isn't rejected: %s", rec.Body.String())
+	}
+	if _, ok := res.Skipped[".env"]; !ok {
+		t.Errorf(".env isn't skipped: %s", rec.Body.String())
+	}
+}
+
+func TestIsExcluded(t *testing.T) {
+	useConfig(t, "EXCLUDE_PATTERNS", "tools/,*.md,docs/**/draft-*,Resources/*.bak")
+	tests := []struct {
+		rel  string
+		want bool
+	}{
+		{"tools", true},
+		{"tools/build.sh", true},
+		{"sub/tools/x", true},
+		{"README.md", true},
+		{"maps/notes.md", true},
+		{"docs/a/b/draft-1.txt", true},
+		{"docs/draft-1.txt", true},
+		{"docs/a/final.txt", false},
+		{"Resources/spells.bak", true},
+		{"Resources/sub/spells.bak", false},
+		{"maps/a.txt", false},
+		{"toolsmith.txt", false},
+	}
+	for _, tt := range tests {
+		if got := isExcluded(tt.rel); got != tt.want {
+			t.Errorf("isExcluded(%q) = %v, want %v", tt.rel, got, tt.want)
+		}
+	}
+}
+
+func TestExcludedFilesAreLeftOutEverywhere(t *testing.T) {
+	useConfig(t, "TMPDIR", t.TempDir(), "EXCLUDE_PATTERNS", "tools/,*.md,docs/**/draft-*")
+	useContent(t, map[string]string{
+		"tools/build.sh":       "#!/bin/sh",
+		"README.md":            "readme",
+		"docs/a/draft-1.txt":   "draft",
+		"docs/a/final.txt":     "final",
+		"maps/a.txt":           "a",
+		"maps/notes/README.md": "readme",
+	})
+	m, _, err := defaultContent.buildManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var served []string
+	for rel := range m.Files {
+		served = append(served, rel)
+	}
+	sort.Strings(served)
+	if want := []string{"docs/a/final.txt", "maps/a.txt"}; !slices.Equal(served, want) {
+		t.Errorf("manifest has %v, want %v", served, want)
+	}
+
+	configureChunkTokens("test-secret", "")
+	e := echo.New()
+	e.POST("/zip-chunks/init", handleChunkInit)
+	rec := request(e, http.MethodPost, "/zip-chunks/init", `{"files":["tools/build.sh","README.md","docs/a/draft-1.txt","maps/a.txt"]}`)
+	var res struct {
+		Skipped map[string]string `json:"skipped"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"tools/build.sh", "README.md", "docs/a/draft-1.txt"} {
+		if res.Skipped[name] != "excluded" {
+			t.Errorf("init skipped[%q] = %q, want excluded", name, res.Skipped[name])
+		}
+	}
+	if _, ok := res.Skipped["maps/a.txt"]; ok {
+		t.Errorf("init skipped maps/a.txt: %s", rec.Body.String())
+	}
+
+	// an init of nothing but excluded files says why it came to nothing
+	rec = request(e, http.MethodPost, "/zip-chunks/init", `{"files":["tools/build.sh","README.md"]}`)
+	res.Skipped = nil
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != http.StatusBadRequest {
+		t.Fatalf("init of excluded files = %d %s, want 400", rec.Code, rec.Body.String())
+	}
+	if res.Skipped["tools/build.sh"] != "excluded" || res.Skipped["README.md"] != "excluded" {
+		t.Errorf("init of excluded files = %s, want both skipped as excluded", rec.Body.String())
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cloneOrPull clones the repository if it doesn't exist, or pulls the latest changes if it does.
+// With a pinned commit it fetches and checks out exactly that commit instead, with REPO_BRANCH it
+// fetches and resets to that branch or tag. With TRUSTED_SIGNERS
+// set, new commits are verified before they're checked out, a failed verification is returned and
+// the checkout stays where it was. Git failures, timeouts included, are returned the same way.
+func cloneOrPull() error {
+	pin := currentPin()
+	_, err := os.Stat(cloneDir)
+	if resume := err == nil && incompleteClone(cloneDir); os.IsNotExist(err) || resume {
+		// Directory doesn't exist or holds a clone a timer cut short, clone the repository
+		slog.Info("Cloning repository", "dir", cloneDir, "repo", redactURL(os.Getenv("REPO_URL")), "resume", resume)
+		args := []string{"clone", "--progress", os.Getenv("REPO_URL"), cloneDir}
+		if cfg.RepoBranch != "" {
+			args = append(args, "--branch", cfg.RepoBranch)
+		}
+		if cfg.CloneDepth > 0 {
+			args = append(args, "--depth", strconv.Itoa(cfg.CloneDepth), "--single-branch")
+		}
+		if cfg.TrustedSigners != nil {
+			// nothing lands in the served directory before it's verified
+			args = append(args, "--no-checkout")
+		}
+		start := time.Now()
+		if resume {
+			err = resumeClone("", cloneDir, cfg.RepoBranch, cfg.CloneDepth, cfg.TrustedSigners == nil)
+		} else {
+			err = runGitTracked("", "clone", args...)
+		}
+		if err != nil {
+			slog.Error("Error cloning repository", "err", err, "duration", time.Since(start))
+			if resumableClone(cloneDir, err) {
+				slog.Warn("Keeping the clone that was cut short, the next update fetches into it", "dir", cloneDir)
+				return err
+			}
+			// a clone that failed by itself leaves a directory that isn't a checkout
+			_ = os.RemoveAll(cloneDir)
+			return err
+		}
+
+		slog.Info("Repository cloned", "duration", time.Since(start), "depth", cfg.CloneDepth)
+		if cfg.CloneDepth > 0 && (pin != "" || len(branchOrder) > 0) {
+			// the single-branch clone has neither the other branches nor an older pin
+			err = fetchOrigin(pin)
+		}
+		switch {
+		case err != nil:
+		case pin != "":
+			err = checkoutPin(pin)
+		case cfg.TrustedSigners != nil:
+			if err = verifyCommit(cloneDir, "HEAD"); err == nil {
+				err = withContentWrite("checkout", func() error {
+					return gitRun("-C", cloneDir, "reset", "--hard", "HEAD")
+				})
+			}
+		}
+		if err != nil && cfg.TrustedSigners != nil {
+			// nothing verified to serve, the next update clones again
+			_ = os.RemoveAll(cloneDir)
+		}
+		return err
+	} else if pin != "" {
+		if err := fetchOrigin(pin); err != nil {
+			slog.Error("Error fetching repository", "err", err)
+			return err
+		}
+		return checkoutPin(pin)
+	} else if cfg.RepoBranch != "" {
+		return trackRepoBranch()
+	} else {
+		// a cleared pin leaves the checkout detached, pull needs the branch back
+		if err := withContentWrite("checkout", checkoutDefaultBranch); err != nil {
+			slog.Error("Error checking out default branch", "err", err)
+			return err
+		}
+		return pull()
+	}
+}
+
+// pull is split in two so builds only wait for the fast-forward, not the network. With
+// TRUSTED_SIGNERS the fetched branch head is verified in between.
+func pull() error {
+	start := time.Now()
+	if err := runGitTracked("", "pull", fetchArgs()...); err != nil {
+		slog.Error("Error pulling repository", "err", err, "duration", time.Since(start))
+		return err
+	}
+	if err := verifyCommit(cloneDir, "@{upstream}"); err != nil {
+		return err
+	}
+	err := withContentWrite("pull", func() error {
+		if isShallow() {
+			// the fetched head's parents aren't there to prove a fast-forward
+			return gitRun("-C", cloneDir, "reset", "--hard", "@{upstream}")
+		}
+		return gitRun("-C", cloneDir, "merge", "--ff-only", "@{upstream}")
+	})
+	if err != nil {
+		slog.Error("Error pulling repository", "err", err, "duration", time.Since(start))
+		return err
+	}
+	slog.Info("Repository updated", "duration", time.Since(start))
+	return nil
+}
+
+// fetchOrigin fetches origin, a shallow checkout also fetches the pinned commit itself since it
+// may be older than the history it holds
+func fetchOrigin(pin string) error {
+	if err := runGitTracked("", "fetch", fetchArgs()...); err != nil {
+		return err
+	}
+	if pin != "" && isShallow() && isHexSHA(pin) && len(pin) == 40 {
+		if _, err := resolveCommit(cloneDir, pin); err != nil {
+			return runGitTracked("", "fetch", append(fetchArgs(), pin)...)
+		}
+	}
+	return nil
+}
+
+// fetchArgs fetches origin at CLONE_DEPTH when the checkout is shallow. The branches a shallow
+// clone fetches are limited to the followed one, the BRANCHES worktrees and REPO_BRANCH are
+// added to them first.
+func fetchArgs(extra ...string) []string {
+	args := []string{"-C", cloneDir, "fetch", "--progress"}
+	if isShallow() {
+		trackShallowBranches()
+		args = append(args, "--depth", strconv.Itoa(max(cfg.CloneDepth, 1)))
+	}
+	args = append(args, extra...)
+	return append(args, "origin")
+}
+
+// isShallow reports whether the default checkout is a shallow clone
+func isShallow() bool {
+	out, err := gitOutput("-C", cloneDir, "rev-parse", "--is-shallow-repository")
+	return err == nil && out == "true"
+}
+
+// trackShallowBranches adds the branches that are served but missing from a single-branch
+// clone's fetch refspecs
+func trackShallowBranches() {
+	out, _ := gitOutput("-C", cloneDir, "config", "--get-all", "remote.origin.fetch")
+	if strings.Contains(out, "refs/heads/*:") {
+		return
+	}
+	wanted := []string{}
+	if cfg.RepoBranch != "" {
+		wanted = append(wanted, cfg.RepoBranch)
+	}
+	for _, t := range branchOrder {
+		wanted = append(wanted, t.Ref)
+	}
+	for _, b := range wanted {
+		if !strings.Contains(out, "refs/heads/"+b+":") {
+			_ = gitRun("-C", cloneDir, "remote", "set-branches", "--add", "origin", b)
+		}
+	}
+}
+
+// trackRepoBranch fetches and resets the checkout to REPO_BRANCH. Whatever the checkout was on
+// before doesn't matter, so changing the setting or a force push both just move it. Tags are
+// fetched forcibly too, a moved tag is followed like a branch.
+func trackRepoBranch() error {
+	start := time.Now()
+	if err := runGitTracked("", "pull", fetchArgs("--tags", "--force")...); err != nil {
+		slog.Error("Error fetching repository", "ref", cfg.RepoBranch, "err", err, "duration", time.Since(start))
+		return err
+	}
+	target, isBranch := repoBranchTarget()
+	if target == "" {
+		return fmt.Errorf("REPO_BRANCH %s is neither a branch nor a tag of origin", cfg.RepoBranch)
+	}
+	if err := verifyCommit(cloneDir, target); err != nil {
+		return err
+	}
+	err := withContentWrite("checkout", func() error {
+		if isBranch {
+			return gitRun("-C", cloneDir, "checkout", "--force", "-B", cfg.RepoBranch, "--track", target)
+		}
+		return gitRun("-C", cloneDir, "checkout", "--force", "--detach", target)
+	})
+	if err != nil {
+		slog.Error("Error checking out REPO_BRANCH", "ref", cfg.RepoBranch, "err", err)
+		return err
+	}
+	slog.Info("Repository updated", "ref", cfg.RepoBranch, "duration", time.Since(start))
+	return nil
+}
+
+// repoBranchTarget resolves REPO_BRANCH to origin's branch of that name or else the tag, "" when
+// it's neither
+func repoBranchTarget() (string, bool) {
+	if _, err := resolveCommit(cloneDir, "refs/remotes/origin/"+cfg.RepoBranch); err == nil {
+		return "refs/remotes/origin/" + cfg.RepoBranch, true
+	}
+	if _, err := resolveCommit(cloneDir, "refs/tags/"+cfg.RepoBranch); err == nil {
+		return "refs/tags/" + cfg.RepoBranch, false
+	}
+	return "", false
+}
+
+// checkoutPin detaches the default checkout at the pinned commit
+func checkoutPin(pin string) error {
+	sha, err := resolveCommit(cloneDir, pin)
+	if err != nil {
+		return fmt.Errorf("unknown commit %s", pin)
+	}
+	if err := verifyCommit(cloneDir, sha); err != nil {
+		return err
+	}
+	return withContentWrite("checkout", func() error {
+		return gitRun("-C", cloneDir, "checkout", "--detach", "--force", sha)
+	})
+}
+
+// checkoutDefaultBranch puts the checkout back on the branch origin/HEAD points at, from a detached
+// pin or a REPO_BRANCH that has since been unset
+func checkoutDefaultBranch() error {
+	branch, err := originDefaultBranch(cloneDir)
+	if err != nil {
+		return err
+	}
+	if current, err := gitOutput("-C", cloneDir, "symbolic-ref", "-q", "--short", "HEAD"); err == nil && current == branch {
+		return nil
+	}
+	return gitRun("-C", cloneDir, "checkout", "--force", "-B", branch, "--track", "origin/"+branch)
+}
+
+// incompleteClone reports whether dir is a clone cut short before it had a commit: origin is set
+// up but HEAD doesn't resolve. The .git check keeps git from finding a repository further up.
+func incompleteClone(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		return false
+	}
+	if _, err := resolveCommit(dir, "HEAD"); err == nil {
+		return false
+	}
+	_, err := gitOutput("-C", dir, "remote", "get-url", "origin")
+	return err == nil
+}
+
+// resumableClone reports whether a clone that failed with err is worth keeping: a timer killed
+// git rather than the remote refusing it, and what it left can be fetched into
+func resumableClone(dir string, err error) bool {
+	var gerr *gitError
+	return errors.As(err, &gerr) && gerr.TimedOut > 0 && incompleteClone(dir)
+}
+
+// resumeClone finishes a clone of repo ("" for the main one) cut short in dir: fetches origin
+// into it again and points HEAD at the branch the clone would have checked out, origin's default
+// one without a branch. The working tree is only filled in with checkout, like a clone without
+// --no-checkout.
+func resumeClone(repo, dir, branch string, depth int, checkout bool) error {
+	// a clone killed before its first fetch hasn't written the refspec yet
+	if _, err := gitOutput("-C", dir, "config", "--get", "remote.origin.fetch"); err != nil {
+		refspec := "+refs/heads/*:refs/remotes/origin/*"
+		if depth > 0 && branch != "" {
+			refspec = "+refs/heads/" + branch + ":refs/remotes/origin/" + branch
+		}
+		if err := gitRun("-C", dir, "config", "remote.origin.fetch", refspec); err != nil {
+			return err
+		}
+	}
+	args := []string{"-C", dir, "fetch", "--progress", "origin"}
+	if depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(depth))
+	}
+	if err := runGitTracked(repo, "clone", args...); err != nil {
+		return err
+	}
+	if branch == "" {
+		if err := gitRun("-C", dir, "remote", "set-head", "origin", "--auto"); err != nil {
+			return err
+		}
+		var err error
+		if branch, err = originDefaultBranch(dir); err != nil {
+			return err
+		}
+	}
+	if err := gitRun("-C", dir, "branch", "--force", "--track", branch, "origin/"+branch); err != nil {
+		return err
+	}
+	if err := gitRun("-C", dir, "symbolic-ref", "HEAD", "refs/heads/"+branch); err != nil {
+		return err
+	}
+	if !checkout {
+		return nil
+	}
+	return gitRun("-C", dir, "reset", "--hard", "HEAD")
+}
+
+// originDefaultBranch returns the branch origin/HEAD of the checkout in dir points at
+func originDefaultBranch(dir string) (string, error) {
+	out, err := gitOutput("-C", dir, "rev-parse", "--abbrev-ref", "origin/HEAD")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(out, "origin/"), nil
+}
+
+// resolveCommit expands a (possibly abbreviated) SHA to the full commit SHA
+func resolveCommit(dir, rev string) (string, error) {
+	return gitOutput("-C", dir, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+}
+
+// syncRemoteURL points origin at REPO_URL when the checkout was cloned from somewhere else. The new
+// URL is checked for reachability first, and a remote whose history has nothing in common with the
+// checkout is re-cloned from scratch on the following cloneOrPull.
+func syncRemoteURL() {
+	want := os.Getenv("REPO_URL")
+	if want == "" {
+		return
+	}
+	if _, err := os.Stat(cloneDir); err != nil {
+		return
+	}
+	have, err := remoteURL()
+	if err != nil || have == want {
+		return
+	}
+
+	if err := gitRun("ls-remote", "--exit-code", want, "HEAD"); err != nil {
+		slog.Warn("REPO_URL is not reachable, keeping origin", "repo", redactURL(want), "origin", redactURL(have), "err", err)
+		return
+	}
+	if err := gitRun("-C", cloneDir, "remote", "set-url", "origin", want); err != nil {
+		slog.Error("Error updating origin", "err", err)
+		return
+	}
+	slog.Info("Origin changed", "from", redactURL(have), "to", redactURL(want))
+
+	if err := gitRun("-C", cloneDir, "fetch", "--prune", "origin"); err != nil {
+		slog.Error("Error fetching from new origin", "err", err)
+		return
+	}
+	upstream := "@{upstream}"
+	if _, err := resolveCommit(cloneDir, upstream); err != nil {
+		upstream = "origin/HEAD"
+	}
+	if gitRun("-C", cloneDir, "merge-base", "HEAD", upstream) != nil {
+		slog.Warn("New origin shares no history with the checkout, re-cloning")
+		_ = os.RemoveAll(worktreeDir)
+		_ = os.RemoveAll(cloneDir)
+	}
+}
+
+// remoteURL returns the URL origin currently points at
+func remoteURL() (string, error) {
+	return gitOutput("-C", cloneDir, "remote", "get-url", "origin")
+}
+
+// redactURL hides credentials embedded in a remote URL
+func redactURL(raw string) string {
+	if u, err := url.Parse(raw); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return raw
+}
+
+// headCommit returns the SHA checked out in dir
+func headCommit(dir string) (string, error) {
+	return gitOutput("-C", dir, "rev-parse", "HEAD")
+}
+
+// syncWorktrees checks out the latest commit of every configured branch into its worktree and
+// removes worktrees of branches that are no longer configured. Worktrees are detached at
+// origin/<branch> so a branch can be served even when it's the one the default checkout is on.
+func syncWorktrees() error {
+	var errs []error
+	wanted := make(map[string]bool)
+	for _, t := range branchOrder {
+		wanted[filepath.Base(t.Dir)] = true
+		if err := withContentWrite("worktree "+t.Ref, func() error { return updateWorktree(t) }); err != nil {
+			slog.Error("Error updating worktree", "ref", t.Ref, "err", err)
+			errs = append(errs, fmt.Errorf("%s: %w", t.Ref, err))
+		}
+	}
+
+	entries, err := os.ReadDir(worktreeDir)
+	if err != nil {
+		return errors.Join(errs...)
+	}
+	for _, e := range entries {
+		if !e.IsDir() || wanted[e.Name()] {
+			continue
+		}
+		dir := filepath.Join(worktreeDir, e.Name())
+		slog.Info("Removing worktree, its branch is no longer configured", "dir", dir)
+		if abs, err := filepath.Abs(dir); err == nil {
+			_ = gitRun("-C", cloneDir, "worktree", "remove", "--force", abs)
+		}
+		_ = os.RemoveAll(dir)
+	}
+	_ = gitRun("-C", cloneDir, "worktree", "prune")
+	return errors.Join(errs...)
+}
+
+// updateWorktree creates the worktree of a branch or moves it to the fetched branch head
+func updateWorktree(t *contentTree) error {
+	target := "origin/" + t.Ref
+	if head, err := headCommit(t.Dir); err == nil {
+		if sha, err := resolveCommit(cloneDir, target); err == nil && sha == head {
+			return nil
+		}
+	}
+	if err := verifyCommit(cloneDir, target); err != nil {
+		return err
+	}
+	if _, err := os.Stat(t.Dir); os.IsNotExist(err) {
+		if err := os.MkdirAll(worktreeDir, 0o755); err != nil {
+			return err
+		}
+		abs, err := filepath.Abs(t.Dir)
+		if err != nil {
+			return err
+		}
+		slog.Info("Creating worktree", "ref", t.Ref, "dir", abs)
+		return gitRun("-C", cloneDir, "worktree", "add", "--detach", abs, target)
+	}
+	return gitRun("-C", t.Dir, "checkout", "--detach", "--force", target)
+}
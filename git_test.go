@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// gitFixture makes a repository with one commit of readme.txt and returns its path
+func gitFixture(t *testing.T) string {
+	t.Helper()
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"readme.txt": "hello"})
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"add", "readme.txt"},
+		{"-c", "user.name=t", "-c", "user.email=t@example.com", "commit", "-q", "-m", "first"},
+	} {
+		if err := gitRun(append([]string{"-C", dir}, args...)...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// commitFiles writes files into the repository at dir, commits them and returns the commit
+func commitFiles(t *testing.T, dir string, files map[string]string, args ...string) string {
+	t.Helper()
+	writeTree(t, dir, files)
+	commit := append([]string{"-C", dir, "-c", "user.name=t", "-c", "user.email=t@example.com", "commit", "-q", "-m", "update"}, args...)
+	for _, cmd := range [][]string{{"-C", dir, "add", "-A"}, commit} {
+		if err := gitRun(cmd...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sha, err := headCommit(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sha
+}
+
+func TestStalledCloneIsKeptAndResumed(t *testing.T) {
+	useConfig(t, "GIT_TIMEOUT", "100ms", "GIT_TRANSFER_IDLE_TIMEOUT", "500ms")
+	source := gitFixture(t)
+	dir := filepath.Join(t.TempDir(), "clone")
+
+	// a remote that never answers, the clone sits there without progress
+	start := time.Now()
+	err := gitRun("-c", "protocol.ext.allow=always", "clone", "ext::sh -c sleep% 30", dir)
+	var gerr *gitError
+	if !errors.As(err, &gerr) || !gerr.Stalled {
+		t.Fatalf("clone = %v, want it stalled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("stalled clone took %s to be killed", elapsed)
+	}
+	if !resumableClone(dir, err) {
+		t.Fatal("the stalled clone isn't resumable")
+	}
+
+	if err := gitRun("-C", dir, "remote", "set-url", "origin", source); err != nil {
+		t.Fatal(err)
+	}
+	if err := resumeClone("", dir, "", 0, true); err != nil {
+		t.Fatalf("resumeClone: %v", err)
+	}
+	if incompleteClone(dir) {
+		t.Error("still incomplete after the resume")
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "readme.txt")); err != nil || string(data) != "hello" {
+		t.Errorf("readme.txt = %q, %v", data, err)
+	}
+	if branch, err := gitOutput("-C", dir, "rev-parse", "--abbrev-ref", "@{upstream}"); err != nil || branch != "origin/main" {
+		t.Errorf("upstream = %q, %v, want origin/main", branch, err)
+	}
+}
+
+func TestFailedCloneIsNotResumable(t *testing.T) {
+	useConfig(t)
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	dir := filepath.Join(t.TempDir(), "clone")
+	err := gitRun("clone", filepath.Join(t.TempDir(), "missing"), dir)
+	if err == nil {
+		t.Fatal("clone of a missing repository succeeded")
+	}
+	if resumableClone(dir, err) {
+		t.Error("a refused clone counts as resumable")
+	}
+}
+
+func TestFixedTimeoutSkipsTransfers(t *testing.T) {
+	useConfig(t)
+	source := gitFixture(t)
+	useConfig(t, "GIT_TIMEOUT", "1ns", "GIT_TRANSFER_IDLE_TIMEOUT", "0")
+	if err := gitRun("clone", source, filepath.Join(t.TempDir(), "clone")); err != nil {
+		t.Errorf("clone under GIT_TIMEOUT=1ns: %v", err)
+	}
+	var gerr *gitError
+	if err := gitRun("-C", source, "status"); !errors.As(err, &gerr) || gerr.TimedOut == 0 || gerr.Stalled {
+		t.Errorf("status under GIT_TIMEOUT=1ns = %v, want timed out", err)
+	}
+}
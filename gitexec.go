@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+// gitError is a failed git command with what it wrote to stderr
+type gitError struct {
+	Op       string
+	Err      error
+	Stderr   string
+	TimedOut time.Duration // the timeout that killed the command, 0 if it exited by itself
+	Stalled  bool          // TimedOut was GIT_TRANSFER_IDLE_TIMEOUT without any progress
+}
+
+func (e *gitError) Error() string {
+	msg := "git " + e.Op + ": "
+	switch {
+	case e.Stalled:
+		msg += "no progress for " + e.TimedOut.String()
+	case e.TimedOut > 0:
+		msg += "timed out after " + e.TimedOut.String()
+	default:
+		msg += e.Err.Error()
+	}
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	}
+	return msg
+}
+
+func (e *gitError) Unwrap() error { return e.Err }
+
+// errGitStalled cancels a transfer that went GIT_TRANSFER_IDLE_TIMEOUT without output
+var errGitStalled = errors.New("git transfer stalled")
+
+// gitTransferOps move objects over the network and can take as long as the repo is big
+var gitTransferOps = map[string]bool{"clone": true, "fetch": true, "pull": true}
+
+// gitOp names a command by its subcommand, skipping -C <dir> and -c <config>
+func gitOp(args []string) string {
+	if i := gitOpIndex(args); i >= 0 {
+		return args[i]
+	}
+	return ""
+}
+
+func gitOpIndex(args []string) int {
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-C", "-c":
+			i++
+		default:
+			return i
+		}
+	}
+	return -1
+}
+
+// runGit runs git bounded by GIT_TIMEOUT. Clones, fetches and pulls are the exception: a 12GB
+// clone takes however long it takes, they're killed once they go GIT_TRANSFER_IDLE_TIMEOUT
+// without progress output instead, and always report progress so a silent one is a stalled one.
+// Credential prompts are disabled so missing credentials fail right away, and on timeout the
+// whole process group is killed so ssh and other helpers don't linger. Stdout is logged at debug
+// level when it's nil, stderr is captured into the returned error.
+func runGit(stdout, stderr io.Writer, args ...string) error {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	var idle *idleTimer
+	timeout := cfg.GitTimeout
+	if i := gitOpIndex(args); i >= 0 && gitTransferOps[args[i]] {
+		timeout = cfg.GitTransferIdleTimeout
+		if !slices.Contains(args, "--progress") {
+			args = slices.Insert(slices.Clone(args), i+1, "--progress")
+		}
+		if timeout > 0 {
+			idle = &idleTimer{d: timeout, t: time.AfterFunc(timeout, func() { cancel(errGitStalled) })}
+			defer idle.t.Stop()
+		}
+	} else if timeout > 0 {
+		var stop context.CancelFunc
+		ctx, stop = context.WithTimeout(ctx, timeout)
+		defer stop()
+	}
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if os.Getenv("GIT_SSH_COMMAND") == "" {
+		cmd.Env = append(cmd.Env, "GIT_SSH_COMMAND=ssh -o BatchMode=yes")
+	}
+	setProcessGroup(cmd)
+	cmd.WaitDelay = 5 * time.Second
+
+	if stdout == nil {
+		var out tailBuffer
+		stdout = &out
+		defer func() {
+			if s := out.String(); s != "" {
+				slog.Debug("git output", "op", gitOp(args), "output", s)
+			}
+		}()
+	}
+	var captured tailBuffer
+	cmd.Stdout = stdout
+	cmd.Stderr = &captured
+	if stderr != nil {
+		cmd.Stderr = io.MultiWriter(&captured, stderr)
+	}
+	if idle != nil {
+		cmd.Stdout = io.MultiWriter(idle, cmd.Stdout)
+		cmd.Stderr = io.MultiWriter(idle, cmd.Stderr)
+	}
+
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	gerr := &gitError{Op: gitOp(args), Err: err, Stderr: captured.String()}
+	if errors.Is(context.Cause(ctx), errGitStalled) {
+		gerr.TimedOut, gerr.Stalled = timeout, true
+	} else if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		gerr.TimedOut = timeout
+	}
+	return gerr
+}
+
+// idleTimer pushes its deadline back on every write
+type idleTimer struct {
+	d time.Duration
+	t *time.Timer
+}
+
+func (w *idleTimer) Write(p []byte) (int, error) {
+	w.t.Reset(w.d)
+	return len(p), nil
+}
+
+// gitRun runs a git command for its effect
+func gitRun(args ...string) error {
+	return runGit(io.Discard, nil, args...)
+}
+
+// gitOutput runs a git command and returns its trimmed stdout
+func gitOutput(args ...string) (string, error) {
+	var out bytes.Buffer
+	if err := runGit(&out, nil, args...); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// tailBuffer keeps the last lines written to it, enough to explain a failure
+type tailBuffer struct {
+	buf []byte
+}
+
+const tailBufferSize = 4 << 10
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > tailBufferSize {
+		t.buf = t.buf[len(t.buf)-tailBufferSize:]
+	}
+	return len(p), nil
+}
+
+// String returns the captured lines without progress updates, joined on one line
+func (t *tailBuffer) String() string {
+	var lines []string
+	for _, l := range strings.Split(string(t.buf), "\n") {
+		if i := strings.LastIndexByte(l, '\r'); i >= 0 {
+			l = l[i+1:]
+		}
+		if l = strings.TrimSpace(l); l != "" && !progressLine.MatchString(l) {
+			lines = append(lines, l)
+		}
+	}
+	return strings.Join(lines, "; ")
+}
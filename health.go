@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"os"
+)
+
+// GET /healthz answers 503 until the first update put a checkout in place and its manifest is
+// built. A failed update after that leaves the instance serving what it has, degraded but 200.
+func handleHealthz(c echo.Context) error {
+	update := getLastUpdate()
+	head, headErr := headCommit(cloneDir)
+	ready := !update.At.IsZero() && headErr == nil && defaultContent.getManifest() != nil
+	status := "ok"
+	code := http.StatusOK
+	switch {
+	case !ready:
+		status = "starting"
+		code = http.StatusServiceUnavailable
+	case hasUnhealthyFiles() || !update.OK:
+		status = "degraded"
+	}
+
+	checkout := echo.Map{"dir": cloneDir, "exists": headErr == nil}
+	if headErr == nil {
+		checkout["commit"] = head
+	}
+	tempDir := echo.Map{"path": os.TempDir()}
+	if free, err := diskFree(os.TempDir()); err == nil {
+		tempDir["free_bytes"] = free
+	}
+
+	branches := echo.Map{}
+	for _, t := range branchOrder {
+		branches[t.Ref] = manifestInfo(t)
+	}
+
+	return c.JSON(code, echo.Map{
+		"status":      status,
+		"ready":       ready,
+		"stale":       !update.OK,
+		"checkout":    checkout,
+		"temp_dir":    tempDir,
+		"update":      update,
+		"pull":        getPullProgress(""),
+		"manifest":    manifestInfo(defaultContent),
+		"branches":    branches,
+		"repos":       repoStatus(),
+		"integrity":   integrityStatus(),
+		"breaker":     breaker.status(),
+		"builds":      builds.snapshot(),
+		"maintenance": getMaintenance(),
+	})
+}
+
+func manifestInfo(t *contentTree) echo.Map {
+	m := t.getManifest()
+	if m == nil {
+		return echo.Map{"built": false}
+	}
+	return echo.Map{
+		"built":          true,
+		"files":          len(m.Files),
+		"rejected_names": len(m.Rejected),
+		"built_at":       m.BuiltAt,
+		"commit":         m.Commit,
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	integrityOff  = "off"  // served bytes aren't checked
+	integrityLog  = "log"  // mismatches are logged and counted but the data still goes out
+	integrityFail = "fail" // mismatching files fail the request
+)
+
+// integrityError is returned when served bytes don't hash to the manifest value
+type integrityError struct {
+	Path     string
+	Expected string
+	Actual   string
+}
+
+func (e *integrityError) Error() string {
+	return fmt.Sprintf("integrity mismatch for %s: manifest md5 %s, read %s", e.Path, e.Expected, e.Actual)
+}
+
+// unhealthyFile records a file that failed verification
+type unhealthyFile struct {
+	Path       string    `json:"path"`
+	Expected   string    `json:"expected_md5"`
+	Actual     string    `json:"actual_md5"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+var integrityStats = struct {
+	sync.Mutex
+	checked    int64
+	mismatches int64
+	bytes      int64
+	hashTime   time.Duration // time spent hashing, the overhead of the feature
+	unhealthy  map[string]*unhealthyFile
+}{unhealthy: make(map[string]*unhealthyFile)}
+
+// integrityCheck verifies one file as it's read
+type integrityCheck struct {
+	rel      string
+	expected string
+	h        hash.Hash
+	n        int64
+	spent    time.Duration
+}
+
+// newIntegrityCheck returns a check for the file or nil when there's nothing to verify against.
+// Files whose size or mtime differ from the manifest changed legitimately (a pull since the last
+// rebuild) and are skipped rather than reported as corrupt.
+func newIntegrityCheck(t *contentTree, rel string, info os.FileInfo) *integrityCheck {
+	if cfg.IntegrityMode == integrityOff {
+		return nil
+	}
+	entry, ok := t.manifestEntryFor(rel)
+	if !ok || entry.Size != info.Size() || !entry.Modified.Equal(info.ModTime()) {
+		return nil
+	}
+	return &integrityCheck{rel: rel, expected: entry.MD5, h: md5.New()}
+}
+
+func (c *integrityCheck) write(p []byte) {
+	start := time.Now()
+	c.h.Write(p)
+	c.spent += time.Since(start)
+	c.n += int64(len(p))
+}
+
+func (c *integrityCheck) reset() {
+	c.h.Reset()
+	c.n = 0
+}
+
+// reader wraps r so everything read through it is hashed
+func (c *integrityCheck) reader(r io.Reader) io.Reader {
+	return &integrityReader{r: r, check: c}
+}
+
+// seeker wraps an http.ServeContent source so a full sequential read is hashed
+func (c *integrityCheck) seeker(f io.ReadSeeker) *sequentialReadSeeker {
+	return &sequentialReadSeeker{f: f, check: c}
+}
+
+// verifyFile reads the whole file up front and verifies it
+func (c *integrityCheck) verifyFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(io.Discard, c.reader(f)); err != nil {
+		return err
+	}
+	return c.verify()
+}
+
+// verify compares what was read against the manifest and records the outcome
+func (c *integrityCheck) verify() error {
+	actual := hex.EncodeToString(c.h.Sum(nil))
+
+	integrityStats.Lock()
+	defer integrityStats.Unlock()
+	integrityStats.checked++
+	integrityStats.bytes += c.n
+	integrityStats.hashTime += c.spent
+
+	if actual == c.expected {
+		delete(integrityStats.unhealthy, c.rel)
+		return nil
+	}
+
+	integrityStats.mismatches++
+	integrityStats.unhealthy[c.rel] = &unhealthyFile{
+		Path:       c.rel,
+		Expected:   c.expected,
+		Actual:     actual,
+		DetectedAt: time.Now(),
+	}
+	err := &integrityError{Path: c.rel, Expected: c.expected, Actual: actual}
+	slog.Error("Integrity check failed", "path", c.rel, "expected", c.expected, "actual", actual)
+	return err
+}
+
+type integrityReader struct {
+	r     io.Reader
+	check *integrityCheck
+}
+
+func (r *integrityReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.check.write(p[:n])
+	}
+	return n, err
+}
+
+// integrityStatus summarizes verification for /healthz
+func integrityStatus() echo.Map {
+	integrityStats.Lock()
+	defer integrityStats.Unlock()
+
+	files := make([]*unhealthyFile, 0, len(integrityStats.unhealthy))
+	for _, f := range integrityStats.unhealthy {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	var mbps float64
+	if secs := integrityStats.hashTime.Seconds(); secs > 0 {
+		mbps = float64(integrityStats.bytes) / secs / (1 << 20)
+	}
+
+	return echo.Map{
+		"mode":            cfg.IntegrityMode,
+		"checked":         integrityStats.checked,
+		"mismatches":      integrityStats.mismatches,
+		"bytes_verified":  integrityStats.bytes,
+		"hash_seconds":    integrityStats.hashTime.Seconds(),
+		"hash_mb_per_sec": mbps,
+		"unhealthy_files": files,
+	}
+}
+
+// hasUnhealthyFiles reports whether any served file currently fails verification
+func hasUnhealthyFiles() bool {
+	integrityStats.Lock()
+	defer integrityStats.Unlock()
+	return len(integrityStats.unhealthy) > 0
+}
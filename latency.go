@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	latencyWindow     = 5 * time.Minute // span of the /admin/latency summary
+	latencyMaxSamples = 10000           // per route, the oldest are dropped beyond this
+)
+
+var (
+	metricRequestDuration *prometheus.HistogramVec
+	metricRequestTTFB     *prometheus.HistogramVec
+)
+
+// registerLatencyMetrics creates the request histograms with the configured buckets
+func registerLatencyMetrics(buckets []float64) {
+	metricRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "patcher_http_request_duration_seconds",
+		Help:    "Total request duration by route and status class, including the full body of streamed downloads.",
+		Buckets: buckets,
+	}, []string{"route", "class"})
+	metricRequestTTFB = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "patcher_http_time_to_first_byte_seconds",
+		Help:    "Time until response headers were written, by route and status class.",
+		Buckets: buckets,
+	}, []string{"route", "class"})
+}
+
+type latencySample struct {
+	at       time.Time
+	ttfb     time.Duration
+	duration time.Duration
+}
+
+var (
+	latencySamples   = make(map[string][]latencySample) // route -> samples, oldest first
+	latencySamplesMu sync.Mutex
+)
+
+func recordLatency(route string, s latencySample) {
+	latencySamplesMu.Lock()
+	defer latencySamplesMu.Unlock()
+	samples := append(latencySamples[route], s)
+	if len(samples) > latencyMaxSamples {
+		samples = samples[len(samples)-latencyMaxSamples:]
+	}
+	latencySamples[route] = samples
+}
+
+// latencyMiddleware records how long each request took to its first byte and in total. Downloads
+// stream for minutes, so their TTFB is what tells whether the server was slow to respond.
+func latencyMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		var ttfb time.Duration
+		c.Response().Before(func() { ttfb = time.Since(start) })
+
+		err := next(c)
+
+		duration := time.Since(start)
+		status := c.Response().Status
+		if err != nil && !c.Response().Committed {
+			// the error handler writes the response after us
+			status = http.StatusInternalServerError
+			var he *echo.HTTPError
+			if errors.As(err, &he) {
+				status = he.Code
+			}
+			ttfb = duration
+		}
+
+		route := c.Path()
+		if route == "" || route == "/*" {
+			route = "static"
+		}
+		class := strconv.Itoa(status/100) + "xx"
+		metricRequestDuration.WithLabelValues(route, class).Observe(duration.Seconds())
+		metricRequestTTFB.WithLabelValues(route, class).Observe(ttfb.Seconds())
+		recordLatency(route, latencySample{at: start, ttfb: ttfb, duration: duration})
+		requestStatuses.record(status)
+		return err
+	}
+}
+
+// GET /admin/latency summarizes the last five minutes per route
+func handleAdminLatency(c echo.Context) error {
+	cutoff := time.Now().Add(-latencyWindow)
+
+	type summary struct {
+		Route    string             `json:"route"`
+		Count    int                `json:"count"`
+		TTFB     map[string]float64 `json:"ttfb_ms"`
+		Duration map[string]float64 `json:"duration_ms"`
+	}
+	var routes []summary
+
+	latencySamplesMu.Lock()
+	for route, samples := range latencySamples {
+		i := sort.Search(len(samples), func(i int) bool { return samples[i].at.After(cutoff) })
+		samples = samples[i:]
+		if len(samples) == 0 {
+			delete(latencySamples, route)
+			continue
+		}
+		latencySamples[route] = samples
+
+		ttfb := make([]time.Duration, len(samples))
+		duration := make([]time.Duration, len(samples))
+		for i, s := range samples {
+			ttfb[i], duration[i] = s.ttfb, s.duration
+		}
+		routes = append(routes, summary{
+			Route:    route,
+			Count:    len(samples),
+			TTFB:     percentiles(ttfb),
+			Duration: percentiles(duration),
+		})
+	}
+	latencySamplesMu.Unlock()
+
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Route < routes[j].Route })
+	if wantsCSV(c) {
+		out := startCSV(c, "latency", latencyWindow.String(), "route", "count",
+			"ttfb_p50_ms", "ttfb_p95_ms", "ttfb_p99_ms", "duration_p50_ms", "duration_p95_ms", "duration_p99_ms")
+		for _, r := range routes {
+			out.row(r.Route, r.Count, r.TTFB["p50"], r.TTFB["p95"], r.TTFB["p99"],
+				r.Duration["p50"], r.Duration["p95"], r.Duration["p99"])
+		}
+		return out.close()
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"window_seconds": latencyWindow.Seconds(),
+		"routes":         routes,
+	})
+}
+
+// percentiles returns p50/p95/p99 in milliseconds, sorting d in place
+func percentiles(d []time.Duration) map[string]float64 {
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	at := func(p float64) float64 {
+		i := int(p * float64(len(d)-1))
+		return float64(d[i]) / float64(time.Millisecond)
+	}
+	return map[string]float64{"p50": at(0.50), "p95": at(0.95), "p99": at(0.99)}
+}
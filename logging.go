@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logEntry is one structured log record as kept in the ring buffer
+type logEntry struct {
+	Seq   uint64         `json:"seq"`
+	Time  time.Time      `json:"time"`
+	Level string         `json:"level"`
+	Msg   string         `json:"msg"`
+	Attrs map[string]any `json:"attrs,omitempty"`
+}
+
+// logRing keeps the most recent log records for /admin/logs and fans new ones out to live
+// streams. Subscribers get a buffered channel and miss records when they fall behind, the
+// logger never waits on them.
+type logRing struct {
+	mu      sync.Mutex
+	entries []logEntry
+	next    int
+	full    bool
+	seq     uint64
+	subs    map[chan logEntry]struct{}
+}
+
+// buffered records per live stream before it starts dropping
+const logStreamBuffer = 256
+
+var logs = newLogRing(2000)
+
+// setupLogging installs the default slog logger, a JSON or text handler on stdout feeding the ring
+func setupLogging() {
+	logs.resize(cfg.LogBufferSize)
+	opts := &slog.HandlerOptions{Level: cfg.LogLevel}
+	var out slog.Handler = slog.NewJSONHandler(os.Stdout, opts)
+	if cfg.LogFormat == "text" {
+		out = slog.NewTextHandler(os.Stdout, opts)
+	}
+	slog.SetDefault(slog.New(&ringHandler{out: out, ring: logs}))
+}
+
+// fatal logs an error the server can't start or keep running with and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{entries: make([]logEntry, size), subs: make(map[chan logEntry]struct{})}
+}
+
+func (r *logRing) resize(size int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries, r.next, r.full = make([]logEntry, size), 0, false
+}
+
+func (r *logRing) add(e logEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	e.Seq = r.seq
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+	for ch := range r.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// snapshot returns up to limit of the newest records matching f, oldest first
+func (r *logRing) snapshot(limit int, f logFilter) []logEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ordered []logEntry
+	if r.full {
+		ordered = append(ordered, r.entries[r.next:]...)
+	}
+	ordered = append(ordered, r.entries[:r.next]...)
+
+	out := make([]logEntry, 0, limit)
+	for i := len(ordered) - 1; i >= 0 && len(out) < limit; i-- {
+		if f.match(ordered[i]) {
+			out = append(out, ordered[i])
+		}
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+func (r *logRing) subscribe() (chan logEntry, func()) {
+	ch := make(chan logEntry, logStreamBuffer)
+	r.mu.Lock()
+	r.subs[ch] = struct{}{}
+	r.mu.Unlock()
+	return ch, func() {
+		r.mu.Lock()
+		delete(r.subs, ch)
+		r.mu.Unlock()
+	}
+}
+
+// ringHandler passes records to the output handler and copies them into the ring
+type ringHandler struct {
+	out    slog.Handler
+	ring   *logRing
+	attrs  []slog.Attr
+	prefix string // group prefix of attrs added from now on
+}
+
+func (h *ringHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.out.Enabled(ctx, level)
+}
+
+func (h *ringHandler) Handle(ctx context.Context, rec slog.Record) error {
+	e := logEntry{Time: rec.Time, Level: rec.Level.String(), Msg: rec.Message}
+	if len(h.attrs) > 0 || rec.NumAttrs() > 0 {
+		e.Attrs = make(map[string]any)
+		for _, a := range h.attrs {
+			flattenAttr(e.Attrs, "", a)
+		}
+		rec.Attrs(func(a slog.Attr) bool {
+			flattenAttr(e.Attrs, h.prefix, a)
+			return true
+		})
+	}
+	h.ring.add(e)
+	return h.out.Handle(ctx, rec)
+}
+
+func (h *ringHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.out = h.out.WithAttrs(attrs)
+	c.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, a := range attrs {
+		c.attrs = append(c.attrs, slog.Attr{Key: h.prefix + a.Key, Value: a.Value})
+	}
+	return &c
+}
+
+func (h *ringHandler) WithGroup(name string) slog.Handler {
+	c := *h
+	c.out = h.out.WithGroup(name)
+	c.prefix = h.prefix + name + "."
+	return &c
+}
+
+func flattenAttr(m map[string]any, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		for _, g := range v.Group() {
+			flattenAttr(m, prefix+a.Key+".", g)
+		}
+		return
+	}
+	m[prefix+a.Key] = v.Any()
+}
+
+// logFilter selects records by minimum level, request ID and route template
+type logFilter struct {
+	level     slog.Level
+	requestID string
+	route     string
+}
+
+func parseLogFilter(c echo.Context) (logFilter, error) {
+	f := logFilter{level: slog.LevelDebug, requestID: c.QueryParam("request_id"), route: c.QueryParam("route")}
+	if v := c.QueryParam("level"); v != "" {
+		if err := f.level.UnmarshalText([]byte(v)); err != nil {
+			return f, echo.NewHTTPError(http.StatusBadRequest, "Unknown level, expected debug, info, warn or error")
+		}
+	}
+	return f, nil
+}
+
+func (f logFilter) match(e logEntry) bool {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(e.Level)); err == nil && level < f.level {
+		return false
+	}
+	if f.requestID != "" && fmt.Sprint(e.Attrs["request_id"]) != f.requestID {
+		return false
+	}
+	if f.route != "" && !strings.HasPrefix(fmt.Sprint(e.Attrs["route"]), f.route) {
+		return false
+	}
+	return true
+}
+
+// requestLogger logs every request through slog with its ID and route template
+func requestLogger() echo.MiddlewareFunc {
+	return middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+		HandleError:     true,
+		LogRequestID:    true,
+		LogRoutePath:    true,
+		LogMethod:       true,
+		LogURI:          true,
+		LogStatus:       true,
+		LogLatency:      true,
+		LogRemoteIP:     true,
+		LogResponseSize: true,
+		LogError:        true,
+		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+			level := slog.LevelInfo
+			switch {
+			case v.Status >= 500:
+				level = slog.LevelError
+			case v.Status >= 400:
+				level = slog.LevelWarn
+			}
+			attrs := []slog.Attr{
+				slog.String("request_id", v.RequestID),
+				slog.String("method", v.Method),
+				slog.String("uri", v.URI),
+				slog.String("route", v.RoutePath),
+				slog.Int("status", v.Status),
+				slog.Duration("latency", v.Latency),
+				slog.String("remote_ip", v.RemoteIP),
+				slog.Int64("bytes_out", v.ResponseSize),
+			}
+			if v.Error != nil {
+				attrs = append(attrs, slog.String("error", v.Error.Error()))
+			}
+			slog.LogAttrs(c.Request().Context(), level, "request", attrs...)
+			return nil
+		},
+	})
+}
+
+// GET /admin/logs?limit=500&level=&request_id=&route=
+func handleAdminLogs(c echo.Context) error {
+	f, err := parseLogFilter(c)
+	if err != nil {
+		return err
+	}
+	limit := 500
+	if v := c.QueryParam("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid limit")
+		}
+	}
+	return c.JSON(http.StatusOK, echo.Map{"entries": logs.snapshot(limit, f)})
+}
+
+// GET /admin/logs/stream?level=&request_id=&route= tails the log as server-sent events
+func handleAdminLogStream(c echo.Context) error {
+	f, err := parseLogFilter(c)
+	if err != nil {
+		return err
+	}
+	ch, cancel := logs.subscribe()
+	defer cancel()
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.Flush()
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			w.Flush()
+		case e := <-ch:
+			if !f.match(e) {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", e.Seq, data)
+			w.Flush()
+		}
+	}
+}
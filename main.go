@@ -1,396 +1,219 @@
 package main
 
 import (
-	"archive/zip"
-	"fmt"
+	"context"
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	"golang.org/x/time/rate"
-	"io"
-	"log"
-	"net"
+	"log/slog"
 	"net/http"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"strconv"
-	"strings"
-	"sync"
-	"time"
+	"os/signal"
+	"syscall"
 )
 
 // This entire file was extremely quickly thrown together
 // TODO for me (Akkadius) to restructure this into a formal app at a later time
 
 const cloneDir = "eqemupatcher" // Directory to clone the repository to
-const tempZipDir = "/tmp/patcher"
 
-var (
-	chunkStore   = make(map[string][]string) // chunkID -> file list
-	chunkStoreMu sync.Mutex
-)
-
-var (
-	visitors   = make(map[string]*rate.Limiter)
-	visitorsMu sync.Mutex
-)
-
-func getVisitor(ip string) *rate.Limiter {
-	visitorsMu.Lock()
-	defer visitorsMu.Unlock()
-
-	limiter, exists := visitors[ip]
-	if !exists {
-		limiter = rate.NewLimiter(rate.Every(time.Minute/10), 10) // 10 requests/minute
-		visitors[ip] = limiter
-	}
-	return limiter
-}
-
-func getClientIP(r *http.Request) string {
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr
-	}
-	return ip
-}
-
-func rateLimitMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		ip := getClientIP(c.Request())
-		limiter := getVisitor(ip)
-
-		if !limiter.Allow() {
-			return c.JSON(http.StatusTooManyRequests, echo.Map{
-				"error": "Rate limit exceeded. Max 10 requests per minute.",
-			})
+func main() {
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			fatal("Command failed", "command", os.Args[1], "err", err)
 		}
-		return next(c)
+		return
 	}
-}
 
-func main() {
-	// load .env
+	// load .env, logged by slog's default handler until the configured one is installed
 	err := godotenv.Load()
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		fatal("Error loading .env file", "err", err)
 	}
 
-	cloneOrPull()
-
-	e := echo.New()
-	e.Use(middleware.Logger())
-
-	// Webhook endpoint to trigger the pull or clone
-	e.POST("/gh-update", func(c echo.Context) error {
-		// Retrieve the secret key from the query string
-		queryKey := c.QueryParam("key")
-		expectedKey := os.Getenv("WEBHOOK_KEY")
+	cfg, err = loadConfig()
+	if err != nil {
+		fatal("Invalid configuration", "err", err)
+	}
+	setupLogging()
+	if cfg.WebhookSecret == "" && !cfg.WebhookAllowQueryKey {
+		slog.Warn("Neither WEBHOOK_SECRET nor WEBHOOK_ALLOW_QUERY_KEY is set, /gh-update rejects every call")
+	}
+	registerLatencyMetrics(cfg.LatencyBuckets)
 
-		if queryKey == "" || queryKey != expectedKey {
-			return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid or missing key."})
+	if cfg.SigningKeyPath != "" {
+		signingKey, err = loadSigningKey(cfg.SigningKeyPath)
+		if err != nil {
+			fatal("Error loading signing key", "path", cfg.SigningKeyPath, "err", err)
 		}
+	}
 
+	downloads.configure(cfg.MaxConcurrentDownloads, cfg.DownloadQueueSize, cfg.DownloadQueueTimeout)
+	builds.configure(cfg.MaxConcurrentBuilds, cfg.BuildQueueSize, cfg.BuildAging)
+	configureThrottle(cfg.MaxTotalBytesPerSec)
+	configureAlerts()
+	chunkEvents.configure(cfg.ChunkEventLog, cfg.ChunkEventLogMaxBytes)
+	accessLogs.configure(cfg.AccessLogPath, cfg.AccessLogMaxBytes, cfg.AccessLogRotateInterval, cfg.AccessLogMaxFiles)
+	stats.load()
+	configureStoreExtensions(cfg.StoreExtensions)
+	configureChunkTokens(cfg.ChunkTokenSecret, cfg.ChunkTokenKeyPath)
+
+	configureBranches(cfg.Branches)
+	configureRepos(cfg.Repos)
+	configureMirrors(cfg.Mirrors)
+
+	setPin(cfg.PinCommit)
+	syncRemoteURL()
+	if _, err := os.Stat(cloneDir); err == nil && !incompleteClone(cloneDir) {
+		initialUpdate()
+		go rebuildManifests()
+	} else {
+		// a first clone can take a while, /healthz answers 503 until it's done
 		go func() {
-			time.Sleep(5 * time.Second)
-			cloneOrPull()
+			initialUpdate()
+			rebuildManifests()
 		}()
+	}
+	updateRepos()
 
-		return c.JSON(http.StatusOK, echo.Map{"message": "Update triggered."})
-	})
-
-	// POST /zip-chunks/init
-	e.POST("/zip-chunks/init", func(c echo.Context) error {
-		var payload struct {
-			Files        []string `json:"files"`
-			MaxChunkSize int64    `json:"max_chunk_size"` // bytes
-		}
-		if err := c.Bind(&payload); err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "Invalid JSON payload")
-		}
-
-		// Default to 10MB if not provided
-		if payload.MaxChunkSize <= 0 {
-			payload.MaxChunkSize = 30 * 1024 * 1024 // 30MB
-		}
-
-		// Expand file paths with size data
-		var filesWithSize []struct {
-			Path string
-			Size int64
-		}
-		for _, file := range payload.Files {
-			full := filepath.Join(cloneDir, file)
-			info, err := os.Stat(full)
-			if err != nil || info.IsDir() {
-				continue // skip if missing or directory
-			}
-			filesWithSize = append(filesWithSize, struct {
-				Path string
-				Size int64
-			}{file, info.Size()})
-		}
-
-		// Chunk files by max total byte size
-		chunks := chunkBySize(filesWithSize, payload.MaxChunkSize)
-
-		// Store chunks using unique ID
-		chunkID := strconv.FormatInt(time.Now().UnixNano(), 10)
-		chunkStoreMu.Lock()
-		for i, chunk := range chunks {
-			var names []string
-			for _, f := range chunk {
-				names = append(names, f.Path)
-			}
-			chunkStore[chunkID+"-"+strconv.Itoa(i)] = names
-		}
-		chunkStoreMu.Unlock()
-
-		// Return chunk URLs
-		var urls []string
-		for i := range chunks {
-			urls = append(urls, fmt.Sprintf("/zip-chunks/%s-%d", chunkID, i))
-		}
-
-		type ChunkInfo struct {
-			URL                   string `json:"url"`
-			FileCount             int    `json:"file_count"`
-			TotalSizeUncompressed int64  `json:"total_size_uncompressed"` // uncompressed size in bytes
-		}
-
-		var result []ChunkInfo
-
-		for i, chunk := range chunks {
-			var size int64
-			for _, f := range chunk {
-				size += f.Size
-			}
-
-			result = append(result, ChunkInfo{
-				URL:                   fmt.Sprintf("/zip-chunks/%s-%d", chunkID, i),
-				FileCount:             len(chunk),
-				TotalSizeUncompressed: size,
-			})
-		}
-
-		return c.JSON(http.StatusOK, echo.Map{
-			"chunks": result,
-		})
-	}, rateLimitMiddleware)
-
-	// GET /zip-chunks/:chunkID
-	e.GET("/zip-chunks/:chunkID", func(c echo.Context) error {
-		chunkID := c.Param("chunkID")
-
-		chunkStoreMu.Lock()
-		files, ok := chunkStore[chunkID]
-		chunkStoreMu.Unlock()
-		if !ok {
-			return echo.NewHTTPError(http.StatusNotFound, "Chunk not found")
-		}
-
-		// Ensure /tmp/patcher/ exists
-		tmpDir := filepath.Join(os.TempDir(), "patcher")
-		if err := os.MkdirAll(tmpDir, 0o755); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create temp dir")
-		}
-
-		// Create a temp file under /tmp/patcher/
-		tmpFile, err := os.CreateTemp(tmpDir, chunkID+"-*.zip")
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create temp zip")
-		}
-		defer tmpFile.Close()
-
-		zipWriter := zip.NewWriter(tmpFile)
-		for _, f := range files {
-			fullPath := filepath.Join(cloneDir, f)
-			file, err := os.Open(fullPath)
-			if err != nil {
-				continue
-			}
-			defer file.Close()
-
-			w, err := zipWriter.Create(f)
-			if err != nil {
-				continue
-			}
-			io.Copy(w, file)
-		}
-		zipWriter.Close()
-
-		// Get full path of created zip
-		tmpPath := tmpFile.Name()
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	e.IPExtractor = getClientIP
+	if len(cfg.CORSAllowedOrigins) > 0 {
+		e.Pre(corsMiddleware(cfg.CORSAllowedOrigins))
+	}
+	e.Use(middleware.RequestID())
+	if cfg.AccessLogPath != "" {
+		e.Use(accessLogMiddleware)
+	}
+	e.Use(requestLogger())
+	e.Use(latencyMiddleware)
+	e.Use(statsMiddleware)
+	if cfg.ResponseCompression {
+		e.Use(compressMiddleware)
+	}
 
-		fmt.Printf("Downloading %s\n", filepath.Join(tmpDir, chunkID))
+	// Webhook endpoint to trigger the pull or clone
+	e.POST("/gh-update", handleWebhook)
+	e.GET("/gh-update/status", handleUpdateStatus)
+
+	initLimit := newRateLimiter("init", cfg.RateLimitInit).middleware
+	downloadLimit := newRateLimiter("download", cfg.RateLimitDownload).middleware
+
+	registerRepoRoutes(e, initLimit, downloadLimit)
+
+	e.POST("/zip-chunks/init", handleChunkInit, apiKeyMiddleware, maintenanceMiddleware, initLimit)
+	e.POST("/zip-chunks/plan", handleChunkPlan, apiKeyMiddleware, maintenanceMiddleware)
+	e.GET("/zip-chunks/:chunkID", handleChunkDownload, apiKeyMiddleware, downloadLimit, chunkStreamLimitMiddleware, downloadQueueMiddleware, throttleMiddleware)
+	e.HEAD("/zip-chunks/:chunkID", handleChunkHead, apiKeyMiddleware)
+	e.GET("/zip-chunks/:chunkID/entries", handleChunkEntries, apiKeyMiddleware)
+	e.GET("/zip-chunks/:chunkID/checksum", handleChunkChecksum, apiKeyMiddleware)
+	e.GET("/file/*", handleFile, fileAPIKeyMiddleware, maintenanceMiddleware, downloadLimit, streamLimitMiddleware, downloadQueueMiddleware, throttleMiddleware)
+	e.GET("/zip-all", handleZipAll, fileAPIKeyMiddleware, maintenanceMiddleware, downloadLimit, streamLimitMiddleware, downloadQueueMiddleware, throttleMiddleware)
+	e.GET("/zip-all.torrent", handleZipAllTorrent, fileAPIKeyMiddleware)
+	e.GET("/zip-all/parts", handleZipAllParts, fileAPIKeyMiddleware)
+	e.GET("/zip-all/parts/:name", handleZipAllPart, fileAPIKeyMiddleware, maintenanceMiddleware, downloadLimit, streamLimitMiddleware, downloadQueueMiddleware, throttleMiddleware)
+	e.GET("/queue-status", handleQueueStatus)
+	e.GET("/mirrors", handleMirrors)
+	e.GET("/news", handleNews)
+	e.GET("/sync/*", handleSync)
+	e.GET("/delta", handleDelta, maintenanceMiddleware, downloadLimit)
+	e.GET("/checksum", handleChecksum)
+	e.POST("/diff", handleDiff)
+	e.POST("/sync/*", handleSyncDiff)
+	e.GET("/speedtest", handleSpeedtestDownload, speedtestMiddleware, streamLimitMiddleware)
+	e.POST("/speedtest", handleSpeedtestUpload, speedtestMiddleware, streamLimitMiddleware)
+	e.GET("/healthz", handleHealthz)
+	e.GET("/manifest", handleFilelist)
+	e.GET("/"+filelistName, handleFilelist)
+	e.GET("/manifest.json", handleManifestJSON)
+	e.GET("/manifest.sig", handleManifestSig)
+	e.GET("/pubkey", handlePubkey)
+	e.GET("/tree", handleTree)
+	e.GET("/latest", handleLatest)
+	e.GET("/version", handleVersion)
+
+	// with ADMIN_LISTEN_ADDR the admin endpoints and /metrics aren't on the public listener at all
+	adminServer := e
+	if cfg.AdminListenAddr != "" {
+		adminServer = echo.New()
+		adminServer.HideBanner = true
+		adminServer.HidePort = true
+		adminServer.IPExtractor = getClientIP
+		adminServer.Use(middleware.RequestID())
+		adminServer.Use(requestLogger())
+	}
+	if cfg.MetricsAddr == "" {
+		adminServer.GET("/metrics", handleMetrics)
+	}
 
-		// Use a custom stream that deletes the file 3 minutes after the download completes
-		return c.Stream(http.StatusOK, "application/zip", &delayedDeleteFile{
-			path:    tmpPath,
-			chunkID: chunkID,
-			delay:   3 * time.Minute,
-			onDelete: func() {
-				fmt.Printf("Deleting %s\n", filepath.Join(tmpDir, chunkID))
-				chunkStoreMu.Lock()
-				delete(chunkStore, chunkID)
-				chunkStoreMu.Unlock()
-			},
-		})
-	})
+	adminServer.GET("/stats", handleStats, adminMiddleware)
+
+	admin := adminServer.Group("/admin", adminMiddleware)
+	admin.GET("", func(c echo.Context) error { return c.Redirect(http.StatusMovedPermanently, "/admin/") })
+	admin.GET("/", handleDashboard)
+	admin.GET("/status", handleAdminStatus)
+	admin.GET("/chunks", handleAdminChunks)
+	admin.GET("/chunks/:id", handleAdminChunk)
+	admin.GET("/chunks/:id/events", handleAdminChunkEvents)
+	admin.POST("/update", handleAdminUpdate)
+	admin.POST("/pin", handleAdminPin)
+	admin.POST("/cleanup", handleAdminCleanup)
+	admin.GET("/maintenance", handleAdminMaintenance)
+	admin.POST("/maintenance", handleAdminSetMaintenance)
+	admin.GET("/pulls/current", handlePullProgress)
+	admin.GET("/runtime", handleAdminRuntime)
+	admin.GET("/latency", handleAdminLatency)
+	admin.GET("/alerts", handleAdminAlerts)
+	admin.GET("/reports/downloads", handleDownloadReport)
+	admin.GET("/reports/updates", handleUpdateReport)
+	admin.GET("/reports/webhooks", handleWebhookReport)
+	admin.GET("/reports/names", handleNameReport)
+	admin.GET("/reports/compression", handleCompressionReport)
+	admin.GET("/logs", handleAdminLogs)
+	admin.GET("/logs/stream", handleAdminLogStream)
+
+	// stops the background loops and the server on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// expire old entries
-	go func() {
-		ticker := time.NewTicker(1 * time.Minute)
-		defer ticker.Stop()
-
-		for range ticker.C {
-			now := time.Now()
-			maxAge := 1 * time.Minute
-
-			chunkStoreMu.Lock()
-			for chunkKey := range chunkStore {
-				// Extract the timestamp from the prefix of the chunkKey
-				tsPart := chunkKey[:strings.Index(chunkKey, "-")]
-				tsInt, err := strconv.ParseInt(tsPart, 10, 64)
-				if err != nil {
-					continue // skip invalid entries
-				}
-
-				chunkTime := time.Unix(0, tsInt) // ns to time.Time
-				if now.Sub(chunkTime) > maxAge {
-					fmt.Printf("Auto-cleaning expired chunk: %s\n", chunkKey)
-					delete(chunkStore, chunkKey)
-
-					// Delete zip file if it exists
-					matches, _ := filepath.Glob(filepath.Join(tempZipDir, chunkKey+"-*.zip"))
-					for _, path := range matches {
-						_ = os.Remove(path)
-					}
-				}
-			}
-			chunkStoreMu.Unlock()
-
-			tmpDir := filepath.Join(os.TempDir(), "patcher")
-			err := filepath.Walk(tmpDir, func(path string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-				if !info.IsDir() && filepath.Ext(path) == ".zip" {
-					if now.Sub(info.ModTime()) > maxAge {
-						fmt.Printf("Cleaning up old temp file: %s\n", path)
-						os.Remove(path)
-					}
-				}
-				return nil
-			})
-			if err != nil {
-				fmt.Printf("Error during temp file cleanup: %v\n", err)
-			}
-		}
-	}()
-
-	// Serve the static files
-	e.Use(middleware.StaticWithConfig(middleware.StaticConfig{
-		Root:   cloneDir,
-		Browse: true,
-	}))
-
-	e.Logger.Fatal(e.Start(fmt.Sprintf(":4444")))
-}
-
-// cloneOrPull clones the repository if it doesn't exist, or pulls the latest changes if it does
-func cloneOrPull() {
-	if _, err := os.Stat(cloneDir); os.IsNotExist(err) {
-		// Directory doesn't exist, clone the repository
-		fmt.Println("Directory does not exist. Cloning repository...")
-		cmd := exec.Command("git", "clone", os.Getenv("REPO_URL"), cloneDir)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		fmt.Println("Cloning repository...")
-
-		err = cmd.Run()
-		if err != nil {
-			fmt.Printf("Error cloning repository: %v\n", err)
-			os.Exit(1)
-		}
-
-		fmt.Println("Repository cloned successfully.")
-	} else {
-		cmd := exec.Command("git", "-C", cloneDir, "pull")
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		fmt.Println("Cloning repository...")
-
-		err = cmd.Run()
-		if err != nil {
-			fmt.Printf("Error pulling repository: %v\n", err)
-			os.Exit(1)
-		}
-
-		fmt.Println("Repository updated successfully.")
+	go runChunkCleanup(ctx)
+	go runVisitorCleanup(ctx)
+	go runQueueSweep(ctx)
+	if cfg.AccessLogPath != "" {
+		go reopenOnHangup(ctx)
 	}
-}
 
-func chunkBySize(files []struct {
-	Path string
-	Size int64
-}, maxSize int64) [][]struct {
-	Path string
-	Size int64
-} {
-	var chunks [][]struct {
-		Path string
-		Size int64
+	if cfg.MetricsAddr != "" {
+		go serveMetrics(ctx, cfg.MetricsAddr)
 	}
-	var current []struct {
-		Path string
-		Size int64
+	if adminServer != e {
+		go serveAdmin(ctx, adminServer, cfg.AdminListenAddr)
 	}
-	var currentSize int64
 
-	for _, f := range files {
-		if currentSize+f.Size > maxSize && len(current) > 0 {
-			chunks = append(chunks, current)
-			current = nil
-			currentSize = 0
-		}
-		current = append(current, f)
-		currentSize += f.Size
-	}
-	if len(current) > 0 {
-		chunks = append(chunks, current)
+	if cfg.CompressionAutotune {
+		go runCompressionAutotune()
 	}
-	return chunks
-}
-
-type delayedDeleteFile struct {
-	path     string
-	chunkID  string
-	delay    time.Duration
-	onDelete func()
-}
 
-func (d *delayedDeleteFile) Read(p []byte) (int, error) {
-	return 0, io.EOF
-}
+	// Serve the static files
+	serveStatic(e, cloneDir)
 
-func (d *delayedDeleteFile) WriteTo(w io.Writer) (int64, error) {
-	f, err := os.Open(d.path)
-	if err != nil {
-		return 0, err
+	if err := serve(ctx, e, cfg.ListenAddr); err != nil {
+		fatal("Server failed", "err", err)
 	}
-	defer f.Close()
-
-	n, err := io.Copy(w, f)
-
-	// After streaming finishes, schedule deletion
-	time.AfterFunc(d.delay, func() {
-		_ = os.Remove(d.path)
-		if d.onDelete != nil {
-			d.onDelete()
-		}
-	})
+}
 
-	return n, err
+// serveStatic ends the middleware chain with the files of the checkout in dir, for the requests no
+// route took
+func serveStatic(e *echo.Echo, dir string) {
+	e.Use(staticAPIKeyMiddleware)
+	e.Use(staticMaintenanceMiddleware)
+	e.Use(staticStreamLimitMiddleware)
+	e.Use(middleware.StaticWithConfig(middleware.StaticConfig{
+		Skipper:    staticSkipper,
+		Filesystem: servedFS{http.Dir(dir)},
+		Browse:     true,
+	}))
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/labstack/echo/v4"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useConfig loads cfg from the defaults plus env, given as key/value pairs, and puts the previous
+// one back when the test ends
+func useConfig(t *testing.T, env ...string) {
+	t.Helper()
+	for i := 0; i+1 < len(env); i += 2 {
+		t.Setenv(env[i], env[i+1])
+	}
+	previous := cfg
+	c, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	cfg = c
+	t.Cleanup(func() { cfg = previous })
+}
+
+// writeTree creates files under root, by slash separated path
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// useContent makes a tree of files the default content for the test and returns its root
+func useContent(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	writeTree(t, root, files)
+	previous := defaultContent
+	defaultContent = newContentTree("", root)
+	t.Cleanup(func() { defaultContent = previous })
+	return root
+}
+
+// request runs one request through e, with headers as key/value pairs
+func request(e *echo.Echo, method, target, body string, headers ...string) *httptest.ResponseRecorder {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, r)
+	if body != "" {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+// chunkServer is an echo with the chunk routes and none of the limits in front of them
+func chunkServer(t *testing.T) *echo.Echo {
+	t.Helper()
+	configureChunkTokens("test-secret", "")
+	e := echo.New()
+	e.POST("/zip-chunks/init", handleChunkInit)
+	e.POST("/zip-chunks/plan", handleChunkPlan)
+	e.GET("/zip-chunks/:chunkID", handleChunkDownload)
+	e.HEAD("/zip-chunks/:chunkID", handleChunkHead)
+	e.GET("/zip-chunks/:chunkID/entries", handleChunkEntries)
+	e.GET("/zip-chunks/:chunkID/checksum", handleChunkChecksum)
+	return e
+}
+
+// initResult is the part of an init response the tests look at
+type initResult struct {
+	Chunks []struct {
+		URL                   string `json:"url"`
+		ETag                  string `json:"etag"`
+		Order                 int    `json:"order"`
+		Critical              bool   `json:"critical"`
+		FileCount             int    `json:"file_count"`
+		TotalSizeUncompressed int64  `json:"total_size_uncompressed"`
+		Zip64                 bool   `json:"zip64"`
+	} `json:"chunks"`
+	Rejected      map[string]string `json:"rejected"`
+	Skipped       map[string]string `json:"skipped"`
+	Missing       []string          `json:"missing"`
+	DownloadToken string            `json:"download_token"`
+}
+
+// chunkInit runs an init with the JSON body, with headers as key/value pairs
+func chunkInit(t *testing.T, e *echo.Echo, body string, headers ...string) initResult {
+	t.Helper()
+	rec := request(e, http.MethodPost, "/zip-chunks/init", body, headers...)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("init = %d %s", rec.Code, rec.Body.String())
+	}
+	var res initResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// initChunks runs an init with the JSON body and returns the chunk URLs
+func initChunks(t *testing.T, e *echo.Echo, body string) []string {
+	t.Helper()
+	res := chunkInit(t, e, body)
+	urls := make([]string, len(res.Chunks))
+	for i, c := range res.Chunks {
+		urls[i] = c.URL
+	}
+	return urls
+}
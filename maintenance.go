@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maintenanceState is the switch the dashboard flips. While it's on new downloads don't start:
+// chunk inits and file, archive and delta downloads answer 503 with the message, chunk sessions
+// created before keep downloading. It's in memory only, a restart turns it off.
+type maintenanceState struct {
+	Enabled bool       `json:"enabled"`
+	Message string     `json:"message,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+const defaultMaintenanceMessage = "The patcher is down for maintenance, try again in a few minutes."
+
+var (
+	maintenance   maintenanceState
+	maintenanceMu sync.Mutex
+)
+
+func getMaintenance() maintenanceState {
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+	return maintenance
+}
+
+func setMaintenance(enabled bool, message string) maintenanceState {
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+	if !enabled {
+		maintenance = maintenanceState{}
+		return maintenance
+	}
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+	if !maintenance.Enabled {
+		now := time.Now()
+		maintenance.Since = &now
+	}
+	maintenance.Enabled, maintenance.Message = true, message
+	return maintenance
+}
+
+// maintenanceMiddleware turns downloads away while maintenance is on
+func maintenanceMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if m := getMaintenance(); m.Enabled {
+			c.Response().Header().Set(echo.HeaderRetryAfter, "300")
+			return c.JSON(http.StatusServiceUnavailable, echo.Map{"error": m.Message, "maintenance": true})
+		}
+		return next(c)
+	}
+}
+
+// staticMaintenanceMiddleware is maintenanceMiddleware for the static files, which have no route
+func staticMaintenanceMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	guarded := maintenanceMiddleware(next)
+	return func(c echo.Context) error {
+		if c.Path() != "" || staticSkipper(c) {
+			return next(c)
+		}
+		return guarded(c)
+	}
+}
+
+// GET /admin/maintenance
+func handleAdminMaintenance(c echo.Context) error {
+	return c.JSON(http.StatusOK, getMaintenance())
+}
+
+// POST /admin/maintenance {"enabled": true, "message": "..."} turns maintenance on or off, the
+// message is what clients are answered with
+func handleAdminSetMaintenance(c echo.Context) error {
+	var payload struct {
+		Enabled bool   `json:"enabled"`
+		Message string `json:"message"`
+	}
+	if err := c.Bind(&payload); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid JSON payload")
+	}
+	m := setMaintenance(payload.Enabled, strings.TrimSpace(payload.Message))
+	if m.Enabled {
+		slog.Info("Maintenance on, downloads are turned away", "message", m.Message, "ip", c.RealIP())
+	} else {
+		slog.Info("Maintenance off", "ip", c.RealIP())
+	}
+	return c.JSON(http.StatusOK, m)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/cespare/xxhash/v2"
+	"github.com/labstack/echo/v4"
+	"github.com/zeebo/xxh3"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// manifestEntry describes one served file
+type manifestEntry struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	MD5      string    `json:"md5"`
+	SHA256   string    `json:"sha256"`
+	XXH3     string    `json:"xxh3"`
+	XXH64    string    `json:"xxh64"`
+}
+
+// manifest is a snapshot of every file under the content root
+type manifest struct {
+	Files   map[string]*manifestEntry // repo relative forward slash path -> entry
+	BuiltAt time.Time
+	Commit  string    // HEAD of the checkout the manifest was built from
+	Tree    *treeNode // directory hashes, see tree.go
+
+	// Rejected are files left out because their names can't be extracted on Windows, path -> reason
+	Rejected map[string]string
+
+	// Canonical is the sha256 JSON rendering, the exact bytes Signature covers
+	Canonical []byte
+	Signature []byte
+}
+
+// getManifest returns the current manifest of the tree or nil if it hasn't been built yet
+func (t *contentTree) getManifest() *manifest {
+	t.manifestMu.RLock()
+	defer t.manifestMu.RUnlock()
+	return t.manifest
+}
+
+// manifestEntryFor returns the manifest entry of a repo relative path
+func (t *contentTree) manifestEntryFor(rel string) (*manifestEntry, bool) {
+	m := t.getManifest()
+	if m == nil {
+		return nil, false
+	}
+	entry, ok := m.Files[rel]
+	return entry, ok
+}
+
+// rebuildManifest walks the tree's checkout and swaps in a fresh manifest
+func (t *contentTree) rebuildManifest() {
+	t.buildMu.Lock()
+	defer t.buildMu.Unlock()
+
+	// the checkout moved, archives built from it may name the wrong commit
+	purgeArchiveCache(t)
+
+	start := time.Now()
+	m, hashed, err := t.buildManifest()
+	if err != nil {
+		slog.Error("Error building manifest", "ref", t.Ref, "err", err)
+		return
+	}
+
+	m.Commit, err = headCommit(t.Dir)
+	if err != nil {
+		slog.Error("Error reading HEAD commit", "ref", t.Ref, "err", err)
+	}
+	m.Tree = buildTree(m)
+	t.cacheTree(m.Commit, m.Tree)
+	t.rebuildNews(m.Commit)
+
+	// render and sign before the swap so the signature always matches the served manifest
+	m.Canonical, err = renderManifestJSON(m, "sha256")
+	if err != nil {
+		slog.Error("Error rendering manifest", "ref", t.Ref, "err", err)
+		return
+	}
+	m.Signature = signManifest(m.Canonical)
+
+	t.manifestMu.Lock()
+	t.manifest = m
+	t.manifestMu.Unlock()
+	if t == defaultContent {
+		scheduleZipAll(m)
+	}
+
+	slog.Info("Manifest built", "ref", t.Ref, "commit", m.Commit, "file_count", len(m.Files), "hashed", hashed, "duration", time.Since(start), "tree", m.Tree.Hash)
+	for _, rel := range sortedKeys(m.Rejected) {
+		// see /admin/reports/names
+		slog.Warn("File is not served, its name breaks Windows clients", "ref", t.Ref, "path", rel, "reason", m.Rejected[rel])
+	}
+}
+
+// buildManifest hashes every file of the checkout, reusing cached digests for unchanged files.
+// It returns the manifest and the number of files that actually had to be read.
+func (t *contentTree) buildManifest() (*manifest, int, error) {
+	root := t.Dir
+	m := &manifest{Files: make(map[string]*manifestEntry), Rejected: make(map[string]string)}
+	hashed := 0
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// .git is a directory in the clone, a file pointing at it in worktrees
+		if d.Name() == ".git" || (!cfg.ServeDotfiles && path != root && strings.HasPrefix(d.Name(), ".")) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if isExcluded(rel) {
+			return nil
+		}
+		if problem := entryNameProblem(rel); problem != "" {
+			m.Rejected[rel] = problem
+			return nil
+		}
+
+		t.hashCacheMu.Lock()
+		cached, ok := t.hashCache[rel]
+		t.hashCacheMu.Unlock()
+		if ok && cached.Size == info.Size() && cached.Modified.Equal(info.ModTime()) {
+			m.Files[rel] = cached
+			return nil
+		}
+
+		var entry *manifestEntry
+		if ok && cached.Size == info.Size() {
+			// only the mtime moved (checkouts touch files), a cheap xxh3 pass tells whether the
+			// content really changed before paying for the cryptographic digests
+			sum, err := xxh3File(path)
+			if err != nil {
+				return err
+			}
+			if sum == cached.XXH3 {
+				touched := *cached
+				entry = &touched
+			}
+		}
+		if entry == nil {
+			entry, err = hashFile(path)
+			if err != nil {
+				return err
+			}
+			hashed++
+		}
+		entry.Path = rel
+		entry.Modified = info.ModTime()
+
+		t.hashCacheMu.Lock()
+		t.hashCache[rel] = entry
+		t.hashCacheMu.Unlock()
+		m.Files[rel] = entry
+		return nil
+	})
+	if err != nil {
+		return nil, hashed, err
+	}
+
+	// drop cache entries for files that no longer exist
+	t.hashCacheMu.Lock()
+	for rel := range t.hashCache {
+		if _, ok := m.Files[rel]; !ok {
+			delete(t.hashCache, rel)
+		}
+	}
+	t.hashCacheMu.Unlock()
+
+	m.BuiltAt = time.Now()
+	return m, hashed, nil
+}
+
+// hashFile computes the digests of a single file in one pass
+func hashFile(path string) (*manifestEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	md5h := md5.New()
+	sha := sha256.New()
+	x3 := xxh3.New()
+	x64 := xxhash.New()
+	n, err := io.Copy(io.MultiWriter(md5h, sha, x3, x64), f)
+	if err != nil {
+		return nil, err
+	}
+
+	return &manifestEntry{
+		Size:   n,
+		MD5:    hex.EncodeToString(md5h.Sum(nil)),
+		SHA256: hex.EncodeToString(sha.Sum(nil)),
+		XXH3:   fmt.Sprintf("%016x", x3.Sum64()),
+		XXH64:  fmt.Sprintf("%016x", x64.Sum64()),
+	}, nil
+}
+
+// xxh3File computes only the fast xxh3 digest, used for change detection
+func xxh3File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := xxh3.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%016x", h.Sum64()), nil
+}
+
+// manifestAlgorithms are the digests the JSON manifest can be rendered with. The EQEmu
+// filelist.yml format only ever carries md5 and stays that way for patcher compatibility.
+// xxh3/xxh64 are fast but not cryptographic, fine for "did this change" checks, while clients
+// verifying what they downloaded should use sha256 (or md5).
+var manifestAlgorithms = map[string]func(*manifestEntry) string{
+	"md5":    func(e *manifestEntry) string { return e.MD5 },
+	"sha256": func(e *manifestEntry) string { return e.SHA256 },
+	"xxh3":   func(e *manifestEntry) string { return e.XXH3 },
+	"xxh64":  func(e *manifestEntry) string { return e.XXH64 },
+}
+
+// GET /manifest.json?algo=md5|sha256|xxh3|xxh64&ref=<branch>
+func handleManifestJSON(c echo.Context) error {
+	algo := c.QueryParam("algo")
+	if algo == "" {
+		algo = "md5"
+	}
+	if _, ok := manifestAlgorithms[algo]; !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown algo, expected md5, sha256, xxh3 or xxh64")
+	}
+
+	t, err := contentFor(c)
+	if err != nil {
+		return err
+	}
+	m := t.getManifest()
+	if m == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Manifest is still being built")
+	}
+
+	c.Response().Header().Set("X-Content-Tree-Hash", m.Tree.Hash)
+	c.Response().Header().Set(deltaEndpointHeader, t.urlPrefix()+"/delta")
+
+	// the sha256 rendering is the signed one and is served byte for byte as it was signed
+	if algo == "sha256" {
+		return c.JSONBlob(http.StatusOK, m.Canonical)
+	}
+
+	data, err := renderManifestJSON(m, algo)
+	if err != nil {
+		return err
+	}
+	return c.JSONBlob(http.StatusOK, data)
+}
+
+// renderManifestJSON renders the manifest deterministically (sorted by path) with one digest
+func renderManifestJSON(m *manifest, algo string) ([]byte, error) {
+	digest := manifestAlgorithms[algo]
+
+	type fileInfo struct {
+		Path     string    `json:"path"`
+		Size     int64     `json:"size"`
+		Modified time.Time `json:"modified"`
+		Hash     string    `json:"hash"`
+	}
+
+	files := make([]fileInfo, 0, len(m.Files))
+	for _, e := range m.Files {
+		files = append(files, fileInfo{Path: e.Path, Size: e.Size, Modified: e.Modified, Hash: digest(e)})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	return json.Marshal(struct {
+		Algo    string     `json:"algo"`
+		BuiltAt time.Time  `json:"built_at"`
+		Files   []fileInfo `json:"files"`
+	}{algo, m.BuiltAt, files})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+var (
+	metricDownloadsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "patcher_downloads_active",
+		Help: "Downloads currently holding a slot of the global download cap.",
+	})
+	metricDownloadQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "patcher_download_queue_depth",
+		Help: "Requests waiting for a download slot.",
+	})
+	metricDownloadQueueWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "patcher_download_queue_wait_seconds",
+		Help:    "Time requests spent waiting for a download slot.",
+		Buckets: []float64{0.1, 0.5, 1, 5, 15, 30, 60, 120, 300},
+	})
+	metricDownloadQueueRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "patcher_download_queue_rejected_total",
+		Help: "Requests turned away by the download queue, by reason.",
+	}, []string{"reason"})
+
+	metricBuildsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "patcher_builds_active",
+		Help: "Chunk archive builds currently running.",
+	})
+	metricBuildQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "patcher_build_queue_depth",
+		Help: "Chunk builds waiting for a worker, by size class.",
+	}, []string{"class"})
+	metricBuildsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "patcher_builds_rejected_total",
+		Help: "Chunk builds turned away by the build queue, by reason (full, timeout).",
+	}, []string{"reason"})
+	metricBuildsNoSpace = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "patcher_builds_no_space_total",
+		Help: "Chunk inits and builds turned away for lack of temp disk space, by stage (init, download).",
+	}, []string{"stage"})
+	metricArchiveCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "patcher_archive_cache_lookups_total",
+		Help: "Chunk downloads looked up in the shared archive cache, by result (hit, miss).",
+	}, []string{"result"})
+	metricBuildQueueWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "patcher_build_queue_wait_seconds",
+		Help:    "Time chunk builds waited for a worker, by size class.",
+		Buckets: []float64{0.01, 0.1, 0.5, 1, 5, 15, 30, 60, 120, 300},
+	}, []string{"class"})
+
+	metricBreakerState = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "patcher_build_breaker_state",
+		Help: "IO pressure breaker state: 0 closed, 1 half-open, 2 open.",
+	})
+	metricBuildThroughput = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "patcher_build_throughput_mbps",
+		Help: "Rolling average chunk build throughput in MB/s of source bytes.",
+	})
+	metricTempWriteLatency = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "patcher_temp_write_latency_seconds",
+		Help: "Rolling average latency of writes to the temp dir during builds.",
+	})
+
+	metricChunkInitRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "patcher_chunk_init_requests_total",
+		Help: "Chunk inits answered, by mode (init, dry_run).",
+	}, []string{"mode"})
+	metricAPIKeyRejections = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "patcher_api_key_rejections_total",
+		Help: "Requests turned away for a missing or unknown API key.",
+	})
+	metricChunksCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "patcher_chunks_created_total",
+		Help: "Chunk URLs handed out by init.",
+	})
+	metricChunkBuilds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "patcher_chunk_builds_total",
+		Help: "Chunk archive builds by format and result (ok, failed, incomplete, aborted).",
+	}, []string{"format", "result"})
+	metricChunkBuildDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "patcher_chunk_build_duration_seconds",
+		Help:    "Time chunk archive builds took by format, streamed builds include the transfer.",
+		Buckets: []float64{0.05, 0.1, 0.5, 1, 2, 5, 10, 30, 60, 120, 300},
+	}, []string{"format"})
+	metricChunkBytesServed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "patcher_chunk_bytes_served_total",
+		Help: "Chunk archive bytes written to clients, by how the response ended (completed, partial, aborted).",
+	}, []string{"result"})
+	metricRateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "patcher_rate_limited_requests_total",
+		Help: "Requests answered 429, by limiter.",
+	}, []string{"limiter"})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "patcher_active_chunkstore_entries",
+		Help: "Chunk sessions this instance holds in memory.",
+	}, func() float64 {
+		chunkStoreMu.Lock()
+		defer chunkStoreMu.Unlock()
+		return float64(len(chunkStore))
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "patcher_temp_dir_bytes",
+		Help: "Bytes of chunk archives in the temp dir, quarantined ones included.",
+	}, func() float64 {
+		return float64(tempDirBytes())
+	})
+)
+
+// recordChunkBuild counts a finished build, the duration only of those that produced an archive
+func recordChunkBuild(format, result string, elapsed time.Duration) {
+	metricChunkBuilds.WithLabelValues(format, result).Inc()
+	if result == "ok" {
+		metricChunkBuildDuration.WithLabelValues(format).Observe(elapsed.Seconds())
+	}
+}
+
+// tempDirBytes sums the files under the chunk temp dir, measured on every scrape
+func tempDirBytes() int64 {
+	var total int64
+	_ = filepath.WalkDir(chunkTempDir(), func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// GET /metrics, on the public server unless METRICS_ADDR moves it to a listener of its own
+var handleMetrics = echo.WrapHandler(promhttp.Handler())
+
+// serveMetrics runs the METRICS_ADDR listener until ctx is done
+func serveMetrics(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	slog.Info("Serving metrics", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Metrics listener failed", "addr", addr, "err", err)
+	}
+}
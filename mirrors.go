@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mirrorUnknown = "unknown" // not probed yet
+	mirrorOK      = "ok"      // reachable and serving our commit
+	mirrorStale   = "stale"   // reachable but serving another commit
+	mirrorDead    = "dead"    // the probe failed
+)
+
+// mirrorConfig is one entry of MIRRORS, "<base url>|<region>|<priority>"
+type mirrorConfig struct {
+	URL      string
+	Region   string
+	Priority int // lower is preferred
+}
+
+// parseMirrors reads the MIRRORS entries, region and priority are optional
+func parseMirrors(entries []string) ([]mirrorConfig, error) {
+	var mirrors []mirrorConfig
+	for _, e := range entries {
+		parts := strings.Split(e, "|")
+		m := mirrorConfig{URL: strings.TrimRight(strings.TrimSpace(parts[0]), "/")}
+		if u, err := url.Parse(m.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid mirror URL %q", parts[0])
+		}
+		if len(parts) > 1 {
+			m.Region = strings.TrimSpace(parts[1])
+		}
+		if len(parts) > 2 {
+			p, err := strconv.Atoi(strings.TrimSpace(parts[2]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid priority for mirror %s: %q", m.URL, parts[2])
+			}
+			m.Priority = p
+		}
+		if len(parts) > 3 {
+			return nil, fmt.Errorf("invalid mirror %q, expected <url>|<region>|<priority>", e)
+		}
+		mirrors = append(mirrors, m)
+	}
+	return mirrors, nil
+}
+
+// mirrorStatus is the cached result of the last probe of a mirror
+type mirrorStatus struct {
+	URL       string     `json:"url"`
+	Region    string     `json:"region,omitempty"`
+	Priority  int        `json:"priority"`
+	State     string     `json:"state"`
+	Commit    string     `json:"commit,omitempty"` // last known, kept when a later probe fails
+	LatencyMS int64      `json:"latency_ms,omitempty"`
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+var (
+	mirrors   []*mirrorStatus // sorted by priority
+	mirrorsMu sync.Mutex
+)
+
+// configureMirrors sets up the configured mirrors and starts probing them
+func configureMirrors(list []mirrorConfig) {
+	for _, m := range list {
+		mirrors = append(mirrors, &mirrorStatus{URL: m.URL, Region: m.Region, Priority: m.Priority, State: mirrorUnknown})
+	}
+	sort.SliceStable(mirrors, func(i, j int) bool { return mirrors[i].Priority < mirrors[j].Priority })
+	if len(mirrors) == 0 {
+		return
+	}
+
+	go func() {
+		probeMirrors()
+		ticker := time.NewTicker(cfg.MirrorProbeInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			probeMirrors()
+		}
+	}()
+}
+
+// probeMirrors checks every mirror's /latest concurrently
+func probeMirrors() {
+	commit, _ := headCommit(cloneDir)
+	var wg sync.WaitGroup
+	for _, m := range mirrors {
+		wg.Add(1)
+		go func(m *mirrorStatus) {
+			defer wg.Done()
+			start := time.Now()
+			got, err := probeMirror(m.URL)
+
+			mirrorsMu.Lock()
+			defer mirrorsMu.Unlock()
+			now := time.Now()
+			m.CheckedAt = &now
+			m.LatencyMS = time.Since(start).Milliseconds()
+			m.Error = ""
+			switch {
+			case err != nil:
+				m.State = mirrorDead
+				m.Error = err.Error()
+			case commit != "" && got != commit:
+				m.State, m.Commit = mirrorStale, got
+			default:
+				m.State, m.Commit = mirrorOK, got
+			}
+		}(m)
+	}
+	wg.Wait()
+}
+
+// probeMirror returns the commit a mirror serves
+func probeMirror(base string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.MirrorProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/latest", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("/latest answered %d", resp.StatusCode)
+	}
+	var latest struct {
+		Commit string `json:"commit"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&latest); err != nil {
+		return "", fmt.Errorf("/latest: %w", err)
+	}
+	return latest.Commit, nil
+}
+
+// GET /mirrors lists the mirrors by priority with their last probe, answered from the cache
+func handleMirrors(c echo.Context) error {
+	commit, _ := headCommit(cloneDir)
+	mirrorsMu.Lock()
+	list := make([]mirrorStatus, 0, len(mirrors))
+	for _, m := range mirrors {
+		list = append(list, *m)
+	}
+	mirrorsMu.Unlock()
+	return c.JSON(http.StatusOK, echo.Map{
+		"commit":  commit,
+		"mirrors": list,
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxEntryPath leaves room under Windows' 260 character MAX_PATH for the install directory
+const maxEntryPath = 200
+
+// windowsReserved are device names Windows won't create as files, with or without an extension
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// entryNameProblem explains why a forward slash relative path can't be extracted on a player's
+// machine, "" when it's fine. Such files are left out of manifests and archives.
+func entryNameProblem(rel string) string {
+	if !utf8.ValidString(rel) {
+		return "name is not valid UTF-8"
+	}
+	if n := utf8.RuneCountInString(rel); n > maxEntryPath {
+		return "path is longer than 200 characters"
+	}
+	for _, part := range strings.Split(rel, "/") {
+		if strings.HasSuffix(part, " ") || strings.HasSuffix(part, ".") {
+			return "\"" + part + "\" ends in a space or dot"
+		}
+		if strings.ContainsAny(part, `<>:"\|?*`) {
+			return "\"" + part + "\" contains a character Windows doesn't allow"
+		}
+		for _, r := range part {
+			if r < 0x20 {
+				return "\"" + part + "\" contains a control character"
+			}
+		}
+		base, _, _ := strings.Cut(part, ".")
+		if windowsReserved[strings.ToUpper(strings.TrimRight(base, " "))] {
+			return "\"" + part + "\" is a reserved device name on Windows"
+		}
+	}
+	return ""
+}
+
+// GET /admin/reports/names lists the files left out of the manifests for their names
+func handleNameReport(c echo.Context) error {
+	type rejected struct {
+		Ref    string `json:"ref"`
+		Path   string `json:"path"`
+		Reason string `json:"reason"`
+	}
+	var rows []rejected
+	for _, t := range allContent() {
+		m := t.getManifest()
+		if m == nil {
+			continue
+		}
+		for _, path := range sortedKeys(m.Rejected) {
+			shown := path
+			if !utf8.ValidString(shown) {
+				// escaped so the bytes survive JSON and CSV
+				shown = strconv.Quote(shown)
+			}
+			rows = append(rows, rejected{Ref: t.Ref, Path: shown, Reason: m.Rejected[path]})
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].Ref < rows[j].Ref })
+
+	if !wantsCSV(c) {
+		return c.JSON(http.StatusOK, echo.Map{"rejected": rows})
+	}
+	out := startCSV(c, "rejected-names", "", "ref", "path", "reason")
+	for _, r := range rows {
+		out.row(r.Ref, r.Path, r.Reason)
+	}
+	return out.close()
+}
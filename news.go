@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/yuin/goldmark"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// newsFeed is NEWS_FILE rendered for launchers: JSON is validated and re-encoded, markdown is
+// converted to HTML without raw HTML or unsafe links
+type newsFeed struct {
+	ContentType string
+	Body        []byte
+	ETag        string
+	Commit      string
+}
+
+var (
+	newsFeeds   = make(map[*contentTree]*newsFeed) // last good feed per tree
+	newsFeedsMu sync.Mutex
+)
+
+// rebuildNews renders the news file of the tree at commit, run with every manifest build. A bad
+// file is reported here and the previous feed keeps being served.
+func (t *contentTree) rebuildNews(commit string) {
+	if cfg.NewsFile == "" {
+		return
+	}
+	newsFeedsMu.Lock()
+	current := newsFeeds[t]
+	newsFeedsMu.Unlock()
+	if current != nil && current.Commit == commit && commit != "" {
+		return
+	}
+
+	feed, err := renderNews(filepath.Join(t.Dir, filepath.FromSlash(cfg.NewsFile)))
+	if os.IsNotExist(err) {
+		newsFeedsMu.Lock()
+		delete(newsFeeds, t)
+		newsFeedsMu.Unlock()
+		return
+	}
+	if err != nil {
+		slog.Warn("News file is invalid, still serving the previous news", "path", cfg.NewsFile, "ref", t.Ref, "err", err)
+		return
+	}
+	feed.Commit = commit
+	newsFeedsMu.Lock()
+	newsFeeds[t] = feed
+	newsFeedsMu.Unlock()
+}
+
+func renderNews(path string) (*newsFeed, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	feed := &newsFeed{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		var v any
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		if feed.Body, err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+		feed.ContentType = echo.MIMEApplicationJSON
+	case ".md", ".markdown":
+		// goldmark leaves out raw HTML and javascript: style links unless told otherwise
+		var html bytes.Buffer
+		if err := goldmark.Convert(data, &html); err != nil {
+			return nil, err
+		}
+		feed.Body = html.Bytes()
+		feed.ContentType = echo.MIMETextHTMLCharsetUTF8
+	default:
+		return nil, fmt.Errorf("unsupported news format %q, expected .json or .md", filepath.Ext(path))
+	}
+
+	sum := sha256.Sum256(feed.Body)
+	feed.ETag = `"` + hex.EncodeToString(sum[:16]) + `"`
+	return feed, nil
+}
+
+// GET /news?ref=<branch>
+func handleNews(c echo.Context) error {
+	content, err := contentFor(c)
+	if err != nil {
+		return err
+	}
+	newsFeedsMu.Lock()
+	feed := newsFeeds[content]
+	newsFeedsMu.Unlock()
+	if feed == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "No news")
+	}
+
+	h := c.Response().Header()
+	h.Set("ETag", feed.ETag)
+	h.Set(contentCommitHeader, feed.Commit)
+	h.Set("Cache-Control", "no-cache")
+	if strings.Contains(c.Request().Header.Get("If-None-Match"), feed.ETag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.Blob(http.StatusOK, feed.ContentType, feed.Body)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// chunk ordering policies of init, picked with CHUNK_ORDER
+const (
+	chunkOrderNone     = "none"     // files are chunked and returned in the order they were requested
+	chunkOrderSmallest = "smallest" // smallest chunks first, for fast visible progress
+	chunkOrderCritical = "critical" // critical files in chunks of their own first, then smallest first
+)
+
+// sizedFile is a requested file with its size on disk
+type sizedFile = struct {
+	Path string
+	Size int64
+}
+
+// plannedChunk is one chunk of an init, in the order clients should download it
+type plannedChunk struct {
+	Files    []sizedFile
+	Size     int64
+	Critical bool // holds files matching CRITICAL_FILES
+}
+
+// isCriticalFile matches a repo relative path against CRITICAL_FILES. Patterns ending in a slash
+// match everything below that directory, others are path.Match globs tried against the full path
+// and the base name, so "eqgame.exe" and "*.dll" work wherever the file sits.
+func isCriticalFile(rel string) bool {
+	rel = path.Clean(strings.ReplaceAll(rel, "\\", "/"))
+	for _, p := range cfg.CriticalFiles {
+		if strings.HasSuffix(p, "/") {
+			if strings.HasPrefix(rel, p) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(p, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, path.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// planChunks splits the files into chunks of at most maxSize and orders them by the configured
+// policy. Clients downloading the chunks in the returned order get core files first.
+func planChunks(files []sizedFile, maxSize int64) []plannedChunk {
+	var chunks []plannedChunk
+	if cfg.ChunkOrder == chunkOrderCritical {
+		// critical files never share a chunk with optional content, so they're done sooner
+		var critical, optional []sizedFile
+		for _, f := range files {
+			if isCriticalFile(f.Path) {
+				critical = append(critical, f)
+			} else {
+				optional = append(optional, f)
+			}
+		}
+		chunks = append(smallestFirst(toPlanned(chunkBySize(critical, maxSize))),
+			smallestFirst(toPlanned(chunkBySize(optional, maxSize)))...)
+	} else {
+		chunks = toPlanned(chunkBySize(files, maxSize))
+		if cfg.ChunkOrder == chunkOrderSmallest {
+			chunks = smallestFirst(chunks)
+		}
+	}
+	return chunks
+}
+
+func toPlanned(chunks [][]sizedFile) []plannedChunk {
+	out := make([]plannedChunk, 0, len(chunks))
+	for _, files := range chunks {
+		c := plannedChunk{Files: files}
+		for _, f := range files {
+			c.Size += f.Size
+			c.Critical = c.Critical || isCriticalFile(f.Path)
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// smallestFirst sorts chunks by size, chunks of equal size keep their order
+func smallestFirst(chunks []plannedChunk) []plannedChunk {
+	sort.SliceStable(chunks, func(i, j int) bool { return chunks[i].Size < chunks[j].Size })
+	return chunks
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestIsCriticalFile(t *testing.T) {
+	useConfig(t, "CRITICAL_FILES", "eqgame.exe,*.dll,Resources/,maps/base_*.txt")
+	tests := []struct {
+		rel  string
+		want bool
+	}{
+		{"eqgame.exe", true},
+		{"bin/eqgame.exe", true},
+		{"dinput8.dll", true},
+		{"plugins/x/mq2.dll", true},
+		{"Resources/spells_us.txt", true},
+		{"Resources/sub/a.txt", true},
+		{"./Resources/a.txt", true},
+		{"Resources\\a.txt", true},
+		{"maps/base_1.txt", true},
+		{"maps/zone_1.txt", false},
+		{"old/Resources/a.txt", false},
+		{"eqgame.exe.bak", false},
+		{"readme.txt", false},
+	}
+	for _, tt := range tests {
+		if got := isCriticalFile(tt.rel); got != tt.want {
+			t.Errorf("isCriticalFile(%q) = %v, want %v", tt.rel, got, tt.want)
+		}
+	}
+}
+
+func TestPlanChunksOrder(t *testing.T) {
+	// chunks of at most 10 bytes: {big1} {a b} {eqgame.exe} {big2 (12)} {c Resources/x}
+	files := []sizedFile{
+		{"big1.pak", 9}, {"a.txt", 4}, {"b.txt", 4}, {"eqgame.exe", 7}, {"big2.pak", 12},
+		{"c.txt", 2}, {"Resources/x.txt", 3},
+	}
+	type chunk struct {
+		files    string
+		critical bool
+	}
+	tests := []struct {
+		order string
+		want  []chunk
+	}{
+		{chunkOrderNone, []chunk{
+			{"big1.pak", false}, {"a.txt b.txt", false}, {"eqgame.exe", true},
+			{"big2.pak", false}, {"c.txt Resources/x.txt", true},
+		}},
+		{chunkOrderSmallest, []chunk{
+			{"c.txt Resources/x.txt", true}, {"eqgame.exe", true}, {"a.txt b.txt", false},
+			{"big1.pak", false}, {"big2.pak", false},
+		}},
+		// critical files don't share a chunk with optional ones and go first, each group smallest first
+		{chunkOrderCritical, []chunk{
+			{"eqgame.exe Resources/x.txt", true},
+			{"c.txt", false}, {"a.txt b.txt", false}, {"big1.pak", false}, {"big2.pak", false},
+		}},
+	}
+	for _, tt := range tests {
+		useConfig(t, "CHUNK_ORDER", tt.order, "CRITICAL_FILES", "eqgame.exe,Resources/")
+		var got []chunk
+		for _, c := range planChunks(slices.Clone(files), 10) {
+			var names []string
+			var size int64
+			for _, f := range c.Files {
+				names = append(names, f.Path)
+				size += f.Size
+			}
+			if size != c.Size {
+				t.Errorf("%s: chunk %v has size %d, its files add up to %d", tt.order, names, c.Size, size)
+			}
+			got = append(got, chunk{strings.Join(names, " "), c.Critical})
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("CHUNK_ORDER=%s planned %v, want %v", tt.order, got, tt.want)
+		}
+	}
+}
+
+func TestChunkInitReturnsThePlannedOrder(t *testing.T) {
+	files := map[string]string{
+		"eqgame.exe":      strings.Repeat("e", 300),
+		"Resources/a.txt": strings.Repeat("r", 200),
+		"maps/big.txt":    strings.Repeat("m", 900),
+		"maps/small.txt":  strings.Repeat("s", 100),
+	}
+	for order, want := range map[string][]string{
+		chunkOrderNone:     {"maps/big.txt", "maps/small.txt eqgame.exe", "Resources/a.txt"},
+		chunkOrderSmallest: {"Resources/a.txt", "maps/small.txt eqgame.exe", "maps/big.txt"},
+		chunkOrderCritical: {"eqgame.exe Resources/a.txt", "maps/small.txt", "maps/big.txt"},
+	} {
+		useConfig(t, "TMPDIR", t.TempDir(), "CHUNK_ORDER", order, "CRITICAL_FILES", "eqgame.exe,Resources/")
+		useContent(t, files)
+		e := chunkServer(t)
+		res := chunkInit(t, e, `{"files":["maps/big.txt","maps/small.txt","eqgame.exe","Resources/a.txt"],"max_chunk_size":500}`)
+		if len(res.Chunks) != len(want) {
+			t.Fatalf("CHUNK_ORDER=%s: %d chunks, want %d", order, len(res.Chunks), len(want))
+		}
+		for i, c := range res.Chunks {
+			critical := strings.Contains(want[i], "eqgame") || strings.Contains(want[i], "Resources")
+			if c.Order != i || c.Critical != critical {
+				t.Errorf("CHUNK_ORDER=%s: chunk %d has order %d, critical %v, want critical %v", order, i, c.Order, c.Critical, critical)
+			}
+			rec := request(e, http.MethodGet, c.URL, "")
+			if got := strings.Join(zipNames(t, rec.Body.Bytes()), " "); got != want[i] {
+				t.Errorf("CHUNK_ORDER=%s: chunk %d holds %s, want %s", order, i, got, want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// setProcessGroup is a no-op where process groups aren't available, cancel kills git itself
+func setProcessGroup(cmd *exec.Cmd) {}
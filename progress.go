@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"github.com/labstack/echo/v4"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// how often a running clone or fetch logs its progress
+const progressLogInterval = 10 * time.Second
+
+// gitProgress is the progress of one clone, fetch or pull, parsed from git's --progress output
+type gitProgress struct {
+	Repo         string     `json:"repo,omitempty"` // name in REPOS, empty for the main repository
+	Op           string     `json:"op"`
+	State        string     `json:"state"` // running, done or failed
+	Phase        string     `json:"phase,omitempty"`
+	Percent      int        `json:"percent"` // of the current phase
+	Objects      int64      `json:"objects_received"`
+	TotalObjects int64      `json:"objects_total"`
+	Bytes        int64      `json:"bytes_received"`
+	StartedAt    time.Time  `json:"started_at"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// the latest clone/fetch of each repository, by name in REPOS and "" for the main one. The
+// repos update concurrently, one shared record would show whichever wrote last.
+var (
+	pulls   = make(map[string]*gitProgress)
+	pullsMu sync.Mutex
+)
+
+// getPullProgress returns a copy of the latest clone/fetch progress of a repository, "" being the
+// main one, nil if none has run
+func getPullProgress(repo string) *gitProgress {
+	pullsMu.Lock()
+	defer pullsMu.Unlock()
+	if pulls[repo] == nil {
+		return nil
+	}
+	p := *pulls[repo]
+	return &p
+}
+
+// matches e.g. "Receiving objects:  45% (450/1000), 1.20 MiB | 2.00 MiB/s"
+var progressLine = regexp.MustCompile(`^(?:remote: )?([A-Za-z ]+):\s+(\d+)% \((\d+)/(\d+)\)(?:, ([\d.]+) (bytes|KiB|MiB|GiB))?`)
+
+var byteUnits = map[string]float64{"bytes": 1, "KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30}
+
+// progressWriter parses the git stderr stream, progress updates are \r separated. Other output is
+// left to the capture in runGit, which puts it in the error of a failed command.
+type progressWriter struct {
+	progress *gitProgress // guarded by pullsMu
+	buf      []byte
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexAny(w.buf, "\r\n")
+		if i < 0 {
+			break
+		}
+		w.line(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *progressWriter) line(s string) {
+	m := progressLine.FindStringSubmatch(s)
+	if m == nil {
+		return
+	}
+
+	pullsMu.Lock()
+	defer pullsMu.Unlock()
+	p := w.progress
+	p.Phase = m[1]
+	p.Percent, _ = strconv.Atoi(m[2])
+	if m[1] == "Receiving objects" {
+		p.Objects, _ = strconv.ParseInt(m[3], 10, 64)
+		p.TotalObjects, _ = strconv.ParseInt(m[4], 10, 64)
+		if m[5] != "" {
+			n, _ := strconv.ParseFloat(m[5], 64)
+			p.Bytes = int64(n * byteUnits[m[6]])
+		}
+	}
+}
+
+// runGitTracked runs a clone/fetch/pull of a repository ("" for the main one) with progress
+// reporting, the progress record is finalized whether it succeeds or fails
+func runGitTracked(repo, op string, args ...string) error {
+	p := &gitProgress{Repo: repo, Op: op, State: "running", StartedAt: time.Now()}
+	pullsMu.Lock()
+	pulls[repo] = p
+	pullsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(progressLogInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if p := getPullProgress(repo); p != nil {
+					slog.Info("git progress", "repo", p.Repo, "op", p.Op, "phase", p.Phase, "percent", p.Percent, "objects", p.Objects, "total_objects", p.TotalObjects, "bytes", p.Bytes)
+				}
+			}
+		}
+	}()
+
+	err := runGit(nil, &progressWriter{progress: p}, args...)
+	close(done)
+
+	pullsMu.Lock()
+	now := time.Now()
+	p.FinishedAt = &now
+	if err != nil {
+		p.State = "failed"
+		p.Error = err.Error()
+	} else {
+		p.State = "done"
+	}
+	pullsMu.Unlock()
+	return err
+}
+
+// GET /admin/pulls/current is the main repository's latest clone or fetch, ?repo=<name> that of
+// a repo of REPOS
+func handlePullProgress(c echo.Context) error {
+	name := c.QueryParam("repo")
+	if _, ok := repos[name]; name != "" && !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "Unknown repo")
+	}
+	p := getPullProgress(name)
+	if p == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "No clone or fetch has run yet")
+	}
+	return c.JSON(http.StatusOK, p)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// usePulls starts the test without pull progress and puts the previous progress back when it ends
+func usePulls(t *testing.T) {
+	pullsMu.Lock()
+	previous := pulls
+	pulls = make(map[string]*gitProgress)
+	pullsMu.Unlock()
+	t.Cleanup(func() {
+		pullsMu.Lock()
+		defer pullsMu.Unlock()
+		pulls = previous
+	})
+}
+
+func TestPullProgressIsKeptPerRepo(t *testing.T) {
+	useConfig(t)
+	usePulls(t)
+	source := gitFixture(t)
+	repos["extra"] = &repo{Name: "extra"}
+	t.Cleanup(func() { delete(repos, "extra") })
+
+	// the main repository and a repo of REPOS clone at the same time
+	var wg sync.WaitGroup
+	for _, name := range []string{"", "extra", "missing"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			url := source
+			if name == "missing" {
+				url = filepath.Join(t.TempDir(), "nothing here")
+			}
+			_ = runGitTracked(name, "clone", "clone", "--progress", url, filepath.Join(t.TempDir(), "clone"))
+		}()
+	}
+	wg.Wait()
+	for name, state := range map[string]string{"": "done", "extra": "done", "missing": "failed"} {
+		p := getPullProgress(name)
+		if p == nil || p.Repo != name || p.Op != "clone" || p.State != state || p.FinishedAt == nil {
+			t.Errorf("progress of %q = %+v, want a finished clone that %s", name, p, state)
+		}
+	}
+
+	// progress lines go to the record of the run writing them, not to the one that started last
+	main, extra := &gitProgress{Repo: "", State: "running"}, &gitProgress{Repo: "extra", State: "running"}
+	pullsMu.Lock()
+	pulls[""], pulls["extra"] = main, extra
+	pullsMu.Unlock()
+	(&progressWriter{progress: main}).Write([]byte("Receiving objects:  45% (450/1000), 1.00 MiB | 2.00 MiB/s\r"))
+	(&progressWriter{progress: extra}).Write([]byte("remote: Counting objects:  10% (1/10)\r"))
+	if p := getPullProgress(""); p.Phase != "Receiving objects" || p.Percent != 45 || p.Objects != 450 || p.Bytes != 1<<20 {
+		t.Errorf("main repository progress = %+v", p)
+	}
+	if p := getPullProgress("extra"); p.Phase != "Counting objects" || p.Percent != 10 || p.Objects != 0 {
+		t.Errorf("extra progress = %+v", p)
+	}
+
+	e := echo.New()
+	e.GET("/admin/pulls/current", handlePullProgress)
+	for target, want := range map[string]string{"/admin/pulls/current": "", "/admin/pulls/current?repo=extra": "extra"} {
+		rec := request(e, http.MethodGet, target, "")
+		var p gitProgress
+		if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil || rec.Code != http.StatusOK || p.Repo != want {
+			t.Errorf("GET %s = %d %s, want the progress of %q", target, rec.Code, rec.Body.String(), want)
+		}
+	}
+	if rec := request(e, http.MethodGet, "/admin/pulls/current?repo=nowhere", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("GET /admin/pulls/current of an unknown repo = %d, want 404", rec.Code)
+	}
+}
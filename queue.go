@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	errQueueFull       = errors.New("download queue is full")
+	errQueueTimeout    = errors.New("timed out waiting for a download slot")
+	errQueueTokenGone  = errors.New("queue token is unknown or expired")
+	errQueueNotYetDone = errors.New("still queued")
+)
+
+// poll mode tickets not polled (or, once granted, not claimed) within this window are dropped
+const queuePollTTL = 30 * time.Second
+
+// number of recent download durations the wait estimate is based on
+const queueDurationSamples = 32
+
+// downloadQueue enforces the global concurrent download cap. Requests over the cap wait in a
+// bounded FIFO, either blocking on the request itself or, for launchers that prefer to poll,
+// holding a token they check via /queue-status and redeem once their slot is reserved.
+type downloadQueue struct {
+	mu        sync.Mutex
+	limit     int           // 0 means unlimited
+	capacity  int           // max waiting requests
+	timeout   time.Duration // max time a blocking request waits
+	active    int
+	waiting   []*queueTicket
+	tickets   map[string]*queueTicket // poll mode tickets by token
+	durations []time.Duration
+}
+
+type queueTicket struct {
+	token    string
+	enqueued time.Time
+	lastSeen time.Time
+	granted  time.Time // zero until a slot is reserved for the ticket
+	ready    chan struct{}
+}
+
+// queueStatus describes a ticket's place in the queue
+type queueStatus struct {
+	Token                string   `json:"token,omitempty"`
+	Ready                bool     `json:"ready"`
+	Position             int      `json:"position"`
+	EstimatedWaitSeconds *float64 `json:"estimated_wait_seconds,omitempty"`
+}
+
+var downloads = &downloadQueue{tickets: make(map[string]*queueTicket)}
+
+func (q *downloadQueue) configure(limit, capacity int, timeout time.Duration) {
+	q.mu.Lock()
+	q.limit, q.capacity, q.timeout = limit, capacity, timeout
+	q.mu.Unlock()
+}
+
+// tryAcquire takes a slot if one is free and nobody is queued ahead
+func (q *downloadQueue) tryAcquire() (func(), bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.limit <= 0 {
+		return func() {}, true
+	}
+	if q.active < q.limit && len(q.waiting) == 0 {
+		q.active++
+		metricDownloadsActive.Set(float64(q.active))
+		return q.releaser(), true
+	}
+	return nil, false
+}
+
+// acquire waits for a slot until ctx is done or the queue timeout passes. It returns the release
+// func along with the position the request entered the queue at (0 if it never waited).
+func (q *downloadQueue) acquire(ctx context.Context) (func(), int, error) {
+	if release, ok := q.tryAcquire(); ok {
+		return release, 0, nil
+	}
+
+	q.mu.Lock()
+	if len(q.waiting) >= q.capacity {
+		q.mu.Unlock()
+		return nil, 0, errQueueFull
+	}
+	t := &queueTicket{enqueued: time.Now(), ready: make(chan struct{})}
+	q.waiting = append(q.waiting, t)
+	position := len(q.waiting)
+	q.grantLocked() // a slot may have freed up since tryAcquire
+	timeout := q.timeout
+	q.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-t.ready:
+		metricDownloadQueueWait.Observe(time.Since(t.enqueued).Seconds())
+		return q.releaser(), position, nil
+	case <-ctx.Done():
+		q.abandon(t)
+		return nil, position, ctx.Err()
+	case <-timer.C:
+		q.abandon(t)
+		return nil, position, errQueueTimeout
+	}
+}
+
+// enqueuePoll queues a poll mode ticket
+func (q *downloadQueue) enqueuePoll() (queueStatus, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiting) >= q.capacity {
+		return queueStatus{}, errQueueFull
+	}
+	now := time.Now()
+	t := &queueTicket{token: randomToken(), enqueued: now, lastSeen: now, ready: make(chan struct{})}
+	q.waiting = append(q.waiting, t)
+	q.tickets[t.token] = t
+	q.grantLocked()
+	return q.statusLocked(t), nil
+}
+
+// status reports a poll ticket's position, refreshing its expiry
+func (q *downloadQueue) status(token string) (queueStatus, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t, ok := q.tickets[token]
+	if !ok {
+		return queueStatus{}, errQueueTokenGone
+	}
+	t.lastSeen = time.Now()
+	return q.statusLocked(t), nil
+}
+
+// claim redeems a poll ticket whose slot has been reserved
+func (q *downloadQueue) claim(token string) (func(), queueStatus, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t, ok := q.tickets[token]
+	if !ok {
+		return nil, queueStatus{}, errQueueTokenGone
+	}
+	t.lastSeen = time.Now()
+	if t.granted.IsZero() {
+		return nil, q.statusLocked(t), errQueueNotYetDone
+	}
+	delete(q.tickets, token)
+	metricDownloadQueueWait.Observe(t.granted.Sub(t.enqueued).Seconds())
+	return q.releaser(), q.statusLocked(t), nil
+}
+
+// releaser returns a func giving the slot back, recording how long it was held
+func (q *downloadQueue) releaser() func() {
+	start := time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.durations = append(q.durations, time.Since(start))
+			if len(q.durations) > queueDurationSamples {
+				q.durations = q.durations[1:]
+			}
+			q.releaseLocked()
+		})
+	}
+}
+
+func (q *downloadQueue) releaseLocked() {
+	q.active--
+	q.grantLocked()
+}
+
+// grantLocked hands free slots to the head of the queue
+func (q *downloadQueue) grantLocked() {
+	for q.active < q.limit && len(q.waiting) > 0 {
+		t := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		t.granted = time.Now()
+		q.active++
+		close(t.ready)
+	}
+	metricDownloadsActive.Set(float64(q.active))
+	metricDownloadQueueDepth.Set(float64(len(q.waiting)))
+}
+
+// abandon removes a ticket whose client went away, giving back its slot if it was already granted
+func (q *downloadQueue) abandon(t *queueTicket) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.abandonLocked(t)
+}
+
+func (q *downloadQueue) abandonLocked(t *queueTicket) {
+	if t.token != "" {
+		delete(q.tickets, t.token)
+	}
+	if !t.granted.IsZero() {
+		q.releaseLocked()
+		return
+	}
+	for i, w := range q.waiting {
+		if w == t {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			break
+		}
+	}
+	metricDownloadQueueDepth.Set(float64(len(q.waiting)))
+}
+
+// runQueueSweep expires the poll tickets of the download queue until ctx is done
+func runQueueSweep(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			downloads.expireTickets(now)
+		}
+	}
+}
+
+// expireTickets drops poll tickets that stopped polling or never claimed their slot
+func (q *downloadQueue) expireTickets(now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, t := range q.tickets {
+		if now.Sub(t.lastSeen) > queuePollTTL {
+			metricDownloadQueueRejected.WithLabelValues("expired").Inc()
+			q.abandonLocked(t)
+		}
+	}
+}
+
+func (q *downloadQueue) statusLocked(t *queueTicket) queueStatus {
+	s := queueStatus{Token: t.token, Ready: !t.granted.IsZero()}
+	if s.Ready {
+		return s
+	}
+	for i, w := range q.waiting {
+		if w == t {
+			s.Position = i + 1
+			break
+		}
+	}
+	s.EstimatedWaitSeconds = q.estimateLocked(s.Position)
+	return s
+}
+
+// estimateLocked guesses the wait for a queue position from recent download durations
+func (q *downloadQueue) estimateLocked(position int) *float64 {
+	if len(q.durations) == 0 || q.limit <= 0 {
+		return nil
+	}
+	var total time.Duration
+	for _, d := range q.durations {
+		total += d
+	}
+	avg := total.Seconds() / float64(len(q.durations))
+	wait := avg * float64(position) / float64(q.limit)
+	return &wait
+}
+
+func (q *downloadQueue) retryAfter() string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if wait := q.estimateLocked(len(q.waiting) + 1); wait != nil && *wait >= 1 {
+		return strconv.Itoa(int(*wait))
+	}
+	return "30"
+}
+
+// snapshot reports the cap and current occupancy
+func (q *downloadQueue) snapshot() echo.Map {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return echo.Map{"limit": q.limit, "active": q.active, "waiting": len(q.waiting)}
+}
+
+func randomToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// downloadQueueMiddleware holds a download slot for the duration of the request. Requests over the
+// cap wait in line; with ?queue=poll they get a token right away and come back with ?queue_token=.
+func downloadQueueMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var release func()
+
+		if token := c.QueryParam("queue_token"); token != "" {
+			var status queueStatus
+			var err error
+			release, status, err = downloads.claim(token)
+			if errors.Is(err, errQueueTokenGone) {
+				return echo.NewHTTPError(http.StatusNotFound, "Queue token is unknown or expired")
+			}
+			if errors.Is(err, errQueueNotYetDone) {
+				return c.JSON(http.StatusAccepted, status)
+			}
+		} else if c.QueryParam("queue") == "poll" {
+			var ok bool
+			if release, ok = downloads.tryAcquire(); !ok {
+				status, err := downloads.enqueuePoll()
+				if err != nil {
+					return queueRejected(c, "full")
+				}
+				return c.JSON(http.StatusAccepted, status)
+			}
+		} else {
+			start := time.Now()
+			var position int
+			var err error
+			release, position, err = downloads.acquire(c.Request().Context())
+			switch {
+			case errors.Is(err, errQueueFull):
+				return queueRejected(c, "full")
+			case errors.Is(err, errQueueTimeout):
+				return queueRejected(c, "timeout")
+			case err != nil:
+				metricDownloadQueueRejected.WithLabelValues("disconnected").Inc()
+				return err
+			}
+			if position > 0 {
+				c.Response().Header().Set("X-Queue-Position", strconv.Itoa(position))
+				c.Response().Header().Set("X-Queue-Wait", fmt.Sprintf("%.3f", time.Since(start).Seconds()))
+			}
+		}
+
+		defer release()
+		return next(c)
+	}
+}
+
+func queueRejected(c echo.Context, reason string) error {
+	metricDownloadQueueRejected.WithLabelValues(reason).Inc()
+	c.Response().Header().Set("Retry-After", downloads.retryAfter())
+	return c.JSON(http.StatusServiceUnavailable, echo.Map{
+		"error": "Too many downloads in progress, try again later.",
+	})
+}
+
+// GET /queue-status?token=
+func handleQueueStatus(c echo.Context) error {
+	status, err := downloads.status(c.QueryParam("token"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Queue token is unknown or expired")
+	}
+	return c.JSON(http.StatusOK, status)
+}
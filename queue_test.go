@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// useDownloadQueue gives the test a download queue of its own
+func useDownloadQueue(t *testing.T, limit, capacity int, timeout time.Duration) *downloadQueue {
+	previous := downloads
+	downloads = &downloadQueue{tickets: make(map[string]*queueTicket)}
+	downloads.configure(limit, capacity, timeout)
+	t.Cleanup(func() { downloads = previous })
+	return downloads
+}
+
+// queuedDownloads is how many requests are waiting in q
+func queuedDownloads(q *downloadQueue) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting)
+}
+
+// awaitQueued waits until n requests are waiting in q
+func awaitQueued(t *testing.T, q *downloadQueue, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); queuedDownloads(q) != n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests queued, want %d", queuedDownloads(q), n)
+		}
+	}
+}
+
+func TestDownloadQueueGrantsInOrder(t *testing.T) {
+	q := useDownloadQueue(t, 1, 10, time.Minute)
+	held, ok := q.tryAcquire()
+	if !ok {
+		t.Fatal("the first download didn't get the free slot")
+	}
+	type grant struct {
+		n        int
+		position int
+		release  func()
+	}
+	granted := make(chan grant, 3)
+	for n := range 3 {
+		go func() {
+			release, position, err := q.acquire(context.Background())
+			if err != nil {
+				t.Errorf("acquire %d: %v", n, err)
+				return
+			}
+			granted <- grant{n, position, release}
+		}()
+		awaitQueued(t, q, n+1)
+	}
+	if _, ok := q.tryAcquire(); ok {
+		t.Fatal("a new download jumped the queue")
+	}
+
+	held()
+	for want := range 3 {
+		select {
+		case g := <-granted:
+			if g.n != want || g.position != want+1 {
+				t.Fatalf("download %d got the slot from position %d, want %d from %d", g.n, g.position, want, want+1)
+			}
+			select {
+			case g := <-granted:
+				t.Fatalf("download %d got a slot while %d held the only one", g.n, want)
+			case <-time.After(10 * time.Millisecond):
+			}
+			g.release()
+			g.release() // a second release gives nothing back
+		case <-time.After(time.Second):
+			t.Fatalf("download %d never got the slot", want)
+		}
+	}
+	if s := q.snapshot(); s["active"] != 0 || s["waiting"] != 0 {
+		t.Errorf("queue after every download = %v", s)
+	}
+}
+
+func TestDownloadQueueDropsDisconnectedClients(t *testing.T) {
+	q := useDownloadQueue(t, 1, 1, time.Minute)
+	held, _ := q.tryAcquire()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := q.acquire(ctx)
+		done <- err
+	}()
+	awaitQueued(t, q, 1)
+	if _, _, err := q.acquire(context.Background()); !errors.Is(err, errQueueFull) {
+		t.Errorf("acquire with the queue full = %v, want errQueueFull", err)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("acquire of a client that went away = %v", err)
+	}
+	if n := queuedDownloads(q); n != 0 {
+		t.Errorf("%d requests still queued after the client went away", n)
+	}
+
+	// the slot goes to the next client rather than to the one that left
+	held()
+	release, ok := q.tryAcquire()
+	if !ok {
+		t.Fatal("the freed slot went to a client that left")
+	}
+	release()
+
+	useDownloadQueue(t, 1, 1, 10*time.Millisecond)
+	held, _ = downloads.tryAcquire()
+	defer held()
+	if _, _, err := downloads.acquire(context.Background()); !errors.Is(err, errQueueTimeout) {
+		t.Errorf("acquire past DOWNLOAD_QUEUE_TIMEOUT = %v, want errQueueTimeout", err)
+	}
+}
+
+func TestDownloadQueuePollTickets(t *testing.T) {
+	q := useDownloadQueue(t, 1, 10, time.Minute)
+	e := echo.New()
+	e.GET("/download", func(c echo.Context) error { return c.String(http.StatusOK, "file") }, downloadQueueMiddleware)
+	e.GET("/queue-status", handleQueueStatus)
+	ticket := func() queueStatus {
+		t.Helper()
+		rec := request(e, http.MethodGet, "/download?queue=poll", "")
+		var s queueStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil || rec.Code != http.StatusAccepted || s.Token == "" {
+			t.Fatalf("GET ?queue=poll with every slot taken = %d %s", rec.Code, rec.Body.String())
+		}
+		return s
+	}
+
+	held, _ := q.tryAcquire()
+	first, second := ticket(), ticket()
+	if first.Position != 1 || second.Position != 2 || first.Ready {
+		t.Errorf("tickets %+v and %+v", first, second)
+	}
+	if rec := request(e, http.MethodGet, "/download?queue_token="+first.Token, ""); rec.Code != http.StatusAccepted {
+		t.Errorf("claim of a ticket still queued = %d, want 202", rec.Code)
+	}
+
+	// the first ticket's slot is reserved once one frees, and it's claimed with the token
+	held()
+	rec := request(e, http.MethodGet, "/queue-status?token="+first.Token, "")
+	var status queueStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil || !status.Ready {
+		t.Fatalf("status of the first ticket = %d %s, want it ready", rec.Code, rec.Body.String())
+	}
+	if rec := request(e, http.MethodGet, "/download?queue_token="+first.Token, ""); rec.Code != http.StatusOK || rec.Body.String() != "file" {
+		t.Errorf("claim of the ready ticket = %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := request(e, http.MethodGet, "/download?queue_token="+first.Token, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("second claim of the ticket = %d, want 404", rec.Code)
+	}
+
+	// the slot went on to the second ticket, which is never claimed: it expires and the slot goes
+	// to the third
+	third := ticket()
+	q.mu.Lock()
+	q.tickets[second.Token].lastSeen = time.Now().Add(-queuePollTTL - time.Second)
+	q.mu.Unlock()
+	q.expireTickets(time.Now())
+	for _, target := range []string{"/queue-status?token=" + second.Token, "/download?queue_token=" + second.Token, "/download?queue_token=unknown"} {
+		if rec := request(e, http.MethodGet, target, ""); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", target, rec.Code)
+		}
+	}
+	rec = request(e, http.MethodGet, "/queue-status?token="+third.Token, "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil || !status.Ready {
+		t.Errorf("status of the ticket behind the expired one = %d %s, want it ready", rec.Code, rec.Body.String())
+	}
+}
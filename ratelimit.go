@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/time/rate"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// open download streams per client identity, swept with the limiters' visitors
+	streams   = make(map[string]*clientStreams)
+	streamsMu sync.Mutex
+
+	// every limiter newRateLimiter made, for the idle sweep
+	rateLimiters   []*rateLimiter
+	rateLimitersMu sync.Mutex
+)
+
+// visitorSweepEvery is how often idle limiters are looked for
+const visitorSweepEvery = time.Minute
+
+// rateLimitConfig is a per client budget of Requests every Interval, up to Burst at once.
+// Requests 0 disables the limit.
+type rateLimitConfig struct {
+	Requests int
+	Interval time.Duration
+	Burst    int
+}
+
+// String describes the budget for error messages, "10 requests per minute"
+func (l rateLimitConfig) String() string {
+	per := l.Interval.String()
+	switch l.Interval {
+	case time.Second:
+		per = "second"
+	case time.Minute:
+		per = "minute"
+	case time.Hour:
+		per = "hour"
+	}
+	return fmt.Sprintf("%d requests per %s", l.Requests, per)
+}
+
+// rateLimiter keeps a token bucket per client, each instance with its own budget and clients
+type rateLimiter struct {
+	name     string
+	limit    rateLimitConfig
+	mu       sync.Mutex
+	visitors map[string]*visitor
+}
+
+// clientStreams are the streams a client has open, Chunks of them chunk downloads
+type clientStreams struct {
+	Open   int `json:"open"`
+	Chunks int `json:"chunks"`
+}
+
+// visitor is a client's limiter and when it last made a request
+type visitor struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter(name string, limit rateLimitConfig) *rateLimiter {
+	l := &rateLimiter{name: name, limit: limit, visitors: make(map[string]*visitor)}
+	rateLimitersMu.Lock()
+	rateLimiters = append(rateLimiters, l)
+	rateLimitersMu.Unlock()
+	return l
+}
+
+// every is the time one request's token takes to come back
+func (l *rateLimiter) every() time.Duration {
+	return l.limit.Interval / time.Duration(l.limit.Requests)
+}
+
+func (l *rateLimiter) getVisitor(ip string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	v, exists := l.visitors[ip]
+	if !exists {
+		v = &visitor{limiter: rate.NewLimiter(rate.Every(l.every()), l.limit.Burst)}
+		l.visitors[ip] = v
+	}
+	v.lastSeen = time.Now()
+	return v.limiter
+}
+
+// middleware rejects clients over the budget with 429, a disabled limit lets everything through
+func (l *rateLimiter) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	if l.limit.Requests <= 0 {
+		return next
+	}
+	return func(c echo.Context) error {
+		limiter := l.getVisitor(clientIdentity(c.Request()))
+		if !limiter.Allow() {
+			metricRateLimited.WithLabelValues(l.name).Inc()
+			wait := (1 - limiter.Tokens()) * l.every().Seconds()
+			c.Response().Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait)))))
+			return c.JSON(http.StatusTooManyRequests, echo.Map{
+				"error": fmt.Sprintf("Rate limit exceeded. Max %s.", l.limit),
+			})
+		}
+		return next(c)
+	}
+}
+
+func runVisitorCleanup(ctx context.Context) {
+	ticker := time.NewTicker(visitorSweepEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			evictVisitors(now, cfg.VisitorIdleTimeout)
+		}
+	}
+}
+
+// evictVisitors drops the limiters of clients idle for longer than idle, in every rate limiter.
+// A limiter whose bucket hasn't refilled yet stays whatever the idle time, so dropping one never
+// hands a client a fresh burst it wouldn't have had anyway.
+func evictVisitors(now time.Time, idle time.Duration) int {
+	rateLimitersMu.Lock()
+	limiters := slices.Clone(rateLimiters)
+	rateLimitersMu.Unlock()
+
+	evicted := 0
+	for _, l := range limiters {
+		l.mu.Lock()
+		for ip, v := range l.visitors {
+			if now.Sub(v.lastSeen) > idle && v.limiter.TokensAt(now) >= float64(v.limiter.Burst()) {
+				delete(l.visitors, ip)
+				evicted++
+			}
+		}
+		l.mu.Unlock()
+	}
+
+	// a release always deletes the client's entry, this only catches one left at zero
+	streamsMu.Lock()
+	for id, s := range streams {
+		if s.Open <= 0 {
+			delete(streams, id)
+		}
+	}
+	streamsMu.Unlock()
+	return evicted
+}
+
+// streamsSnapshot copies the open stream counts by client
+func streamsSnapshot() map[string]clientStreams {
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+	out := make(map[string]clientStreams, len(streams))
+	for id, s := range streams {
+		out[id] = *s
+	}
+	return out
+}
+
+// getClientIP returns the address of the client. Requests from a TRUSTED_PROXIES address are
+// attributed to the rightmost X-Forwarded-For hop that isn't a trusted proxy itself, or to
+// X-Real-IP when there's no X-Forwarded-For. It's also echo's IPExtractor, so c.RealIP() and the
+// request log agree with the limiters.
+func getClientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if len(cfg.TrustedProxies) == 0 || !isTrustedProxy(ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHop(hops[i])
+		if hop == "" {
+			// nothing left of a malformed hop can be trusted
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			return hop
+		}
+	}
+	if len(hops) == 0 {
+		if hop := parseHop(r.Header.Get("X-Real-IP")); hop != "" {
+			return hop
+		}
+	}
+	return ip
+}
+
+func isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && ipInNets(parsed, cfg.TrustedProxies)
+}
+
+// parseHop returns the IP of a forwarding header entry, which may carry a port, "" if it has none
+func parseHop(hop string) string {
+	hop = strings.TrimSpace(hop)
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	hop = strings.Trim(hop, "[]")
+	if net.ParseIP(hop) == nil {
+		return ""
+	}
+	return hop
+}
+
+// clientIdentity is the key per-client limits are tracked under, the client IP in canonical
+// form so IPv4-mapped IPv6 addresses and differently written IPv6 addresses share a bucket
+func clientIdentity(r *http.Request) string {
+	ip := getClientIP(r)
+	if parsed := net.ParseIP(ip); parsed != nil {
+		if v4 := parsed.To4(); v4 != nil {
+			return v4.String()
+		}
+		return parsed.String()
+	}
+	return ip
+}
+
+// streamAllowlisted tells whether the client with identity id is in STREAM_LIMIT_ALLOWLIST, or
+// presented one of STREAM_LIMIT_ALLOWLIST_KEYS
+func streamAllowlisted(id string, r *http.Request) bool {
+	if ip := net.ParseIP(id); ip != nil && ipInNets(ip, cfg.StreamAllowlist) {
+		return true
+	}
+	key := presentedAPIKey(r)
+	if key == "" {
+		return false
+	}
+	// compared against every key, so the time taken doesn't tell which one came close
+	match := 0
+	for _, k := range cfg.StreamAllowlistKeys {
+		match |= subtle.ConstantTimeCompare([]byte(key), []byte(k))
+	}
+	return match == 1
+}
+
+// streamLimitFor returns the number of concurrent streams a client may open, 0 being unlimited
+func streamLimitFor(allowlisted bool) int {
+	if allowlisted {
+		return cfg.AllowlistMaxStreamsPerIP
+	}
+	return cfg.MaxStreamsPerIP
+}
+
+// chunkStreamLimitFor returns the number of those streams that may be chunk downloads, allowlisted
+// clients only have their overall limit
+func chunkStreamLimitFor(allowlisted bool) int {
+	if allowlisted {
+		return 0
+	}
+	return cfg.MaxChunkStreamsPerIP
+}
+
+// streamRefusal is the limit a new stream ran into
+type streamRefusal struct {
+	limit int
+	open  int
+	chunk bool // the chunk download limit rather than the overall one
+}
+
+// acquireStream counts a new stream for the client, chunk for a chunk download, returning the
+// limit it's at instead when it is
+func acquireStream(id string, allowlisted, chunk bool) (func(), *streamRefusal) {
+	limit, chunkLimit := streamLimitFor(allowlisted), 0
+	if chunk {
+		chunkLimit = chunkStreamLimitFor(allowlisted)
+	}
+	if limit <= 0 && chunkLimit <= 0 {
+		return func() {}, nil
+	}
+
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+	s := streams[id]
+	if s == nil {
+		s = &clientStreams{}
+	}
+	if limit > 0 && s.Open >= limit {
+		return nil, &streamRefusal{limit: limit, open: s.Open}
+	}
+	if chunkLimit > 0 && s.Chunks >= chunkLimit {
+		return nil, &streamRefusal{limit: chunkLimit, open: s.Chunks, chunk: true}
+	}
+	streams[id] = s
+	s.Open++
+	if chunk {
+		s.Chunks++
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			streamsMu.Lock()
+			defer streamsMu.Unlock()
+			s.Open--
+			if chunk {
+				s.Chunks--
+			}
+			if s.Open <= 0 && streams[id] == s {
+				delete(streams, id)
+			}
+		})
+	}, nil
+}
+
+// streamLimitMiddleware enforces MAX_STREAMS_PER_IP on a streaming route, the stream is counted
+// until the handler returns however it exits
+func streamLimitMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return limitStreams(next, false)
+}
+
+// chunkStreamLimitMiddleware is streamLimitMiddleware for chunk downloads, which also count
+// against MAX_CHUNK_STREAMS_PER_IP
+func chunkStreamLimitMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return limitStreams(next, true)
+}
+
+func limitStreams(next echo.HandlerFunc, chunk bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := clientIdentity(c.Request())
+		release, refused := acquireStream(id, streamAllowlisted(id, c.Request()), chunk)
+		if refused != nil {
+			what := "downloads"
+			if refused.chunk {
+				what = "chunk downloads"
+				metricRateLimited.WithLabelValues("chunk_streams").Inc()
+			} else {
+				metricRateLimited.WithLabelValues("streams").Inc()
+			}
+			c.Response().Header().Set("Retry-After", "10")
+			return c.JSON(http.StatusTooManyRequests, echo.Map{
+				"error":       fmt.Sprintf("Too many simultaneous %s from your address, %d of %d open. Retry once one finishes.", what, refused.open, refused.limit),
+				"open":        refused.open,
+				"limit":       refused.limit,
+				"retry_after": 10,
+			})
+		}
+		defer release()
+		openStreams.Add(1)
+		defer openStreams.Add(-1)
+		return next(c)
+	}
+}
+
+// staticStreamLimitMiddleware applies the stream limit and throttle to static files of at least
+// LARGE_FILE_THRESHOLD bytes, small files are served without counting
+func staticStreamLimitMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	limited := streamLimitMiddleware(throttleMiddleware(next))
+	return func(c echo.Context) error {
+		unlimited := cfg.MaxStreamsPerIP <= 0 && cfg.AllowlistMaxStreamsPerIP <= 0 &&
+			cfg.MaxStreamBytesPerSec <= 0 && totalThrottle == nil
+		if staticSkipper(c) || unlimited {
+			return next(c)
+		}
+		p, err := url.PathUnescape(c.Request().URL.Path)
+		if err != nil {
+			return next(c)
+		}
+		_, full, err := resolveRepoPath(defaultContent.Dir, strings.TrimPrefix(p, "/"))
+		if err != nil {
+			return next(c)
+		}
+		if info, err := os.Stat(full); err == nil && info.Mode().IsRegular() && info.Size() >= cfg.LargeFileThreshold {
+			return limited(c)
+		}
+		return next(c)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useRateLimiter makes a limiter for the test and takes it off the idle sweep when it ends
+func useRateLimiter(t *testing.T, name string, limit rateLimitConfig) *rateLimiter {
+	l := newRateLimiter(name, limit)
+	t.Cleanup(func() {
+		rateLimitersMu.Lock()
+		rateLimiters = slices.DeleteFunc(rateLimiters, func(r *rateLimiter) bool { return r == l })
+		rateLimitersMu.Unlock()
+	})
+	return l
+}
+
+func TestEvictVisitorsShrinksTheMap(t *testing.T) {
+	useConfig(t)
+	l := useRateLimiter(t, "test", rateLimitConfig{Requests: 1, Interval: time.Hour, Burst: 2})
+	e := echo.New()
+	e.GET("/", func(c echo.Context) error { return c.NoContent(http.StatusOK) }, l.middleware)
+	get := func(ip string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// scanner traffic, one request from each of a few thousand addresses
+	for i := 0; i < 5000; i++ {
+		get(fmt.Sprintf("10.%d.%d.%d", i>>16&255, i>>8&255, i&255))
+	}
+	// a client that has used its whole burst
+	for get("192.0.2.7") != http.StatusTooManyRequests {
+	}
+	if n := len(l.visitors); n != 5001 {
+		t.Fatalf("%d visitors, want 5001", n)
+	}
+
+	// idle but not long enough: nothing goes
+	if evicted := evictVisitors(time.Now(), time.Minute); evicted != 0 {
+		t.Errorf("evicted %d visitors seen just now", evicted)
+	}
+	// the scanners' buckets refill in an hour, the drained one takes two
+	evictVisitors(time.Now().Add(90*time.Minute), time.Minute)
+	if n := len(l.visitors); n != 1 {
+		t.Fatalf("%d visitors after the sweep, want the drained client alone", n)
+	}
+	if _, ok := l.visitors["192.0.2.7"]; !ok {
+		t.Fatal("the drained client was evicted, it would get a fresh burst")
+	}
+	if code := get("192.0.2.7"); code != http.StatusTooManyRequests {
+		t.Errorf("drained client after the sweep = %d, want 429", code)
+	}
+	evictVisitors(time.Now().Add(3*time.Hour), time.Minute)
+	if n := len(l.visitors); n != 0 {
+		t.Errorf("%d visitors once every bucket refilled, want 0", n)
+	}
+}
+
+func TestStreamAllowlistTakesAddressesAndKeys(t *testing.T) {
+	useConfig(t, "MAX_STREAMS_PER_IP", "1", "MAX_CHUNK_STREAMS_PER_IP", "1", "ALLOWLIST_MAX_STREAMS_PER_IP", "3",
+		"STREAM_LIMIT_ALLOWLIST", "198.51.100.0/24", "STREAM_LIMIT_ALLOWLIST_KEYS", "partner-key, other-key")
+	tests := []struct {
+		ip      string
+		headers []string
+		limit   int
+	}{
+		{"192.0.2.1", nil, 1},
+		{"198.51.100.9", nil, 3},
+		{"192.0.2.2", []string{"X-Api-Key", "partner-key"}, 3},
+		{"192.0.2.3", []string{"Authorization", "Bearer other-key"}, 3},
+		{"192.0.2.4", []string{"X-Api-Key", "partner-key-but-longer"}, 1},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.ip + ":1234"
+		for i := 0; i+1 < len(tt.headers); i += 2 {
+			req.Header.Set(tt.headers[i], tt.headers[i+1])
+		}
+		id := clientIdentity(req)
+		allowlisted := streamAllowlisted(id, req)
+		// chunk downloads, the allowlisted aren't held to MAX_CHUNK_STREAMS_PER_IP
+		var releases []func()
+		for i := 0; i < tt.limit; i++ {
+			release, refused := acquireStream(id, allowlisted, true)
+			if refused != nil {
+				t.Fatalf("%s %v: stream %d refused at %+v, want a limit of %d", tt.ip, tt.headers, i+1, *refused, tt.limit)
+			}
+			releases = append(releases, release)
+		}
+		if _, refused := acquireStream(id, allowlisted, false); refused == nil || refused.limit != tt.limit {
+			t.Errorf("%s %v: stream over the limit refused with %+v, want the limit of %d", tt.ip, tt.headers, refused, tt.limit)
+		}
+		for _, release := range releases {
+			release()
+		}
+	}
+
+	// through the middleware, a client at its limit gets 429 unless it sends an allowlisted key
+	e := echo.New()
+	e.GET("/", func(c echo.Context) error { return c.NoContent(http.StatusOK) }, streamLimitMiddleware)
+	release, _ := acquireStream("192.0.2.1", false, false)
+	defer release()
+	for key, want := range map[string]int{"": http.StatusTooManyRequests, "wrong": http.StatusTooManyRequests, "other-key": http.StatusOK} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Api-Key", key)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("with key %q at the limit = %d, want %d", key, rec.Code, want)
+		}
+	}
+}
+
+func TestEnvRateLimit(t *testing.T) {
+	tests := []struct {
+		env            []string
+		init, download rateLimitConfig
+		err            string
+	}{
+		{nil, rateLimitConfig{10, time.Minute, 10}, rateLimitConfig{600, time.Minute, 120}, ""},
+		{[]string{"RATE_LIMIT_INIT", "5/10s", "RATE_LIMIT_DOWNLOAD", " 30 / 1h "},
+			rateLimitConfig{5, 10 * time.Second, 5}, rateLimitConfig{30, time.Hour, 30}, ""},
+		{[]string{"RATE_LIMIT_INIT_BURST", "3", "RATE_LIMIT_DOWNLOAD", "off"},
+			rateLimitConfig{10, time.Minute, 3}, rateLimitConfig{}, ""},
+		{[]string{"RATE_LIMIT_INIT", "0"}, rateLimitConfig{}, rateLimitConfig{600, time.Minute, 120}, ""},
+		{[]string{"RATE_LIMIT_INIT", "10"}, rateLimitConfig{}, rateLimitConfig{}, "RATE_LIMIT_INIT: expected"},
+		{[]string{"RATE_LIMIT_INIT", "-1/1m"}, rateLimitConfig{}, rateLimitConfig{}, "RATE_LIMIT_INIT: expected"},
+		{[]string{"RATE_LIMIT_DOWNLOAD", "10/soon"}, rateLimitConfig{}, rateLimitConfig{}, "RATE_LIMIT_DOWNLOAD: invalid interval"},
+		{[]string{"RATE_LIMIT_DOWNLOAD", "10/0s"}, rateLimitConfig{}, rateLimitConfig{}, "RATE_LIMIT_DOWNLOAD: invalid interval"},
+		{[]string{"RATE_LIMIT_DOWNLOAD_BURST", "-5"}, rateLimitConfig{}, rateLimitConfig{}, "RATE_LIMIT_DOWNLOAD_BURST"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.env), func(t *testing.T) {
+			for i := 0; i+1 < len(tt.env); i += 2 {
+				t.Setenv(tt.env[i], tt.env[i+1])
+			}
+			c, err := loadConfig()
+			if tt.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+					t.Errorf("loadConfig = %v, want an error starting %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.RateLimitInit != tt.init || c.RateLimitDownload != tt.download {
+				t.Errorf("limits = %+v and %+v, want %+v and %+v", c.RateLimitInit, c.RateLimitDownload, tt.init, tt.download)
+			}
+		})
+	}
+}
+
+func TestRateLimitsArePerEndpoint(t *testing.T) {
+	useConfig(t)
+	initLimit := useRateLimiter(t, "init", rateLimitConfig{Requests: 2, Interval: time.Minute, Burst: 2})
+	downloadLimit := useRateLimiter(t, "download", rateLimitConfig{Requests: 3, Interval: time.Minute, Burst: 3})
+	off := useRateLimiter(t, "off", rateLimitConfig{})
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	e := echo.New()
+	e.POST("/zip-chunks/init", ok, initLimit.middleware)
+	e.GET("/file/*", ok, downloadLimit.middleware)
+	e.GET("/healthz", ok, off.middleware)
+	send := func(method, target, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for range 2 {
+		if rec := send(http.MethodPost, "/zip-chunks/init", "192.0.2.1"); rec.Code != http.StatusOK {
+			t.Fatalf("init within its burst = %d", rec.Code)
+		}
+	}
+	rec := send(http.MethodPost, "/zip-chunks/init", "192.0.2.1")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "30" ||
+		!strings.Contains(rec.Body.String(), "Max 2 requests per minute") {
+		t.Errorf("init past its burst = %d, Retry-After %q, %s", rec.Code, rec.Header().Get("Retry-After"), rec.Body.String())
+	}
+
+	// the downloads of the same client draw on a budget of their own, as do other clients' inits
+	for i := range 3 {
+		if rec := send(http.MethodGet, "/file/maps/a.txt", "192.0.2.1"); rec.Code != http.StatusOK {
+			t.Fatalf("download %d after init ran out = %d", i, rec.Code)
+		}
+	}
+	if rec := send(http.MethodGet, "/file/maps/a.txt", "192.0.2.1"); rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "20" {
+		t.Errorf("download past its burst = %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := send(http.MethodPost, "/zip-chunks/init", "192.0.2.2"); rec.Code != http.StatusOK {
+		t.Errorf("init from another client = %d", rec.Code)
+	}
+
+	// a limit that's off never rejects nor tracks anyone
+	for range 100 {
+		if rec := send(http.MethodGet, "/healthz", "192.0.2.1"); rec.Code != http.StatusOK {
+			t.Fatalf("request under a disabled limit = %d", rec.Code)
+		}
+	}
+	if len(off.visitors) != 0 {
+		t.Errorf("a disabled limit tracked %d visitors", len(off.visitors))
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const repoDir = "repos" // one clone per entry of REPOS
+
+// repoConfig is one entry of REPOS, name=url
+type repoConfig struct {
+	Name string
+	URL  string
+}
+
+// repoNamePattern keeps repo names usable as a path segment and in chunk IDs and file names
+var repoNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// reservedRepoNames are the top level paths a repo prefix would shadow
+var reservedRepoNames = map[string]bool{
+	"admin": true, "checksum": true, "delta": true, "diff": true, "file": true, "gh-update": true, "healthz": true, "latest": true, "manifest": true,
+	"manifest.json": true, "manifest.sig": true, "metrics": true, "mirrors": true, "news": true,
+	"pubkey": true, "queue-status": true, "speedtest": true, "sync": true, "tree": true,
+	"version": true, "zip-all": true, "zip-all.torrent": true, "zip-chunks": true, filelistName: true,
+}
+
+// repo is an additional repository served under /<name>/ with its own clone, manifest and chunk
+// endpoints. It just follows its default branch: pins, BRANCHES and the full archive only apply
+// to the main repository.
+type repo struct {
+	Name    string
+	URL     string
+	Content *contentTree
+
+	updateMu sync.Mutex // serializes updates of this repo
+
+	lastMu  sync.Mutex
+	last    updateResult
+	lastID  int64         // last update ID handed out for the repo
+	running *updateResult // the run in progress, nil when idle
+}
+
+var (
+	repos     = make(map[string]*repo)
+	repoOrder []*repo
+)
+
+// configureRepos creates the content trees of the configured repos and keeps the static
+// middleware of the main checkout away from their prefixes
+func configureRepos(configs []repoConfig) {
+	for _, rc := range configs {
+		t := newContentTree("", filepath.Join(repoDir, rc.Name))
+		t.Repo = rc.Name
+		r := &repo{Name: rc.Name, URL: rc.URL, Content: t}
+		repos[rc.Name] = r
+		repoOrder = append(repoOrder, r)
+		staticSkipPrefixes = append(staticSkipPrefixes, "/"+rc.Name+"/")
+	}
+}
+
+// registerRepoRoutes serves every repo's content endpoints under its prefix, any other path below
+// it is a file of the repo
+func registerRepoRoutes(e *echo.Echo, initLimit, downloadLimit echo.MiddlewareFunc) {
+	for _, r := range repoOrder {
+		g := e.Group("/"+r.Name, repoMiddleware(r.Content))
+		g.POST("/zip-chunks/init", handleChunkInit, apiKeyMiddleware, maintenanceMiddleware, initLimit)
+		g.POST("/zip-chunks/plan", handleChunkPlan, apiKeyMiddleware, maintenanceMiddleware)
+		g.GET("/zip-chunks/:chunkID", handleChunkDownload, apiKeyMiddleware, downloadLimit, chunkStreamLimitMiddleware, downloadQueueMiddleware, throttleMiddleware)
+		g.HEAD("/zip-chunks/:chunkID", handleChunkHead, apiKeyMiddleware)
+		g.GET("/zip-chunks/:chunkID/entries", handleChunkEntries, apiKeyMiddleware)
+		g.GET("/zip-chunks/:chunkID/checksum", handleChunkChecksum, apiKeyMiddleware)
+		g.GET("/file/*", handleFile, fileAPIKeyMiddleware, maintenanceMiddleware, downloadLimit, streamLimitMiddleware, downloadQueueMiddleware, throttleMiddleware)
+		g.GET("/news", handleNews)
+		g.GET("/sync/*", handleSync)
+		g.GET("/delta", handleDelta, maintenanceMiddleware, downloadLimit)
+		g.GET("/checksum", handleChecksum)
+		g.POST("/diff", handleDiff)
+		g.POST("/sync/*", handleSyncDiff)
+		g.GET("/manifest", handleFilelist)
+		g.GET("/"+filelistName, handleFilelist)
+		g.GET("/manifest.json", handleManifestJSON)
+		g.GET("/manifest.sig", handleManifestSig)
+		g.GET("/tree", handleTree)
+		g.GET("/*", handleFile, fileAPIKeyMiddleware, maintenanceMiddleware, downloadLimit, streamLimitMiddleware, downloadQueueMiddleware, throttleMiddleware)
+	}
+}
+
+// repoContentKey is where repoMiddleware leaves the tree of the repo a request is under
+const repoContentKey = "repo_content"
+
+func repoMiddleware(t *contentTree) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set(repoContentKey, t)
+			return next(c)
+		}
+	}
+}
+
+// repoFor returns the tree of the repo the request is under, nil on the main repo's routes
+func repoFor(c echo.Context) *contentTree {
+	t, _ := c.Get(repoContentKey).(*contentTree)
+	return t
+}
+
+// urlPrefix is the path the tree's endpoints are served under, "" for the main repo
+func (t *contentTree) urlPrefix() string {
+	if t.Repo == "" {
+		return ""
+	}
+	return "/" + t.Repo
+}
+
+// updateRepos clones or pulls every repo, each in its own goroutine
+func updateRepos() {
+	for _, r := range repoOrder {
+		go r.update()
+	}
+}
+
+// update clones the repo or fast-forwards it to origin, then rebuilds its manifest. With
+// TRUSTED_SIGNERS set the new head is verified before it's checked out, like the main repo's.
+func (r *repo) update() {
+	r.updateMu.Lock()
+	defer r.updateMu.Unlock()
+
+	start := time.Now()
+	before, _ := headCommit(r.Content.Dir)
+	r.lastMu.Lock()
+	r.running = &updateResult{ID: r.lastID, At: start, Before: before}
+	r.lastMu.Unlock()
+	err := r.cloneOrPull()
+	if err != nil {
+		slog.Error("Error updating repository", "repo", r.Name, "err", err, "duration", time.Since(start))
+	} else {
+		slog.Info("Repository updated", "repo", r.Name, "duration", time.Since(start))
+	}
+
+	result := updateResult{At: time.Now(), OK: err == nil, Before: before, Remote: redactURL(r.URL)}
+	result.Commit, _ = headCommit(r.Content.Dir)
+	if err != nil {
+		result.Error = err.Error()
+		raiseAlert("Update of repo " + r.Name + " failed, still serving " + result.Commit + ": " + result.Error)
+	}
+	r.lastMu.Lock()
+	result.ID = r.running.ID
+	r.last, r.running = result, nil
+	r.lastMu.Unlock()
+
+	if result.Commit != "" {
+		r.Content.rebuildManifest()
+	}
+}
+
+func (r *repo) cloneOrPull() error {
+	dir := r.Content.Dir
+	_, err := os.Stat(dir)
+	if resume := err == nil && incompleteClone(dir); os.IsNotExist(err) || resume {
+		if err := os.MkdirAll(repoDir, 0o755); err != nil {
+			return err
+		}
+		args := []string{"clone", "--progress", r.URL, dir}
+		if cfg.TrustedSigners != nil {
+			args = append(args, "--no-checkout")
+		}
+		if resume {
+			err = resumeClone(r.Name, dir, "", 0, cfg.TrustedSigners == nil)
+		} else {
+			err = runGitTracked(r.Name, "clone", args...)
+		}
+		if err != nil {
+			if !resumableClone(dir, err) {
+				_ = os.RemoveAll(dir)
+			}
+			return err
+		}
+		if cfg.TrustedSigners == nil {
+			return nil
+		}
+		err := verifyCommit(dir, "HEAD")
+		if err == nil {
+			err = withContentWrite("checkout "+r.Name, func() error {
+				return gitRun("-C", dir, "reset", "--hard", "HEAD")
+			})
+		}
+		if err != nil {
+			_ = os.RemoveAll(dir)
+		}
+		return err
+	}
+
+	if err := runGitTracked(r.Name, "pull", "-C", dir, "fetch", "--progress", "origin"); err != nil {
+		return err
+	}
+	if err := verifyCommit(dir, "@{upstream}"); err != nil {
+		return err
+	}
+	return withContentWrite("pull "+r.Name, func() error {
+		return gitRun("-C", dir, "merge", "--ff-only", "@{upstream}")
+	})
+}
+
+// nextUpdateID numbers an update of the repo that is about to be triggered
+func (r *repo) nextUpdateID() int64 {
+	r.lastMu.Lock()
+	defer r.lastMu.Unlock()
+	r.lastID++
+	return r.lastID
+}
+
+func (r *repo) lastUpdate() updateResult {
+	r.lastMu.Lock()
+	defer r.lastMu.Unlock()
+	return r.last
+}
+
+// repoStatus is the /healthz view of every repo
+func repoStatus() echo.Map {
+	status := echo.Map{}
+	for _, r := range repoOrder {
+		status[r.Name] = echo.Map{
+			"update":   r.lastUpdate(),
+			"pull":     getPullProgress(r.Name),
+			"manifest": manifestInfo(r.Content),
+		}
+	}
+	return status
+}
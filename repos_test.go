@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useRepos configures REPOS for the test, under a fresh working directory, and forgets them when
+// it ends
+func useRepos(t *testing.T, env ...string) {
+	t.Helper()
+	useConfig(t, env...)
+	useWorkDir(t)
+	previous, order, prefixes := repos, repoOrder, slices.Clone(staticSkipPrefixes)
+	repos, repoOrder = make(map[string]*repo), nil
+	t.Cleanup(func() { repos, repoOrder, staticSkipPrefixes = previous, order, prefixes })
+	configureRepos(cfg.Repos)
+}
+
+func TestRepoRoutes(t *testing.T) {
+	source := gitFixture(t)
+	commitFiles(t, source, map[string]string{"maps/a.txt": "repo a", "maps/b.txt": "repo b"})
+	useRepos(t, "TMPDIR", t.TempDir(), "REPOS", "extra="+source,
+		"WEBHOOK_KEY", "hook-secret", "WEBHOOK_ALLOW_QUERY_KEY", "true")
+	useContent(t, map[string]string{"maps/a.txt": "main a"})
+	r := repos["extra"]
+	r.update()
+	if u := r.lastUpdate(); !u.OK {
+		t.Fatalf("clone of the repo = %+v", u)
+	}
+
+	e := chunkServer(t)
+	none := func(next echo.HandlerFunc) echo.HandlerFunc { return next }
+	registerRepoRoutes(e, none, none)
+	e.POST("/gh-update", handleWebhook)
+	body := `{"files":["maps/a.txt","maps/b.txt"]}`
+
+	// the plan of a repo is a dry run like the main one's
+	rec := request(e, http.MethodPost, "/extra/zip-chunks/plan", body)
+	var plan map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &plan); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("POST /extra/zip-chunks/plan = %d %s", rec.Code, rec.Body.String())
+	}
+	chunks, _ := plan["chunks"].([]any)
+	if plan["dry_run"] != true || plan["expires_at"] != nil || len(chunks) != 1 || chunks[0].(map[string]any)["url"] != "" {
+		t.Errorf("POST /extra/zip-chunks/plan = %s, want a dry run without URLs", rec.Body.String())
+	}
+
+	// init and download under the prefix serve the repo's files, not the main checkout's
+	rec = request(e, http.MethodPost, "/extra/zip-chunks/init", body)
+	var res initResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != http.StatusOK || len(res.Chunks) != 1 {
+		t.Fatalf("POST /extra/zip-chunks/init = %d %s", rec.Code, rec.Body.String())
+	}
+	url := res.Chunks[0].URL
+	if !strings.HasPrefix(url, "/extra/zip-chunks/") {
+		t.Fatalf("chunk URL %s isn't under the repo's prefix", url)
+	}
+	rec = request(e, http.MethodGet, url, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s = %d %s", url, rec.Code, rec.Body.String())
+	}
+	if got := strings.Join(zipNames(t, rec.Body.Bytes()), " "); got != "maps/a.txt maps/b.txt" {
+		t.Errorf("repo chunk holds %s", got)
+	}
+	if rec := request(e, http.MethodGet, "/extra/maps/a.txt", ""); rec.Body.String() != "repo a" {
+		t.Errorf("GET /extra/maps/a.txt = %d %q", rec.Code, rec.Body.String())
+	}
+
+	// a chunk is only served under the prefix it was made for
+	main := initChunks(t, e, `{"files":["maps/a.txt"]}`)
+	for _, target := range []string{strings.TrimPrefix(url, "/extra"), "/extra" + main[0]} {
+		if rec := request(e, http.MethodGet, target, ""); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", target, rec.Code)
+		}
+	}
+
+	// ?repo= on the webhook updates that repo alone
+	previousDelay := webhookUpdateDelay
+	webhookUpdateDelay = 0
+	t.Cleanup(func() { webhookUpdateDelay = previousDelay })
+	next := commitFiles(t, source, map[string]string{"maps/a.txt": "repo a changed"})
+	if rec := request(e, http.MethodPost, "/gh-update?key=hook-secret&repo=nowhere", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("webhook for an unknown repo = %d, want 404", rec.Code)
+	}
+	rec = request(e, http.MethodPost, "/gh-update?key=hook-secret&repo=extra", "")
+	var triggered struct {
+		UpdateID int64  `json:"update_id"`
+		Repo     string `json:"repo"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &triggered); err != nil || rec.Code != http.StatusOK || triggered.Repo != "extra" {
+		t.Fatalf("webhook for the repo = %d %s", rec.Code, rec.Body.String())
+	}
+	for deadline := time.Now().Add(10 * time.Second); r.lastUpdate().ID != triggered.UpdateID; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("update %d never ran, last one %+v", triggered.UpdateID, r.lastUpdate())
+		}
+	}
+	if u := r.lastUpdate(); !u.OK || u.Commit != next {
+		t.Errorf("update triggered by the webhook = %+v, want it at %s", u, next)
+	}
+	if rec := request(e, http.MethodGet, "/extra/maps/a.txt", ""); rec.Body.String() != "repo a changed" {
+		t.Errorf("GET /extra/maps/a.txt after the update = %q", rec.Body.String())
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/labstack/echo/v4"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// response codings in order of preference, among those a client weighs the same
+const (
+	codingBrotli = "br"
+	codingZstd   = "zstd"
+	codingGzip   = "gzip"
+)
+
+// responseBrotliLevel keeps brotli about as fast as gzip's default, the higher levels are meant
+// for precompressed assets rather than responses built per request
+const responseBrotliLevel = 5
+
+// defaultResponseCompressionSkip are the responses sent as they are: the archive store set,
+// other compressed formats and the MIME types of binaries, media and streams
+var defaultResponseCompressionSkip = append(append([]string{}, defaultStoreExtensions...),
+	".zst", ".xz", ".bz2", ".rar", ".jpeg", ".gif", ".webp",
+	"application/octet-stream", "application/zip", "application/gzip", "application/zstd",
+	"application/x-bittorrent", "image/*", "audio/*", "video/*", "text/event-stream",
+)
+
+var responseEncoders = map[string]*sync.Pool{
+	codingBrotli: {New: func() any { return brotli.NewWriterLevel(io.Discard, responseBrotliLevel) }},
+	codingGzip:   {New: func() any { return gzip.NewWriter(io.Discard) }},
+	codingZstd: {New: func() any {
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(1<<20))
+		return w
+	}},
+}
+
+// responseEncoder is what both pooled encoders implement
+type responseEncoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// compressMiddleware compresses the responses whose type is worth it with the coding the client
+// prefers. Compressible responses carry Vary: Accept-Encoding whether compressed or not, so a
+// cache keeps the variants apart. Ranges, HEAD and bodies under RESPONSE_COMPRESSION_MIN_SIZE go
+// out as they are.
+func compressMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		res := c.Response()
+		cw := &compressWriter{
+			ResponseWriter: res.Writer,
+			req:            c.Request(),
+			coding:         negotiateCoding(c.Request().Header.Get(echo.HeaderAcceptEncoding)),
+		}
+		res.Writer = cw
+		defer func() {
+			if !cw.decided {
+				// nothing written, the error handler answers uncompressed
+				res.Writer = cw.ResponseWriter
+				return
+			}
+			cw.close()
+		}()
+		return next(c)
+	}
+}
+
+// negotiateCoding picks the supported coding with the highest q value in Accept-Encoding, ""
+// for identity
+func negotiateCoding(accept string) string {
+	best, bestQ := "", 0.0
+	q := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		weight := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				weight = f
+			}
+		}
+		q[strings.ToLower(strings.TrimSpace(coding))] = weight
+	}
+	for _, coding := range []string{codingBrotli, codingZstd, codingGzip} {
+		weight, ok := q[coding]
+		if !ok {
+			weight, ok = q["*"]
+		}
+		if ok && weight > bestQ {
+			best, bestQ = coding, weight
+		}
+	}
+	return best
+}
+
+// skipsCompression reports whether the response to urlPath with this content type goes out as it is
+func skipsCompression(urlPath, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+	ext := strings.ToLower(path.Ext(urlPath))
+	for _, skip := range cfg.ResponseCompressionSkip {
+		switch {
+		case strings.HasPrefix(skip, "."):
+			if ext == skip {
+				return true
+			}
+		case strings.HasSuffix(skip, "/*"):
+			if strings.HasPrefix(mediaType, strings.TrimSuffix(skip, "*")) {
+				return true
+			}
+		case mediaType == skip:
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter decides on the first header write, when the handler has set the type and length
+type compressWriter struct {
+	http.ResponseWriter
+	req     *http.Request
+	coding  string
+	decided bool
+	enc     responseEncoder
+}
+
+func (w *compressWriter) decide(code int) {
+	w.decided = true
+	h := w.Header()
+	if h.Get(echo.HeaderContentEncoding) != "" || skipsCompression(w.req.URL.Path, h.Get(echo.HeaderContentType)) {
+		return
+	}
+	if !strings.Contains(strings.ToLower(strings.Join(h.Values(echo.HeaderVary), ",")), "accept-encoding") {
+		h.Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+	}
+	if w.coding == "" || code != http.StatusOK || w.req.Method == http.MethodHead {
+		return
+	}
+	if n, err := strconv.ParseInt(h.Get(echo.HeaderContentLength), 10, 64); err == nil && n < cfg.ResponseCompressionMinSize {
+		return
+	}
+
+	h.Set(echo.HeaderContentEncoding, w.coding)
+	h.Del(echo.HeaderContentLength)
+	h.Del("Accept-Ranges")
+	// the encoded bytes differ from the identity ones, a strong tag would claim they don't
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	w.enc = responseEncoders[w.coding].Get().(responseEncoder)
+	w.enc.Reset(w.ResponseWriter)
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if !w.decided {
+		w.decide(code)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressWriter) Flush() {
+	if w.enc != nil {
+		_ = w.enc.Flush()
+	}
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressWriter) close() {
+	if w.enc == nil {
+		return
+	}
+	_ = w.enc.Close()
+	w.enc.Reset(io.Discard)
+	responseEncoders[w.coding].Put(w.enc)
+	w.enc = nil
+}
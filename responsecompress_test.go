@@ -0,0 +1,151 @@
+package main
+
+import (
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/labstack/echo/v4"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateCoding(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", codingGzip},
+		{"GZIP", codingGzip},
+		{"gzip, deflate, br, zstd", codingBrotli},
+		{"gzip, zstd", codingZstd},
+		{"br;q=0.5, gzip", codingGzip},
+		{"br;q=0.5, zstd;q=0.8, gzip;q=0.2", codingZstd},
+		{"br;q=0, gzip;q=0", ""},
+		{"*", codingBrotli},
+		{"*;q=0.5, gzip", codingGzip},
+		{"br;q=0, *", codingZstd},
+		{"*;q=0", ""},
+		{"gzip;q=bogus", codingGzip},
+	}
+	for _, tt := range tests {
+		if got := negotiateCoding(tt.accept); got != tt.want {
+			t.Errorf("negotiateCoding(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+// decodeBody undoes the response's Content-Encoding
+func decodeBody(t *testing.T, coding string, body io.Reader) string {
+	t.Helper()
+	var r io.Reader
+	switch coding {
+	case "":
+		r = body
+	case codingBrotli:
+		r = brotli.NewReader(body)
+	case codingGzip:
+		gr, err := gzip.NewReader(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gr
+	case codingZstd:
+		zr, err := zstd.NewReader(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		t.Fatalf("unexpected coding %q", coding)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("decoding %s: %v", coding, err)
+	}
+	return string(data)
+}
+
+func TestCompressMiddleware(t *testing.T) {
+	useConfig(t, "RESPONSE_COMPRESSION_MIN_SIZE", "100")
+	text := strings.Repeat("a manifest line that compresses well\n", 100)
+	e := echo.New()
+	e.Use(compressMiddleware)
+	serve := func(contentType, body string, code int) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			h := c.Response().Header()
+			h.Set(echo.HeaderContentLength, strconv.Itoa(len(body)))
+			h.Set("ETag", `"v1"`)
+			h.Set("Accept-Ranges", "bytes")
+			if code == http.StatusNotModified {
+				c.Response().WriteHeader(code)
+				return nil
+			}
+			return c.Blob(code, contentType, []byte(body))
+		}
+	}
+	e.GET("/manifest.txt", serve("text/plain; charset=utf-8", text, http.StatusOK))
+	e.HEAD("/manifest.txt", serve("text/plain; charset=utf-8", text, http.StatusOK))
+	e.GET("/small.txt", serve("text/plain", "tiny", http.StatusOK))
+	e.GET("/client.zip", serve("application/zip", text, http.StatusOK))
+	e.GET("/spells.dat", serve("text/plain", text, http.StatusOK))
+	e.GET("/range.txt", serve("text/plain", text[:200], http.StatusPartialContent))
+	e.GET("/cached.txt", serve("text/plain", text, http.StatusNotModified))
+
+	// the coding the client prefers, with a weak ETag and no length or ranges of the identity body
+	for accept, coding := range map[string]string{"gzip": codingGzip, "br, gzip": codingBrotli, "zstd;q=1, br;q=0.9": codingZstd} {
+		rec := request(e, http.MethodGet, "/manifest.txt", "", "Accept-Encoding", accept)
+		h := rec.Header()
+		if h.Get(echo.HeaderContentEncoding) != coding {
+			t.Fatalf("Accept-Encoding %q: Content-Encoding %q, want %q", accept, h.Get(echo.HeaderContentEncoding), coding)
+		}
+		if got := decodeBody(t, coding, rec.Body); got != text {
+			t.Errorf("%s body decodes to %d bytes, want %d", coding, len(got), len(text))
+		}
+		if h.Get("ETag") != `W/"v1"` || h.Get(echo.HeaderContentLength) != "" || h.Get("Accept-Ranges") != "" {
+			t.Errorf("%s: ETag %q, Content-Length %q, Accept-Ranges %q", coding, h.Get("ETag"), h.Get(echo.HeaderContentLength), h.Get("Accept-Ranges"))
+		}
+		if h.Get(echo.HeaderVary) != echo.HeaderAcceptEncoding {
+			t.Errorf("%s: Vary %q", coding, h.Get(echo.HeaderVary))
+		}
+	}
+
+	// everything else passes through as it is, compressible types still saying what they vary on
+	for _, tt := range []struct {
+		method, target, accept string
+		vary                   bool
+	}{
+		{http.MethodGet, "/manifest.txt", "", true},
+		{http.MethodGet, "/manifest.txt", "identity", true},
+		{http.MethodHead, "/manifest.txt", "gzip", true},
+		{http.MethodGet, "/small.txt", "gzip", true},
+		{http.MethodGet, "/range.txt", "gzip", true},
+		// a 304 has no type to go by, like the ones the handlers send
+		{http.MethodGet, "/cached.txt", "gzip", false},
+		{http.MethodGet, "/client.zip", "gzip", false},
+	} {
+		rec := request(e, tt.method, tt.target, "", "Accept-Encoding", tt.accept)
+		h := rec.Header()
+		if h.Get(echo.HeaderContentEncoding) != "" || h.Get("ETag") != `"v1"` || h.Get(echo.HeaderContentLength) == "" {
+			t.Errorf("%s %s with %q: Content-Encoding %q, ETag %q, Content-Length %q, want it untouched", tt.method, tt.target, tt.accept,
+				h.Get(echo.HeaderContentEncoding), h.Get("ETag"), h.Get(echo.HeaderContentLength))
+		}
+		if got := h.Get(echo.HeaderVary) == echo.HeaderAcceptEncoding; got != tt.vary {
+			t.Errorf("%s %s with %q: Vary %q", tt.method, tt.target, tt.accept, h.Get(echo.HeaderVary))
+		}
+	}
+
+	// the skip list takes extensions as well as types
+	useConfig(t, "RESPONSE_COMPRESSION_MIN_SIZE", "100", "RESPONSE_COMPRESSION_SKIP", ".dat,image/*")
+	if rec := request(e, http.MethodGet, "/spells.dat", "", "Accept-Encoding", "gzip"); rec.Header().Get(echo.HeaderContentEncoding) != "" {
+		t.Error("a skipped extension was compressed")
+	}
+	if rec := request(e, http.MethodGet, "/client.zip", "", "Accept-Encoding", "gzip"); rec.Header().Get(echo.HeaderContentEncoding) != codingGzip {
+		t.Error("application/zip stayed skipped with a RESPONSE_COMPRESSION_SKIP that doesn't list it")
+	}
+}
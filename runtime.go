@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+var startedAt = time.Now()
+
+// disk usage walks are cached this long, a multi-GB checkout takes a while to stat
+const diskUsageTTL = 30 * time.Second
+
+type cachedSize struct {
+	bytes int64
+	at    time.Time
+}
+
+var (
+	diskUsage   = make(map[string]cachedSize)
+	diskUsageMu sync.Mutex
+)
+
+// cachedDirSize is dirSize with a short TTL cache
+func cachedDirSize(dir string) int64 {
+	diskUsageMu.Lock()
+	c, ok := diskUsage[dir]
+	diskUsageMu.Unlock()
+	if ok && time.Since(c.at) < diskUsageTTL {
+		return c.bytes
+	}
+	n := dirSize(dir)
+	diskUsageMu.Lock()
+	diskUsage[dir] = cachedSize{bytes: n, at: time.Now()}
+	diskUsageMu.Unlock()
+	return n
+}
+
+// openFDs counts the process's open file descriptors, -1 where /proc isn't available
+func openFDs() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries)
+}
+
+// GET /admin/runtime
+func handleAdminRuntime(c echo.Context) error {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	// PauseNs is a circular buffer of the most recent 256 pauses
+	pauses := int(min(ms.NumGC, uint32(len(ms.PauseNs))))
+	var total, maxPause uint64
+	for i := 0; i < pauses; i++ {
+		p := ms.PauseNs[i]
+		total += p
+		maxPause = max(maxPause, p)
+	}
+	gc := echo.Map{
+		"cycles":              ms.NumGC,
+		"pause_total_ms":      float64(ms.PauseTotalNs) / 1e6,
+		"recent_pause_max_ms": float64(maxPause) / 1e6,
+		"last_run":            time.Unix(0, int64(ms.LastGC)),
+	}
+	if pauses > 0 {
+		gc["recent_pause_avg_ms"] = float64(total) / float64(pauses) / 1e6
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"uptime_seconds": time.Since(startedAt).Seconds(),
+		"goroutines":     runtime.NumGoroutine(),
+		"open_fds":       openFDs(),
+		"memory": echo.Map{
+			"heap_alloc_bytes":  ms.HeapAlloc,
+			"heap_inuse_bytes":  ms.HeapInuse,
+			"heap_objects":      ms.HeapObjects,
+			"sys_bytes":         ms.Sys,
+			"total_alloc_bytes": ms.TotalAlloc,
+		},
+		"gc": gc,
+		"disk": echo.Map{
+			"work_dir_bytes":  cachedDirSize(cloneDir) + cachedDirSize(worktreeDir),
+			"cache_dir_bytes": cachedDirSize(chunkTempDir()),
+		},
+		"downloads": downloads.snapshot(),
+		"builds":    builds.snapshot(),
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// openStreams counts the download streams in flight, what a shutdown waits for
+var openStreams atomic.Int64
+
+// serve runs the server until ctx is done, then stops accepting connections and gives in-flight
+// requests SHUTDOWN_TIMEOUT to finish before closing them
+func serve(ctx context.Context, e *echo.Echo, addr string) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- startListener(e, addr)
+	}()
+	if tlsEnabled() && cfg.HTTPAddr != "" {
+		go serveHTTP(ctx, e, addr)
+	}
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	inFlight := openStreams.Load()
+	slog.Info("Shutting down", "timeout", cfg.ShutdownTimeout, "streams", inFlight)
+	start := time.Now()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	err := e.Shutdown(shutdownCtx)
+	aborted := openStreams.Load()
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = e.Close()
+	}
+	slog.Info("Server stopped", "duration", time.Since(start), "drained", max(inFlight-aborted, 0), "aborted", aborted)
+
+	if startErr := <-errc; !errors.Is(startErr, http.ErrServerClosed) && err == nil {
+		err = startErr
+	}
+	removeChunkArtifacts()
+	stats.flush()
+	return err
+}
+
+// serveAdmin runs the ADMIN_LISTEN_ADDR listener until ctx is done, the log streams it may still
+// hold are cut after SHUTDOWN_TIMEOUT
+func serveAdmin(ctx context.Context, a *echo.Echo, addr string) {
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := a.Shutdown(shutdownCtx); err != nil {
+			_ = a.Close()
+		}
+	}()
+	slog.Info("Serving admin endpoints", "addr", addr)
+	if err := a.Start(addr); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Admin listener failed", "addr", addr, "err", err)
+	}
+}
+
+// removeChunkArtifacts deletes the built chunk archives on the way out. The sessions that kept
+// them die with the process, a chunk requested again after a restart is built anew.
+func removeChunkArtifacts() {
+	dir := chunkTempDir()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Error during temp file cleanup", "dir", dir, "err", err)
+		}
+		return
+	}
+	removed := 0
+	for _, e := range entries {
+		if e.IsDir() || !isArtifactName(e.Name()) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err == nil {
+			removed++
+		}
+	}
+	_ = os.RemoveAll(archiveCacheDir())
+	slog.Info("Removed chunk archives", "dir", dir, "count", removed)
+}
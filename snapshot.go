@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// contentRW keeps archive builds and checkout changes apart: builds hold it shared for as long as
+// they read source files, the update pipeline holds it exclusively while it moves checkouts. Network
+// work (clone, fetch) happens outside of it so builds only wait for the local checkout step.
+var contentRW sync.RWMutex
+
+// contentGeneration counts checkout changes, long builds that can't hold contentRW compare it
+// before and after to know the content stayed put
+var contentGeneration atomic.Int64
+
+// readContent holds the content steady for a build, the returned func releases it
+func readContent() func() {
+	contentRW.RLock()
+	return contentRW.RUnlock
+}
+
+// withContentWrite runs fn once the running builds are done. New builds wait behind it, and if the
+// running ones don't finish within UPDATE_LOCK_TIMEOUT the step fails so the update is retried.
+func withContentWrite(step string, fn func() error) error {
+	acquired := make(chan struct{})
+	go func() {
+		contentRW.Lock()
+		close(acquired)
+	}()
+
+	start := time.Now()
+	select {
+	case <-acquired:
+	case <-time.After(cfg.UpdateLockTimeout):
+		// the lock is still coming, give it back as soon as it arrives
+		go func() {
+			<-acquired
+			contentRW.Unlock()
+		}()
+		slog.Error("Gave up waiting for running builds", "step", step, "duration", cfg.UpdateLockTimeout)
+		return fmt.Errorf("%s: timed out after %s waiting for running builds", step, cfg.UpdateLockTimeout)
+	}
+	defer contentRW.Unlock()
+	contentGeneration.Add(1)
+	if waited := time.Since(start); waited > time.Second {
+		slog.Info("Waited for running builds", "step", step, "duration", waited)
+	}
+	return fn()
+}
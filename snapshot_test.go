@@ -0,0 +1,138 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// useWorkDir runs the test in a fresh working directory, where cloneDir and repoDir are
+func useWorkDir(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+}
+
+// useCheckout makes a clone of source the default checkout, at cloneDir under a fresh working
+// directory
+func useCheckout(t *testing.T, source string) {
+	t.Helper()
+	useWorkDir(t)
+	if err := gitRun("clone", "-q", source, cloneDir); err != nil {
+		t.Fatal(err)
+	}
+	previous := defaultContent
+	defaultContent = newContentTree("", cloneDir)
+	t.Cleanup(func() { defaultContent = previous })
+}
+
+func TestArchivesMatchOneCommitDuringPulls(t *testing.T) {
+	useConfig(t, "TMPDIR", t.TempDir())
+	source := gitFixture(t)
+	version := func(n int) map[string]string {
+		files := make(map[string]string)
+		for i := range 5 {
+			files[fmt.Sprintf("maps/zone%d.txt", i)] = strings.Repeat(fmt.Sprintf("v%d-%d ", n, i), 2000+97*n)
+		}
+		return files
+	}
+	commits := map[string]map[string]string{commitFiles(t, source, version(0)): version(0)}
+	useCheckout(t, source)
+	e := chunkServer(t)
+	init := `{"files":["maps/zone0.txt","maps/zone1.txt","maps/zone2.txt","maps/zone3.txt","maps/zone4.txt"]}`
+
+	var mu sync.Mutex
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for n := 1; n <= 10; n++ {
+			sha := commitFiles(t, source, version(n))
+			mu.Lock()
+			commits[sha] = version(n)
+			mu.Unlock()
+			if err := pull(); err != nil {
+				t.Errorf("pull %d: %v", n, err)
+				return
+			}
+		}
+	}()
+
+	var builders sync.WaitGroup
+	var archives, mismatched int
+	for range 4 {
+		builders.Add(1)
+		go func() {
+			defer builders.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// no t.Fatal off the test goroutine
+				var res initResult
+				rec := request(e, http.MethodPost, "/zip-chunks/init", init)
+				if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || len(res.Chunks) != 1 {
+					t.Errorf("init = %d %s", rec.Code, rec.Body.String())
+					return
+				}
+				rec = request(e, http.MethodGet, res.Chunks[0].URL, "")
+				got, err := unzipAll(rec.Body.Bytes())
+				if rec.Code != http.StatusOK || err != nil {
+					t.Errorf("GET = %d %v", rec.Code, err)
+					return
+				}
+				commit := rec.Header().Get(contentCommitHeader)
+				mu.Lock()
+				archives++
+				if want, ok := commits[commit]; !ok || !maps.Equal(got, want) {
+					mismatched++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	builders.Wait()
+	if mismatched > 0 {
+		t.Errorf("%d of %d archives don't match the commit in %s", mismatched, archives, contentCommitHeader)
+	}
+	if archives == 0 {
+		t.Error("no archive was built during the pulls")
+	}
+}
+
+// unzipAll returns every file in a zip by name
+func unzipAll(body []byte) (map[string]string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		files[f.Name] = string(data)
+	}
+	return files, nil
+}
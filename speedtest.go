@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/time/rate"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// speedtest runs have their own budget so measuring doesn't eat into the init rate limit
+var (
+	speedtestVisitors   = make(map[string]*rate.Limiter)
+	speedtestVisitorsMu sync.Mutex
+)
+
+func speedtestAllowed(id string) bool {
+	speedtestVisitorsMu.Lock()
+	defer speedtestVisitorsMu.Unlock()
+	limiter, ok := speedtestVisitors[id]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Every(time.Minute/time.Duration(cfg.SpeedtestPerMinute)), cfg.SpeedtestPerMinute)
+		speedtestVisitors[id] = limiter
+	}
+	return limiter.Allow()
+}
+
+// speedtestMiddleware applies the speedtest rate limit, the stream cap comes from streamLimitMiddleware
+func speedtestMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if cfg.SpeedtestMaxBytes <= 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "Speedtest is disabled")
+		}
+		if !speedtestAllowed(clientIdentity(c.Request())) {
+			return c.JSON(http.StatusTooManyRequests, echo.Map{
+				"error": "Rate limit exceeded. Max " + strconv.Itoa(cfg.SpeedtestPerMinute) + " speedtests per minute.",
+			})
+		}
+		return next(c)
+	}
+}
+
+// randomReader produces incompressible bytes cheaply, ChaCha8 keeps up with any link
+type randomReader struct {
+	rng *rand.ChaCha8
+}
+
+func (r randomReader) Read(p []byte) (int, error) {
+	var buf [8]byte
+	for i := 0; i < len(p); i += 8 {
+		binary.LittleEndian.PutUint64(buf[:], r.rng.Uint64())
+		copy(p[i:], buf[:])
+	}
+	return len(p), nil
+}
+
+// GET /speedtest?bytes=N streams N random bytes, capped at SPEEDTEST_MAX_BYTES
+func handleSpeedtestDownload(c echo.Context) error {
+	n := int64(1 << 20)
+	if v := c.QueryParam("bytes"); v != "" {
+		parsed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || parsed <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid bytes")
+		}
+		n = parsed
+	}
+	n = min(n, cfg.SpeedtestMaxBytes)
+
+	var seed [32]byte
+	copy(seed[:], randomToken())
+	h := c.Response().Header()
+	h.Set(echo.HeaderContentType, "application/octet-stream")
+	h.Set(echo.HeaderContentLength, strconv.FormatInt(n, 10))
+	h.Set("Cache-Control", "no-store")
+	c.Response().WriteHeader(http.StatusOK)
+	_, err := io.CopyN(c.Response(), randomReader{rand.NewChaCha8(seed)}, n)
+	return err
+}
+
+// POST /speedtest reads and discards an upload of up to SPEEDTEST_MAX_BYTES and reports how fast
+// it arrived
+func handleSpeedtestUpload(c echo.Context) error {
+	start := time.Now()
+	n, err := io.Copy(io.Discard, io.LimitReader(c.Request().Body, cfg.SpeedtestMaxBytes))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Upload interrupted")
+	}
+	elapsed := time.Since(start)
+	mbps := 0.0
+	if elapsed > 0 {
+		mbps = float64(n) * 8 / elapsed.Seconds() / 1e6
+	}
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.JSON(http.StatusOK, echo.Map{
+		"bytes":   n,
+		"seconds": elapsed.Seconds(),
+		"mbps":    mbps,
+	})
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/labstack/echo/v4"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	statsMaxKeys    = 1000 // files and clients tracked per hour, the rest is folded into statsOther
+	statsOther      = "(other)"
+	statsTopN       = 20 // rows of the top files/clients in reports
+	statsFlushEvery = time.Minute
+)
+
+// statsCount is a request and byte tally
+type statsCount struct {
+	Requests int64 `json:"requests"`
+	Bytes    int64 `json:"bytes"`
+}
+
+func (s *statsCount) add(bytes int64) {
+	s.Requests++
+	s.Bytes += bytes
+}
+
+// statsHour aggregates the downloads served within one hour
+type statsHour struct {
+	Hour    time.Time              `json:"hour"`
+	Total   statsCount             `json:"total"`
+	Routes  map[string]*statsCount `json:"routes"`
+	Files   map[string]*statsCount `json:"files"`
+	Clients map[string]*statsCount `json:"clients"`
+	Unique  clientSketch           `json:"unique,omitempty"` // every client, where Clients stops at statsMaxKeys
+
+	// Chunks counts the completed chunk downloads by chunk ID, the chunks' files are in Files
+	Chunks map[string]*statsCount `json:"chunks,omitempty"`
+
+	// Compression totals per file extension of the archives built this hour
+	Compression map[string]*compressionTally `json:"compression,omitempty"`
+}
+
+// downloadStats keeps hourly download counters for STATS_RETENTION and persists them to
+// STATS_PATH, so reports span restarts. Memory is bounded by the retention times statsMaxKeys.
+type downloadStats struct {
+	mu    sync.Mutex
+	hours []*statsHour // oldest first
+	dirty bool
+}
+
+var stats = &downloadStats{}
+
+// load restores persisted counters and starts the periodic flush
+func (s *downloadStats) load() {
+	if cfg.StatsPath == "" {
+		return
+	}
+	if data, err := os.ReadFile(cfg.StatsPath); err == nil {
+		var hours []*statsHour
+		if err := json.Unmarshal(data, &hours); err != nil {
+			slog.Error("Error reading stats, starting empty", "path", cfg.StatsPath, "err", err)
+		} else {
+			s.mu.Lock()
+			s.hours = hours
+			s.pruneLocked(time.Now())
+			s.mu.Unlock()
+		}
+	}
+	go func() {
+		ticker := time.NewTicker(statsFlushEvery)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.flush()
+		}
+	}()
+}
+
+// flush writes the counters if they changed, through a temp file so a crash never leaves half a file
+func (s *downloadStats) flush() {
+	s.mu.Lock()
+	if !s.dirty || cfg.StatsPath == "" {
+		s.mu.Unlock()
+		return
+	}
+	data, err := json.Marshal(s.hours)
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	tmp := cfg.StatsPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		slog.Error("Error writing stats", "path", cfg.StatsPath, "err", err)
+		return
+	}
+	if err := os.Rename(tmp, cfg.StatsPath); err != nil {
+		slog.Error("Error writing stats", "path", cfg.StatsPath, "err", err)
+	}
+}
+
+// record counts one served download
+func (s *downloadStats) record(route, file, client string, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.hourLocked(time.Now())
+	h.Total.add(bytes)
+	countKey(h.Routes, route).add(bytes)
+	if file != "" {
+		countKey(h.Files, file).add(bytes)
+	}
+	countKey(h.Clients, client).add(bytes)
+	h.Unique.add(client)
+	s.dirty = true
+}
+
+// recordChunk counts a completed chunk download and each file in it, at the file's size. The
+// bytes sent were counted by record.
+func (s *downloadStats) recordChunk(chunkID string, session *chunkSession, bytes int64) {
+	var m *manifest
+	if session.Content != nil {
+		m = session.Content.getManifest()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.hourLocked(time.Now())
+	if h.Chunks == nil {
+		h.Chunks = make(map[string]*statsCount)
+	}
+	countKey(h.Chunks, chunkID).add(bytes)
+	for _, f := range session.Files {
+		var size int64
+		if m != nil {
+			if e, ok := m.Files[f]; ok {
+				size = e.Size
+			}
+		}
+		countKey(h.Files, f).add(size)
+	}
+	s.dirty = true
+}
+
+// recordCompression adds the per-extension totals of one finished build
+func (s *downloadStats) recordCompression(tallies map[string]*compressionTally) {
+	if len(tallies) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.hourLocked(time.Now())
+	if h.Compression == nil {
+		h.Compression = make(map[string]*compressionTally)
+	}
+	for ext, t := range tallies {
+		dst, ok := h.Compression[ext]
+		if !ok {
+			if len(h.Compression) >= statsMaxKeys {
+				ext = statsOther
+				dst = h.Compression[ext]
+			}
+			if dst == nil {
+				dst = &compressionTally{}
+				h.Compression[ext] = dst
+			}
+		}
+		dst.merge(t)
+	}
+	s.dirty = true
+}
+
+// hourLocked returns the counters of the current hour, starting a new one when the hour turned
+func (s *downloadStats) hourLocked(now time.Time) *statsHour {
+	hour := now.Truncate(time.Hour)
+	if n := len(s.hours); n > 0 && s.hours[n-1].Hour.Equal(hour) {
+		return s.hours[n-1]
+	}
+	h := &statsHour{
+		Hour:    hour,
+		Routes:  make(map[string]*statsCount),
+		Files:   make(map[string]*statsCount),
+		Clients: make(map[string]*statsCount),
+	}
+	s.hours = append(s.hours, h)
+	s.pruneLocked(now)
+	return h
+}
+
+func countKey(m map[string]*statsCount, key string) *statsCount {
+	c, ok := m[key]
+	if !ok {
+		if len(m) >= statsMaxKeys {
+			key = statsOther
+			if c, ok = m[key]; ok {
+				return c
+			}
+		}
+		c = &statsCount{}
+		m[key] = c
+	}
+	return c
+}
+
+func (s *downloadStats) pruneLocked(now time.Time) {
+	cutoff := now.Add(-cfg.StatsRetention)
+	i := sort.Search(len(s.hours), func(i int) bool { return s.hours[i].Hour.After(cutoff) })
+	s.hours = s.hours[i:]
+}
+
+// statsRoute classifies a request for the route breakdown, "" for requests that aren't downloads
+func statsRoute(c echo.Context) string {
+	switch c.Path() {
+	case "/zip-chunks/:chunkID":
+		return "chunks"
+	case "/file/*":
+		return "file"
+	case "/zip-all", "/zip-all/parts/:name":
+		return "zip-all"
+	case "", "/*":
+		return "static"
+	}
+	return ""
+}
+
+// statsMiddleware counts the bytes of every successful download
+func statsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+		route := statsRoute(c)
+		res := c.Response()
+		if route == "" || !res.Committed || res.Status >= 400 {
+			return err
+		}
+		file := ""
+		switch route {
+		case "file":
+			file, _ = url.PathUnescape(c.Param("*"))
+		case "static":
+			file, _ = url.PathUnescape(strings.TrimPrefix(c.Request().URL.Path, "/"))
+		}
+		stats.record(route, file, clientIdentity(c.Request()), res.Size)
+		return err
+	}
+}
+
+// downloadReport is the aggregate of the hours within a window
+type downloadReport struct {
+	Window  string                 `json:"window"`
+	From    time.Time              `json:"from"`
+	Total   statsCount             `json:"total"`
+	Routes  map[string]*statsCount `json:"routes"`
+	Files   []statsRow             `json:"top_files"`
+	Clients []statsRow             `json:"top_clients"`
+	Hours   []statsHourRow         `json:"hours"`
+}
+
+type statsRow struct {
+	Key string `json:"key"`
+	statsCount
+}
+
+type statsHourRow struct {
+	Hour time.Time `json:"hour"`
+	statsCount
+}
+
+func (s *downloadStats) report(window time.Duration) downloadReport {
+	from := time.Now().Add(-window).Truncate(time.Hour)
+	r := downloadReport{Window: window.String(), From: from, Routes: make(map[string]*statsCount)}
+	files := make(map[string]*statsCount)
+	clients := make(map[string]*statsCount)
+
+	s.mu.Lock()
+	for _, h := range s.hours {
+		if h.Hour.Before(from) {
+			continue
+		}
+		r.Total.Requests += h.Total.Requests
+		r.Total.Bytes += h.Total.Bytes
+		r.Hours = append(r.Hours, statsHourRow{Hour: h.Hour, statsCount: h.Total})
+		mergeCounts(r.Routes, h.Routes)
+		mergeCounts(files, h.Files)
+		mergeCounts(clients, h.Clients)
+	}
+	s.mu.Unlock()
+
+	r.Files = topRows(files)
+	r.Clients = topRows(clients)
+	return r
+}
+
+func mergeCounts(dst, src map[string]*statsCount) {
+	for k, v := range src {
+		c, ok := dst[k]
+		if !ok {
+			c = &statsCount{}
+			dst[k] = c
+		}
+		c.Requests += v.Requests
+		c.Bytes += v.Bytes
+	}
+}
+
+// topRows returns the statsTopN keys with the most bytes
+func topRows(m map[string]*statsCount) []statsRow {
+	rows := make([]statsRow, 0, len(m))
+	for k, v := range m {
+		rows = append(rows, statsRow{Key: k, statsCount: *v})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Bytes != rows[j].Bytes {
+			return rows[i].Bytes > rows[j].Bytes
+		}
+		return rows[i].Key < rows[j].Key
+	})
+	if len(rows) > statsTopN {
+		rows = rows[:statsTopN]
+	}
+	return rows
+}
+
+// GET /admin/reports/downloads?window=24h&format=csv
+func handleDownloadReport(c echo.Context) error {
+	window, label := 24*time.Hour, "24h"
+	if v := c.QueryParam("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid window, expected a duration like 24h")
+		}
+		window, label = d, v
+	}
+	r := stats.report(window)
+
+	if !wantsCSV(c) {
+		return c.JSON(http.StatusOK, r)
+	}
+
+	// one table with a section column so the whole report imports as a single sheet. The window
+	// rows come first, then every hour with its full per-file and per-client breakdown.
+	out := startCSV(c, "downloads", label,
+		"section", "hour", "key", "requests", "bytes")
+	out.row("total", "", "", r.Total.Requests, r.Total.Bytes)
+	for _, k := range sortedKeys(r.Routes) {
+		out.row("route", "", k, r.Routes[k].Requests, r.Routes[k].Bytes)
+	}
+	for _, f := range r.Files {
+		out.row("top_file", "", f.Key, f.Requests, f.Bytes)
+	}
+	for _, cl := range r.Clients {
+		out.row("top_client", "", cl.Key, cl.Requests, cl.Bytes)
+	}
+	out.flush()
+	stats.eachHour(r.From, func(h *statsHour) {
+		out.row("hour", h.Hour, "", h.Total.Requests, h.Total.Bytes)
+		for _, section := range []struct {
+			name string
+			m    map[string]*statsCount
+		}{{"hour_route", h.Routes}, {"hour_file", h.Files}, {"hour_client", h.Clients}} {
+			for _, k := range sortedKeys(section.m) {
+				out.row(section.name, h.Hour, k, section.m[k].Requests, section.m[k].Bytes)
+			}
+		}
+		out.flush()
+	})
+	return out.close()
+}
+
+// statsDayRow is one UTC day of a /stats response
+type statsDayRow struct {
+	Day           string `json:"day"`
+	UniqueClients int64  `json:"unique_clients"`
+	statsCount
+}
+
+// GET /stats?days=1 is the download totals of the last days UTC days, today being the first, with
+// unique clients, the top files (chunk files included) and the most downloaded chunks
+func handleStats(c echo.Context) error {
+	days := 1
+	if v := c.QueryParam("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid days, expected a positive number")
+		}
+		days = n
+	}
+	now := time.Now().UTC()
+	from := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1-days)
+
+	var total statsCount
+	var unique clientSketch
+	files := make(map[string]*statsCount)
+	chunks := make(map[string]*statsCount)
+	byDay := make(map[string]*statsDayRow)
+	daySketches := make(map[string]*clientSketch)
+	var dayOrder []string
+
+	stats.mu.Lock()
+	for _, h := range stats.hours {
+		if h.Hour.Before(from) {
+			continue
+		}
+		day := h.Hour.UTC().Format(time.DateOnly)
+		row, ok := byDay[day]
+		if !ok {
+			row = &statsDayRow{Day: day}
+			byDay[day] = row
+			daySketches[day] = new(clientSketch)
+			dayOrder = append(dayOrder, day)
+		}
+		row.Requests += h.Total.Requests
+		row.Bytes += h.Total.Bytes
+		daySketches[day].merge(h.Unique)
+		total.Requests += h.Total.Requests
+		total.Bytes += h.Total.Bytes
+		unique.merge(h.Unique)
+		mergeCounts(files, h.Files)
+		mergeCounts(chunks, h.Chunks)
+	}
+	stats.mu.Unlock()
+
+	rows := make([]statsDayRow, 0, len(dayOrder))
+	for _, day := range dayOrder {
+		byDay[day].UniqueClients = daySketches[day].estimate()
+		rows = append(rows, *byDay[day])
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"from":           from,
+		"total":          total,
+		"unique_clients": unique.estimate(),
+		"top_files":      topRows(files),
+		"top_chunks":     topRows(chunks),
+		"days":           rows,
+	})
+}
+
+// eachHour calls fn with a copy of every hour since from, the lock is only held while copying
+// one hour so a slow client doesn't block recording
+func (s *downloadStats) eachHour(from time.Time, fn func(h *statsHour)) {
+	next := from
+	for {
+		s.mu.Lock()
+		i := sort.Search(len(s.hours), func(i int) bool { return !s.hours[i].Hour.Before(next) })
+		if i >= len(s.hours) {
+			s.mu.Unlock()
+			return
+		}
+		h := s.hours[i]
+		cp := &statsHour{Hour: h.Hour, Total: h.Total, Routes: copyCounts(h.Routes), Files: copyCounts(h.Files), Clients: copyCounts(h.Clients)}
+		s.mu.Unlock()
+		fn(cp)
+		next = cp.Hour.Add(time.Hour)
+	}
+}
+
+func copyCounts(m map[string]*statsCount) map[string]*statsCount {
+	cp := make(map[string]*statsCount, len(m))
+	mergeCounts(cp, m)
+	return cp
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// syncFile is one file of a synced directory, path is repo relative
+type syncFile struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Hash     string    `json:"hash"`
+	Modified time.Time `json:"modified"`
+	Delta    string    `json:"delta,omitempty"` // GET it for a delta from the client's commit instead
+}
+
+// collect appends every file under the node
+func (n *treeNode) collect(digest func(*manifestEntry) string, out *[]syncFile) {
+	for _, f := range n.Files {
+		*out = append(*out, syncFile{Path: f.Path, Size: f.Size, Hash: digest(f), Modified: f.Modified})
+	}
+	for _, d := range n.Dirs {
+		d.collect(digest, out)
+	}
+}
+
+// syncTarget resolves the directory and digest of a /sync request
+func syncTarget(c echo.Context, algo string) (*manifest, *treeNode, string, func(*manifestEntry) string, error) {
+	if algo == "" {
+		algo = "md5"
+	}
+	digest, ok := manifestAlgorithms[algo]
+	if !ok {
+		return nil, nil, "", nil, echo.NewHTTPError(http.StatusBadRequest, "Unknown algo, expected md5, sha256, xxh3 or xxh64")
+	}
+	content, err := contentFor(c)
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+	m := content.getManifest()
+	if m == nil {
+		return nil, nil, "", nil, echo.NewHTTPError(http.StatusServiceUnavailable, "Manifest is still being built")
+	}
+	dir, err := url.PathUnescape(c.Param("*"))
+	if err != nil {
+		return nil, nil, "", nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid path")
+	}
+	dir = strings.Trim(dir, "/")
+	node, ok := m.Tree.lookup(dir)
+	if !ok {
+		return nil, nil, "", nil, echo.NewHTTPError(http.StatusNotFound, "Directory not found")
+	}
+	return m, node, dir, digest, nil
+}
+
+// GET /sync/*dir?algo=md5&ref=<branch> lists every file under dir from the manifest. The subtree
+// hash is the ETag, a client sending it back in If-None-Match gets 304 when nothing changed.
+func handleSync(c echo.Context) error {
+	m, node, dir, digest, err := syncTarget(c, c.QueryParam("algo"))
+	if err != nil {
+		return err
+	}
+
+	etag := `"` + node.Hash + `"`
+	c.Response().Header().Set("ETag", etag)
+	if inm := c.Request().Header.Get("If-None-Match"); inm != "" && strings.Contains(inm, etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	files := []syncFile{}
+	node.collect(digest, &files)
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return c.JSON(http.StatusOK, echo.Map{
+		"commit": m.Commit,
+		"dir":    dir,
+		"hash":   node.Hash,
+		"files":  files,
+	})
+}
+
+// linkDeltas sets the delta URL of the files to download that have one from commit
+func linkDeltas(c echo.Context, m *manifest, files []syncFile, commit string) {
+	if commit == "" || commit == m.Commit {
+		return
+	}
+	t, err := contentFor(c)
+	if err != nil {
+		return
+	}
+	var blobs map[string]string // listed on the first file big enough to need them
+	for i, f := range files {
+		if f.Size < cfg.DeltaMinSize || f.Size > cfg.DeltaMaxSize {
+			continue
+		}
+		if blobs == nil {
+			if blobs = fromBlobs(t, commit); blobs == nil {
+				return
+			}
+		}
+		files[i].Delta = deltaURL(t, m, f.Path, commit, blobs)
+	}
+}
+
+// POST /sync/*dir {"algo": "md5", "hash": "<subtree hash>", "files": {"<path>": "<hash>"}} compares
+// the client's copy of dir with the manifest and returns what to download and what to delete. With
+// the "commit" the client last synced to, changed files that have a delta from it link to it.
+func handleSyncDiff(c echo.Context) error {
+	var payload struct {
+		Algo   string            `json:"algo"`
+		Hash   string            `json:"hash"`
+		Commit string            `json:"commit"`
+		Files  map[string]string `json:"files"`
+	}
+	if err := c.Bind(&payload); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid JSON payload")
+	}
+	m, node, dir, digest, err := syncTarget(c, payload.Algo)
+	if err != nil {
+		return err
+	}
+
+	download, remove := []syncFile{}, []string{}
+	if payload.Hash != node.Hash {
+		var files []syncFile
+		node.collect(digest, &files)
+		current := make(map[string]bool, len(files))
+		for _, f := range files {
+			current[f.Path] = true
+			if have, ok := payload.Files[f.Path]; !ok || !strings.EqualFold(have, f.Hash) {
+				download = append(download, f)
+			}
+		}
+		for path := range payload.Files {
+			if !current[path] {
+				remove = append(remove, path)
+			}
+		}
+		sort.Slice(download, func(i, j int) bool { return download[i].Path < download[j].Path })
+		sort.Strings(remove)
+		linkDeltas(c, m, download, payload.Commit)
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"commit":    m.Commit,
+		"dir":       dir,
+		"hash":      node.Hash,
+		"unchanged": len(download) == 0 && len(remove) == 0,
+		"download":  download,
+		"delete":    remove,
+	})
+}
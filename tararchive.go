@@ -0,0 +1,328 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	formatZip    = "zip"
+	formatTarGz  = "tar.gz"
+	formatTarZst = "tar.zst"
+)
+
+// archiveFormat is a container chunks can be served in
+type archiveFormat struct {
+	Ext         string
+	ContentType string
+}
+
+var archiveFormats = map[string]archiveFormat{
+	formatZip:    {Ext: ".zip", ContentType: "application/zip"},
+	formatTarGz:  {Ext: ".tar.gz", ContentType: "application/gzip"},
+	formatTarZst: {Ext: ".tar.zst", ContentType: "application/zstd"},
+}
+
+// formatMethods are the compression methods a tar format can be built with, zip takes them all
+var formatMethods = map[string][]string{
+	formatTarGz:  {methodDeflate, methodStore},
+	formatTarZst: {methodZstd},
+}
+
+// paxOmittedKey carries the best-effort omissions in a trailing global header, tar's stand-in for
+// the zip comment
+const paxOmittedKey = "THJPATCHER.omitted"
+
+// formatCompression fills in the method of a tar format when the client didn't name one and the
+// server default can't build it, so {"format": "tar.zst"} alone is enough
+func formatCompression(format string, req *compressionRequest) *compressionRequest {
+	methods, ok := formatMethods[format]
+	if !ok || (req != nil && req.Method != "") || slices.Contains(methods, cfg.DefaultCompression) {
+		return req
+	}
+	adjusted := &compressionRequest{Method: methods[0]}
+	if req != nil {
+		adjusted.Level = req.Level
+	}
+	return adjusted
+}
+
+// resolveFormat validates the "format" of the init payload, "" is zip. A tar stream is compressed
+// as a whole, so only the methods its compressor can honor are accepted.
+func resolveFormat(format string, compression compressionSettings) (string, error) {
+	if format == "" {
+		return formatZip, nil
+	}
+	if _, ok := archiveFormats[format]; !ok {
+		return "", fmt.Errorf("unknown format %q, expected zip, tar.gz or tar.zst", format)
+	}
+	if methods, ok := formatMethods[format]; ok && !slices.Contains(methods, compression.Method) {
+		return "", fmt.Errorf("%s can't be built with %s, use %s", format, compression.Method, strings.Join(methods, " or "))
+	}
+	return format, nil
+}
+
+// isTarFormat reports whether a format is one of the tar containers rather than zip
+func isTarFormat(format string) bool {
+	return format != "" && format != formatZip
+}
+
+// format returns the container the session's chunks are built in
+func (s *chunkSession) format() archiveFormat {
+	if f, ok := archiveFormats[s.Format]; ok {
+		return f
+	}
+	return archiveFormats[formatZip]
+}
+
+// isArtifactName reports whether a file in the temp dir is a chunk artifact of any format
+func isArtifactName(name string) bool {
+	for _, f := range archiveFormats {
+		if strings.HasSuffix(name, f.Ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// tarCompressor wraps w in the stream compressor of the session's format, store is gzip level 0.
+// The zstd encoder runs on one goroutine with its window bounded by the level, like the zip one.
+func (s *chunkSession) tarCompressor(w io.Writer) (io.WriteCloser, error) {
+	if s.Format == formatTarZst {
+		return zstd.NewWriter(w,
+			zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(s.Compression.Level)),
+			zstd.WithEncoderConcurrency(1),
+		)
+	}
+	level := gzip.NoCompression
+	if s.Compression.Method == methodDeflate {
+		level = s.Compression.Level
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+// tarDecompressor reads back what tarCompressor wrote
+func tarDecompressor(format string, r io.Reader) (io.ReadCloser, error) {
+	if format == formatTarZst {
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return gzip.NewReader(r)
+}
+
+// writeTarArchive is writeChunkArchive for the tar formats
+func writeTarArchive(dir, chunkID string, session *chunkSession) (a *builtArchive, err error) {
+	tmpFile, err := os.CreateTemp(dir, chunkID+"-"+session.Compression.key()+"-*"+session.format().Ext)
+	if err != nil {
+		return nil, fmt.Errorf("create temp archive: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tmpFile.Close()
+			_ = os.Remove(tmpFile.Name())
+		}
+	}()
+
+	timed := &latencyWriter{w: tmpFile}
+	sum := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(timed, sum)}
+	entries, omitted, err := writeTarEntries(context.Background(), counter, session, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return nil, fmt.Errorf("close temp archive: %w", err)
+	}
+
+	var sourceBytes int64
+	for _, e := range entries {
+		sourceBytes += int64(e.UncompressedSize)
+	}
+	return &builtArchive{
+		Path:         tmpFile.Name(),
+		Format:       session.Format,
+		Size:         counter.n,
+		SHA256:       hex.EncodeToString(sum.Sum(nil)),
+		Entries:      entries,
+		Omitted:      omitted,
+		SourceBytes:  sourceBytes,
+		WriteLatency: timed.average(),
+	}, nil
+}
+
+// writeTarEntries writes the session's files as a compressed tar stream to w. Paths are the repo
+// relative names and permissions come from the checkout, parent directories are implied by the
+// names like they are in the zip. strict fails on the first file that can't be read instead of
+// omitting it, flush is called after every entry when the stream goes straight to a client.
+// Entries have no compressed size of their own, the stream is compressed as a whole.
+func writeTarEntries(ctx context.Context, w io.Writer, session *chunkSession, strict bool, flush func()) ([]archiveEntry, []archiveOmission, error) {
+	comp, err := session.tarCompressor(w)
+	if err != nil {
+		return nil, nil, err
+	}
+	tw := tar.NewWriter(comp)
+	var entries []archiveEntry
+	var omitted []archiveOmission
+
+	for _, f := range session.Files {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		entry, err := writeTarEntry(tw, session, f)
+		var omission *omissionError
+		if errors.As(err, &omission) {
+			if strict {
+				return nil, nil, fmt.Errorf("%s: %s", f, omission.reason)
+			}
+			omitted = append(omitted, archiveOmission{Name: f, Reason: omission.reason})
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		entries = append(entries, entry)
+		if flush != nil {
+			if err := tw.Flush(); err != nil {
+				return nil, nil, err
+			}
+			if flusher, ok := comp.(interface{ Flush() error }); ok {
+				if err := flusher.Flush(); err != nil {
+					return nil, nil, err
+				}
+			}
+			flush()
+		}
+	}
+	if len(omitted) > 0 && session.BestEffort {
+		data, err := json.Marshal(omitted)
+		if err == nil {
+			_ = tw.WriteHeader(&tar.Header{
+				Typeflag:   tar.TypeXGlobalHeader,
+				PAXRecords: map[string]string{paxOmittedKey: string(data)},
+			})
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, nil, fmt.Errorf("finish tar: %w", err)
+	}
+	if err := comp.Close(); err != nil {
+		return nil, nil, fmt.Errorf("finish compression: %w", err)
+	}
+	return entries, omitted, nil
+}
+
+// writeTarEntry adds one source file to the tar, checksummed like a zip entry so /entries means
+// the same for both formats
+func writeTarEntry(tw *tar.Writer, session *chunkSession, f string) (archiveEntry, error) {
+	name, file, info, err := openEntrySource(session, f)
+	if err != nil {
+		return archiveEntry{}, err
+	}
+	defer file.Close()
+
+	var src io.Reader = file
+	check := newIntegrityCheck(session.Content, name, info)
+	if check != nil {
+		src = check.reader(file)
+	}
+
+	// the size is fixed up front, a file that grows past it since the stat is cut off there and
+	// one that shrank fails the entry
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     int64(info.Mode().Perm()),
+		Size:     info.Size(),
+		ModTime:  info.ModTime().Truncate(time.Second),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return archiveEntry{}, fmt.Errorf("create entry %s: %w", f, err)
+	}
+	sum := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(tw, sum), io.LimitReader(src, info.Size()))
+	if err != nil {
+		return archiveEntry{}, fmt.Errorf("write entry %s: %w", f, err)
+	}
+	if n != info.Size() {
+		return archiveEntry{}, fmt.Errorf("write entry %s: read %d of %d bytes", f, n, info.Size())
+	}
+
+	if check != nil {
+		if err := check.verify(); err != nil && cfg.IntegrityMode == integrityFail {
+			return archiveEntry{}, err
+		}
+	}
+	return archiveEntry{
+		Name:             name,
+		UncompressedSize: uint64(n),
+		CRC32:            fmt.Sprintf("%08x", sum.Sum32()),
+	}, nil
+}
+
+// verifyTarArchive reads the whole stream back, there's no central directory to compare against.
+// The gzip trailer or zstd frame checksum catches corruption the entry checksums don't.
+func verifyTarArchive(a *builtArchive) error {
+	f, err := os.Open(a.Path)
+	if err != nil {
+		return fmt.Errorf("reopen: %w", err)
+	}
+	defer f.Close()
+	zr, err := tarDecompressor(a.Format, f)
+	if err != nil {
+		return fmt.Errorf("reopen: %w", err)
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+
+	i := 0
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("entry %d: %w", i, err)
+		}
+		if h.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		if i >= len(a.Entries) {
+			return fmt.Errorf("archive has more than the %d entries written", len(a.Entries))
+		}
+		e := a.Entries[i]
+		sum := crc32.NewIEEE()
+		n, err := io.Copy(sum, tr)
+		if err != nil {
+			return fmt.Errorf("entry %d (%s): %w", i, e.Name, err)
+		}
+		if h.Name != e.Name || uint64(n) != e.UncompressedSize || fmt.Sprintf("%08x", sum.Sum32()) != e.CRC32 {
+			return fmt.Errorf("entry %d (%s) doesn't match what was written", i, e.Name)
+		}
+		i++
+	}
+	if i != len(a.Entries) {
+		return fmt.Errorf("archive has %d entries, wrote %d", i, len(a.Entries))
+	}
+	// drain to the end of the stream so its trailing checksum is verified
+	if _, err := io.Copy(io.Discard, zr); err != nil {
+		return fmt.Errorf("trailer: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/time/rate"
+	"net"
+	"net/http"
+)
+
+// throttleBurst is the most a throttled stream writes in one go, and so how far ahead of its rate
+// it can get
+const throttleBurst = 64 * 1024
+
+// totalThrottle is the MAX_TOTAL_BYTES_PER_SEC bucket every throttled stream draws from, nil
+// when unlimited
+var totalThrottle *rate.Limiter
+
+func configureThrottle(total int) {
+	if total > 0 {
+		totalThrottle = newByteLimiter(total)
+	}
+}
+
+func newByteLimiter(bytesPerSec int) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(bytesPerSec), throttleBurst)
+}
+
+// throttleMiddleware holds a download to MAX_STREAM_BYTES_PER_SEC and its share of
+// MAX_TOTAL_BYTES_PER_SEC. Writes wait on the buckets' timers and give up when the client goes.
+func throttleMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if cfg.MaxStreamBytesPerSec <= 0 && totalThrottle == nil {
+			return next(c)
+		}
+		res := c.Response()
+		w := &throttledWriter{ResponseWriter: res.Writer, ctx: c.Request().Context(), total: totalThrottle}
+		if cfg.MaxStreamBytesPerSec > 0 {
+			w.stream = newByteLimiter(cfg.MaxStreamBytesPerSec)
+		}
+		res.Writer = w
+		defer func() { res.Writer = w.ResponseWriter }()
+		return next(c)
+	}
+}
+
+// throttledWriter takes its tokens before each write of at most throttleBurst bytes
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx    context.Context
+	stream *rate.Limiter
+	total  *rate.Limiter
+}
+
+func (w *throttledWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), throttleBurst)
+		for _, l := range []*rate.Limiter{w.stream, w.total} {
+			if l == nil {
+				continue
+			}
+			if err := l.WaitN(w.ctx, n); err != nil {
+				return written, err
+			}
+		}
+		m, err := w.ResponseWriter.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (w *throttledWriter) Flush() {
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *throttledWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useThrottle configures the test's byte rates and puts the shared bucket back when it ends
+func useThrottle(t *testing.T, stream, total string) {
+	useConfig(t, "MAX_STREAM_BYTES_PER_SEC", stream, "MAX_TOTAL_BYTES_PER_SEC", total)
+	previous := totalThrottle
+	totalThrottle = nil
+	configureThrottle(cfg.MaxTotalBytesPerSec)
+	t.Cleanup(func() { totalThrottle = previous })
+}
+
+// throttledServer serves body from /download behind throttleMiddleware
+func throttledServer(body []byte) *echo.Echo {
+	e := echo.New()
+	e.GET("/download", func(c echo.Context) error {
+		return c.Blob(http.StatusOK, "application/octet-stream", body)
+	}, throttleMiddleware)
+	return e
+}
+
+func TestThrottleHoldsStreamsToTheirRate(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 5*throttleBurst)
+
+	// unlimited, the download goes out at once
+	useThrottle(t, "0", "0")
+	e := throttledServer(body)
+	start := time.Now()
+	if rec := request(e, http.MethodGet, "/download", ""); !bytes.Equal(rec.Body.Bytes(), body) || time.Since(start) > 200*time.Millisecond {
+		t.Fatalf("unthrottled download = %d bytes in %v", rec.Body.Len(), time.Since(start))
+	}
+
+	// the first burst is free, the other four are paced at 512KB/s
+	useThrottle(t, "524288", "0")
+	start = time.Now()
+	rec := request(e, http.MethodGet, "/download", "")
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("%d bytes at MAX_STREAM_BYTES_PER_SEC=524288 took %v, want about 500ms", len(body), elapsed)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), body) {
+		t.Errorf("throttled download = %d bytes, want %d", rec.Body.Len(), len(body))
+	}
+
+	// MAX_TOTAL_BYTES_PER_SEC is shared: two streams together take as long as one twice the size
+	useThrottle(t, "0", "524288")
+	start = time.Now()
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rec := request(e, http.MethodGet, "/download", ""); rec.Body.Len() != len(body) {
+				t.Errorf("download sharing the total = %d bytes, want %d", rec.Body.Len(), len(body))
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("two downloads under MAX_TOTAL_BYTES_PER_SEC=524288 took %v, want about 1.1s", elapsed)
+	}
+}
+
+func TestThrottleGivesUpWhenTheClientGoes(t *testing.T) {
+	useThrottle(t, "1024", "0")
+	var served error
+	e := echo.New()
+	e.GET("/download", func(c echo.Context) error {
+		_, err := c.Response().Write(bytes.Repeat([]byte("x"), 2*throttleBurst))
+		served = err
+		return err
+	}, throttleMiddleware)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/download", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	e.ServeHTTP(rec, req)
+	if !errors.Is(served, context.Canceled) || time.Since(start) > time.Second {
+		t.Errorf("write to a client that went away = %v after %v, want context.Canceled at once", served, time.Since(start))
+	}
+	if rec.Body.Len() != throttleBurst {
+		t.Errorf("%d bytes written before the client went, want the first burst of %d", rec.Body.Len(), throttleBurst)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/acme/autocert"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+func tlsEnabled() bool {
+	return cfg.TLSCertFile != "" || len(cfg.AutocertDomains) > 0
+}
+
+// startListener runs the public listener on addr: TLS from the certificate files, TLS with
+// autocert's certificates, or plain HTTP when neither is configured
+func startListener(e *echo.Echo, addr string) error {
+	logged := []any{"addr", addr}
+	if resolved, err := net.ResolveTCPAddr("tcp", addr); err == nil && resolved.String() != addr {
+		logged = append(logged, "resolved", resolved.String())
+	}
+	switch {
+	case cfg.TLSCertFile != "":
+		slog.Info("Listening", append(logged, "tls", "files", "cert", cfg.TLSCertFile)...)
+		return e.StartTLS(addr, cfg.TLSCertFile, cfg.TLSKeyFile)
+	case len(cfg.AutocertDomains) > 0:
+		e.AutoTLSManager.Prompt = autocert.AcceptTOS
+		e.AutoTLSManager.HostPolicy = autocert.HostWhitelist(cfg.AutocertDomains...)
+		e.AutoTLSManager.Cache = autocert.DirCache(cfg.AutocertCacheDir)
+		e.AutoTLSManager.Email = cfg.AutocertEmail
+		slog.Info("Listening", append(logged, "tls", "autocert", "domains", cfg.AutocertDomains)...)
+		return e.StartAutoTLS(addr)
+	}
+	slog.Info("Listening", logged...)
+	return e.Start(addr)
+}
+
+// serveHTTP runs the plain listener next to a TLS one until ctx is done. It answers autocert's
+// HTTP-01 challenges, everything else is redirected to the TLS port or, with HTTP_REDIRECT off,
+// served as is.
+func serveHTTP(ctx context.Context, e *echo.Echo, tlsAddr string) {
+	var handler http.Handler = e
+	if cfg.HTTPRedirect {
+		handler = httpsRedirect(tlsAddr)
+	}
+	if len(cfg.AutocertDomains) > 0 {
+		handler = e.AutoTLSManager.HTTPHandler(handler)
+	}
+	srv := &http.Server{Addr: cfg.HTTPAddr, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			_ = srv.Close()
+		}
+	}()
+	slog.Info("Listening", "addr", cfg.HTTPAddr, "redirect", cfg.HTTPRedirect)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("HTTP listener failed", "addr", cfg.HTTPAddr, "err", err)
+	}
+}
+
+// httpsRedirect sends requests to the same host and path on the TLS listener's port
+func httpsRedirect(tlsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// torrentMeta is a generated BitTorrent v1 metainfo file
+type torrentMeta struct {
+	Data     []byte // the bencoded .torrent
+	InfoHash string // hex sha1 of the bencoded info dictionary
+}
+
+// buildTorrent hashes the content read from r into a single-file torrent. Webseeds go into url-list
+// (BEP 19) so clients can fetch pieces over HTTP when there are no peers.
+func buildTorrent(r io.Reader, name string, pieceLength int64, webseeds, trackers []string, comment string) (*torrentMeta, error) {
+	var pieces bytes.Buffer
+	buf := make([]byte, pieceLength)
+	var length int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sum := sha1.Sum(buf[:n])
+			pieces.Write(sum[:])
+			length += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	info := map[string]any{
+		"length":       length,
+		"name":         name,
+		"piece length": pieceLength,
+		"pieces":       pieces.Bytes(),
+	}
+	var encodedInfo bytes.Buffer
+	if err := bencode(&encodedInfo, info); err != nil {
+		return nil, err
+	}
+	hash := sha1.Sum(encodedInfo.Bytes())
+
+	meta := map[string]any{
+		"info":          info,
+		"created by":    "thj-patcher-web",
+		"creation date": time.Now().Unix(),
+		"comment":       comment,
+	}
+	if len(webseeds) > 0 {
+		meta["url-list"] = toAnySlice(webseeds)
+	}
+	if len(trackers) > 0 {
+		meta["announce"] = trackers[0]
+		tiers := make([]any, 0, len(trackers))
+		for _, t := range trackers {
+			tiers = append(tiers, []any{t})
+		}
+		meta["announce-list"] = tiers
+	}
+	var data bytes.Buffer
+	if err := bencode(&data, meta); err != nil {
+		return nil, err
+	}
+	return &torrentMeta{Data: data.Bytes(), InfoHash: hex.EncodeToString(hash[:])}, nil
+}
+
+func toAnySlice(items []string) []any {
+	out := make([]any, len(items))
+	for i, s := range items {
+		out[i] = s
+	}
+	return out
+}
+
+// bencode writes v in BitTorrent's encoding. Dictionary keys are sorted as raw bytes, as the
+// spec requires, so the info hash is stable.
+func bencode(w *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case string:
+		w.WriteString(strconv.Itoa(len(v)))
+		w.WriteByte(':')
+		w.WriteString(v)
+	case []byte:
+		w.WriteString(strconv.Itoa(len(v)))
+		w.WriteByte(':')
+		w.Write(v)
+	case int:
+		fmt.Fprintf(w, "i%de", v)
+	case int64:
+		fmt.Fprintf(w, "i%de", v)
+	case []any:
+		w.WriteByte('l')
+		for _, item := range v {
+			if err := bencode(w, item); err != nil {
+				return err
+			}
+		}
+		w.WriteByte('e')
+	case map[string]any:
+		w.WriteByte('d')
+		for _, k := range sortedKeys(v) {
+			if err := bencode(w, k); err != nil {
+				return err
+			}
+			if err := bencode(w, v[k]); err != nil {
+				return err
+			}
+		}
+		w.WriteByte('e')
+	default:
+		return fmt.Errorf("bencode: unsupported type %T", v)
+	}
+	return nil
+}
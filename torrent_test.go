@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// metainfo is a parsed .torrent, with the info dictionary's bytes as they are in the file
+type metainfo struct {
+	Dict     map[string]any
+	Info     map[string]any
+	InfoHash string
+}
+
+func parseTorrent(t *testing.T, data []byte) metainfo {
+	t.Helper()
+	v, end, err := bdecode(data, 0)
+	if err != nil {
+		t.Fatalf("bdecode: %v", err)
+	}
+	if end != len(data) {
+		t.Fatalf("%d bytes after the metainfo", len(data)-end)
+	}
+	dict, ok := v.(map[string]any)
+	if !ok {
+		t.Fatalf("metainfo is a %T", v)
+	}
+	// the hash covers the info dictionary exactly as encoded, find where it sits
+	start := bytes.Index(data, []byte("4:info")) + len("4:info")
+	_, stop, err := bdecode(data, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum(data[start:stop])
+	info, _ := dict["info"].(map[string]any)
+	return metainfo{Dict: dict, Info: info, InfoHash: hex.EncodeToString(sum[:])}
+}
+
+// bdecode reads one value at data[i:], strings come back as string and integers as int64
+func bdecode(data []byte, i int) (any, int, error) {
+	if i >= len(data) {
+		return nil, i, errors.New("unexpected end")
+	}
+	switch c := data[i]; {
+	case c == 'i':
+		end := bytes.IndexByte(data[i:], 'e')
+		if end < 0 {
+			return nil, i, errors.New("unterminated integer")
+		}
+		n, err := strconv.ParseInt(string(data[i+1:i+end]), 10, 64)
+		return n, i + end + 1, err
+	case c == 'l':
+		var list []any
+		for i++; i < len(data) && data[i] != 'e'; {
+			v, next, err := bdecode(data, i)
+			if err != nil {
+				return nil, i, err
+			}
+			list, i = append(list, v), next
+		}
+		return list, i + 1, nil
+	case c == 'd':
+		dict := make(map[string]any)
+		last := ""
+		for i++; i < len(data) && data[i] != 'e'; {
+			k, next, err := bdecode(data, i)
+			if err != nil {
+				return nil, i, err
+			}
+			key, ok := k.(string)
+			if !ok || (len(dict) > 0 && key <= last) {
+				return nil, i, fmt.Errorf("dictionary key %v out of order", k)
+			}
+			v, next, err := bdecode(data, next)
+			if err != nil {
+				return nil, i, err
+			}
+			dict[key], last, i = v, key, next
+		}
+		return dict, i + 1, nil
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(data[i:], ':')
+		if colon < 0 {
+			return nil, i, errors.New("string without length")
+		}
+		n, err := strconv.Atoi(string(data[i : i+colon]))
+		start := i + colon + 1
+		if err != nil || start+n > len(data) {
+			return nil, i, errors.New("bad string length")
+		}
+		return string(data[start : start+n]), start + n, nil
+	}
+	return nil, i, fmt.Errorf("unexpected %q at %d", data[i], i)
+}
+
+// checkPieces fails unless the torrent's info describes content piece by piece
+func checkPieces(t *testing.T, info map[string]any, content []byte) {
+	t.Helper()
+	pieceLength, _ := info["piece length"].(int64)
+	pieces, _ := info["pieces"].(string)
+	if length, _ := info["length"].(int64); length != int64(len(content)) {
+		t.Errorf("length = %d, want %d", length, len(content))
+	}
+	if pieceLength <= 0 || len(pieces)%sha1.Size != 0 {
+		t.Fatalf("piece length %d with %d bytes of piece hashes", pieceLength, len(pieces))
+	}
+	if want := (int64(len(content)) + pieceLength - 1) / pieceLength; int64(len(pieces)/sha1.Size) != want {
+		t.Fatalf("%d pieces, want %d", len(pieces)/sha1.Size, want)
+	}
+	for i := 0; i < len(pieces)/sha1.Size; i++ {
+		piece := content[int64(i)*pieceLength : min(int64(i+1)*pieceLength, int64(len(content)))]
+		if sum := sha1.Sum(piece); string(sum[:]) != pieces[i*sha1.Size:(i+1)*sha1.Size] {
+			t.Errorf("piece %d doesn't hash to what the torrent says", i)
+		}
+	}
+}
+
+func TestBuildTorrent(t *testing.T) {
+	for _, size := range []int{0, 100, 16384, 16384*2 + 5000} {
+		content := make([]byte, size)
+		rand.Read(content)
+		meta, err := buildTorrent(bytes.NewReader(content), "client.zip", 16384,
+			[]string{"https://a.example/zip-all", "https://b.example/zip-all"}, []string{"udp://t1.example:6969", "udp://t2.example:6969"}, "commit abc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := parseTorrent(t, meta.Data)
+		if m.InfoHash != meta.InfoHash {
+			t.Errorf("%d bytes: infohash %s, the info dictionary hashes to %s", size, meta.InfoHash, m.InfoHash)
+		}
+		checkPieces(t, m.Info, content)
+		if m.Info["name"] != "client.zip" || m.Info["piece length"] != int64(16384) || m.Dict["comment"] != "commit abc" {
+			t.Errorf("%d bytes: metainfo = %v", size, m.Dict)
+		}
+		if seeds := m.Dict["url-list"]; !slices.Equal(seeds.([]any), []any{"https://a.example/zip-all", "https://b.example/zip-all"}) {
+			t.Errorf("url-list = %v", seeds)
+		}
+		tiers := m.Dict["announce-list"].([]any)
+		if m.Dict["announce"] != "udp://t1.example:6969" || len(tiers) != 2 || tiers[1].([]any)[0] != "udp://t2.example:6969" {
+			t.Errorf("announce = %v, announce-list = %v", m.Dict["announce"], tiers)
+		}
+	}
+
+	// the infohash depends on the content alone, not on when or with which sources it was made
+	content := []byte("the same content")
+	a, _ := buildTorrent(bytes.NewReader(content), "client.zip", 16384, nil, nil, "")
+	b, _ := buildTorrent(bytes.NewReader(content), "client.zip", 16384, []string{"https://c.example/zip-all"}, nil, "later")
+	if a.InfoHash != b.InfoHash {
+		t.Errorf("infohash %s and %s for the same content", a.InfoHash, b.InfoHash)
+	}
+	if _, ok := parseTorrent(t, a.Data).Dict["url-list"]; ok {
+		t.Error("url-list without webseeds")
+	}
+}
+
+// useZipAll forgets the full archive being served when the test ends
+func useZipAll(t *testing.T) {
+	t.Cleanup(func() {
+		zipAll.Lock()
+		defer zipAll.Unlock()
+		zipAll.current, zipAll.pending = nil, nil
+	})
+}
+
+// awaitZipAll waits for the full archive of commit to be served
+func awaitZipAll(t *testing.T, commit string) *zipAllArtifact {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if a := currentZipAll(); a != nil && a.Commit == commit {
+			return a
+		}
+	}
+	t.Fatalf("full archive of %s never built", commit)
+	return nil
+}
+
+func TestZipAllTorrentMatchesTheArtifact(t *testing.T) {
+	useConfig(t, "TMPDIR", t.TempDir(), "ZIP_ALL", "true", "ZIP_ALL_DIR", t.TempDir(), "ZIP_ALL_PIECE_SIZE", "16384",
+		"PUBLIC_URL", "https://patch.example/", "MIRRORS", "https://mirror.example|eu")
+	useZipAll(t)
+	source := gitFixture(t)
+	random := func() string {
+		b := make([]byte, 70000)
+		rand.Read(b)
+		return hex.EncodeToString(b)
+	}
+	previous := defaultContent
+	defaultContent = newContentTree("", source)
+	t.Cleanup(func() { defaultContent = previous })
+
+	e := echo.New()
+	e.GET("/zip-all", handleZipAll)
+	e.GET("/zip-all.torrent", handleZipAllTorrent)
+	e.GET("/latest", handleLatest)
+
+	var infohashes []string
+	for range 2 {
+		commit := commitFiles(t, source, map[string]string{"maps/a.txt": random(), "Resources/b.txt": random()})
+		defaultContent.rebuildManifest()
+		awaitZipAll(t, commit)
+
+		// the torrent, the archive and /latest come from the same build
+		archive := request(e, http.MethodGet, "/zip-all", "")
+		torrent := request(e, http.MethodGet, "/zip-all.torrent", "")
+		if archive.Code != http.StatusOK || torrent.Code != http.StatusOK {
+			t.Fatalf("/zip-all = %d, /zip-all.torrent = %d", archive.Code, torrent.Code)
+		}
+		m := parseTorrent(t, torrent.Body.Bytes())
+		checkPieces(t, m.Info, archive.Body.Bytes())
+		if got := torrent.Header().Get(contentCommitHeader); got != commit || archive.Header().Get(contentCommitHeader) != commit {
+			t.Errorf("torrent of %s, archive of %s, want %s", got, archive.Header().Get(contentCommitHeader), commit)
+		}
+		if torrent.Header().Get("ETag") != `"`+m.InfoHash+`"` {
+			t.Errorf("torrent ETag = %s, infohash %s", torrent.Header().Get("ETag"), m.InfoHash)
+		}
+		if seeds := m.Dict["url-list"]; !slices.Equal(seeds.([]any), []any{"https://patch.example/zip-all", "https://mirror.example/zip-all"}) {
+			t.Errorf("url-list = %v", seeds)
+		}
+		if m.Info["piece length"] != int64(16384) {
+			t.Errorf("piece length = %v, want ZIP_ALL_PIECE_SIZE", m.Info["piece length"])
+		}
+
+		var latest struct {
+			ZipAll struct {
+				Commit   string `json:"commit"`
+				InfoHash string `json:"infohash"`
+				Size     int64  `json:"size"`
+			} `json:"zip_all"`
+		}
+		if err := json.Unmarshal(request(e, http.MethodGet, "/latest", "").Body.Bytes(), &latest); err != nil {
+			t.Fatal(err)
+		}
+		if latest.ZipAll.Commit != commit || latest.ZipAll.InfoHash != m.InfoHash || latest.ZipAll.Size != int64(archive.Body.Len()) {
+			t.Errorf("/latest zip_all = %+v, want %s %s", latest.ZipAll, commit, m.InfoHash)
+		}
+		if rec := request(e, http.MethodGet, "/zip-all.torrent", "", "If-None-Match", `"`+m.InfoHash+`"`); rec.Code != http.StatusNotModified {
+			t.Errorf("torrent with its infohash as If-None-Match = %d, want 304", rec.Code)
+		}
+		infohashes = append(infohashes, m.InfoHash)
+	}
+	if infohashes[0] == infohashes[1] {
+		t.Error("a new commit kept the infohash")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// treeNode is one directory of the content tree with its subtree hash. A directory hashes the
+// sorted list of its children, files as (name, size, sha256) and directories as (name, hash),
+// so identical content always yields identical hashes and any change bubbles up to the root.
+type treeNode struct {
+	Hash  string
+	Dirs  map[string]*treeNode
+	Files map[string]*manifestEntry
+}
+
+// trees of recent commits are kept per content tree, so a mirror can still compare against the
+// commit it last saw
+const treeCacheSize = 8
+
+// buildTree computes the directory hashes of a manifest
+func buildTree(m *manifest) *treeNode {
+	root := newTreeNode()
+	for rel, entry := range m.Files {
+		parts := strings.Split(rel, "/")
+		node := root
+		for _, dir := range parts[:len(parts)-1] {
+			child, ok := node.Dirs[dir]
+			if !ok {
+				child = newTreeNode()
+				node.Dirs[dir] = child
+			}
+			node = child
+		}
+		node.Files[parts[len(parts)-1]] = entry
+	}
+	root.hash()
+	return root
+}
+
+func newTreeNode() *treeNode {
+	return &treeNode{Dirs: make(map[string]*treeNode), Files: make(map[string]*manifestEntry)}
+}
+
+func (n *treeNode) hash() string {
+	var lines []string
+	for name, f := range n.Files {
+		lines = append(lines, fmt.Sprintf("f %s %d %s\n", name, f.Size, f.SHA256))
+	}
+	for name, d := range n.Dirs {
+		lines = append(lines, fmt.Sprintf("d %s %s\n", name, d.hash()))
+	}
+	sort.Strings(lines)
+
+	h := sha256.New()
+	for _, l := range lines {
+		h.Write([]byte(l))
+	}
+	n.Hash = hex.EncodeToString(h.Sum(nil))
+	return n.Hash
+}
+
+// lookup descends to a repo relative directory, "" being the root
+func (n *treeNode) lookup(dir string) (*treeNode, bool) {
+	dir = strings.Trim(dir, "/")
+	if dir == "" {
+		return n, true
+	}
+	node := n
+	for _, part := range strings.Split(dir, "/") {
+		child, ok := node.Dirs[part]
+		if !ok {
+			return nil, false
+		}
+		node = child
+	}
+	return node, true
+}
+
+// cacheTree remembers the tree of a commit
+func (t *contentTree) cacheTree(commit string, tree *treeNode) {
+	if commit == "" {
+		return
+	}
+	t.treeCacheMu.Lock()
+	defer t.treeCacheMu.Unlock()
+	if _, ok := t.treeCache[commit]; !ok {
+		t.treeCacheOrder = append(t.treeCacheOrder, commit)
+	}
+	t.treeCache[commit] = tree
+	for len(t.treeCacheOrder) > treeCacheSize {
+		delete(t.treeCache, t.treeCacheOrder[0])
+		t.treeCacheOrder = t.treeCacheOrder[1:]
+	}
+}
+
+func (t *contentTree) cachedTree(commit string) (*treeNode, bool) {
+	t.treeCacheMu.Lock()
+	defer t.treeCacheMu.Unlock()
+	tree, ok := t.treeCache[commit]
+	return tree, ok
+}
+
+// GET /tree?dir=maps&commit=<sha>&ref=<branch>
+func handleTree(c echo.Context) error {
+	content, err := contentFor(c)
+	if err != nil {
+		return err
+	}
+	m := content.getManifest()
+	if m == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Manifest is still being built")
+	}
+
+	tree, commit := m.Tree, m.Commit
+	if want := c.QueryParam("commit"); want != "" && want != commit {
+		t, ok := content.cachedTree(want)
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "Tree for that commit is not cached")
+		}
+		tree, commit = t, want
+	}
+
+	dir := c.QueryParam("dir")
+	node, ok := tree.lookup(dir)
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "Directory not found")
+	}
+
+	type dirInfo struct {
+		Name string `json:"name"`
+		Hash string `json:"hash"`
+	}
+	type fileInfo struct {
+		Name   string `json:"name"`
+		Size   int64  `json:"size"`
+		SHA256 string `json:"sha256"`
+	}
+
+	dirs := make([]dirInfo, 0, len(node.Dirs))
+	for name, d := range node.Dirs {
+		dirs = append(dirs, dirInfo{Name: name, Hash: d.Hash})
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Name < dirs[j].Name })
+
+	files := make([]fileInfo, 0, len(node.Files))
+	for name, f := range node.Files {
+		files = append(files, fileInfo{Name: name, Size: f.Size, SHA256: f.SHA256})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	c.Response().Header().Set("X-Content-Tree-Hash", tree.Hash)
+	return c.JSON(http.StatusOK, echo.Map{
+		"commit": commit,
+		"dir":    strings.Trim(dir, "/"),
+		"hash":   node.Hash,
+		"dirs":   dirs,
+		"files":  files,
+	})
+}
+
+// GET /latest?ref=<branch>
+func handleLatest(c echo.Context) error {
+	content, err := contentFor(c)
+	if err != nil {
+		return err
+	}
+	m := content.getManifest()
+	if m == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Manifest is still being built")
+	}
+	c.Response().Header().Set("X-Content-Tree-Hash", m.Tree.Hash)
+	response := echo.Map{
+		"ref":               content.Ref,
+		"commit":            m.Commit,
+		"tree_hash":         m.Tree.Hash,
+		"files":             len(m.Files),
+		"manifest_built_at": m.BuiltAt,
+	}
+	// the full archive can trail the manifest while a new one builds, its commit tells
+	if info := zipAllInfo(); info != nil && content == defaultContent {
+		response["zip_all"] = info
+	}
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// treeFixture is content with files at the root and two directories deep
+var treeFixture = map[string]string{
+	"readme.txt":          "readme",
+	"maps/a.txt":          "a",
+	"maps/deep/b.txt":     "b",
+	"Resources/spell.txt": "spell",
+}
+
+// manifestTree rebuilds the content's manifest and returns its tree
+func manifestTree(t *testing.T, content *contentTree) *treeNode {
+	t.Helper()
+	content.rebuildManifest()
+	m := content.getManifest()
+	if m == nil || m.Tree == nil {
+		t.Fatal("no manifest was built")
+	}
+	return m.Tree
+}
+
+// subtreeHash is the hash of the directory under n, failing when it isn't there
+func subtreeHash(t *testing.T, n *treeNode, dir string) string {
+	t.Helper()
+	node, ok := n.lookup(dir)
+	if !ok {
+		t.Fatalf("tree has no %q", dir)
+	}
+	return node.Hash
+}
+
+func TestTreeHashIsStableAcrossRebuilds(t *testing.T) {
+	useConfig(t, "TMPDIR", t.TempDir())
+	root := useContent(t, treeFixture)
+	first := manifestTree(t, defaultContent)
+
+	// modification times and the digest cache don't go into the hash, nor does where the checkout is
+	later := time.Now().Add(time.Hour)
+	for name := range treeFixture {
+		if err := os.Chtimes(filepath.Join(root, filepath.FromSlash(name)), later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	copied := t.TempDir()
+	writeTree(t, copied, treeFixture)
+	for _, tree := range []*treeNode{manifestTree(t, defaultContent), manifestTree(t, newContentTree("", copied))} {
+		for _, dir := range []string{"", "maps", "maps/deep", "Resources"} {
+			if got, want := subtreeHash(t, tree, dir), subtreeHash(t, first, dir); got != want {
+				t.Errorf("hash of %q = %s after the rebuild, was %s", dir, got, want)
+			}
+		}
+	}
+
+	// a change shows in every directory above it and nowhere else
+	writeTree(t, root, map[string]string{"maps/deep/b.txt": "b changed"})
+	changed := manifestTree(t, defaultContent)
+	for dir, moved := range map[string]bool{"": true, "maps": true, "maps/deep": true, "Resources": false} {
+		if got := subtreeHash(t, changed, dir) != subtreeHash(t, first, dir); got != moved {
+			t.Errorf("hash of %q changed = %v, want %v", dir, got, moved)
+		}
+	}
+	// an empty directory isn't content, and undoing the change brings the old hash back
+	if err := os.Mkdir(filepath.Join(root, "empty"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTree(t, root, map[string]string{"maps/deep/b.txt": "b"})
+	if got := subtreeHash(t, manifestTree(t, defaultContent), ""); got != first.Hash {
+		t.Errorf("root hash = %s once the change is undone, want %s", got, first.Hash)
+	}
+}
+
+func TestTreeServesCachedCommits(t *testing.T) {
+	useConfig(t, "TMPDIR", t.TempDir())
+	source := gitFixture(t)
+	before := commitFiles(t, source, treeFixture)
+	previous := defaultContent
+	defaultContent = newContentTree("", source)
+	t.Cleanup(func() { defaultContent = previous })
+	old := manifestTree(t, defaultContent)
+	after := commitFiles(t, source, map[string]string{"maps/a.txt": "a changed"})
+	current := manifestTree(t, defaultContent)
+
+	e := echo.New()
+	e.GET("/tree", handleTree)
+	e.GET("/latest", handleLatest)
+	var tree struct {
+		Commit string `json:"commit"`
+		Dir    string `json:"dir"`
+		Hash   string `json:"hash"`
+		Dirs   []struct {
+			Name string `json:"name"`
+			Hash string `json:"hash"`
+		} `json:"dirs"`
+		Files []struct {
+			Name string `json:"name"`
+		} `json:"files"`
+	}
+	for target, want := range map[string]struct {
+		commit string
+		tree   *treeNode
+	}{
+		"/tree?dir=maps":                  {after, current},
+		"/tree?dir=maps&commit=" + after:  {after, current},
+		"/tree?dir=maps&commit=" + before: {before, old},
+	} {
+		rec := request(e, http.MethodGet, target, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d %s", target, rec.Code, rec.Body.String())
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &tree); err != nil {
+			t.Fatal(err)
+		}
+		if tree.Commit != want.commit || tree.Dir != "maps" || tree.Hash != subtreeHash(t, want.tree, "maps") {
+			t.Errorf("GET %s = %s %s %s, want %s %s", target, tree.Commit, tree.Dir, tree.Hash, want.commit, subtreeHash(t, want.tree, "maps"))
+		}
+		if len(tree.Dirs) != 1 || tree.Dirs[0].Name != "deep" || tree.Dirs[0].Hash != subtreeHash(t, want.tree, "maps/deep") {
+			t.Errorf("GET %s dirs = %+v", target, tree.Dirs)
+		}
+		if len(tree.Files) != 1 || tree.Files[0].Name != "a.txt" {
+			t.Errorf("GET %s files = %+v", target, tree.Files)
+		}
+		if got := rec.Header().Get("X-Content-Tree-Hash"); got != want.tree.Hash {
+			t.Errorf("GET %s X-Content-Tree-Hash = %s, want %s", target, got, want.tree.Hash)
+		}
+	}
+	if old.Hash == current.Hash || subtreeHash(t, old, "Resources") != subtreeHash(t, current, "Resources") {
+		t.Error("only the directories above the changed file should hash differently")
+	}
+
+	for _, target := range []string{"/tree?commit=" + strings.Repeat("0", 40), "/tree?dir=nowhere"} {
+		if rec := request(e, http.MethodGet, target, ""); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", target, rec.Code)
+		}
+	}
+
+	rec := request(e, http.MethodGet, "/latest", "")
+	var latest struct {
+		Commit   string `json:"commit"`
+		TreeHash string `json:"tree_hash"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &latest); err != nil {
+		t.Fatal(err)
+	}
+	if latest.Commit != after || latest.TreeHash != current.Hash || rec.Header().Get("X-Content-Tree-Hash") != current.Hash {
+		t.Errorf("/latest = %s %s, want %s %s", latest.Commit, latest.TreeHash, after, current.Hash)
+	}
+}
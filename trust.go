@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// trustedSigners is who may sign served commits: GPG key fingerprints, or an SSH allowed_signers file
+type trustedSigners struct {
+	Fingerprints       []string // uppercase, no spaces
+	AllowedSignersFile string
+}
+
+// parseTrustedSigners reads TRUSTED_SIGNERS, a path to an allowed_signers file or a comma separated
+// list of GPG fingerprints
+func parseTrustedSigners(v string) (*trustedSigners, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return nil, nil
+	}
+	if info, err := os.Stat(v); err == nil && !info.IsDir() {
+		return &trustedSigners{AllowedSignersFile: v}, nil
+	}
+	t := &trustedSigners{}
+	for _, fp := range strings.Split(v, ",") {
+		fp = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(fp), " ", ""))
+		if fp == "" {
+			continue
+		}
+		if !isHexSHA(fp) {
+			return nil, fmt.Errorf("%q is neither an allowed_signers file nor a GPG fingerprint", fp)
+		}
+		t.Fingerprints = append(t.Fingerprints, fp)
+	}
+	return t, nil
+}
+
+// verifyCommit checks that rev carries a good signature from a trusted signer. GPG keys must be in
+// the server's keyring, the fingerprint check here is what decides trust.
+func verifyCommit(dir, rev string) error {
+	t := cfg.TrustedSigners
+	if t == nil {
+		return nil
+	}
+
+	args := []string{"-C", dir}
+	if t.AllowedSignersFile != "" {
+		args = append(args, "-c", "gpg.ssh.allowedSignersFile="+t.AllowedSignersFile)
+	}
+	args = append(args, "log", "-1", "--format=%H%n%G?%n%GF%n%GP", rev, "--")
+	var out bytes.Buffer
+	if err := runGit(&out, nil, args...); err != nil {
+		return fmt.Errorf("verify %s: %w", rev, err)
+	}
+	fields := strings.Split(strings.TrimRight(out.String(), "\n"), "\n")
+	for len(fields) < 4 {
+		fields = append(fields, "")
+	}
+	sha, status, key, primary := fields[0], fields[1], strings.ToUpper(fields[2]), strings.ToUpper(fields[3])
+
+	if t.AllowedSignersFile != "" {
+		// git only reports G for SSH signatures whose principal is in the allowed_signers file
+		if status != "G" {
+			return &untrustedCommitError{Commit: sha, Reason: signatureReason(status)}
+		}
+		return nil
+	}
+
+	// U is a good signature from a key the keyring doesn't trust, the fingerprint list overrides that
+	if status != "G" && status != "U" {
+		return &untrustedCommitError{Commit: sha, Reason: signatureReason(status)}
+	}
+	for _, fp := range t.Fingerprints {
+		if fp == key || fp == primary {
+			return nil
+		}
+	}
+	return &untrustedCommitError{Commit: sha, Reason: "signed by untrusted key " + key}
+}
+
+func signatureReason(status string) string {
+	switch status {
+	case "N":
+		return "not signed"
+	case "B":
+		return "bad signature"
+	case "E":
+		return "signature can't be checked, key missing from the keyring or allowed_signers"
+	case "X", "Y":
+		return "signature or key has expired"
+	case "R":
+		return "signing key has been revoked"
+	case "U":
+		return "signed by a key that isn't trusted"
+	}
+	return "signature not trusted (" + status + ")"
+}
+
+// untrustedCommitError is returned when a fetched commit fails signature verification
+type untrustedCommitError struct {
+	Commit string
+	Reason string
+}
+
+func (e *untrustedCommitError) Error() string {
+	return fmt.Sprintf("commit %s rejected: %s", e.Commit, e.Reason)
+}
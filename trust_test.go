@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sshSigner makes an SSH key and returns its path and its allowed_signers line
+func sshSigner(t *testing.T, name string) (string, string) {
+	t.Helper()
+	key := filepath.Join(t.TempDir(), name)
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", name, "-f", key).CombinedOutput(); err != nil {
+		t.Skipf("ssh-keygen not available: %v %s", err, out)
+	}
+	pub, err := os.ReadFile(key + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, `t@example.com namespaces="git" ` + strings.TrimSpace(string(pub))
+}
+
+// signWith makes the commits of the test sign with key, "" leaves them unsigned
+func signWith(t *testing.T, format, key string) {
+	t.Setenv("GIT_CONFIG_COUNT", "3")
+	t.Setenv("GIT_CONFIG_KEY_0", "gpg.format")
+	t.Setenv("GIT_CONFIG_VALUE_0", format)
+	t.Setenv("GIT_CONFIG_KEY_1", "user.signingkey")
+	t.Setenv("GIT_CONFIG_VALUE_1", key)
+	t.Setenv("GIT_CONFIG_KEY_2", "commit.gpgsign")
+	t.Setenv("GIT_CONFIG_VALUE_2", "false")
+	if key != "" {
+		t.Setenv("GIT_CONFIG_VALUE_2", "true")
+	}
+}
+
+// trustSSHSigners writes an allowed_signers file of lines and makes it TRUSTED_SIGNERS
+func trustSSHSigners(t *testing.T, env []string, lines ...string) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "allowed_signers")
+	if err := os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	useConfig(t, append([]string{"TRUSTED_SIGNERS", file}, env...)...)
+}
+
+// wantRejected fails unless err is the rejection of a commit for the reason
+func wantRejected(t *testing.T, what string, err error, reason string) {
+	t.Helper()
+	var untrusted *untrustedCommitError
+	if !errors.As(err, &untrusted) || !strings.Contains(untrusted.Reason, reason) {
+		t.Errorf("%s = %v, want it rejected as %q", what, err, reason)
+	}
+}
+
+func TestVerifyCommitWithSSHSigners(t *testing.T) {
+	source := gitFixture(t)
+	trusted, line := sshSigner(t, "trusted")
+	stranger, _ := sshSigner(t, "stranger")
+
+	signWith(t, "ssh", "")
+	unsigned := commitFiles(t, source, map[string]string{"a.txt": "unsigned"})
+	signWith(t, "ssh", trusted)
+	good := commitFiles(t, source, map[string]string{"a.txt": "trusted"})
+	signWith(t, "ssh", stranger)
+	foreign := commitFiles(t, source, map[string]string{"a.txt": "stranger"})
+
+	useConfig(t)
+	for _, rev := range []string{unsigned, good, foreign} {
+		if err := verifyCommit(source, rev); err != nil {
+			t.Errorf("verifyCommit(%s) without TRUSTED_SIGNERS = %v", rev, err)
+		}
+	}
+
+	trustSSHSigners(t, nil, line)
+	if err := verifyCommit(source, good); err != nil {
+		t.Errorf("verifyCommit of the trusted signer's commit = %v", err)
+	}
+	wantRejected(t, "verifyCommit of the unsigned commit", verifyCommit(source, unsigned), "not signed")
+	wantRejected(t, "verifyCommit of the stranger's commit", verifyCommit(source, foreign), "key that isn't trusted")
+	if err := verifyCommit(source, "HEAD"); err == nil || !strings.Contains(err.Error(), foreign) {
+		t.Errorf("verifyCommit(HEAD) = %v, want the rejection to name %s", err, foreign)
+	}
+}
+
+func TestVerifyCommitWithGPGFingerprints(t *testing.T) {
+	home, err := os.MkdirTemp("", "gpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = exec.Command("gpgconf", "--homedir", home, "--kill", "gpg-agent").Run()
+		os.RemoveAll(home)
+	})
+	t.Setenv("GNUPGHOME", home)
+	if out, err := exec.Command("gpg", "--batch", "--passphrase", "", "--quick-gen-key", "T <t@example.com>", "ed25519", "sign", "never").CombinedOutput(); err != nil {
+		t.Skipf("gpg can't make a key: %v %s", err, out)
+	}
+	out, err := exec.Command("gpg", "--batch", "--with-colons", "--list-secret-keys").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fingerprint string
+	for _, l := range strings.Split(string(out), "\n") {
+		if f := strings.Split(l, ":"); f[0] == "fpr" && fingerprint == "" {
+			fingerprint = f[9]
+		}
+	}
+
+	source := gitFixture(t)
+	signWith(t, "openpgp", fingerprint)
+	signed := commitFiles(t, source, map[string]string{"a.txt": "signed"})
+	signWith(t, "openpgp", "")
+	unsigned := commitFiles(t, source, map[string]string{"a.txt": "unsigned"})
+
+	// fingerprints are taken with spaces and in lowercase, as gpg prints them
+	useConfig(t, "TRUSTED_SIGNERS", strings.ToLower(fingerprint[:20]+" "+fingerprint[20:]))
+	if err := verifyCommit(source, signed); err != nil {
+		t.Errorf("verifyCommit of the trusted key's commit = %v", err)
+	}
+	wantRejected(t, "verifyCommit of the unsigned commit", verifyCommit(source, unsigned), "not signed")
+	useConfig(t, "TRUSTED_SIGNERS", strings.Repeat("AB", 20))
+	wantRejected(t, "verifyCommit with another key trusted", verifyCommit(source, signed), "untrusted key "+fingerprint)
+
+	if _, err := parseTrustedSigners("not-a-fingerprint"); err == nil {
+		t.Error("parseTrustedSigners takes a value that's neither a file nor a fingerprint")
+	}
+}
+
+// useUpdateState puts the update pipeline's state back when the test ends
+func useUpdateState(t *testing.T) {
+	lastUpdateMu.Lock()
+	last, history, served, success := lastUpdate, updateHistory, servedVersion, lastSuccess
+	lastUpdateMu.Unlock()
+	t.Cleanup(func() {
+		lastUpdateMu.Lock()
+		defer lastUpdateMu.Unlock()
+		if updateRetry != nil {
+			updateRetry.Stop()
+			updateRetry = nil
+		}
+		lastUpdate, updateHistory, servedVersion, lastSuccess = last, history, served, success
+		updateRetryDelay = 0
+	})
+}
+
+func TestUntrustedPullKeepsServingTheVerifiedCommit(t *testing.T) {
+	source := gitFixture(t)
+	trusted, line := sshSigner(t, "trusted")
+	signWith(t, "ssh", trusted)
+	verified := commitFiles(t, source, map[string]string{"maps/a.txt": "verified"})
+
+	alerts := make(chan string, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		alerts <- string(body)
+	}))
+	defer hook.Close()
+	trustSSHSigners(t, []string{"NOTIFY_WEBHOOK_URL", hook.URL}, line)
+	useCheckout(t, source)
+	useUpdateState(t)
+
+	signWith(t, "ssh", "")
+	unsigned := commitFiles(t, source, map[string]string{"maps/a.txt": "unsigned"})
+	err := cloneOrPull()
+	recordUpdate(verified, err)
+	wantRejected(t, "the pull of the unsigned commit", err, "not signed")
+	if head, _ := headCommit(cloneDir); head != verified {
+		t.Errorf("checkout moved to %s, want it kept at %s", head, verified)
+	}
+	if data, _ := os.ReadFile(filepath.Join(cloneDir, "maps", "a.txt")); string(data) != "verified" {
+		t.Errorf("served maps/a.txt = %q", data)
+	}
+	if u := getLastUpdate(); u.OK || u.Commit != verified || !strings.Contains(u.Error, unsigned) {
+		t.Errorf("last update = %+v, want it failed on %s and still at %s", u, unsigned, verified)
+	}
+	select {
+	case alert := <-alerts:
+		if !strings.Contains(alert, "rejected") {
+			t.Errorf("alert = %s", alert)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("no alert for the rejected commit")
+	}
+	lastUpdateMu.Lock()
+	retrying := updateRetry != nil
+	lastUpdateMu.Unlock()
+	if retrying {
+		t.Error("an untrusted commit is retried, it can't change by retrying")
+	}
+
+	// the next signed push moves the checkout on, past the unsigned commit
+	signWith(t, "ssh", trusted)
+	next := commitFiles(t, source, map[string]string{"maps/a.txt": "next"})
+	err = cloneOrPull()
+	recordUpdate(verified, err)
+	if err != nil {
+		t.Fatalf("pull of the signed commit = %v", err)
+	}
+	if head, _ := headCommit(cloneDir); head != next || !getLastUpdate().OK {
+		t.Errorf("checkout at %s, last update %+v, want it at %s", head, getLastUpdate(), next)
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// updateMu serializes the update pipeline, webhooks and admin changes all go through it
+	updateMu sync.Mutex
+
+	// pinCommit is the commit the default checkout is held at, "" follows the branch
+	pinCommit string
+	pinMu     sync.Mutex
+
+	lastUpdate   updateResult
+	lastSuccess  time.Time
+	lastUpdateMu sync.Mutex
+
+	// recent updates and webhook deliveries for the admin reports, oldest first, guarded by lastUpdateMu
+	updateHistory  []updateResult
+	webhookHistory []webhookDelivery
+)
+
+const historySize = 200
+
+// failed updates are retried in the background, backing off between these bounds
+const (
+	updateRetryMin = 30 * time.Second
+	updateRetryMax = 10 * time.Minute
+)
+
+var (
+	updateRetry      *time.Timer // pending retry, nil if none, guarded by lastUpdateMu
+	updateRetryDelay time.Duration
+
+	// update IDs number the triggered updates, a run covers every ID handed out before it started.
+	// Guarded by lastUpdateMu.
+	lastUpdateID  int64
+	runningUpdate *updateResult // the run in progress, nil when idle
+
+	// servedVersion describes the checkout for /version, refreshed after every update so the
+	// endpoint doesn't run git. Guarded by lastUpdateMu.
+	servedVersion checkoutVersion
+)
+
+// checkoutVersion is the commit the default checkout is on
+type checkoutVersion struct {
+	Commit      string    `json:"commit"`
+	CommittedAt time.Time `json:"committed_at"`
+	Branch      string    `json:"branch"` // "" when detached at a pin or tag
+	Shallow     bool      `json:"shallow"`
+}
+
+// webhookDelivery is one call of /gh-update
+type webhookDelivery struct {
+	At       time.Time `json:"at"`
+	RemoteIP string    `json:"remote_ip"`
+	Accepted bool      `json:"accepted"`
+	Message  string    `json:"message"`
+	Delivery string    `json:"delivery,omitempty"` // GitHub's X-GitHub-Delivery ID
+}
+
+// updateResult is the outcome of the last run of the update pipeline
+type updateResult struct {
+	ID     int64     `json:"id,omitempty"` // last update ID the run covers
+	At     time.Time `json:"at"`
+	OK     bool      `json:"ok"`
+	Before string    `json:"before"` // HEAD of the default checkout before the update
+	Commit string    `json:"commit"` // HEAD of the default checkout afterwards
+	Remote string    `json:"remote"` // origin the checkout pulls from
+	Error  string    `json:"error,omitempty"`
+	Stderr string    `json:"stderr,omitempty"` // of the git command that failed
+}
+
+func currentPin() string {
+	pinMu.Lock()
+	defer pinMu.Unlock()
+	return pinCommit
+}
+
+func setPin(sha string) {
+	pinMu.Lock()
+	pinCommit = sha
+	pinMu.Unlock()
+}
+
+// initialUpdate brings the checkout up to date at startup, the manifests are built after it
+func initialUpdate() {
+	updateMu.Lock()
+	defer updateMu.Unlock()
+	before, _ := headCommit(cloneDir)
+	beginUpdate(before)
+	updateErr := cloneOrPull()
+	if updateErr != nil {
+		// without network the checkout already on disk is still worth serving, the failed update
+		// is retried in the background. Without a checkout there's nothing to serve.
+		var untrusted *untrustedCommitError
+		if head, err := headCommit(cloneDir); err == nil {
+			slog.Error("Update failed, serving the existing checkout", "commit", head, "err", updateErr)
+		} else if !errors.As(updateErr, &untrusted) {
+			fatal("No checkout to serve", "err", updateErr)
+		}
+	}
+	if pin := currentPin(); pin != "" {
+		// store the full SHA so /version reports exactly what's served
+		sha, err := resolveCommit(cloneDir, pin)
+		if err != nil {
+			fatal("PIN_COMMIT is not a known commit", "commit", pin)
+		}
+		setPin(sha)
+	}
+	if head, err := headCommit(cloneDir); err == nil {
+		history := "full"
+		if isShallow() {
+			history = "shallow"
+		}
+		slog.Info("Serving checkout", "commit", head, "history", history)
+	}
+	recordUpdate(before, errors.Join(updateErr, syncWorktrees()))
+}
+
+// updateContent pulls the default checkout (or moves it to the pin), updates the branch
+// worktrees and rebuilds every manifest
+func updateContent() {
+	updateMu.Lock()
+	defer updateMu.Unlock()
+	updateContentLocked()
+}
+
+// updateContentLocked returns the error of the default checkout, branch failures are only recorded
+func updateContentLocked() error {
+	before, _ := headCommit(cloneDir)
+	beginUpdate(before)
+	err := cloneOrPull()
+	recordUpdate(before, errors.Join(err, syncWorktrees()))
+	rebuildManifests()
+	return err
+}
+
+// nextUpdateID numbers an update that is about to be triggered
+func nextUpdateID() int64 {
+	lastUpdateMu.Lock()
+	defer lastUpdateMu.Unlock()
+	lastUpdateID++
+	return lastUpdateID
+}
+
+// beginUpdate marks the pipeline as pulling, covering the updates triggered so far
+func beginUpdate(before string) {
+	lastUpdateMu.Lock()
+	defer lastUpdateMu.Unlock()
+	runningUpdate = &updateResult{ID: lastUpdateID, At: time.Now(), Before: before}
+}
+
+// readCheckoutVersion asks git what the default checkout is on
+func readCheckoutVersion() (checkoutVersion, error) {
+	out, err := gitOutput("-C", cloneDir, "log", "-1", "--format=%H%n%cI", "HEAD", "--")
+	if err != nil {
+		return checkoutVersion{}, err
+	}
+	v := checkoutVersion{Shallow: isShallow()}
+	commit, date, _ := strings.Cut(out, "\n")
+	v.Commit = commit
+	v.CommittedAt, _ = time.Parse(time.RFC3339, date)
+	v.Branch, _ = gitOutput("-C", cloneDir, "symbolic-ref", "-q", "--short", "HEAD")
+	return v, nil
+}
+
+// recordUpdate stores the outcome of an update, failures raise an alert
+func recordUpdate(before string, err error) {
+	r := updateResult{At: time.Now(), OK: err == nil, Before: before}
+	version, _ := readCheckoutVersion()
+	r.Commit = version.Commit
+	if remote, err := remoteURL(); err == nil {
+		r.Remote = redactURL(remote)
+	}
+	if err != nil {
+		r.Error = err.Error()
+		var gerr *gitError
+		if errors.As(err, &gerr) {
+			r.Stderr = gerr.Stderr
+		}
+		raiseAlert("Content update failed, still serving " + r.Commit + ": " + r.Error)
+	}
+	lastUpdateMu.Lock()
+	defer lastUpdateMu.Unlock()
+	servedVersion = version
+	if runningUpdate != nil {
+		r.ID = runningUpdate.ID
+		runningUpdate = nil
+	}
+	lastUpdate = r
+	updateHistory = appendBounded(updateHistory, r)
+	if r.OK {
+		lastSuccess = r.At
+		updateRetryDelay = 0
+		return
+	}
+
+	// an untrusted commit won't change by retrying, the next push or pin does
+	var untrusted *untrustedCommitError
+	if updateRetry == nil && !errors.As(err, &untrusted) {
+		updateRetryDelay = min(max(updateRetryDelay*2, updateRetryMin), updateRetryMax)
+		slog.Info("Retrying the update", "delay", updateRetryDelay)
+		updateRetry = time.AfterFunc(updateRetryDelay, func() {
+			lastUpdateMu.Lock()
+			updateRetry = nil
+			lastUpdateMu.Unlock()
+			updateContent()
+		})
+	}
+}
+
+// contentStale reports whether the last update failed, what's served may be behind the remote
+func contentStale() bool {
+	return !getLastUpdate().OK
+}
+
+// recordWebhook keeps a delivery of /gh-update for the webhook report
+func recordWebhook(c echo.Context, accepted bool, message string) {
+	lastUpdateMu.Lock()
+	defer lastUpdateMu.Unlock()
+	webhookHistory = appendBounded(webhookHistory, webhookDelivery{
+		At:       time.Now(),
+		RemoteIP: c.RealIP(),
+		Accepted: accepted,
+		Message:  message,
+		Delivery: c.Request().Header.Get(webhookDeliveryHeader),
+	})
+}
+
+func appendBounded[T any](list []T, v T) []T {
+	list = append(list, v)
+	if len(list) > historySize {
+		list = list[len(list)-historySize:]
+	}
+	return list
+}
+
+func lastSuccessfulUpdate() time.Time {
+	lastUpdateMu.Lock()
+	defer lastUpdateMu.Unlock()
+	return lastSuccess
+}
+
+func getLastUpdate() updateResult {
+	lastUpdateMu.Lock()
+	defer lastUpdateMu.Unlock()
+	return lastUpdate
+}
+
+// GET /version describes the served commit as of the last update, for bug reports and for
+// clients deciding whether their manifest is current
+func handleVersion(c echo.Context) error {
+	lastUpdateMu.Lock()
+	v, last := servedVersion, lastSuccess
+	lastUpdateMu.Unlock()
+	if v.Commit == "" {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Checkout is not available")
+	}
+	pin := currentPin()
+	status := echo.Map{
+		"commit":       v.Commit,
+		"committed_at": v.CommittedAt,
+		"branch":       v.Branch,
+		"last_pull":    nil,
+		"pinned":       pin != "",
+		"pin_commit":   pin,
+		"stale":        contentStale(),
+		"shallow":      v.Shallow,
+	}
+	if !last.IsZero() {
+		status["last_pull"] = last
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+// POST /admin/pin {"commit": "<sha>"}, an empty commit clears the pin. The change goes through the
+// update pipeline and the manifest is rebuilt before the response, the hash and tree caches are
+// keyed by mtime and commit so they carry over.
+func handleAdminPin(c echo.Context) error {
+	var payload struct {
+		Commit string `json:"commit"`
+	}
+	if err := c.Bind(&payload); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid JSON payload")
+	}
+
+	updateMu.Lock()
+	defer updateMu.Unlock()
+
+	sha := ""
+	if payload.Commit != "" {
+		if err := fetchOrigin(payload.Commit); err != nil {
+			return echo.NewHTTPError(http.StatusBadGateway, "Failed to fetch from origin")
+		}
+		var err error
+		sha, err = resolveCommit(cloneDir, payload.Commit)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unknown commit %s", payload.Commit))
+		}
+	}
+
+	previous := currentPin()
+	setPin(sha)
+	if sha == "" {
+		slog.Info("Pin cleared, following the branch again", "ip", c.RealIP())
+	} else {
+		slog.Info("Pinning content", "commit", sha, "ip", c.RealIP())
+	}
+	if err := updateContentLocked(); err != nil {
+		setPin(previous)
+		var untrusted *untrustedCommitError
+		if errors.As(err, &untrusted) {
+			return echo.NewHTTPError(http.StatusConflict, untrusted.Error())
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update content")
+	}
+
+	return handleVersion(c)
+}
+
+// POST /admin/update runs the update pipeline now, without the webhook's delay
+func handleAdminUpdate(c echo.Context) error {
+	id := nextUpdateID()
+	go updateContent()
+	return c.JSON(http.StatusOK, echo.Map{"message": "Update triggered.", "update_id": id})
+}
+
+// GET /gh-update/status reports where the update pipeline stands: pulling while a run is in
+// progress, otherwise how the last run ended. With ?id= it's the state of that update, pending
+// until a run covering it starts, ?repo=<name> asks about that repo of REPOS. WEBHOOK_KEY or
+// ADMIN_KEY let a caller in, a setup verifying deliveries by signature alone has only the latter.
+func handleUpdateStatus(c echo.Context) error {
+	if !validAdminKey(c.Request()) {
+		if problem := authenticateWebhookKey(c); problem != "" {
+			return c.JSON(http.StatusUnauthorized, echo.Map{"error": problem})
+		}
+	}
+
+	if name := c.QueryParam("repo"); name != "" {
+		r, ok := repos[name]
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "Unknown repo")
+		}
+		r.lastMu.Lock()
+		defer r.lastMu.Unlock()
+		var history []updateResult
+		if !r.last.At.IsZero() {
+			// only the last run is kept, it covers every update up to its ID
+			history = append(history, r.last)
+		}
+		status, err := updateStatus(c, r.lastID, r.running, history)
+		if err != nil {
+			return err
+		}
+		status["repo"] = name
+		return c.JSON(http.StatusOK, status)
+	}
+
+	lastUpdateMu.Lock()
+	defer lastUpdateMu.Unlock()
+	status, err := updateStatus(c, lastUpdateID, runningUpdate, updateHistory)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+// updateStatus describes a pipeline from the last update ID it handed out, the run in progress
+// and its finished runs, oldest first
+func updateStatus(c echo.Context, lastID int64, runningUpdate *updateResult, history []updateResult) (echo.Map, error) {
+	var running *updateResult
+	if runningUpdate != nil {
+		r := *runningUpdate
+		running = &r
+	}
+	status := echo.Map{"last_id": lastID, "running": running}
+
+	var last *updateResult
+	if raw := c.QueryParam("id"); raw != "" {
+		id, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || id < 1 || id > lastID {
+			return nil, echo.NewHTTPError(http.StatusNotFound, "Unknown update ID")
+		}
+		status["id"] = id
+		for _, r := range history {
+			if r.ID >= id {
+				last = &r
+				break
+			}
+		}
+		if last == nil {
+			status["state"] = "pending"
+			if running != nil && running.ID >= id {
+				status["state"] = "pulling"
+			}
+			return status, nil
+		}
+	} else if len(history) > 0 {
+		r := history[len(history)-1]
+		last = &r
+	}
+
+	switch {
+	case running != nil && c.QueryParam("id") == "":
+		status["state"] = "pulling"
+	case last == nil:
+		status["state"] = "idle"
+	case last.OK:
+		status["state"] = "succeeded"
+	default:
+		status["state"] = "failed"
+	}
+	status["update"] = last
+	return status, nil
+}
+
+// GET /admin/reports/updates lists the recent runs of the update pipeline, newest first
+func handleUpdateReport(c echo.Context) error {
+	lastUpdateMu.Lock()
+	history := make([]updateResult, 0, len(updateHistory))
+	for i := len(updateHistory) - 1; i >= 0; i-- {
+		history = append(history, updateHistory[i])
+	}
+	lastUpdateMu.Unlock()
+
+	if !wantsCSV(c) {
+		return c.JSON(http.StatusOK, echo.Map{"updates": history})
+	}
+	out := startCSV(c, "updates", "", "at", "ok", "before", "commit", "remote", "error")
+	for _, r := range history {
+		out.row(r.At, r.OK, r.Before, r.Commit, r.Remote, r.Error)
+	}
+	return out.close()
+}
+
+// GET /admin/reports/webhooks lists the recent /gh-update deliveries, newest first
+func handleWebhookReport(c echo.Context) error {
+	lastUpdateMu.Lock()
+	history := make([]webhookDelivery, 0, len(webhookHistory))
+	for i := len(webhookHistory) - 1; i >= 0; i-- {
+		history = append(history, webhookHistory[i])
+	}
+	lastUpdateMu.Unlock()
+
+	if !wantsCSV(c) {
+		return c.JSON(http.StatusOK, echo.Map{"webhooks": history})
+	}
+	out := startCSV(c, "webhooks", "", "at", "remote_ip", "accepted", "message", "delivery")
+	for _, d := range history {
+		out.row(d.At, d.RemoteIP, d.Accepted, d.Message, d.Delivery)
+	}
+	return out.close()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpdateStatusTakesTheWebhookOrAdminKey(t *testing.T) {
+	// signatures verify the deliveries, the status needs one of the keys
+	useConfig(t, "WEBHOOK_SECRET", "hook-secret", "WEBHOOK_KEY", "webhook-key", "ADMIN_KEY", "admin-secret")
+	e := echo.New()
+	e.GET("/gh-update/status", handleUpdateStatus)
+	tests := []struct {
+		headers []string
+		want    int
+	}{
+		{nil, http.StatusUnauthorized},
+		{[]string{webhookKeyHeader, "wrong"}, http.StatusUnauthorized},
+		{[]string{"X-Admin-Key", "wrong"}, http.StatusUnauthorized},
+		{[]string{webhookKeyHeader, "webhook-key"}, http.StatusOK},
+		{[]string{"X-Admin-Key", "admin-secret"}, http.StatusOK},
+		{[]string{"Authorization", "Bearer admin-secret"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rec := request(e, http.MethodGet, "/gh-update/status", "", tt.headers...); rec.Code != tt.want {
+			t.Errorf("GET /gh-update/status with %v = %d, want %d", tt.headers, rec.Code, tt.want)
+		}
+	}
+	// without WEBHOOK_KEY the admin key is the only way in
+	useConfig(t, "WEBHOOK_SECRET", "hook-secret", "WEBHOOK_KEY", "", "ADMIN_KEY", "admin-secret")
+	if rec := request(e, http.MethodGet, "/gh-update/status", "", "X-Admin-Key", "admin-secret"); rec.Code != http.StatusOK {
+		t.Errorf("GET /gh-update/status with ADMIN_KEY alone = %d", rec.Code)
+	}
+}
+
+func TestRepoUpdateStatus(t *testing.T) {
+	useConfig(t, "TMPDIR", t.TempDir(), "ADMIN_KEY", "admin-secret")
+	source := gitFixture(t)
+	useWorkDir(t)
+	content := newContentTree("", filepath.Join(repoDir, "extra"))
+	content.Repo = "extra"
+	r := &repo{Name: "extra", URL: source, Content: content}
+	repos["extra"] = r
+	t.Cleanup(func() { delete(repos, "extra") })
+
+	e := echo.New()
+	e.GET("/gh-update/status", handleUpdateStatus)
+	status := func(query string, want int) map[string]any {
+		t.Helper()
+		rec := request(e, http.MethodGet, "/gh-update/status?"+query, "", "X-Admin-Key", "admin-secret")
+		if rec.Code != want {
+			t.Fatalf("GET ?%s = %d %s, want %d", query, rec.Code, rec.Body.String(), want)
+		}
+		var s map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	if s := status("repo=extra", http.StatusOK); s["state"] != "idle" || s["repo"] != "extra" || s["last_id"] != 0.0 {
+		t.Errorf("status before any update = %v", s)
+	}
+	id := r.nextUpdateID()
+	if s := status("repo=extra&id=1", http.StatusOK); id != 1 || s["state"] != "pending" {
+		t.Errorf("status of update %d before it runs = %v", id, s)
+	}
+	status("repo=extra&id=2", http.StatusNotFound)
+	status("repo=nowhere", http.StatusNotFound)
+
+	r.update()
+	head, err := headCommit(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := status("repo=extra&id=1", http.StatusOK)
+	update, _ := s["update"].(map[string]any)
+	if s["state"] != "succeeded" || update["id"] != 1.0 || update["commit"] != head {
+		t.Errorf("status of update 1 once it ran = %v, want it at %s", s, head)
+	}
+	// the main pipeline's IDs are its own
+	if s := status("", http.StatusOK); s["repo"] != nil {
+		t.Errorf("status of the main repo = %v", s)
+	}
+}
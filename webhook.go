@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	webhookSignatureHeader = "X-Hub-Signature-256"
+	webhookDeliveryHeader  = "X-GitHub-Delivery"
+	webhookKeyHeader       = "X-Webhook-Key"
+	webhookMaxBody         = 25 << 20 // GitHub caps payloads at 25MB
+)
+
+// webhookUpdateDelay is how long an update a delivery triggered waits before it runs
+var webhookUpdateDelay = 5 * time.Second
+
+// POST /gh-update triggers the pull or clone. GitHub deliveries are authenticated by their
+// X-Hub-Signature-256 HMAC of the body with WEBHOOK_SECRET. WEBHOOK_KEY, as ?key= or X-Webhook-Key,
+// is only accepted with WEBHOOK_ALLOW_QUERY_KEY, for triggering updates with plain curl.
+func handleWebhook(c echo.Context) error {
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, webhookMaxBody+1))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Failed to read the request body")
+	}
+	if len(body) > webhookMaxBody {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "Payload too large")
+	}
+
+	if problem := authenticateWebhook(c, body); problem != "" {
+		slog.Warn("Rejected webhook delivery", "delivery", c.Request().Header.Get(webhookDeliveryHeader), "ip", c.RealIP(), "problem", problem)
+		recordWebhook(c, false, problem)
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": problem})
+	}
+
+	// the ping GitHub sends when the hook is created only checks the setup, and no other event
+	// changes the content
+	switch event := c.Request().Header.Get("X-GitHub-Event"); event {
+	case "", "push":
+	case "ping":
+		recordWebhook(c, true, "Ping received.")
+		return c.JSON(http.StatusOK, echo.Map{"message": "Ping received."})
+	default:
+		message := "Ignored " + event + " event."
+		recordWebhook(c, true, message)
+		return c.JSON(http.StatusOK, echo.Map{"message": message})
+	}
+
+	push, err := parsePush(c, body)
+	if err != nil {
+		slog.Warn("Malformed webhook payload", "delivery", c.Request().Header.Get(webhookDeliveryHeader), "ip", c.RealIP(), "err", err)
+		recordWebhook(c, false, "Malformed push payload.")
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Malformed push payload."})
+	}
+	logArgs := []any{"delivery", c.Request().Header.Get(webhookDeliveryHeader), "ip", c.RealIP()}
+	if push != nil {
+		logArgs = append(logArgs, "ref", push.Ref, "pusher", push.Pusher.Name, "commit", push.headCommit(), "commits", len(push.Commits))
+	}
+
+	// ?repo=<name> only pulls that repo of REPOS
+	if name := c.QueryParam("repo"); name != "" {
+		r, ok := repos[name]
+		if !ok {
+			recordWebhook(c, false, "Unknown repo.")
+			return c.JSON(http.StatusNotFound, echo.Map{"error": "Unknown repo."})
+		}
+		if message := push.ignored(servedRefs(r.Content.Dir, nil)); message != "" {
+			slog.Info("Webhook push ignored", append(logArgs, "repo", name)...)
+			recordWebhook(c, true, message)
+			return c.JSON(http.StatusOK, echo.Map{"message": message})
+		}
+		id := r.nextUpdateID()
+		go func() {
+			time.Sleep(webhookUpdateDelay)
+			r.update()
+		}()
+		slog.Info("Webhook triggered an update", append(logArgs, "repo", name, "update_id", id)...)
+		message := "Update of " + name + " triggered."
+		recordWebhook(c, true, message)
+		return c.JSON(http.StatusOK, echo.Map{"message": message, "update_id": id, "repo": name})
+	}
+
+	if message := push.ignored(servedRefs(cloneDir, branchOrder)); message != "" {
+		slog.Info("Webhook push ignored", logArgs...)
+		recordWebhook(c, true, message)
+		return c.JSON(http.StatusOK, echo.Map{"message": message})
+	}
+
+	id := nextUpdateID()
+	go func() {
+		time.Sleep(webhookUpdateDelay)
+		updateContent()
+	}()
+
+	slog.Info("Webhook triggered an update", append(logArgs, "update_id", id)...)
+	message := "Update triggered."
+	if pin := currentPin(); pin != "" {
+		message = "Update triggered, content is pinned to " + pin + "."
+	}
+	recordWebhook(c, true, message)
+	return c.JSON(http.StatusOK, echo.Map{"message": message, "update_id": id})
+}
+
+// pushEvent is the part of a GitHub push payload the webhook looks at
+type pushEvent struct {
+	Ref     string `json:"ref"`
+	After   string `json:"after"`
+	Deleted bool   `json:"deleted"`
+	Pusher  struct {
+		Name string `json:"name"`
+	} `json:"pusher"`
+	HeadCommit *struct {
+		ID string `json:"id"`
+	} `json:"head_commit"`
+	Commits []json.RawMessage `json:"commits"`
+}
+
+// parsePush decodes the push a delivery describes, GitHub sends it as JSON or as the payload field
+// of a form. A trigger without a body, like a plain curl, is no push and returns nil.
+func parsePush(c echo.Context, body []byte) (*pushEvent, error) {
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEApplicationForm) {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+		body = []byte(form.Get("payload"))
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		if c.Request().Header.Get("X-GitHub-Event") == "push" {
+			return nil, errors.New("empty payload")
+		}
+		return nil, nil
+	}
+	var push pushEvent
+	if err := json.Unmarshal(body, &push); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(push.Ref, "refs/") {
+		return nil, fmt.Errorf("invalid ref %q", push.Ref)
+	}
+	return &push, nil
+}
+
+// headCommit is the SHA the push moved its ref to
+func (p *pushEvent) headCommit() string {
+	if p.HeadCommit != nil {
+		return p.HeadCommit.ID
+	}
+	return p.After
+}
+
+// ignored returns why the push doesn't change anything served from refs, "" when it does. A
+// plain trigger, or a checkout whose refs aren't known yet, always updates.
+func (p *pushEvent) ignored(refs []string) string {
+	if p == nil || refs == nil {
+		return ""
+	}
+	if !slices.Contains(refs, p.Ref) {
+		return "Ignored push to " + p.Ref + ", serving " + strings.Join(refs, ", ") + "."
+	}
+	if p.Deleted {
+		return "Ignored deletion of " + p.Ref + "."
+	}
+	return ""
+}
+
+// servedRefs are the refs a push to which changes the checkout in dir or one of the branch
+// worktrees: REPO_BRANCH for the main checkout, otherwise origin's default branch. nil when
+// the checkout isn't there to tell.
+func servedRefs(dir string, branches []*contentTree) []string {
+	var refs []string
+	switch {
+	case dir == cloneDir && cfg.RepoBranch != "":
+		refs = append(refs, "refs/heads/"+cfg.RepoBranch, "refs/tags/"+cfg.RepoBranch)
+	default:
+		branch, err := originDefaultBranch(dir)
+		if err != nil {
+			return nil
+		}
+		refs = append(refs, "refs/heads/"+branch)
+	}
+	for _, t := range branches {
+		refs = append(refs, "refs/heads/"+t.Ref)
+	}
+	return refs
+}
+
+// authenticateWebhook returns why a delivery isn't authentic, "" when it is
+func authenticateWebhook(c echo.Context, body []byte) string {
+	if sig := c.Request().Header.Get(webhookSignatureHeader); sig != "" || !cfg.WebhookAllowQueryKey {
+		if cfg.WebhookSecret == "" {
+			return "Signature verification is not configured."
+		}
+		if !validWebhookSignature(cfg.WebhookSecret, body, sig) {
+			return "Invalid or missing signature."
+		}
+		return ""
+	}
+	return authenticateWebhookKey(c)
+}
+
+// authenticateWebhookKey checks WEBHOOK_KEY, sent in the X-Webhook-Key header or, with
+// WEBHOOK_ALLOW_QUERY_KEY, the ?key= query
+func authenticateWebhookKey(c echo.Context) string {
+	key := c.Request().Header.Get(webhookKeyHeader)
+	if key == "" && cfg.WebhookAllowQueryKey {
+		key = c.QueryParam("key")
+	}
+	if key == "" || cfg.WebhookKey == "" || !hmac.Equal([]byte(key), []byte(cfg.WebhookKey)) {
+		return "Invalid or missing key."
+	}
+	return ""
+}
+
+// validWebhookSignature checks a "sha256=<hex>" signature of body, in constant time
+func validWebhookSignature(secret string, body []byte, sig string) bool {
+	hexSum, ok := strings.CutPrefix(sig, "sha256=")
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(hexSum)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhookKeyConfig(t *testing.T) {
+	t.Setenv("WEBHOOK_KEY", "")
+	t.Setenv("WEBHOOK_ALLOW_QUERY_KEY", "true")
+	if _, err := loadConfig(); err == nil {
+		t.Error("WEBHOOK_ALLOW_QUERY_KEY without WEBHOOK_KEY loads")
+	}
+
+	useConfig(t, "WEBHOOK_KEY", " webhook-key ", "WEBHOOK_ALLOW_QUERY_KEY", "true", "ADMIN_KEY", "")
+	if cfg.WebhookKey != "webhook-key" || cfg.AdminKey != "webhook-key" {
+		t.Errorf("WebhookKey = %q, AdminKey = %q, want both the trimmed WEBHOOK_KEY", cfg.WebhookKey, cfg.AdminKey)
+	}
+	// the key is read once, a later change of the environment doesn't let anyone else in
+	t.Setenv("WEBHOOK_KEY", "changed")
+	for target, want := range map[string]string{
+		"/gh-update?key=webhook-key": "",
+		"/gh-update?key=changed":     "Invalid or missing key.",
+		"/gh-update":                 "Invalid or missing key.",
+	} {
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, target, nil), httptest.NewRecorder())
+		if got := authenticateWebhookKey(c); got != want {
+			t.Errorf("authenticateWebhookKey(%s) = %q, want %q", target, got, want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+)
+
+const worktreeDir = "worktrees" // one git worktree per configured branch, see BRANCHES
+
+// contentTree is one served checkout, the default clone, the worktree of a branch or the clone of
+// a repo from REPOS. Each has its own manifest, hash cache and tree cache so branches and repos
+// never see each other's state.
+type contentTree struct {
+	Ref  string // branch name, "" for the default checkout
+	Repo string // name in REPOS, "" for the main repository
+	Dir  string
+
+	manifest   *manifest
+	manifestMu sync.RWMutex
+
+	// hashCache keeps digests between rebuilds, entries are reused while size and mtime are unchanged
+	hashCache   map[string]*manifestEntry
+	hashCacheMu sync.Mutex
+
+	// buildMu serializes rebuilds, a pull during a rebuild queues another one
+	buildMu sync.Mutex
+
+	treeCache      map[string]*treeNode
+	treeCacheOrder []string
+	treeCacheMu    sync.Mutex
+}
+
+func newContentTree(ref, dir string) *contentTree {
+	return &contentTree{
+		Ref:       ref,
+		Dir:       dir,
+		hashCache: make(map[string]*manifestEntry),
+		treeCache: make(map[string]*treeNode),
+	}
+}
+
+var (
+	defaultContent = newContentTree("", cloneDir)
+
+	// branch trees are set up once at startup from the config, so a branch dropped from BRANCHES
+	// loses its caches with the restart and syncWorktrees removes its checkout
+	branchContent = make(map[string]*contentTree)
+	branchOrder   []*contentTree
+)
+
+// configureBranches creates the content trees of the configured branches
+func configureBranches(branches []string) {
+	for _, ref := range branches {
+		t := newContentTree(ref, filepath.Join(worktreeDir, url.PathEscape(ref)))
+		branchContent[ref] = t
+		branchOrder = append(branchOrder, t)
+	}
+}
+
+// allContent returns the default tree followed by the branch trees
+func allContent() []*contentTree {
+	return append([]*contentTree{defaultContent}, branchOrder...)
+}
+
+// contentFor picks the tree a request targets: the repo it's under, ?ref=<branch> or the default
+// checkout. Branches are only served for the main repository.
+func contentFor(c echo.Context) (*contentTree, error) {
+	ref := c.QueryParam("ref")
+	if t := repoFor(c); t != nil {
+		if ref != "" {
+			return nil, echo.NewHTTPError(http.StatusNotFound, "Unknown ref")
+		}
+		return t, nil
+	}
+	if ref == "" {
+		return defaultContent, nil
+	}
+	t, ok := branchContent[ref]
+	if !ok {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Unknown ref")
+	}
+	return t, nil
+}
+
+// rebuildManifests rebuilds the manifest of every tree
+func rebuildManifests() {
+	for _, t := range allContent() {
+		t.rebuildManifest()
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// zipAllArtifact is the full client archive of one commit of the default checkout, together with
+// the torrent generated from exactly these bytes
+type zipAllArtifact struct {
+	Commit  string
+	Path    string
+	Name    string // file name clients save it as
+	Size    int64
+	Built   time.Time
+	SHA256  string
+	Torrent *torrentMeta
+	Parts   []zipAllPart // nil unless ZIP_ALL_PART_SIZE is set
+}
+
+// zipAll keeps the current full archive. Builds run one at a time in the background, a commit
+// landing during a build is queued and only the newest pending one is built next.
+var zipAll struct {
+	sync.Mutex
+	current *zipAllArtifact
+	pending *manifest
+	running bool
+}
+
+// currentZipAll returns the artifact being served or nil before the first build finished
+func currentZipAll() *zipAllArtifact {
+	zipAll.Lock()
+	defer zipAll.Unlock()
+	return zipAll.current
+}
+
+// scheduleZipAll queues a full archive build for a freshly built manifest of the default checkout
+func scheduleZipAll(m *manifest) {
+	if !cfg.ZipAll || m.Commit == "" {
+		return
+	}
+	zipAll.Lock()
+	defer zipAll.Unlock()
+	if zipAll.current != nil && zipAll.current.Commit == m.Commit {
+		return
+	}
+	zipAll.pending = m
+	if !zipAll.running {
+		zipAll.running = true
+		go runZipAll()
+	}
+}
+
+func runZipAll() {
+	for {
+		zipAll.Lock()
+		m := zipAll.pending
+		zipAll.pending = nil
+		if m == nil {
+			zipAll.running = false
+			zipAll.Unlock()
+			return
+		}
+		zipAll.Unlock()
+
+		if err := buildZipAll(m); errors.Is(err, errZipAllSuperseded) {
+			slog.Info("Full archive build dropped", "commit", shortCommit(m.Commit), "err", err)
+		} else if err != nil {
+			slog.Error("Error building full archive", "commit", shortCommit(m.Commit), "err", err)
+		}
+	}
+}
+
+var errZipAllSuperseded = errors.New("content changed during the build")
+
+// buildZipAll writes the full archive of the manifest's commit and its torrent, then swaps both in
+// at once so the infohash in /latest always describes the bytes /zip-all serves. A build can run for
+// a long time, so rather than holding the content lock it checks no checkout change happened
+// while it read the files and drops the result otherwise, the newer commit is queued by then.
+func buildZipAll(m *manifest) error {
+	dir := cfg.ZipAllDir
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	final := filepath.Join(dir, "zip-all-"+m.Commit+".zip")
+
+	// an artifact left by an earlier run only needs its torrent
+	if _, err := os.Stat(final); err != nil {
+		if err := writeZipAll(dir, final, m); err != nil {
+			return err
+		}
+	}
+	info, err := os.Stat(final)
+	if err != nil {
+		return err
+	}
+
+	a := &zipAllArtifact{
+		Commit: m.Commit,
+		Path:   final,
+		Name:   "client-" + shortCommit(m.Commit) + ".zip",
+		Size:   info.Size(),
+		Built:  info.ModTime(),
+	}
+	// torrent pieces, split volumes and the archive digest all come from one read of the file
+	f, err := os.Open(final)
+	if err != nil {
+		return err
+	}
+	partSize := cfg.ZipAllPartSize
+	if partSize <= 0 {
+		partSize = a.Size + 1
+	}
+	parts := newPartHasher(a.Name, partSize)
+	a.Torrent, err = buildTorrent(io.TeeReader(f, parts), a.Name, cfg.ZipAllPieceSize, zipAllWebseeds(), cfg.ZipAllTrackers, "commit "+m.Commit)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("torrent: %w", err)
+	}
+	var split []zipAllPart
+	split, a.SHA256 = parts.result()
+	if cfg.ZipAllPartSize > 0 {
+		a.Parts = split
+	}
+
+	zipAll.Lock()
+	zipAll.current = a
+	zipAll.Unlock()
+	slog.Info("Full archive built", "commit", shortCommit(m.Commit), "bytes", a.Size, "parts", len(a.Parts), "infohash", a.Torrent.InfoHash)
+
+	// downloads of older commits keep reading their open file after it's unlinked
+	removeOtherZipAll(dir, final)
+	return nil
+}
+
+// writeZipAll builds the archive of every manifest file into final
+func writeZipAll(dir, final string, m *manifest) error {
+	var total int64
+	for _, e := range m.Files {
+		total += e.Size
+	}
+	release, err := builds.acquire(context.Background(), total, cfg.BuildQueueTimeout)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	gen := contentGeneration.Load()
+	if head, err := headCommit(defaultContent.Dir); err != nil || head != m.Commit {
+		return errZipAllSuperseded
+	}
+	compression, err := resolveCompression(nil)
+	if err != nil {
+		return err
+	}
+	session := &chunkSession{
+		Content:     defaultContent,
+		Created:     time.Now(),
+		Files:       sortedKeys(m.Files),
+		Size:        total,
+		Compression: compression,
+	}
+
+	start := time.Now()
+	built, err := writeChunkArchive(dir, "zip-all-"+m.Commit, session)
+	if err != nil {
+		return err
+	}
+	if err := verifyArchive(built); err != nil {
+		_ = os.Remove(built.Path)
+		return err
+	}
+	if contentGeneration.Load() != gen {
+		_ = os.Remove(built.Path)
+		return errZipAllSuperseded
+	}
+	stats.recordCompression(built.Compression)
+	if err := os.Rename(built.Path, final); err != nil {
+		_ = os.Remove(built.Path)
+		return err
+	}
+	slog.Info("Full archive written", "commit", shortCommit(m.Commit), "duration", time.Since(start))
+	return nil
+}
+
+// removeOtherZipAll deletes everything in dir but the current artifact, older commits and
+// leftovers of interrupted builds alike
+func removeOtherZipAll(dir, keep string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if path := filepath.Join(dir, e.Name()); path != keep {
+			_ = os.RemoveAll(path)
+		}
+	}
+}
+
+// zipAllWebseeds are the HTTP sources put into the torrent, this server first
+func zipAllWebseeds() []string {
+	var seeds []string
+	if cfg.PublicURL != "" {
+		seeds = append(seeds, strings.TrimRight(cfg.PublicURL, "/")+"/zip-all")
+	}
+	for _, m := range cfg.Mirrors {
+		seeds = append(seeds, strings.TrimRight(m.URL, "/")+"/zip-all")
+	}
+	return seeds
+}
+
+func shortCommit(sha string) string {
+	if len(sha) > 12 {
+		return sha[:12]
+	}
+	return sha
+}
+
+// zipAllFor returns the current artifact or the error to answer with
+func zipAllFor() (*zipAllArtifact, error) {
+	if !cfg.ZipAll {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Full archive is disabled")
+	}
+	a := currentZipAll()
+	if a == nil {
+		return nil, echo.NewHTTPError(http.StatusServiceUnavailable, "Full archive is still being built")
+	}
+	return a, nil
+}
+
+// GET /zip-all serves the full client archive with Range support, the commit is the ETag
+func handleZipAll(c echo.Context) error {
+	a, err := zipAllFor()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(a.Path)
+	if err != nil {
+		// replaced between the lookup and the open
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Full archive is being replaced, try again")
+	}
+	defer f.Close()
+
+	h := c.Response().Header()
+	h.Set("ETag", `"`+a.Commit+`"`)
+	h.Set(contentCommitHeader, a.Commit)
+	h.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", a.Name))
+	h.Set("Content-Type", "application/zip")
+	http.ServeContent(c.Response(), c.Request(), a.Name, a.Built, f)
+	return nil
+}
+
+// GET /zip-all.torrent
+func handleZipAllTorrent(c echo.Context) error {
+	a, err := zipAllFor()
+	if err != nil {
+		return err
+	}
+	h := c.Response().Header()
+	h.Set("ETag", `"`+a.Torrent.InfoHash+`"`)
+	h.Set(contentCommitHeader, a.Commit)
+	h.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", a.Name+".torrent"))
+	if match := c.Request().Header.Get("If-None-Match"); match == `"`+a.Torrent.InfoHash+`"` {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.Blob(http.StatusOK, "application/x-bittorrent", a.Torrent.Data)
+}
+
+// zipAllInfo is the /latest entry describing the full archive, nil while there is none
+func zipAllInfo() echo.Map {
+	a := currentZipAll()
+	if a == nil {
+		return nil
+	}
+	return echo.Map{
+		"commit":   a.Commit,
+		"size":     a.Size,
+		"sha256":   a.SHA256,
+		"url":      "/zip-all",
+		"torrent":  "/zip-all.torrent",
+		"infohash": a.Torrent.InfoHash,
+		"parts":    a.Parts != nil,
+	}
+}
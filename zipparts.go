@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// zipAllPart is one fixed-size volume of the full archive. Parts aren't copies, each is served as
+// its byte range of the artifact, so they always belong to the same build as the archive.
+type zipAllPart struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// partHasher computes the sha256 of every part and of the whole archive in one pass
+type partHasher struct {
+	partSize int64
+	name     string
+	full     hash.Hash
+	current  hash.Hash
+	offset   int64 // of the current part
+	n        int64 // bytes of the current part so far
+	parts    []zipAllPart
+}
+
+func newPartHasher(name string, partSize int64) *partHasher {
+	return &partHasher{partSize: partSize, name: name, full: sha256.New(), current: sha256.New()}
+}
+
+func (p *partHasher) Write(b []byte) (int, error) {
+	written := len(b)
+	p.full.Write(b)
+	for len(b) > 0 {
+		take := min(int64(len(b)), p.partSize-p.n)
+		p.current.Write(b[:take])
+		p.n += take
+		b = b[take:]
+		if p.n == p.partSize {
+			p.finishPart()
+		}
+	}
+	return written, nil
+}
+
+func (p *partHasher) finishPart() {
+	p.parts = append(p.parts, zipAllPart{
+		Name:   fmt.Sprintf("%s.%03d", p.name, len(p.parts)+1),
+		Offset: p.offset,
+		Size:   p.n,
+		SHA256: hex.EncodeToString(p.current.Sum(nil)),
+	})
+	p.offset += p.n
+	p.n = 0
+	p.current.Reset()
+}
+
+// result returns the parts and the digest of the whole archive once everything was written
+func (p *partHasher) result() ([]zipAllPart, string) {
+	if p.n > 0 {
+		p.finishPart()
+	}
+	return p.parts, hex.EncodeToString(p.full.Sum(nil))
+}
+
+// partChecksums renders checksums.txt, sha256sum -c compatible. Comment lines explain the
+// reassembly, the last line checks the joined archive.
+func partChecksums(a *zipAllArtifact) []byte {
+	var b strings.Builder
+	names := make([]string, len(a.Parts))
+	for i, p := range a.Parts {
+		names[i] = p.Name
+	}
+	fmt.Fprintf(&b, "# %s of commit %s, %d parts of up to %d bytes\n", a.Name, a.Commit, len(a.Parts), cfg.ZipAllPartSize)
+	fmt.Fprintf(&b, "# join them in this order: cat %s > %s\n", strings.Join(names, " "), a.Name)
+	for _, p := range a.Parts {
+		fmt.Fprintf(&b, "%s  %s\n", p.SHA256, p.Name)
+	}
+	fmt.Fprintf(&b, "%s  %s\n", a.SHA256, a.Name)
+	return []byte(b.String())
+}
+
+// zipAllPartsFor returns the current artifact when split volumes are enabled
+func zipAllPartsFor() (*zipAllArtifact, error) {
+	if cfg.ZipAllPartSize <= 0 {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Split volumes are disabled")
+	}
+	return zipAllFor()
+}
+
+// GET /zip-all/parts lists the volumes of the current full archive in reassembly order
+func handleZipAllParts(c echo.Context) error {
+	a, err := zipAllPartsFor()
+	if err != nil {
+		return err
+	}
+	type partInfo struct {
+		zipAllPart
+		URL string `json:"url"`
+	}
+	parts := make([]partInfo, len(a.Parts))
+	for i, p := range a.Parts {
+		parts[i] = partInfo{zipAllPart: p, URL: "/zip-all/parts/" + p.Name}
+	}
+	c.Response().Header().Set(contentCommitHeader, a.Commit)
+	return c.JSON(http.StatusOK, echo.Map{
+		"commit":    a.Commit,
+		"name":      a.Name,
+		"size":      a.Size,
+		"sha256":    a.SHA256,
+		"part_size": cfg.ZipAllPartSize,
+		"parts":     parts,
+		"checksums": "/zip-all/parts/checksums.txt",
+	})
+}
+
+// GET /zip-all/parts/:name serves one volume, or checksums.txt, with Range support. A part's
+// sha256 is its ETag, so a validator never matches bytes of a different commit.
+func handleZipAllPart(c echo.Context) error {
+	a, err := zipAllPartsFor()
+	if err != nil {
+		return err
+	}
+	name := c.Param("name")
+	h := c.Response().Header()
+	h.Set(contentCommitHeader, a.Commit)
+
+	if name == "checksums.txt" {
+		data := partChecksums(a)
+		sum := sha256.Sum256(data)
+		h.Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeContent(c.Response(), c.Request(), name, a.Built, strings.NewReader(string(data)))
+		return nil
+	}
+
+	var part *zipAllPart
+	for i := range a.Parts {
+		if a.Parts[i].Name == name {
+			part = &a.Parts[i]
+			break
+		}
+	}
+	if part == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Part not found")
+	}
+	f, err := os.Open(a.Path)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Full archive is being replaced, try again")
+	}
+	defer f.Close()
+
+	h.Set("ETag", `"`+part.SHA256+`"`)
+	h.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", part.Name))
+	h.Set("Content-Type", "application/octet-stream")
+	http.ServeContent(c.Response(), c.Request(), part.Name, a.Built, io.NewSectionReader(f, part.Offset, part.Size))
+	return nil
+}